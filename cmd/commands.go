@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"kubesphere.io/ks-upgrade/pkg/controller"
+	"kubesphere.io/ks-upgrade/pkg/interactive"
+	"kubesphere.io/ks-upgrade/pkg/lock"
+	"kubesphere.io/ks-upgrade/pkg/multicluster"
+	"kubesphere.io/ks-upgrade/pkg/preflight"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+func planCommand(args []string) error {
+	fs := newFlagSet("plan")
+	out := fs.String("out", "", "write the plan to this file, so that it can be applied with apply --plan. With --all-clusters, the plan of every cluster is written to its own file suffixed by the name of the cluster")
+	signKey := fs.String("sign-key", "", "sign the plan with this key file, an ed25519 private key in PEM format or a HMAC secret")
+	filter := addFilterFlags(fs)
+	multiCluster := addMultiClusterFlags(fs)
+	if err := parseFlags(fs, args, nil); err != nil {
+		return err
+	}
+	k8sClient, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	options := newOptions()
+	if err := applyFilterFlags(fs, filter, options); err != nil {
+		return err
+	}
+	var key []byte
+	if *signKey != "" {
+		if key, err = ioutil.ReadFile(*signKey); err != nil {
+			return err
+		}
+	}
+	clusters := make([]string, 0)
+	plans := make(map[string]*task.Plan)
+	err = forEachCluster(k8sClient, multiCluster, options, func(cluster *multicluster.Cluster, kubeconfigPath string, options *task.Options) error {
+		tasks, err := newTasks(cluster.Client, options, kubeconfigPath)
+		if err != nil {
+			return err
+		}
+		plan, err := task.NewRunner(cluster.Client, options, tasks...).Plan()
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			if err := plan.Sign(key); err != nil {
+				return err
+			}
+		}
+		if *out != "" {
+			path := *out
+			if cluster.Name != "" {
+				path = multicluster.ClusterFile(path, cluster.Name)
+			}
+			if err := task.WritePlan(path, plan); err != nil {
+				return err
+			}
+			klog.Infof("plan written to %s", path)
+		}
+		clusters = append(clusters, cluster.Name)
+		// the printed plan doesn't show the values of the redacted fields
+		if plans[cluster.Name], err = plan.Redacted(); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if output == outputJSON {
+		if !multiCluster.all {
+			return printJSON(plans[""])
+		}
+		return printJSON(plans)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if multiCluster.all {
+		fmt.Fprint(w, "CLUSTER\t")
+	}
+	fmt.Fprintln(w, "TASK\tOPERATION\tOBJECT\tDESCRIPTION")
+	total := 0
+	for _, cluster := range clusters {
+		for _, taskPlan := range plans[cluster].Tasks {
+			for _, change := range taskPlan.Changes {
+				if multiCluster.all {
+					fmt.Fprintf(w, "%s\t", cluster)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", taskPlan.Name, change.Operation, change.Key(), change.Description)
+				total++
+			}
+		}
+	}
+	w.Flush()
+	fmt.Printf("\n%d pending changes\n", total)
+	for _, cluster := range clusters {
+		for _, taskPlan := range plans[cluster].Tasks {
+			for _, warning := range taskPlan.Warnings {
+				if cluster != "" {
+					fmt.Printf("warning: %s: %s: %s\n", cluster, taskPlan.Name, warning)
+				} else {
+					fmt.Printf("warning: %s: %s\n", taskPlan.Name, warning)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func applyCommand(args []string) error {
+	fs := newFlagSet("apply")
+	options := task.NewOptions()
+	fs.IntVar(&options.Concurrency, "concurrency", task.DefaultConcurrency, "the number of objects migrated in parallel")
+	fs.BoolVar(&options.RollbackOnFailure, "rollback-on-failure", true, "undo the mutations of a task when it fails")
+	fs.BoolVar(&options.FailFast, "fail-fast", false, "stop applying the changes of a task at its first failure")
+	fs.StringVar(&options.BackupDir, "backup-dir", "", "copy the journal of the run to this directory")
+	fs.BoolVar(&options.DryRun, "dry-run", false, "log the changes instead of applying them")
+	planFile := fs.String("plan", "", "apply the changes of a plan saved by plan --out instead of planning again, with --all-clusters the plan of every cluster is read from its own file")
+	verifyKey := fs.String("verify-key", "", "verify the signature of the plan with this key file, an ed25519 public key in PEM format or a HMAC secret")
+	skipPreflight := fs.Bool("skip-preflight", false, "skip the preflight checks before upgrading")
+	interactiveApproval := fs.Bool("interactive", false, "show the diff of every change modifying or deleting an object and ask for approval, rejected changes are skipped and reported")
+	lockOptions := addLockFlags(fs)
+	filter := addFilterFlags(fs)
+	multiCluster := addMultiClusterFlags(fs)
+	if err := parseFlags(fs, args, options); err != nil {
+		return err
+	}
+	if err := applyFilterFlags(fs, filter, options); err != nil {
+		return err
+	}
+	k8sClient, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	if *interactiveApproval {
+		options.Approver = interactive.NewApprover(os.Stdin, os.Stdout)
+	}
+	klog.Infof("starting run %s", options.RunID)
+	return forEachCluster(k8sClient, multiCluster, options, func(cluster *multicluster.Cluster, kubeconfigPath string, options *task.Options) error {
+		tasks, err := newTasks(cluster.Client, options, kubeconfigPath)
+		if err != nil {
+			return err
+		}
+		if !*skipPreflight && !runPreflight(cluster.Client, tasks...) {
+			return fmt.Errorf("preflight checks failed, fix the failures or rerun with --skip-preflight")
+		}
+
+		runner := task.NewRunner(cluster.Client, options, tasks...)
+		return withLock(cluster.Client, options, lockOptions, func() error {
+			if *planFile == "" {
+				return runner.Run()
+			}
+			path := *planFile
+			if cluster.Name != "" {
+				path = multicluster.ClusterFile(path, cluster.Name)
+			}
+			plan, err := readPlan(cluster.Client, path, *verifyKey)
+			if err != nil {
+				return err
+			}
+			return runner.Apply(plan)
+		})
+	})
+}
+
+// readPlan reads a saved plan and refuses it if its signature is invalid or the cluster
+// changed since it was computed.
+func readPlan(k8sClient kubernetes.Interface, path, verifyKey string) (*task.Plan, error) {
+	plan, err := task.ReadPlan(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if verifyKey != "" {
+		key, err := ioutil.ReadFile(verifyKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := plan.VerifySignature(key); err != nil {
+			return nil, fmt.Errorf("refusing to apply plan %s: %v", path, err)
+		}
+		klog.Infof("signature of plan %s verified", path)
+	} else if plan.Signature != nil {
+		return nil, fmt.Errorf("refusing to apply plan %s: it is signed, pass --verify-key to verify it", path)
+	}
+
+	if err := plan.CheckDrift(k8sClient); err != nil {
+		return nil, fmt.Errorf("refusing to apply plan %s, plan again and review the changes:\n%v", path, err)
+	}
+	return plan, nil
+}
+
+func statusCommand(args []string) error {
+	fs := newFlagSet("status")
+	runID := fs.String("run", "", "the id of the run, the last run if empty")
+	clusterName := fs.String("cluster", "", "show the state of the run on this member cluster, its state is kept in it")
+	if err := parseFlags(fs, args, nil); err != nil {
+		return err
+	}
+	k8sClient, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+	if *clusterName != "" {
+		cluster, err := multicluster.Member(k8sClient, *clusterName)
+		if err != nil {
+			return err
+		}
+		k8sClient = cluster.Client
+	}
+
+	var record *task.RunRecord
+	if *runID != "" {
+		record, err = task.LoadRun(k8sClient, *runID)
+		if err != nil {
+			return err
+		}
+	} else {
+		records, err := task.ListRuns(k8sClient)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return fmt.Errorf("no upgrade has run yet")
+		}
+		record = records[0]
+	}
+
+	if output == outputJSON {
+		return printJSON(record)
+	}
+	fmt.Printf("Run:       %s\n", record.ID)
+	if record.Cluster != "" {
+		fmt.Printf("Cluster:   %s\n", record.Cluster)
+	}
+	fmt.Printf("Phase:     %s\nStarted:   %s\n", record.Phase, record.StartTime.Format(time.RFC3339))
+	if record.CompletionTime != nil {
+		fmt.Printf("Completed: %s\n", record.CompletionTime.Format(time.RFC3339))
+	}
+	if record.Filter != nil {
+		fmt.Printf("Filter:    %s\n", record.Filter)
+	}
+	if len(record.Completes) > 0 {
+		fmt.Printf("Completes: %s\n", strings.Join(record.Completes, ", "))
+	}
+	if record.Message != "" {
+		fmt.Printf("Message:   %s\n", record.Message)
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tPHASE\tCHANGES\tFILTERED\tSKIPPED\tWARNINGS")
+	hooks := append([]task.HookRecord{}, record.Hooks...)
+	skipped := make([]task.SkippedChange, 0)
+	warnings := make([]string, 0)
+	for _, t := range record.Tasks {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", t.Name, t.Phase, t.Changes, t.Filtered, len(t.Skipped), len(t.Warnings))
+		hooks = append(hooks, t.Hooks...)
+		skipped = append(skipped, t.Skipped...)
+		for _, warning := range t.Warnings {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", t.Name, warning))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(warnings) > 0 {
+		fmt.Println("\nObjects left as they are, they have to be handled manually:")
+		for _, warning := range warnings {
+			fmt.Printf("  - %s\n", warning)
+		}
+	}
+	if len(skipped) > 0 {
+		fmt.Println("\nSkipped changes, they have to be handled manually:")
+		fmt.Fprintln(w, "OPERATION\tOBJECT\tREASON\tDESCRIPTION")
+		for _, c := range skipped {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Operation, c.Object, c.Reason, c.Description)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+	fmt.Println()
+	fmt.Fprintln(w, "HOOK\tSTAGE\tPHASE\tMESSAGE")
+	for _, h := range hooks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", h.Name, h.Stage, h.Phase, h.Message)
+	}
+	return w.Flush()
+}
+
+func verifyCommand(args []string) error {
+	fs := newFlagSet("verify")
+	multiCluster := addMultiClusterFlags(fs)
+	if err := parseFlags(fs, args, nil); err != nil {
+		return err
+	}
+	k8sClient, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	results := make(map[string]interface{})
+	err = forEachCluster(k8sClient, multiCluster, newOptions(), func(cluster *multicluster.Cluster, kubeconfigPath string, options *task.Options) error {
+		tasks, err := newTasks(cluster.Client, options, kubeconfigPath)
+		if err != nil {
+			return err
+		}
+		err = task.NewRunner(cluster.Client, options, tasks...).Verify()
+		result := map[string]interface{}{"verified": err == nil}
+		if err != nil {
+			result["message"] = err.Error()
+		}
+		results[cluster.Name] = result
+		if err == nil && output != outputJSON {
+			if cluster.Name != "" {
+				fmt.Printf("cluster %s: ", cluster.Name)
+			}
+			fmt.Println("verification passed")
+		}
+		return err
+	})
+	if output == outputJSON {
+		var printed interface{} = results
+		if !multiCluster.all {
+			printed = results[""]
+		}
+		if printErr := printJSON(printed); printErr != nil {
+			return printErr
+		}
+	}
+	return err
+}
+
+func historyCommand(args []string) error {
+	fs := newFlagSet("history")
+	if err := parseFlags(fs, args, nil); err != nil {
+		return err
+	}
+	k8sClient, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	records, err := task.ListRuns(k8sClient)
+	if err != nil {
+		return err
+	}
+	if output == outputJSON {
+		return printJSON(records)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tPHASE\tSTARTED\tCOMPLETED\tTASKS")
+	for _, record := range records {
+		completed := "-"
+		if record.CompletionTime != nil {
+			completed = record.CompletionTime.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", record.ID, record.Phase, record.StartTime.Format(time.RFC3339), completed, len(record.Tasks))
+	}
+	return w.Flush()
+}
+
+func preflightCommand(args []string) error {
+	fs := newFlagSet("preflight")
+	if err := parseFlags(fs, args, nil); err != nil {
+		return err
+	}
+	k8sClient, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	tasks, err := newTasks(k8sClient, newOptions(), kubeconfig)
+	if err != nil {
+		return err
+	}
+	if !runPreflight(k8sClient, tasks...) {
+		return fmt.Errorf("preflight checks failed")
+	}
+	return nil
+}
+
+// rollbackCommand undoes all the mutations recorded in the journal of a previous run.
+func rollbackCommand(args []string) error {
+	fs := newFlagSet("rollback")
+	runID := fs.String("run", "", "the id of the run to roll back")
+	clusterName := fs.String("cluster", "", "roll back the run on this member cluster, its journal is kept in it")
+	lockOptions := addLockFlags(fs)
+	multiCluster := addMultiClusterFlags(fs)
+	if err := parseFlags(fs, args, nil); err != nil {
+		return err
+	}
+	if *runID == "" {
+		return fmt.Errorf("--run is required")
+	}
+	if *clusterName != "" && multiCluster.all {
+		return fmt.Errorf("--cluster and --all-clusters are mutually exclusive")
+	}
+	k8sClient, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+	if *clusterName != "" {
+		cluster, err := multicluster.Member(k8sClient, *clusterName)
+		if err != nil {
+			return err
+		}
+		k8sClient = cluster.Client
+	}
+
+	options := &task.Options{RunID: *runID}
+	return forEachCluster(k8sClient, multiCluster, options, func(cluster *multicluster.Cluster, _ string, options *task.Options) error {
+		journal, err := task.LoadJournal(cluster.Client, *runID)
+		if err != nil {
+			if errors.IsNotFound(err) && cluster.Name != "" {
+				klog.Infof("run %s didn't run against cluster %s, there's nothing to roll back", *runID, cluster.Name)
+				return nil
+			}
+			return err
+		}
+		options.Journal = journal
+		return withLock(cluster.Client, options, lockOptions, task.NewRunner(cluster.Client, options).Rollback)
+	})
+}
+
+func controllerCommand(args []string) error {
+	fs := newFlagSet("controller")
+	lockOptions := addLockFlags(fs)
+	if err := parseFlags(fs, args, nil); err != nil {
+		return err
+	}
+	k8sClient, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	newTasksForRun := func(options *task.Options, targetVersion string) ([]task.UpgradeTask, error) {
+		runConfig := cfg
+		if targetVersion != "" {
+			runConfig = cfg.WithTargetVersion(targetVersion)
+		}
+		return newTasksFromConfig(runConfig, k8sClient, options, kubeconfig)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	klog.Info("starting KubeSphereUpgrade controller")
+	controller.NewController(k8sClient, newOptions, newTasksForRun, *lockOptions).Start(ctx)
+	return nil
+}
+
+// runPreflight prints the preflight results and reports whether the upgrade may start.
+func runPreflight(k8sClient kubernetes.Interface, tasks ...task.UpgradeTask) bool {
+	results := preflight.NewChecker(k8sClient, tasks...).Run()
+	if output == outputJSON {
+		if err := printJSON(results); err != nil {
+			klog.Error(err)
+		}
+	} else {
+		preflight.PrintTable(os.Stdout, results)
+	}
+	return !preflight.Failed(results)
+}
+
+func addLockFlags(fs *flag.FlagSet) *lock.Options {
+	lockOptions := &lock.Options{}
+	fs.DurationVar(&lockOptions.Wait, "lock-wait", 0, "how long to wait for another running upgrade to release the lock")
+	fs.BoolVar(&lockOptions.Steal, "lock-steal", false, "take over the lock from another running upgrade once --lock-wait has elapsed")
+	return lockOptions
+}
+
+// stringList is a flag holding a comma separated list, setting it again replaces the list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func addFilterFlags(fs *flag.FlagSet) *task.Filter {
+	filter := &task.Filter{}
+	fs.Var((*stringList)(&filter.Namespaces), "namespace", "only change the objects in these namespaces, comma separated")
+	fs.Var((*stringList)(&filter.Workspaces), "workspace", "only change the objects of these workspaces, comma separated")
+	fs.StringVar(&filter.Selector, "selector", "", "only change the objects matching this label selector")
+	fs.Var((*stringList)(&filter.IncludeNames), "include-name", "only change the objects whose name matches one of these globs, or regular expressions enclosed in slashes, comma separated")
+	fs.Var((*stringList)(&filter.ExcludeNames), "exclude-name", "don't change the objects whose name matches one of these globs, or regular expressions enclosed in slashes, comma separated")
+	return filter
+}
+
+// applyFilterFlags sets the filter of the run, every filter flag passed replaces the same key of the configuration.
+func applyFilterFlags(fs *flag.FlagSet, flags *task.Filter, options *task.Options) error {
+	filter := &task.Filter{}
+	if options.Filter != nil {
+		*filter = *options.Filter
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "namespace":
+			filter.Namespaces = flags.Namespaces
+		case "workspace":
+			filter.Workspaces = flags.Workspaces
+		case "selector":
+			filter.Selector = flags.Selector
+		case "include-name":
+			filter.IncludeNames = flags.IncludeNames
+		case "exclude-name":
+			filter.ExcludeNames = flags.ExcludeNames
+		}
+	})
+	if filter.IsEmpty() {
+		options.Filter = nil
+		return nil
+	}
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+	options.Filter = filter
+	return nil
+}
+
+// withLock runs f while holding the upgrade lock, so that two upgrades never mutate the cluster concurrently.
+func withLock(k8sClient kubernetes.Interface, options *task.Options, lockOptions *lock.Options, f func() error) error {
+	hostname, _ := os.Hostname()
+	lockOptions.Identity = fmt.Sprintf("%s_%s", hostname, options.RunID)
+	l := lock.New(k8sClient, *lockOptions)
+	if err := l.Acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := l.Release(); err != nil {
+			klog.Errorf("release lock failed: %v", err)
+		}
+	}()
+	// the run stops as soon as another upgrade may have taken the lock over
+	options.Context = l.Context()
+	if err := f(); err != nil {
+		if lostErr := l.Err(); lostErr != nil {
+			return fmt.Errorf("%v: %v", lostErr, err)
+		}
+		return err
+	}
+	return nil
+}
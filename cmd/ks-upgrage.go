@@ -1,38 +1,239 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"sort"
+
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
+	"kubesphere.io/ks-upgrade/pkg/alerting"
+	"kubesphere.io/ks-upgrade/pkg/cleanup"
+	"kubesphere.io/ks-upgrade/pkg/clusterconfig"
+	"kubesphere.io/ks-upgrade/pkg/config"
+	"kubesphere.io/ks-upgrade/pkg/devops"
+	"kubesphere.io/ks-upgrade/pkg/hook"
+	"kubesphere.io/ks-upgrade/pkg/kubesphereconfig"
+	"kubesphere.io/ks-upgrade/pkg/logging"
+	"kubesphere.io/ks-upgrade/pkg/notification"
+	"kubesphere.io/ks-upgrade/pkg/plugin"
 	"kubesphere.io/ks-upgrade/pkg/role"
+	"kubesphere.io/ks-upgrade/pkg/task"
+	"kubesphere.io/ks-upgrade/pkg/transform"
+	"kubesphere.io/ks-upgrade/pkg/user"
+	"kubesphere.io/ks-upgrade/pkg/workspace"
 
 	"log"
 )
 
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// global flags, every command accepts them
+var (
+	kubeconfig string
+	output     string
+	configFile string
+)
+
+// cfg is the configuration loaded by parseFlags
+var cfg = config.New()
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"plan":       {usage: "compute and print the pending changes", run: planCommand},
+	"apply":      {usage: "apply the pending changes, or the changes of a saved plan", run: applyCommand},
+	"status":     {usage: "show the state of the current or last run", run: statusCommand},
+	"verify":     {usage: "verify the cluster is in the upgraded state", run: verifyCommand},
+	"history":    {usage: "list the past runs", run: historyCommand},
+	"preflight":  {usage: "check the cluster is ready to be upgraded", run: preflightCommand},
+	"rollback":   {usage: "undo the mutations of a run", run: rollbackCommand},
+	"controller": {usage: "run as a controller reconciling KubeSphereUpgrade objects", run: controllerCommand},
+}
+
 func main() {
 	klog.InitFlags(flag.CommandLine)
-	flag.Parse()
-	k8sClient, err := newKubernetesClient()
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "path to the kubeconfig file, the in-cluster config is used if empty")
+	flag.StringVar(&output, "output", outputText, "output format, one of: text, json")
+	flag.StringVar(&configFile, "config", os.Getenv(config.EnvPrefix+"_CONFIG"),
+		"path to the configuration file, every key of it can be overridden by a "+config.EnvPrefix+"_* env var")
+	flag.Usage = usage
+
+	// the command comes first, nothing is ever run by default since most commands mutate the cluster
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		if len(os.Args) < 2 {
+			os.Exit(2)
+		}
+		return
+	}
+	c, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q, the command must come before the flags\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := c.run(os.Args[2:]); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+// newFlagSet returns the flag set of a command, including the global flags.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// parseFlags parses the flags of a command and loads the configuration. When options
+// is given, it's set from the configuration except the flags passed explicitly.
+func parseFlags(fs *flag.FlagSet, args []string, options *task.Options) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q, %s takes no positional argument", fs.Arg(0), fs.Name())
+	}
+	if output != outputText && output != outputJSON {
+		return fmt.Errorf("unknown output format %s", output)
+	}
+
+	var err error
+	if cfg, err = config.Load(configFile); err != nil {
+		return err
+	}
+	if options == nil {
+		return nil
+	}
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	cfg.ApplyTo(options)
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newOptions returns the runtime options of a run set from the configuration.
+func newOptions() *task.Options {
+	options := task.NewOptions()
+	cfg.ApplyTo(options)
+	return options
+}
+
+// newTasks returns the tasks selected by the configuration, the built-in tasks followed by the
+// transformations and the plugins, the plugins are given kubeconfigPath. It also sets up the hooks of the run.
+func newTasks(k8sClient kubernetes.Interface, options *task.Options, kubeconfigPath string) ([]task.UpgradeTask, error) {
+	return newTasksFromConfig(cfg, k8sClient, options, kubeconfigPath)
+}
+
+// newTasksFromConfig is newTasks with the given configuration instead of the loaded one.
+func newTasksFromConfig(cfg *config.Config, k8sClient kubernetes.Interface, options *task.Options, kubeconfigPath string) ([]task.UpgradeTask, error) {
+	hooks, err := hook.NewRunner(k8sClient, cfg.Hooks, options.RunID)
+	if err != nil {
+		return nil, err
+	}
+	options.Hooks = hooks
+
+	// the Roles of the DevOps projects are left to devops-migrate when it runs
+	var devopsNamespaces role.NamespaceLister
+	if len(cfg.Tasks) == 0 || task.InSlice(devops.TaskName, cfg.Tasks) {
+		devopsNamespaces = func() ([]string, error) { return devops.ProjectNamespaces(k8sClient) }
+	}
+	roleMigrateTask, err := role.NewRoleMigrateTask(k8sClient, options, cfg.Role, devopsNamespaces)
+	if err != nil {
+		return nil, err
+	}
+	clusterConfigTask, err := clusterconfig.NewClusterConfigTask(k8sClient, options, cfg.ClusterConfiguration)
 	if err != nil {
-		klog.Fatalln(err)
+		return nil, err
+	}
+	kubesphereConfigTask, err := kubesphereconfig.NewKubeSphereConfigTask(k8sClient, options, cfg.KubeSphereConfig)
+	if err != nil {
+		return nil, err
 	}
+	userMigrateTask := user.NewUserMigrateTask(k8sClient, options, cfg.User, cfg.Role)
+	// the cleanup runs first, it shrinks the collections the other tasks list
+	cleanupTask := cleanup.NewCleanupTask(k8sClient, options, cfg.Cleanup)
+	// the workspace labels are fixed before role-migrate recreates the WorkspaceRoles with them
+	workspaceMigrateTask := workspace.NewWorkspaceMigrateTask(k8sClient, options, cfg.Workspace)
+	notificationTask := notification.NewNotificationTask(k8sClient, options, cfg.Notification)
+	alertingTask := alerting.NewAlertingTask(k8sClient, options, cfg.Alerting)
+	loggingTask := logging.NewLoggingTask(k8sClient, options, cfg.Logging)
+	devopsMigrateTask := devops.NewDevOpsMigrateTask(k8sClient, options, cfg.DevOps, cfg.Role)
+	tasks := []task.UpgradeTask{cleanupTask, workspaceMigrateTask, roleMigrateTask, userMigrateTask, clusterConfigTask, kubesphereConfigTask,
+		notificationTask, alertingTask, loggingTask, devopsMigrateTask}
 
-	task := role.NewRoleMigrateTask(k8sClient)
+	specs, err := transform.Load(cfg.Transformations)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		transformTask, err := transform.NewTransformTask(k8sClient, options, spec)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, transformTask)
+	}
 
-	klog.Infof("starting upgrade: %T", task)
-	if err := task.Run(); err != nil {
-		log.Panicln(err)
+	pluginOptions := *cfg.Plugins
+	pluginOptions.Kubeconfig = kubeconfigPath
+	plugins, err := plugin.Discover(&pluginOptions, options)
+	if err != nil {
+		return nil, err
 	}
-	klog.Infof("successfully upgraded': %T", task)
+	return task.Select(append(tasks, plugins...), cfg.Tasks)
+}
 
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
 }
 
 func newKubernetesClient() (kubernetes.Interface, error) {
-	if config, err := rest.InClusterConfig(); err != nil {
+	var config *rest.Config
+	var err error
+	if kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
 		klog.Error(err)
 		return nil, err
-	} else {
-		return kubernetes.NewForConfig(config)
 	}
+	return kubernetes.NewForConfig(config)
 }
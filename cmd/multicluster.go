@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"kubesphere.io/ks-upgrade/pkg/multicluster"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+type multiClusterFlags struct {
+	all           bool
+	clusters      []string
+	failurePolicy string
+}
+
+func addMultiClusterFlags(fs *flag.FlagSet) *multiClusterFlags {
+	flags := &multiClusterFlags{}
+	fs.BoolVar(&flags.all, "all-clusters", false, "run against the host cluster, then against every ready member cluster")
+	fs.Var((*stringList)(&flags.clusters), "clusters", "with --all-clusters, only these member clusters, comma separated")
+	fs.StringVar(&flags.failurePolicy, "failure-policy", "", "with --all-clusters, whether a failing cluster stops the run, one of: Stop, Continue")
+	return flags
+}
+
+// options returns the multi-cluster options of the configuration overridden by the flags.
+func (f *multiClusterFlags) options() (*multicluster.Options, error) {
+	options := *cfg.MultiCluster
+	if len(f.clusters) > 0 {
+		options.Clusters = f.clusters
+	}
+	if f.failurePolicy != "" {
+		options.FailurePolicy = f.failurePolicy
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return &options, nil
+}
+
+// forEachCluster runs f against the cluster ks-upgrade is connected to. With --all-clusters, it's the
+// host cluster and f runs against every ready member cluster after it, each with its own copy of options:
+// the state, the journal and the lock of a run are kept in the cluster it targets, and the reports are
+// written per cluster. kubeconfigPath is the kubeconfig file of the cluster, empty for the in-cluster config.
+func forEachCluster(hostClient kubernetes.Interface, flags *multiClusterFlags, options *task.Options,
+	f func(cluster *multicluster.Cluster, kubeconfigPath string, options *task.Options) error) error {
+	if !flags.all {
+		return f(&multicluster.Cluster{Client: hostClient}, kubeconfig, options)
+	}
+	multiClusterOptions, err := flags.options()
+	if err != nil {
+		return err
+	}
+	host, err := multicluster.HostName(hostClient)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		klog.Warningf("clusters.cluster.kubesphere.io is not served, multi-cluster isn't enabled, running against the host cluster only")
+		return f(&multicluster.Cluster{Client: hostClient}, kubeconfig, options)
+	}
+	members, skipped, err := multicluster.Members(hostClient, multiClusterOptions)
+	if err != nil {
+		return err
+	}
+	for _, s := range skipped {
+		klog.Warningf("skipping member cluster %s: %s", s.Name, s.Reason)
+	}
+
+	clusters := append([]*multicluster.Cluster{{Name: host, Client: hostClient}}, members...)
+	failures := make([]string, 0)
+	for i, cluster := range clusters {
+		klog.Infof("running against cluster %s", cluster.Name)
+		err := runCluster(cluster, clusterOptions(options, cluster.Name), f)
+		if err == nil {
+			klog.Infof("cluster %s done", cluster.Name)
+			continue
+		}
+		klog.Errorf("cluster %s failed: %v", cluster.Name, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", cluster.Name, err))
+		if multiClusterOptions.FailurePolicy == multicluster.FailurePolicyStop {
+			left := make([]string, 0)
+			for _, c := range clusters[i+1:] {
+				left = append(left, c.Name)
+			}
+			if len(left) > 0 {
+				klog.Warningf("failure policy is %s, clusters left as they are: %s", multicluster.FailurePolicyStop, strings.Join(left, ", "))
+			}
+			break
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d clusters failed:\n%s", len(failures), len(clusters), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// runCluster runs f against a cluster, the kubeconfig of a member cluster is written to a temporary
+// file for the plugins.
+func runCluster(cluster *multicluster.Cluster, options *task.Options,
+	f func(cluster *multicluster.Cluster, kubeconfigPath string, options *task.Options) error) error {
+	if len(cluster.Kubeconfig) == 0 {
+		return f(cluster, kubeconfig, options)
+	}
+	file, err := ioutil.TempFile("", fmt.Sprintf("ks-upgrade-%s-*.kubeconfig", cluster.Name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(cluster.Kubeconfig)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return f(cluster, file.Name(), options)
+}
+
+// clusterOptions returns the options of the run of a cluster, the runs share their id.
+func clusterOptions(options *task.Options, cluster string) *task.Options {
+	c := *options
+	c.Cluster = cluster
+	if options.Journal != nil {
+		c.Journal = task.NewJournal(options.RunID)
+	}
+	if options.Filter != nil {
+		filter := *options.Filter
+		c.Filter = &filter
+	}
+	c.ReportSinks = multicluster.ReportSinks(options.ReportSinks, cluster)
+	return &c
+}
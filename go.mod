@@ -3,9 +3,15 @@ module kubesphere.io/ks-upgrade
 go 1.16
 
 require (
+	github.com/evanphx/json-patch v4.11.0+incompatible
+	github.com/google/cel-go v0.10.1
 	github.com/google/gofuzz v1.2.0 // indirect
+	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
+	google.golang.org/genproto v0.0.0-20210831024726-fe130286e0e2
+	google.golang.org/protobuf v1.27.1
 	k8s.io/api v0.22.1
 	k8s.io/apimachinery v0.22.1
 	k8s.io/client-go v0.22.1
 	k8s.io/klog v1.0.0
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,393 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	group = "alerting.kubesphere.io"
+
+	DefaultTargetVersion = "v2beta1"
+
+	// LevelLabel is set by ks-apiserver on the PrometheusRules of the custom alerting policies, it tells
+	// their scope: namespace, cluster or global.
+	LevelLabel = "custom-alerting-rule-level"
+	// MigratedFromAnnotation is set on the RuleGroups to the PrometheusRule they were converted from.
+	MigratedFromAnnotation = "ks-upgrade.kubesphere.io/migrated-from"
+)
+
+// legacyLabels are the labels routing the legacy PrometheusRules to the rulers, they're not kept.
+var legacyLabels = []string{LevelLabel, "role", "prometheus", "thanos-ruler"}
+
+// scope is where the rules of a level are converted to.
+type scope struct {
+	kind     string
+	resource string
+	// clusterScoped groups have no namespace, whatever the namespace of the PrometheusRule
+	clusterScoped bool
+}
+
+var scopes = map[string]scope{
+	"namespace": {kind: "RuleGroup", resource: "rulegroups"},
+	"cluster":   {kind: "ClusterRuleGroup", resource: "clusterrulegroups", clusterScoped: true},
+	"global":    {kind: "GlobalRuleGroup", resource: "globalrulegroups", clusterScoped: true},
+}
+
+// Options are the parameters of the alerting migration.
+type Options struct {
+	// TargetVersion is the API version of the RuleGroups.
+	TargetVersion string `json:"targetVersion,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{TargetVersion: DefaultTargetVersion}
+}
+
+type alertingTask struct {
+	client  kubernetes.Interface
+	applier *task.Applier
+	options *Options
+
+	task.WarningList
+}
+
+// NewAlertingTask creates the task converting the custom alerting policies, the PrometheusRules labelled
+// by ks-apiserver, to RuleGroups. A PrometheusRule is only deleted once its RuleGroups were verified, by
+// the run after the one creating them.
+func NewAlertingTask(client kubernetes.Interface, options *task.Options, alertingOptions *Options) task.UpgradeTask {
+	return &alertingTask{client: client, applier: task.NewApplier(client, options), options: alertingOptions}
+}
+
+func (t *alertingTask) Name() string {
+	return "alerting-migrate"
+}
+
+func (t *alertingTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+// legacyRules lists the PrometheusRules of the custom alerting policies, none if the CRD isn't installed.
+func (t *alertingTask) legacyRules() ([]*unstructured.Unstructured, error) {
+	objects, err := task.ListObjects(t.client, task.CollectionPath("monitoring.coreos.com", "v1", "prometheusrules", ""), LevelLabel, "")
+	if errors.IsNotFound(err) {
+		klog.Infof("prometheusrules.monitoring.coreos.com is not served, skipping it.")
+		return nil, nil
+	}
+	return objects, err
+}
+
+// ruleGroup is a RuleGroup converted from a group of a PrometheusRule.
+type ruleGroup struct {
+	path   string
+	object *unstructured.Unstructured
+}
+
+func (g *ruleGroup) key() string {
+	return g.path + "/" + g.object.GetName()
+}
+
+// claim records the keys of the RuleGroups of a PrometheusRule in claimed, the ClusterRuleGroups and the
+// GlobalRuleGroups have no namespace and the groups of a rule are suffixed by their index, so two rules may
+// be converted to the same RuleGroup. It returns the RuleGroup and the rule claiming it first on a conflict.
+func claim(claimed map[string]string, name string, groups []*ruleGroup) (*ruleGroup, string) {
+	for _, g := range groups {
+		if other, ok := claimed[g.key()]; ok && other != name {
+			return g, other
+		}
+	}
+	for _, g := range groups {
+		claimed[g.key()] = name
+	}
+	return nil, ""
+}
+
+// objectName returns the name of an object prefixed by its namespace if it has one.
+func objectName(object *unstructured.Unstructured) string {
+	if object.GetNamespace() == "" {
+		return object.GetName()
+	}
+	return fmt.Sprintf("%s/%s", object.GetNamespace(), object.GetName())
+}
+
+func (t *alertingTask) Plan() ([]task.Change, error) {
+	t.ResetWarnings()
+	legacy, err := t.legacyRules()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]task.Change, 0)
+	claimed := make(map[string]string)
+	for _, rule := range legacy {
+		name := fmt.Sprintf("%s/%s", rule.GetNamespace(), rule.GetName())
+		groups, err := t.convert(rule)
+		if err != nil {
+			t.Warn("PrometheusRule %s can't be converted, it's left as it is: %v", name, err)
+			continue
+		}
+		if g, other := claim(claimed, name, groups); g != nil {
+			t.Warn("PrometheusRule %s can't be converted, it's left as it is: %s %s is converted from PrometheusRule %s", name, g.object.GetKind(), objectName(g.object), other)
+			continue
+		}
+
+		// the PrometheusRule is deleted by the run after the one creating its RuleGroups, once they're verified
+		verified := true
+		for _, g := range groups {
+			existing, err := t.get(g)
+			if err != nil {
+				return nil, err
+			}
+			if existing == nil {
+				marshal, err := g.object.MarshalJSON()
+				if err != nil {
+					return nil, err
+				}
+				changes = append(changes, task.Change{
+					Operation:   task.OperationCreate,
+					Path:        g.path,
+					Name:        g.object.GetName(),
+					Object:      marshal,
+					Description: fmt.Sprintf("convert PrometheusRule %s to %s %s", name, g.object.GetKind(), objectName(g.object)),
+				})
+				verified = false
+				continue
+			}
+			if err := verify(existing, g.object); err != nil {
+				verified = false
+				t.Warn("PrometheusRule %s is kept: %v", name, err)
+			}
+		}
+		if !verified {
+			klog.Infof("PrometheusRule %s is deleted by the next run, once its RuleGroups are verified", name)
+			continue
+		}
+		changes = append(changes, task.Change{
+			Operation:       task.OperationDelete,
+			Path:            task.CollectionPath("monitoring.coreos.com", "v1", "prometheusrules", rule.GetNamespace()),
+			Name:            rule.GetName(),
+			ResourceVersion: rule.GetResourceVersion(),
+			Description:     fmt.Sprintf("delete PrometheusRule %s, its RuleGroups were verified", name),
+		})
+	}
+	return changes, nil
+}
+
+// convert returns the RuleGroups of a PrometheusRule, one by group of rules.
+func (t *alertingTask) convert(rule *unstructured.Unstructured) ([]*ruleGroup, error) {
+	level := rule.GetLabels()[LevelLabel]
+	s, ok := scopes[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown level %q", level)
+	}
+	namespace := rule.GetNamespace()
+	if s.clusterScoped {
+		namespace = ""
+	}
+	labels := make(map[string]string)
+	for k, v := range rule.GetLabels() {
+		if !task.InSlice(k, legacyLabels) {
+			labels[k] = v
+		}
+	}
+
+	legacyGroups, _, err := unstructured.NestedSlice(rule.Object, "spec", "groups")
+	if err != nil {
+		return nil, err
+	}
+	if len(legacyGroups) == 0 {
+		return nil, fmt.Errorf("it has no rules")
+	}
+	groups := make([]*ruleGroup, 0, len(legacyGroups))
+	for i, g := range legacyGroups {
+		legacyGroup, ok := g.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid group %v", g)
+		}
+		spec := make(map[string]interface{})
+		for _, field := range []string{"interval", "partial_response_strategy"} {
+			if v, ok := legacyGroup[field]; ok {
+				spec[field] = v
+			}
+		}
+		legacyRules, _ := legacyGroup["rules"].([]interface{})
+		rules := make([]interface{}, 0, len(legacyRules))
+		for _, r := range legacyRules {
+			converted, err := convertRule(r)
+			if err != nil {
+				return nil, fmt.Errorf("group %v: %v", legacyGroup["name"], err)
+			}
+			rules = append(rules, converted)
+		}
+		spec["rules"] = rules
+
+		name := rule.GetName()
+		if len(legacyGroups) > 1 {
+			name = fmt.Sprintf("%s-%d", name, i)
+		}
+		object := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		object.SetAPIVersion(group + "/" + t.options.TargetVersion)
+		object.SetKind(s.kind)
+		if namespace != "" {
+			object.SetNamespace(namespace)
+		}
+		object.SetName(name)
+		if len(labels) > 0 {
+			object.SetLabels(labels)
+		}
+		object.SetAnnotations(map[string]string{MigratedFromAnnotation: fmt.Sprintf("%s/%s", rule.GetNamespace(), rule.GetName())})
+		groups = append(groups, &ruleGroup{path: task.CollectionPath(group, t.options.TargetVersion, s.resource, namespace), object: object})
+	}
+	return groups, nil
+}
+
+// convertRule converts an alerting rule, its severity label becomes the severity of the rule. The
+// rule_id label ks-apiserver identified the rules with isn't kept.
+func convertRule(r interface{}) (map[string]interface{}, error) {
+	legacy, ok := r.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid rule %v", r)
+	}
+	if record, ok := legacy["record"]; ok {
+		return nil, fmt.Errorf("recording rule %v has no equivalent", record)
+	}
+	alert, _ := legacy["alert"].(string)
+	if alert == "" {
+		return nil, fmt.Errorf("rule without alert name")
+	}
+	rule := map[string]interface{}{"alert": alert, "expr": legacy["expr"]}
+	if v, ok := legacy["for"]; ok {
+		rule["for"] = v
+	}
+	if v, ok := legacy["annotations"]; ok {
+		rule["annotations"] = v
+	}
+	if labels, ok := legacy["labels"].(map[string]interface{}); ok {
+		kept := make(map[string]interface{})
+		for k, v := range labels {
+			switch k {
+			case "severity":
+				rule["severity"] = v
+			case "rule_id":
+			default:
+				kept[k] = v
+			}
+		}
+		if len(kept) > 0 {
+			rule["labels"] = kept
+		}
+	}
+	return rule, nil
+}
+
+// get returns the RuleGroup if it exists.
+func (t *alertingTask) get(g *ruleGroup) (*unstructured.Unstructured, error) {
+	raw, err := t.client.Discovery().RESTClient().Get().AbsPath(g.key()).DoRaw(context.TODO())
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// verify checks an existing RuleGroup was converted from the same PrometheusRule and has all its
+// rules, the rules may have fields defaulted by the alerting controller.
+func verify(existing, expected *unstructured.Unstructured) error {
+	kind, name := expected.GetKind(), objectName(expected)
+	if from := existing.GetAnnotations()[MigratedFromAnnotation]; from != expected.GetAnnotations()[MigratedFromAnnotation] {
+		return fmt.Errorf("%s %s already exists and wasn't converted from it", kind, name)
+	}
+	existingRules, _, _ := unstructured.NestedSlice(existing.Object, "spec", "rules")
+	expectedRules, _, _ := unstructured.NestedSlice(expected.Object, "spec", "rules")
+	for _, r := range expectedRules {
+		rule := r.(map[string]interface{})
+		found := false
+		for _, e := range existingRules {
+			if existingRule, ok := e.(map[string]interface{}); ok && covers(existingRule, rule) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("rule %v of %s %s differs from the PrometheusRule", rule["alert"], kind, name)
+		}
+	}
+	return nil
+}
+
+// covers reports whether every field of expected has the same value in existing.
+func covers(existing, expected map[string]interface{}) bool {
+	for k, v := range expected {
+		// the values are compared as JSON, the durations and the numbers may have been decoded differently
+		a, _ := json.Marshal(existing[k])
+		b, _ := json.Marshal(v)
+		if !reflect.DeepEqual(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify checks the RuleGroups of the PrometheusRules which aren't deleted yet exist and have all their rules.
+func (t *alertingTask) Verify() error {
+	legacy, err := t.legacyRules()
+	if err != nil {
+		return err
+	}
+	errs := make([]error, 0)
+	claimed := make(map[string]string)
+	for _, rule := range legacy {
+		groups, err := t.convert(rule)
+		if err != nil {
+			// reported by the plan, the PrometheusRule is left to be handled manually
+			continue
+		}
+		if g, _ := claim(claimed, fmt.Sprintf("%s/%s", rule.GetNamespace(), rule.GetName()), groups); g != nil {
+			// a conflict the plan reported
+			continue
+		}
+		for _, g := range groups {
+			existing, err := t.get(g)
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				errs = append(errs, fmt.Errorf("%s %s of PrometheusRule %s/%s doesn't exist", g.object.GetKind(), objectName(g.object), rule.GetNamespace(), rule.GetName()))
+				continue
+			}
+			// a RuleGroup converted from another PrometheusRule is a conflict the plan reported
+			if existing.GetAnnotations()[MigratedFromAnnotation] != g.object.GetAnnotations()[MigratedFromAnnotation] {
+				continue
+			}
+			if err := verify(existing, g.object); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (t *alertingTask) RequiredPermissions() []task.Permission {
+	permissions := []task.Permission{
+		{Group: "monitoring.coreos.com", Version: "v1", Resource: "prometheusrules", Verbs: []string{"list", "get", "delete"}, Optional: true},
+	}
+	for _, level := range []string{"namespace", "cluster", "global"} {
+		permissions = append(permissions, task.Permission{Group: group, Version: t.options.TargetVersion, Resource: scopes[level].resource, Verbs: []string{"get", "create"}, Optional: true})
+	}
+	return permissions
+}
@@ -0,0 +1,215 @@
+package alerting
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestConvertRule(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     interface{}
+		expected map[string]interface{}
+		err      bool
+	}{
+		{
+			name: "severity and rule_id labels",
+			rule: map[string]interface{}{
+				"alert": "HighCPU", "expr": "cpu > 0.9", "for": "5m",
+				"annotations": map[string]interface{}{"summary": "cpu"},
+				"labels":      map[string]interface{}{"severity": "critical", "rule_id": "1", "team": "a"},
+			},
+			expected: map[string]interface{}{
+				"alert": "HighCPU", "expr": "cpu > 0.9", "for": "5m", "severity": "critical",
+				"annotations": map[string]interface{}{"summary": "cpu"},
+				"labels":      map[string]interface{}{"team": "a"},
+			},
+		},
+		{
+			name:     "no labels",
+			rule:     map[string]interface{}{"alert": "Down", "expr": "up == 0"},
+			expected: map[string]interface{}{"alert": "Down", "expr": "up == 0"},
+		},
+		{
+			name:     "only dropped labels",
+			rule:     map[string]interface{}{"alert": "Down", "expr": "up == 0", "labels": map[string]interface{}{"rule_id": "1"}},
+			expected: map[string]interface{}{"alert": "Down", "expr": "up == 0"},
+		},
+		{
+			name: "recording rule",
+			rule: map[string]interface{}{"record": "cpu:sum", "expr": "sum(cpu)"},
+			err:  true,
+		},
+		{
+			name: "no alert name",
+			rule: map[string]interface{}{"expr": "up == 0"},
+			err:  true,
+		},
+		{
+			name: "invalid rule",
+			rule: "up == 0",
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := convertRule(test.rule)
+			if (err != nil) != test.err {
+				t.Fatalf("convertRule() failed: %v", err)
+			}
+			if !reflect.DeepEqual(rule, test.expected) {
+				t.Errorf("rule is %v, expected %v", rule, test.expected)
+			}
+		})
+	}
+}
+
+func TestConvert(t *testing.T) {
+	groups := []interface{}{
+		map[string]interface{}{"name": "a", "interval": "1m", "rules": []interface{}{map[string]interface{}{"alert": "A", "expr": "a"}}},
+		map[string]interface{}{"name": "b", "rules": []interface{}{map[string]interface{}{"alert": "B", "expr": "b"}}},
+	}
+	tests := []struct {
+		name      string
+		level     string
+		groups    []interface{}
+		paths     []string
+		names     []string
+		namespace string
+		err       bool
+	}{
+		{
+			name:      "namespace",
+			level:     "namespace",
+			groups:    groups[:1],
+			paths:     []string{"/apis/alerting.kubesphere.io/v2beta1/namespaces/ns1/rulegroups"},
+			names:     []string{"rule"},
+			namespace: "ns1",
+		},
+		{
+			name:   "cluster scoped",
+			level:  "cluster",
+			groups: groups,
+			paths:  []string{"/apis/alerting.kubesphere.io/v2beta1/clusterrulegroups", "/apis/alerting.kubesphere.io/v2beta1/clusterrulegroups"},
+			names:  []string{"rule-0", "rule-1"},
+		},
+		{
+			name:   "global",
+			level:  "global",
+			groups: groups[:1],
+			paths:  []string{"/apis/alerting.kubesphere.io/v2beta1/globalrulegroups"},
+			names:  []string{"rule"},
+		},
+		{
+			name:   "unknown level",
+			level:  "tenant",
+			groups: groups,
+			err:    true,
+		},
+		{
+			name:  "no rules",
+			level: "namespace",
+			err:   true,
+		},
+	}
+	task := &alertingTask{options: NewOptions()}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"groups": test.groups}}}
+			rule.SetNamespace("ns1")
+			rule.SetName("rule")
+			rule.SetLabels(map[string]string{LevelLabel: test.level, "thanos-ruler": "ruler", "team": "a"})
+
+			converted, err := task.convert(rule)
+			if (err != nil) != test.err {
+				t.Fatalf("convert() failed: %v", err)
+			}
+			paths, names := make([]string, 0), make([]string, 0)
+			for _, g := range converted {
+				paths = append(paths, g.path)
+				names = append(names, g.object.GetName())
+				if g.object.GetNamespace() != test.namespace {
+					t.Errorf("%s is in namespace %q, expected %q", g.object.GetName(), g.object.GetNamespace(), test.namespace)
+				}
+				if labels := g.object.GetLabels(); !reflect.DeepEqual(labels, map[string]string{"team": "a"}) {
+					t.Errorf("%s has labels %v", g.object.GetName(), labels)
+				}
+			}
+			if test.err {
+				return
+			}
+			if !reflect.DeepEqual(paths, test.paths) || !reflect.DeepEqual(names, test.names) {
+				t.Errorf("converted to %v %v, expected %v %v", paths, names, test.paths, test.names)
+			}
+		})
+	}
+}
+
+func TestClaim(t *testing.T) {
+	task := &alertingTask{options: NewOptions()}
+	convert := func(namespace, name, level string, groups int) []*ruleGroup {
+		legacyGroups := make([]interface{}, 0, groups)
+		for i := 0; i < groups; i++ {
+			legacyGroups = append(legacyGroups, map[string]interface{}{"rules": []interface{}{map[string]interface{}{"alert": "A", "expr": "a"}}})
+		}
+		rule := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"groups": legacyGroups}}}
+		rule.SetNamespace(namespace)
+		rule.SetName(name)
+		rule.SetLabels(map[string]string{LevelLabel: level})
+		converted, err := task.convert(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return converted
+	}
+	tests := []struct {
+		name     string
+		first    []*ruleGroup
+		second   []*ruleGroup
+		conflict bool
+	}{
+		{
+			name:   "namespaced rules with the same name",
+			first:  convert("ns1", "rule", "namespace", 1),
+			second: convert("ns2", "rule", "namespace", 1),
+		},
+		{
+			name:     "cluster rules with the same name",
+			first:    convert("ns1", "rule", "cluster", 1),
+			second:   convert("ns2", "rule", "cluster", 1),
+			conflict: true,
+		},
+		{
+			name:     "suffixed group",
+			first:    convert("ns1", "rule", "global", 2),
+			second:   convert("ns1", "rule-0", "global", 1),
+			conflict: true,
+		},
+		{
+			name:   "cluster and global rules with the same name",
+			first:  convert("ns1", "rule", "cluster", 1),
+			second: convert("ns1", "rule", "global", 1),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claimed := make(map[string]string)
+			if g, _ := claim(claimed, "first", test.first); g != nil {
+				t.Fatalf("the first rule conflicts on %s", g.key())
+			}
+			g, other := claim(claimed, "second", test.second)
+			if (g != nil) != test.conflict {
+				t.Errorf("conflict on %v, expected a conflict %t", g, test.conflict)
+			}
+			if g != nil && other != "first" {
+				t.Errorf("conflicting with %s, expected first", other)
+			}
+			// a rule doesn't conflict with itself, e.g. when it's verified
+			if g, _ := claim(claimed, "first", test.first); g != nil {
+				t.Errorf("the first rule conflicts with itself on %s", g.key())
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package cleanup
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	iamGroup   = "iam.kubesphere.io"
+	iamVersion = "v1alpha2"
+
+	UserReferenceLabel = "iam.kubesphere.io/user-ref"
+
+	// tokenKey is the key of the JWT in a token Secret
+	tokenKey = "token"
+	// batchSize is the number of deletions applied together, beyond the ones of a listed page
+	batchSize = 500
+)
+
+// Options are the retention of the login records and the tokens.
+type Options struct {
+	// LoginRecordMaxAge is how long a login record is kept, they're kept forever if zero.
+	LoginRecordMaxAge metav1.Duration `json:"loginRecordMaxAge"`
+	// LoginRecordMaxPerUser is the number of the latest login records kept for a user, all are kept if zero.
+	LoginRecordMaxPerUser int `json:"loginRecordMaxPerUser"`
+	// TokenMaxAge is how long a token Secret without expiry is kept, they're kept forever if zero. The
+	// expired tokens and the tokens of deleted users are always removed.
+	TokenMaxAge metav1.Duration `json:"tokenMaxAge"`
+	// TokenSecretType is the type of the Secrets holding the tokens.
+	TokenSecretType string `json:"tokenSecretType,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		LoginRecordMaxAge:     metav1.Duration{Duration: 7 * 24 * time.Hour},
+		LoginRecordMaxPerUser: 100,
+		TokenMaxAge:           metav1.Duration{Duration: 7 * 24 * time.Hour},
+		TokenSecretType:       "kubesphere.io/token",
+	}
+}
+
+type cleanupTask struct {
+	client  kubernetes.Interface
+	applier *task.Applier
+	options *Options
+
+	// stale are the numbers of stale login records and tokens found by the last plan, by user
+	staleRecords map[string]int
+	staleTokens  map[string]int
+}
+
+// NewCleanupTask creates the task garbage collecting the login records and the stale tokens, it
+// should run before the other tasks since it shrinks the collections they list. The deletions
+// aren't journaled, garbage isn't worth being restored and could outgrow the journal.
+func NewCleanupTask(client kubernetes.Interface, options *task.Options, cleanupOptions *Options) task.UpgradeTask {
+	return &cleanupTask{client: client, applier: task.NewApplier(client, options), options: cleanupOptions}
+}
+
+func (t *cleanupTask) Name() string {
+	return "iam-cleanup"
+}
+
+func (t *cleanupTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+// Result returns the number of stale objects and the counts by user.
+func (t *cleanupTask) Result() (int, string) {
+	records, tokens := 0, 0
+	users := make(map[string]bool)
+	for user, n := range t.staleRecords {
+		records += n
+		users[user] = true
+	}
+	for user, n := range t.staleTokens {
+		tokens += n
+		users[user] = true
+	}
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	counts := make([]string, 0, len(names))
+	for _, user := range names {
+		counts = append(counts, fmt.Sprintf("%s: %d login records, %d tokens", user, t.staleRecords[user], t.staleTokens[user]))
+	}
+
+	message := fmt.Sprintf("%d stale login records and %d stale tokens", records, tokens)
+	if len(counts) > 0 {
+		message = fmt.Sprintf("%s (%s)", message, strings.Join(counts, "; "))
+	}
+	return records + tokens, message
+}
+
+// Plan returns the deletions of the stale login records and tokens.
+func (t *cleanupTask) Plan() ([]task.Change, error) {
+	changes := make([]task.Change, 0)
+	err := t.PlanBatches(func(batch []task.Change) error {
+		changes = append(changes, batch...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// PlanBatches hands the deletions to apply page by page as the collections are listed, so that a run
+// never holds the deletions of a whole collection.
+func (t *cleanupTask) PlanBatches(apply func(changes []task.Change) error) error {
+	t.staleRecords = make(map[string]int)
+	t.staleTokens = make(map[string]int)
+	if err := t.cleanupLoginRecords(apply); err != nil {
+		return err
+	}
+	return t.cleanupTokens(apply)
+}
+
+type loginRecord struct {
+	name            string
+	resourceVersion string
+	time            time.Time
+}
+
+// cleanupLoginRecords deletes the login records older than the max age page by page, then the oldest
+// records of the users having more than the max per user.
+func (t *cleanupTask) cleanupLoginRecords(apply func(changes []task.Change) error) error {
+	if t.options.LoginRecordMaxAge.Duration <= 0 && t.options.LoginRecordMaxPerUser <= 0 {
+		return nil
+	}
+	path := task.CollectionPath(iamGroup, iamVersion, "loginrecords", "")
+	deadline := time.Now().Add(-t.options.LoginRecordMaxAge.Duration)
+	kept := make(map[string][]loginRecord)
+
+	err := task.ListObjectPages(t.client, path, "", "", func(page []*unstructured.Unstructured) error {
+		changes := make([]task.Change, 0)
+		for _, record := range page {
+			user := record.GetLabels()[UserReferenceLabel]
+			created := record.GetCreationTimestamp().Time
+			if t.options.LoginRecordMaxAge.Duration > 0 && created.Before(deadline) {
+				changes = append(changes, deletion(path, "login record", record.GetName(), record.GetResourceVersion()))
+				t.staleRecords[user]++
+				continue
+			}
+			kept[user] = append(kept[user], loginRecord{name: record.GetName(), resourceVersion: record.GetResourceVersion(), time: created})
+		}
+		return applyBatch(apply, changes)
+	})
+	if err != nil {
+		return err
+	}
+	if t.options.LoginRecordMaxPerUser <= 0 {
+		return nil
+	}
+
+	users := make([]string, 0, len(kept))
+	for user := range kept {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	changes := make([]task.Change, 0)
+	for _, user := range users {
+		records := kept[user]
+		if len(records) <= t.options.LoginRecordMaxPerUser {
+			continue
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].time.After(records[j].time) })
+		for _, r := range records[t.options.LoginRecordMaxPerUser:] {
+			changes = append(changes, deletion(path, "login record", r.name, r.resourceVersion))
+			t.staleRecords[user]++
+			if len(changes) == batchSize {
+				if err := apply(changes); err != nil {
+					return err
+				}
+				changes = make([]task.Change, 0)
+			}
+		}
+	}
+	return applyBatch(apply, changes)
+}
+
+// applyBatch applies the deletions if there are any.
+func applyBatch(apply func(changes []task.Change) error, changes []task.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	return apply(changes)
+}
+
+// cleanupTokens deletes the expired token Secrets and the ones of deleted users page by page. A token
+// without expiry is stale once it's older than the max age.
+func (t *cleanupTask) cleanupTokens(apply func(changes []task.Change) error) error {
+	if t.options.TokenSecretType == "" {
+		return nil
+	}
+	users := make(map[string]bool)
+	err := task.ListObjectPages(t.client, task.CollectionPath(iamGroup, iamVersion, "users", ""), "", "", func(page []*unstructured.Unstructured) error {
+		for _, user := range page {
+			users[user.GetName()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	deadline := now.Add(-t.options.TokenMaxAge.Duration)
+	return task.ListObjectPages(t.client, task.CollectionPath("", "v1", "secrets", ""), "", "type="+t.options.TokenSecretType,
+		func(page []*unstructured.Unstructured) error {
+			changes := make([]task.Change, 0)
+			for _, secret := range page {
+				user := secret.GetLabels()[UserReferenceLabel]
+				stale := user != "" && !users[user]
+				if expiry, ok := tokenExpiry(secret); ok {
+					stale = stale || expiry.Before(now)
+				} else {
+					stale = stale || (t.options.TokenMaxAge.Duration > 0 && secret.GetCreationTimestamp().Time.Before(deadline))
+				}
+				if stale {
+					changes = append(changes, deletion(task.CollectionPath("", "v1", "secrets", secret.GetNamespace()), "token", secret.GetName(), secret.GetResourceVersion()))
+					t.staleTokens[user]++
+				}
+			}
+			return applyBatch(apply, changes)
+		})
+}
+
+// tokenExpiry returns the expiry of the JWT of a token Secret, from its exp claim. The signature isn't
+// checked, the token is only deleted when it can't be used anymore.
+func tokenExpiry(secret *unstructured.Unstructured) (time.Time, bool) {
+	encoded, _, _ := unstructured.NestedString(secret.Object, "data", tokenKey)
+	token, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return time.Time{}, false
+	}
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := struct {
+		ExpiresAt int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ExpiresAt == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.ExpiresAt, 0), true
+}
+
+// deletion returns the deletion of a stale object, it's neither journaled nor logged one by one.
+func deletion(path, kind, name, resourceVersion string) task.Change {
+	return task.Change{
+		Operation:       task.OperationDelete,
+		Path:            path,
+		Name:            name,
+		ResourceVersion: resourceVersion,
+		Description:     fmt.Sprintf("delete the stale %s %s", kind, name),
+		Garbage:         true,
+	}
+}
+
+func (t *cleanupTask) RequiredPermissions() []task.Permission {
+	return []task.Permission{
+		{Group: iamGroup, Version: iamVersion, Resource: "loginrecords", Verbs: []string{"list", "delete"}},
+		{Group: iamGroup, Version: iamVersion, Resource: "users", Verbs: []string{"list"}},
+		{Group: "", Version: "v1", Resource: "secrets", Verbs: []string{"list", "delete"}},
+	}
+}
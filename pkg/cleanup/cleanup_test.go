@@ -0,0 +1,203 @@
+package cleanup
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+// newTestClient returns a client of a server listing the pages of the paths, the continue token of a
+// page is the index of the next one.
+func newTestClient(t *testing.T, pages map[string][][]interface{}) *kubernetes.Clientset {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		index, _ := strconv.Atoi(r.URL.Query().Get("continue"))
+		list, ok := pages[r.URL.Path]
+		if !ok || r.Method != http.MethodGet || index >= len(list) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+		continueToken := ""
+		if index+1 < len(list) {
+			continueToken = strconv.Itoa(index + 1)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]interface{}{"continue": continueToken},
+			"items":    list[index],
+		})
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func testObject(name, namespace, user string, age time.Duration) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"name":              name,
+		"resourceVersion":   "rv-" + name,
+		"creationTimestamp": time.Now().Add(-age).UTC().Format(time.RFC3339),
+		"labels":            map[string]interface{}{UserReferenceLabel: user},
+	}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	return map[string]interface{}{"metadata": metadata}
+}
+
+// testToken returns a token Secret, its JWT has no exp claim if expiry is zero.
+func testToken(name, user string, age, expiry time.Duration) map[string]interface{} {
+	claims := map[string]interface{}{"username": user}
+	if expiry != 0 {
+		claims["exp"] = time.Now().Add(expiry).Unix()
+	}
+	payload, _ := json.Marshal(claims)
+	jwt := fmt.Sprintf("%s.%s.signature", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256"}`)), base64.RawURLEncoding.EncodeToString(payload))
+	secret := testObject(name, "kubesphere-system", user, age)
+	secret["type"] = "kubesphere.io/token"
+	secret["data"] = map[string]interface{}{tokenKey: base64.StdEncoding.EncodeToString([]byte(jwt))}
+	return secret
+}
+
+func TestCleanupPlanBatches(t *testing.T) {
+	day := 24 * time.Hour
+	client := newTestClient(t, map[string][][]interface{}{
+		"/apis/iam.kubesphere.io/v1alpha2/loginrecords": {
+			{
+				testObject("alice-old", "", "alice", 10*day),
+				testObject("alice-1", "", "alice", time.Hour),
+				testObject("alice-2", "", "alice", 2*time.Hour),
+			},
+			{
+				testObject("alice-3", "", "alice", 3*time.Hour),
+				testObject("alice-4", "", "alice", 4*time.Hour),
+				testObject("bob-1", "", "bob", time.Hour),
+				testObject("bob-old", "", "bob", 8*day),
+			},
+		},
+		"/apis/iam.kubesphere.io/v1alpha2/users": {
+			{testObject("alice", "", "", day)},
+			{testObject("bob", "", "", day)},
+		},
+		"/api/v1/secrets": {{
+			testToken("alice-expired", "alice", time.Hour, -time.Minute),
+			testToken("alice-valid", "alice", 10*day, time.Hour),
+			testToken("bob-old", "bob", 10*day, 0),
+			testToken("bob-new", "bob", time.Hour, 0),
+			testToken("carol-valid", "carol", time.Hour, time.Hour),
+		}},
+	})
+	options := NewOptions()
+	options.LoginRecordMaxPerUser = 2
+	cleanup := &cleanupTask{client: client, options: options}
+
+	batches := make([][]string, 0)
+	err := cleanup.PlanBatches(func(changes []task.Change) error {
+		names := make([]string, 0, len(changes))
+		for _, change := range changes {
+			if change.Operation != task.OperationDelete || !change.Garbage {
+				t.Errorf("expected %s to be the deletion of garbage, got %v", change.Key(), change)
+			}
+			if change.ResourceVersion != "rv-"+change.Name {
+				t.Errorf("expected the deletion of %s to be conditional on its resource version, got %q", change.Name, change.ResourceVersion)
+			}
+			names = append(names, change.Name)
+		}
+		sort.Strings(names)
+		batches = append(batches, names)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		// the expired login records of every page
+		{"alice-old"},
+		{"bob-old"},
+		// the oldest records of the users beyond the max per user
+		{"alice-3", "alice-4"},
+		// the expired tokens, the ones without expiry beyond the max age and the ones of deleted users
+		{"alice-expired", "bob-old", "carol-valid"},
+	}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Errorf("expected the batches %v, got %v", expected, batches)
+	}
+	if n, message := cleanup.Result(); n != 7 {
+		t.Errorf("expected 7 stale objects, got %d: %s", n, message)
+	}
+}
+
+func TestCleanupDisabled(t *testing.T) {
+	client := newTestClient(t, map[string][][]interface{}{})
+	cleanup := &cleanupTask{client: client, options: &Options{}}
+	changes, err := cleanup.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected nothing to be cleaned up, got %v", changes)
+	}
+}
+
+func TestCleanupBatchSize(t *testing.T) {
+	records := make([]interface{}, 0, batchSize+10)
+	for i := 0; i < batchSize+10; i++ {
+		records = append(records, testObject(fmt.Sprintf("alice-%d", i), "", "alice", time.Duration(i)*time.Minute))
+	}
+	client := newTestClient(t, map[string][][]interface{}{
+		"/apis/iam.kubesphere.io/v1alpha2/loginrecords": {records},
+	})
+	options := &Options{LoginRecordMaxPerUser: 5}
+	cleanup := &cleanupTask{client: client, options: options}
+
+	sizes := make([]int, 0)
+	err := cleanup.PlanBatches(func(changes []task.Change) error {
+		sizes = append(sizes, len(changes))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{batchSize, 5}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("expected the batches of %v deletions, got %v", expected, sizes)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	tests := map[string]struct {
+		secret map[string]interface{}
+		found  bool
+	}{
+		"exp claim":    {secret: testToken("test", "alice", 0, time.Until(expiry)), found: true},
+		"no exp claim": {secret: testToken("test", "alice", 0, 0), found: false},
+		"not a jwt":    {secret: map[string]interface{}{"data": map[string]interface{}{tokenKey: base64.StdEncoding.EncodeToString([]byte("token"))}}, found: false},
+		"no token":     {secret: map[string]interface{}{}, found: false},
+	}
+	for name, test := range tests {
+		actual, found := tokenExpiry(&unstructured.Unstructured{Object: test.secret})
+		if found != test.found {
+			t.Errorf("%s: expected found %v, got %v", name, test.found, found)
+		}
+		if found && !actual.Equal(expiry) {
+			t.Errorf("%s: expected the expiry %s, got %s", name, expiry, actual)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package clusterconfig
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"kubesphere.io/ks-upgrade/pkg/schema"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	group    = "installer.kubesphere.io"
+	version  = "v1alpha1"
+	resource = "clusterconfigurations"
+
+	// SchemaVersionAnnotation records the release the spec was converted to, so that a converted
+	// ClusterConfiguration isn't converted again from the release of its version label.
+	SchemaVersionAnnotation = "ks-upgrade.kubesphere.io/schema-version"
+	versionLabel            = "version"
+
+	DefaultTargetVersion = "v3.4"
+)
+
+// Options are the parameters of the ClusterConfiguration migration.
+type Options struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	// SourceVersion is the release the spec was written for. If empty, it's read from the version
+	// label or the status of the ClusterConfiguration, which ks-installer updates once it upgraded.
+	SourceVersion string `json:"sourceVersion,omitempty"`
+	// TargetVersion is the release the spec is converted to.
+	TargetVersion string `json:"targetVersion,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{Namespace: task.StateNamespace, Name: "ks-installer", TargetVersion: DefaultTargetVersion}
+}
+
+type clusterConfigTask struct {
+	client  kubernetes.Interface
+	applier *task.Applier
+	dryRun  bool
+	options *Options
+
+	task.WarningList
+}
+
+// NewClusterConfigTask creates the task converting the spec of the ClusterConfiguration of
+// ks-installer from the schema of its release to the schema of the target release.
+func NewClusterConfigTask(client kubernetes.Interface, options *task.Options, configOptions *Options) (task.UpgradeTask, error) {
+	if _, err := schema.ParseVersion(configOptions.TargetVersion); err != nil {
+		return nil, fmt.Errorf("cluster configuration target version: %v", err)
+	}
+	if configOptions.SourceVersion != "" {
+		if _, err := schema.ParseVersion(configOptions.SourceVersion); err != nil {
+			return nil, fmt.Errorf("cluster configuration source version: %v", err)
+		}
+	}
+	return &clusterConfigTask{client: client, applier: task.NewApplier(client, options), dryRun: options.DryRun, options: configOptions}, nil
+}
+
+func (t *clusterConfigTask) Name() string {
+	return "cluster-configuration"
+}
+
+func (t *clusterConfigTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+func (t *clusterConfigTask) path() string {
+	return task.CollectionPath(group, version, resource, t.options.Namespace)
+}
+
+func (t *clusterConfigTask) get() (*unstructured.Unstructured, error) {
+	raw, err := t.client.Discovery().RESTClient().Get().AbsPath(t.path(), t.options.Name).DoRaw(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// sourceVersion returns the release the spec was written for, a spec which was already
+// converted is at the release it was converted to whatever the options say.
+func (t *clusterConfigTask) sourceVersion(object *unstructured.Unstructured) (string, error) {
+	if v := object.GetAnnotations()[SchemaVersionAnnotation]; v != "" {
+		return v, nil
+	}
+	if t.options.SourceVersion != "" {
+		return t.options.SourceVersion, nil
+	}
+	return detectVersion(object)
+}
+
+func detectVersion(object *unstructured.Unstructured) (string, error) {
+	if v := object.GetAnnotations()[SchemaVersionAnnotation]; v != "" {
+		return v, nil
+	}
+	if v := object.GetLabels()[versionLabel]; v != "" {
+		return v, nil
+	}
+	if v, _, _ := unstructured.NestedString(object.Object, "status", "core", "version"); v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("the release of ClusterConfiguration %s/%s is unknown, set its source version", object.GetNamespace(), object.GetName())
+}
+
+func (t *clusterConfigTask) Plan() ([]task.Change, error) {
+	t.ResetWarnings()
+	object, err := t.get()
+	if err != nil {
+		if errors.IsNotFound(err) {
+			klog.Infof("ClusterConfiguration %s/%s is not existing, skipping it.", t.options.Namespace, t.options.Name)
+			return nil, nil
+		}
+		return nil, err
+	}
+	source, err := t.sourceVersion(object)
+	if err != nil {
+		return nil, err
+	}
+	sourceVersion, err := schema.ParseVersion(source)
+	if err != nil {
+		return nil, err
+	}
+	targetVersion, _ := schema.ParseVersion(t.options.TargetVersion)
+	if targetVersion.Less(sourceVersion) {
+		return nil, fmt.Errorf("ClusterConfiguration %s/%s is at %s, it can't be converted back to %s", object.GetNamespace(), object.GetName(), source, t.options.TargetVersion)
+	}
+	if !sourceVersion.Less(targetVersion) {
+		klog.Infof("ClusterConfiguration %s/%s is already at %s, skipping it.", object.GetNamespace(), object.GetName(), targetVersion)
+		return nil, nil
+	}
+
+	original := object.DeepCopy()
+	spec, _, err := unstructured.NestedMap(object.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	result, err := schema.Migrate(spec, steps, sourceVersion.String(), targetVersion.String())
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range result.Warnings {
+		t.Warn("ClusterConfiguration %s/%s: %s", object.GetNamespace(), object.GetName(), w)
+	}
+	if err := unstructured.SetNestedMap(object.Object, spec, "spec"); err != nil {
+		return nil, err
+	}
+	annotations := object.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[SchemaVersionAnnotation] = targetVersion.String()
+	object.SetAnnotations(annotations)
+
+	if t.dryRun {
+		converted, err := yaml.Marshal(spec)
+		if err != nil {
+			return nil, err
+		}
+		klog.Infof("dry-run: converted spec of ClusterConfiguration %s/%s:\n%s", object.GetNamespace(), object.GetName(), converted)
+	}
+
+	originalJSON, err := original.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	modified, err := object.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patch, err := task.CreateMergePatch(originalJSON, modified)
+	if err != nil {
+		return nil, err
+	}
+	description := fmt.Sprintf("convert ClusterConfiguration %s/%s from %s to %s, moving %d settings",
+		object.GetNamespace(), object.GetName(), sourceVersion, targetVersion, len(result.Moved))
+	if len(result.Warnings) > 0 {
+		paths := make([]string, 0, len(result.Warnings))
+		for _, w := range result.Warnings {
+			paths = append(paths, w.Path)
+		}
+		description = fmt.Sprintf("%s, settings without equivalent kept as they are: %s", description, strings.Join(paths, ", "))
+	}
+	return []task.Change{{
+		Operation:       task.OperationUpdate,
+		Path:            t.path(),
+		Name:            object.GetName(),
+		ResourceVersion: object.GetResourceVersion(),
+		Object:          modified,
+		Patch:           patch,
+		Description:     description,
+	}}, nil
+}
+
+// Verify checks the ClusterConfiguration was converted to the target release.
+func (t *clusterConfigTask) Verify() error {
+	object, err := t.get()
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	detected, err := detectVersion(object)
+	if err != nil {
+		return err
+	}
+	current, err := schema.ParseVersion(detected)
+	if err != nil {
+		return err
+	}
+	target, _ := schema.ParseVersion(t.options.TargetVersion)
+	if current.Less(target) {
+		return fmt.Errorf("ClusterConfiguration %s/%s is at %s, expected %s", object.GetNamespace(), object.GetName(), current, target)
+	}
+	return nil
+}
+
+func (t *clusterConfigTask) RequiredPermissions() []task.Permission {
+	return []task.Permission{
+		{Group: group, Version: version, Resource: resource, Verbs: []string{"get", "update"}},
+	}
+}
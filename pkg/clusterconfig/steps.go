@@ -0,0 +1,65 @@
+package clusterconfig
+
+import "kubesphere.io/ks-upgrade/pkg/schema"
+
+// steps are the changes of the ClusterConfiguration spec between the minor releases of ks-installer.
+var steps = []schema.Step{
+	{
+		From: "v3.0",
+		To:   "v3.1",
+		Moves: []schema.Move{
+			{From: "common.minioVolumeSize", To: "common.minio.volumeSize"},
+			{From: "common.openldapVolumeSize", To: "common.openldap.volumeSize"},
+			{From: "common.redisVolumSize", To: "common.redis.volumeSize"},
+			{From: "openpitrix.enabled", To: "openpitrix.store.enabled"},
+			{From: "networkpolicy.enabled", To: "network.networkpolicy.enabled"},
+			{From: "logging.logsidecarReplicas", To: "logging.logsidecar.replicas"},
+		},
+		Removed: []schema.Removed{
+			{Path: "common.mysqlVolumeSize", Reason: "MySQL is no longer deployed"},
+			{Path: "common.etcdVolumeSize", Reason: "the etcd of OpenPitrix is no longer deployed"},
+		},
+	},
+	{
+		From: "v3.1",
+		To:   "v3.2",
+		Moves: []schema.Move{
+			{From: "common.es.elasticsearchMasterReplicas", To: "common.es.master.replicas"},
+			{From: "common.es.elasticsearchMasterVolumeSize", To: "common.es.master.volumeSize"},
+			{From: "common.es.elasticsearchDataReplicas", To: "common.es.data.replicas"},
+			{From: "common.es.elasticsearchDataVolumeSize", To: "common.es.data.volumeSize"},
+			{From: "monitoring.alertmanagerReplicas", To: "alerting.alertmanager.replicas"},
+		},
+	},
+	{
+		From: "v3.2",
+		To:   "v3.3",
+		Moves: []schema.Move{
+			{From: "kubeedge.enabled", To: "edgeruntime.kubeedge.enabled"},
+			{From: "kubeedge.cloudCore", To: "edgeruntime.kubeedge.cloudCore"},
+			{From: "monitoring.prometheusReplicas", To: "monitoring.prometheus.replicas"},
+			{From: "monitoring.prometheusVolumeSize", To: "monitoring.prometheus.volumeSize"},
+			{From: "monitoring.prometheusMemoryRequest", To: "monitoring.prometheus.resources.requests.memory"},
+		},
+		Removed: []schema.Removed{
+			{Path: "kubeedge.edgeWatcher", Reason: "the edge watcher is replaced by the iptables manager of edgeruntime.kubeedge"},
+		},
+	},
+	{
+		From: "v3.3",
+		To:   "v3.4",
+		Moves: []schema.Move{
+			{From: "common.es.enabled", To: "common.opensearch.enabled"},
+			{From: "common.es.logMaxAge", To: "common.opensearch.logMaxAge"},
+			{From: "common.es.elkPrefix", To: "common.opensearch.opensearchPrefix"},
+			{From: "common.es.basicAuth", To: "common.opensearch.basicAuth"},
+			{From: "common.es.externalElasticsearchHost", To: "common.opensearch.externalOpensearchHost"},
+			{From: "common.es.externalElasticsearchPort", To: "common.opensearch.externalOpensearchPort"},
+			{From: "common.es.master", To: "common.opensearch.master"},
+			{From: "common.es.data", To: "common.opensearch.data"},
+		},
+		Removed: []schema.Removed{
+			{Path: "common.es.externalElasticsearchUrl", Reason: "set common.opensearch.externalOpensearchHost and externalOpensearchPort"},
+		},
+	},
+}
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
+
+	"kubesphere.io/ks-upgrade/pkg/alerting"
+	"kubesphere.io/ks-upgrade/pkg/cleanup"
+	"kubesphere.io/ks-upgrade/pkg/clusterconfig"
+	"kubesphere.io/ks-upgrade/pkg/devops"
+	"kubesphere.io/ks-upgrade/pkg/hook"
+	"kubesphere.io/ks-upgrade/pkg/kubesphereconfig"
+	"kubesphere.io/ks-upgrade/pkg/logging"
+	"kubesphere.io/ks-upgrade/pkg/multicluster"
+	"kubesphere.io/ks-upgrade/pkg/notification"
+	"kubesphere.io/ks-upgrade/pkg/plugin"
+	"kubesphere.io/ks-upgrade/pkg/role"
+	"kubesphere.io/ks-upgrade/pkg/task"
+	"kubesphere.io/ks-upgrade/pkg/transform"
+	"kubesphere.io/ks-upgrade/pkg/user"
+	"kubesphere.io/ks-upgrade/pkg/workspace"
+)
+
+const (
+	APIVersion = "ks-upgrade.kubesphere.io/v1alpha1"
+	Kind       = "UpgradeConfiguration"
+
+	// EnvPrefix is the prefix of the env vars overriding the configuration,
+	// e.g. KS_UPGRADE_RETRY_ATTEMPTS overrides retry.attempts.
+	EnvPrefix = "KS_UPGRADE"
+)
+
+// Config holds every runtime option of ks-upgrade, the flags of a command take precedence over it.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Tasks are the names of the tasks to run, all the registered tasks if empty.
+	Tasks []string `json:"tasks,omitempty"`
+	// Concurrency is the maximum number of objects processed in parallel.
+	Concurrency int `json:"concurrency,omitempty"`
+	// RollbackOnFailure undoes the mutations of a task when it fails.
+	RollbackOnFailure bool `json:"rollbackOnFailure"`
+	// FailFast stops applying the changes of a task at its first failure.
+	FailFast bool `json:"failFast,omitempty"`
+	// DryRun logs the changes instead of applying them.
+	DryRun bool   `json:"dryRun,omitempty"`
+	Retry  Retry  `json:"retry"`
+	Backup Backup `json:"backup"`
+	Report Report `json:"report"`
+	// Filter restricts the run to a subset of the objects, e.g. a single workspace.
+	Filter task.Filter `json:"filter,omitempty"`
+	// MultiCluster is how a run fans out to the member clusters with --all-clusters.
+	MultiCluster *multicluster.Options `json:"multiCluster,omitempty"`
+
+	// Cleanup is the retention of the login records and the tokens collected by the iam-cleanup task.
+	Cleanup *cleanup.Options `json:"cleanup,omitempty"`
+	// Workspace are the parameters of the workspace-migrate task.
+	Workspace *workspace.Options `json:"workspace,omitempty"`
+	// Role are the parameters of the role-migrate task.
+	Role *role.Options `json:"role,omitempty"`
+	// User are the parameters of the user-migrate task, it remaps the global roles with the role parameters.
+	User *user.Options `json:"user,omitempty"`
+	// ClusterConfiguration are the parameters of the cluster-configuration task.
+	ClusterConfiguration *clusterconfig.Options `json:"clusterConfiguration,omitempty"`
+	// KubeSphereConfig are the parameters of the kubesphere-config task.
+	KubeSphereConfig *kubesphereconfig.Options `json:"kubesphereConfig,omitempty"`
+	// Notification are the parameters of the notification-migrate task.
+	Notification *notification.Options `json:"notification,omitempty"`
+	// Alerting are the parameters of the alerting-migrate task.
+	Alerting *alerting.Options `json:"alerting,omitempty"`
+	// Logging are the parameters of the logging-migrate task.
+	Logging *logging.Options `json:"logging,omitempty"`
+	// DevOps are the parameters of the devops-migrate task, it fixes the Roles of the DevOps projects with the role parameters.
+	DevOps *devops.Options `json:"devops,omitempty"`
+	// Transformations are the declarative tasks, they run after the built-in tasks.
+	Transformations *transform.Options `json:"transformations,omitempty"`
+	// Plugins are the out-of-tree tasks, they run after the transformations.
+	Plugins *plugin.Options `json:"plugins,omitempty"`
+	// Hooks run around the whole run and around the tasks.
+	Hooks *hook.Config `json:"hooks,omitempty"`
+}
+
+// Retry is how the API calls failing with a transient error are retried.
+type Retry struct {
+	// Attempts is the number of times a call is sent, 1 disables retrying.
+	Attempts int `json:"attempts"`
+	// Backoff is the wait before the first retry, it's multiplied by Factor after every retry.
+	Backoff metav1.Duration `json:"backoff"`
+	Factor  float64         `json:"factor,omitempty"`
+}
+
+type Backup struct {
+	// Dir is the directory the journal of every run is copied to.
+	Dir string `json:"dir,omitempty"`
+}
+
+type Report struct {
+	// Sinks are where the record of a run is written, "stdout", "file:<path>" or a http(s) URL.
+	Sinks []string `json:"sinks,omitempty"`
+}
+
+// New returns the default configuration.
+func New() *Config {
+	return &Config{
+		APIVersion:        APIVersion,
+		Kind:              Kind,
+		Concurrency:       task.DefaultConcurrency,
+		RollbackOnFailure: true,
+		Retry: Retry{
+			Attempts: retry.DefaultBackoff.Steps,
+			Backoff:  metav1.Duration{Duration: retry.DefaultBackoff.Duration},
+			Factor:   retry.DefaultBackoff.Factor,
+		},
+		MultiCluster:         multicluster.NewOptions(),
+		Cleanup:              cleanup.NewOptions(),
+		Workspace:            workspace.NewOptions(),
+		Role:                 role.NewOptions(),
+		User:                 user.NewOptions(),
+		ClusterConfiguration: clusterconfig.NewOptions(),
+		KubeSphereConfig:     kubesphereconfig.NewOptions(),
+		Notification:         notification.NewOptions(),
+		Alerting:             alerting.NewOptions(),
+		Logging:              logging.NewOptions(),
+		DevOps:               devops.NewOptions(),
+		Transformations:      &transform.Options{},
+		Plugins:              plugin.NewOptions(),
+		Hooks:                &hook.Config{},
+	}
+}
+
+// Load reads the configuration file over the defaults, then overrides it with the
+// KS_UPGRADE_* env vars. Only the env vars are used if path is empty.
+func Load(path string) (*Config, error) {
+	c := New()
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(raw, c); err != nil {
+			return nil, fmt.Errorf("parse config %s failed: %v", path, err)
+		}
+		if c.APIVersion != APIVersion || c.Kind != Kind {
+			return nil, fmt.Errorf("config %s is a %s %s, expected a %s %s", path, c.APIVersion, c.Kind, APIVersion, Kind)
+		}
+	}
+	if err := overrideFromEnv(reflect.ValueOf(c).Elem(), EnvPrefix); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ApplyTo sets the runtime options of a run from the configuration.
+func (c *Config) ApplyTo(options *task.Options) {
+	options.Concurrency = c.Concurrency
+	options.RollbackOnFailure = c.RollbackOnFailure
+	options.FailFast = c.FailFast
+	options.DryRun = c.DryRun
+	options.BackupDir = c.Backup.Dir
+	options.ReportSinks = c.Report.Sinks
+	if !c.Filter.IsEmpty() {
+		filter := c.Filter
+		options.Filter = &filter
+	}
+	options.Retry.Steps = c.Retry.Attempts
+	options.Retry.Duration = c.Retry.Backoff.Duration
+	options.Retry.Factor = c.Retry.Factor
+}
+
+// WithTargetVersion returns a copy of the configuration converting the ClusterConfiguration and the
+// KubeSphere configuration to version, the configuration itself is left as it is.
+func (c *Config) WithTargetVersion(version string) *Config {
+	copied := *c
+	clusterConfiguration := *c.ClusterConfiguration
+	clusterConfiguration.TargetVersion = version
+	copied.ClusterConfiguration = &clusterConfiguration
+	kubesphereConfig := *c.KubeSphereConfig
+	kubesphereConfig.TargetVersion = version
+	copied.KubeSphereConfig = &kubesphereConfig
+	return &copied
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// overrideFromEnv walks the fields of v by their json names and sets every field an env var
+// is defined for. The values are JSON, except strings which may be unquoted and lists of
+// strings which may be comma separated.
+func overrideFromEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || name == "apiVersion" || name == "kind" {
+			continue
+		}
+		key := prefix + "_" + envName(name)
+		fieldValue := v.Field(i)
+
+		if value, ok := os.LookupEnv(key); ok {
+			if err := setFromEnv(fieldValue, value); err != nil {
+				return fmt.Errorf("invalid value of %s: %v", key, err)
+			}
+			continue
+		}
+
+		// nested structs are overridden key by key
+		if fieldValue.Kind() == reflect.Ptr && fieldValue.Type().Elem().Kind() == reflect.Struct {
+			if fieldValue.IsNil() {
+				continue
+			}
+			fieldValue = fieldValue.Elem()
+		}
+		if fieldValue.Kind() == reflect.Struct && !reflect.PtrTo(fieldValue.Type()).Implements(unmarshalerType) {
+			if err := overrideFromEnv(fieldValue, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setFromEnv(v reflect.Value, value string) error {
+	target := v.Addr().Interface()
+	value = strings.TrimSpace(value)
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "[") {
+		items := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), target); err != nil {
+		// an unquoted string, e.g. a path or a duration
+		quoted, _ := json.Marshal(value)
+		return json.Unmarshal(quoted, target)
+	}
+	return nil
+}
+
+// envName converts a json name to the env var naming, e.g. deleteGlobalRoles to DELETE_GLOBAL_ROLES.
+func envName(name string) string {
+	b := &strings.Builder{}
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOverrideFromEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(c *Config) interface{}
+		// expected is the value check returns
+		expected interface{}
+		err      bool
+	}{
+		{
+			name:     "number",
+			env:      map[string]string{"KS_UPGRADE_CONCURRENCY": "8"},
+			check:    func(c *Config) interface{} { return c.Concurrency },
+			expected: 8,
+		},
+		{
+			name:     "boolean",
+			env:      map[string]string{"KS_UPGRADE_ROLLBACK_ON_FAILURE": "false"},
+			check:    func(c *Config) interface{} { return c.RollbackOnFailure },
+			expected: false,
+		},
+		{
+			name:     "comma separated list",
+			env:      map[string]string{"KS_UPGRADE_TASKS": "role-migrate, user-migrate"},
+			check:    func(c *Config) interface{} { return c.Tasks },
+			expected: []string{"role-migrate", "user-migrate"},
+		},
+		{
+			name:     "JSON list",
+			env:      map[string]string{"KS_UPGRADE_TASKS": `["role-migrate"]`},
+			check:    func(c *Config) interface{} { return c.Tasks },
+			expected: []string{"role-migrate"},
+		},
+		{
+			name:     "nested unquoted string",
+			env:      map[string]string{"KS_UPGRADE_BACKUP_DIR": "/var/backup"},
+			check:    func(c *Config) interface{} { return c.Backup.Dir },
+			expected: "/var/backup",
+		},
+		{
+			name:     "duration",
+			env:      map[string]string{"KS_UPGRADE_RETRY_BACKOFF": "2s"},
+			check:    func(c *Config) interface{} { return c.Retry.Backoff.Duration },
+			expected: 2 * time.Second,
+		},
+		{
+			name:     "nested struct pointer",
+			env:      map[string]string{"KS_UPGRADE_ROLE_DELETE_GLOBAL_ROLES": "users-manager"},
+			check:    func(c *Config) interface{} { return c.Role.DeleteGlobalRoles },
+			expected: []string{"users-manager"},
+		},
+		{
+			name: "invalid value",
+			env:  map[string]string{"KS_UPGRADE_CONCURRENCY": "many"},
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				os.Setenv(key, value)
+			}
+			defer func() {
+				for key := range test.env {
+					os.Unsetenv(key)
+				}
+			}()
+			c, err := Load("")
+			if (err != nil) != test.err {
+				t.Fatalf("Load() failed: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if got := test.check(c); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"concurrency":       "CONCURRENCY",
+		"deleteGlobalRoles": "DELETE_GLOBAL_ROLES",
+		"dir":               "DIR",
+	}
+	for name, expected := range tests {
+		if got := envName(name); got != expected {
+			t.Errorf("envName(%s) = %s, expected %s", name, got, expected)
+		}
+	}
+}
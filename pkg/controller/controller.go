@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/lock"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	upgradePath = "/apis/upgrade.kubesphere.io/v1alpha1/kubesphereupgrades"
+
+	watchTimeoutSeconds = 300
+)
+
+// TaskFactory creates the registered upgrade tasks for a run, the tasks converting the configurations
+// convert them to targetVersion, or to their configured version if it's empty.
+type TaskFactory func(options *task.Options, targetVersion string) ([]task.UpgradeTask, error)
+
+// Controller reconciles KubeSphereUpgrade objects, so that upgrades can be triggered
+// and tracked declaratively.
+type Controller struct {
+	client      kubernetes.Interface
+	newOptions  func() *task.Options
+	newTasks    TaskFactory
+	lockOptions lock.Options
+}
+
+// NewController creates a controller, newOptions returns the default runtime options of a run.
+func NewController(client kubernetes.Interface, newOptions func() *task.Options, newTasks TaskFactory, lockOptions lock.Options) *Controller {
+	return &Controller{client: client, newOptions: newOptions, newTasks: newTasks, lockOptions: lockOptions}
+}
+
+// Start lists and watches the upgrades until the context is done, the upgrades are
+// reconciled one at a time since two upgrades must never run concurrently.
+func (c *Controller) Start(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		list := &KubeSphereUpgradeList{}
+		if err := c.get(ctx, upgradePath, list); err != nil {
+			klog.Errorf("list KubeSphereUpgrades failed: %v", err)
+			return
+		}
+		for i := range list.Items {
+			c.reconcile(ctx, &list.Items[i])
+		}
+		if err := c.watch(ctx, list.ResourceVersion); err != nil {
+			klog.Errorf("watch KubeSphereUpgrades failed: %v", err)
+		}
+	}, 5*time.Second)
+}
+
+type watchEvent struct {
+	Type   string            `json:"type"`
+	Object KubeSphereUpgrade `json:"object"`
+}
+
+func (c *Controller) watch(ctx context.Context, resourceVersion string) error {
+	stream, err := c.client.Discovery().RESTClient().Get().AbsPath(upgradePath).
+		Param("watch", "true").
+		Param("resourceVersion", resourceVersion).
+		Param("timeoutSeconds", fmt.Sprint(watchTimeoutSeconds)).
+		Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(stream))
+	for {
+		event := &watchEvent{}
+		if err := decoder.Decode(event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			c.reconcile(ctx, &event.Object)
+		case "ERROR":
+			// most likely the resource version is too old, the next resync lists again
+			return fmt.Errorf("watch error: %+v", event.Object)
+		}
+	}
+}
+
+func (c *Controller) reconcile(ctx context.Context, event *KubeSphereUpgrade) {
+	// the object of the event may be stale, the events received during a run are handled after it
+	upgrade := &KubeSphereUpgrade{}
+	if err := c.get(ctx, fmt.Sprintf("%s/%s", upgradePath, event.Name), upgrade); err != nil {
+		if !errors.IsNotFound(err) {
+			klog.Errorf("get KubeSphereUpgrade %s failed: %v", event.Name, err)
+		}
+		return
+	}
+
+	status := upgrade.Status
+	resuming := status.Phase == PhasePaused
+	if upgrade.Spec.Paused {
+		if !resuming {
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: ConditionPaused, Status: metav1.ConditionTrue,
+				Reason: "Paused", Message: "the upgrade is paused", ObservedGeneration: upgrade.Generation})
+			status.Phase = PhasePaused
+			c.updateStatus(ctx, upgrade.Name, status)
+		}
+		return
+	}
+	if status.ObservedGeneration == upgrade.Generation && status.Phase == PhaseRunning {
+		// the run is resumed if it doesn't hold the lock any more, e.g. the pod running it crashed
+		holder, err := lock.Holder(c.client, c.lockOptions)
+		if err != nil {
+			klog.Errorf("get the lock holder of KubeSphereUpgrade %s failed: %v", upgrade.Name, err)
+			return
+		}
+		if strings.HasSuffix(holder, "_"+status.RunID) {
+			return
+		}
+		klog.Infof("run %s of KubeSphereUpgrade %s was interrupted, resuming it", status.RunID, upgrade.Name)
+		resuming = true
+	}
+	if status.ObservedGeneration == upgrade.Generation && !resuming && status.Phase != "" && status.Phase != PhasePending {
+		return
+	}
+
+	klog.Infof("reconciling KubeSphereUpgrade %s to version %s", upgrade.Name, upgrade.Spec.TargetVersion)
+	options := c.newOptions()
+	if upgrade.Spec.Backup != nil {
+		options.BackupDir = upgrade.Spec.Backup.Location
+	}
+	options.Paused = func() bool {
+		current := &KubeSphereUpgrade{}
+		if err := c.get(ctx, fmt.Sprintf("%s/%s", upgradePath, upgrade.Name), current); err != nil {
+			klog.Error(err)
+			return false
+		}
+		return current.Spec.Paused
+	}
+
+	tasks, err := c.newTasks(options, upgrade.Spec.TargetVersion)
+	if err != nil {
+		c.fail(ctx, upgrade, status, err)
+		return
+	}
+	tasks, err = task.Select(tasks, upgrade.Spec.Tasks)
+	if err != nil {
+		c.fail(ctx, upgrade, status, err)
+		return
+	}
+
+	// when resuming, the tasks which already succeeded are not run again
+	succeeded := make([]task.TaskRecord, 0)
+	if resuming {
+		results := status.Results
+		if status.Phase == PhaseRunning {
+			// the results of an interrupted run are only in its record
+			if record, err := task.LoadRun(c.client, status.RunID); err == nil {
+				results = append(append([]task.TaskRecord{}, results...), record.Tasks...)
+			} else if !errors.IsNotFound(err) {
+				c.fail(ctx, upgrade, status, err)
+				return
+			}
+		}
+		done := make(map[string]bool)
+		for _, r := range results {
+			if r.Phase == task.PhaseSucceeded && !done[r.Name] {
+				done[r.Name] = true
+				succeeded = append(succeeded, r)
+			}
+		}
+		remaining := make([]task.UpgradeTask, 0, len(tasks))
+		for _, t := range tasks {
+			if !done[task.Name(t)] {
+				remaining = append(remaining, t)
+			}
+		}
+		tasks = remaining
+	}
+
+	meta.RemoveStatusCondition(&status.Conditions, ConditionPaused)
+	status.ObservedGeneration = upgrade.Generation
+	status.RunID = options.RunID
+	runner := task.NewRunner(c.client, options, tasks...)
+
+	if upgrade.Spec.DryRun {
+		plan, err := runner.Plan()
+		if err != nil {
+			c.fail(ctx, upgrade, status, err)
+			return
+		}
+		status.Results = make([]task.TaskRecord, 0, len(plan.Tasks))
+		for _, taskPlan := range plan.Tasks {
+			status.Results = append(status.Results, task.TaskRecord{Name: taskPlan.Name, Phase: PhasePlanned, Changes: len(taskPlan.Changes)})
+		}
+		status.Phase = PhasePlanned
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: ConditionSucceeded, Status: metav1.ConditionFalse,
+			Reason: "DryRun", Message: "the changes were planned but not applied", ObservedGeneration: upgrade.Generation})
+		c.updateStatus(ctx, upgrade.Name, status)
+		return
+	}
+
+	status.Phase = PhaseRunning
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: ConditionSucceeded, Status: metav1.ConditionUnknown,
+		Reason: "Running", Message: fmt.Sprintf("run %s is in progress", options.RunID), ObservedGeneration: upgrade.Generation})
+	c.updateStatus(ctx, upgrade.Name, status)
+
+	lockOptions := c.lockOptions
+	hostname, _ := os.Hostname()
+	lockOptions.Identity = fmt.Sprintf("%s_%s", hostname, options.RunID)
+	runLock := lock.New(c.client, lockOptions)
+	if err := runLock.Acquire(); err != nil {
+		c.fail(ctx, upgrade, status, err)
+		return
+	}
+	options.Context = runLock.Context()
+	err = runner.Run()
+	if lostErr := runLock.Err(); lostErr != nil && err != nil {
+		err = fmt.Errorf("%v: %v", lostErr, err)
+	}
+	if releaseErr := runLock.Release(); releaseErr != nil {
+		klog.Errorf("release lock failed: %v", releaseErr)
+	}
+
+	if record := runner.Record(); record != nil {
+		status.Results = append(succeeded, record.Tasks...)
+	}
+	switch {
+	case err == task.ErrPaused:
+		status.Phase = PhasePaused
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: ConditionPaused, Status: metav1.ConditionTrue,
+			Reason: "Paused", Message: "the upgrade is paused", ObservedGeneration: upgrade.Generation})
+		c.updateStatus(ctx, upgrade.Name, status)
+	case err != nil:
+		c.fail(ctx, upgrade, status, err)
+	default:
+		status.Phase = PhaseSucceeded
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: ConditionSucceeded, Status: metav1.ConditionTrue,
+			Reason: "Succeeded", Message: fmt.Sprintf("upgraded to %s", upgrade.Spec.TargetVersion), ObservedGeneration: upgrade.Generation})
+		c.updateStatus(ctx, upgrade.Name, status)
+	}
+}
+
+func (c *Controller) fail(ctx context.Context, upgrade *KubeSphereUpgrade, status KubeSphereUpgradeStatus, err error) {
+	klog.Errorf("KubeSphereUpgrade %s failed: %v", upgrade.Name, err)
+	status.ObservedGeneration = upgrade.Generation
+	status.Phase = PhaseFailed
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: ConditionSucceeded, Status: metav1.ConditionFalse,
+		Reason: "Failed", Message: err.Error(), ObservedGeneration: upgrade.Generation})
+	c.updateStatus(ctx, upgrade.Name, status)
+}
+
+// updateStatus writes the status to the latest version of the upgrade.
+func (c *Controller) updateStatus(ctx context.Context, name string, status KubeSphereUpgradeStatus) {
+	path := fmt.Sprintf("%s/%s", upgradePath, name)
+	current := &KubeSphereUpgrade{}
+	if err := c.get(ctx, path, current); err != nil {
+		klog.Errorf("update status of KubeSphereUpgrade %s failed: %v", name, err)
+		return
+	}
+	current.Status = status
+	marshal, err := json.Marshal(current)
+	if err != nil {
+		klog.Error(err)
+		return
+	}
+	if _, err := c.client.Discovery().RESTClient().Put().AbsPath(path, "status").Body(marshal).DoRaw(ctx); err != nil {
+		klog.Errorf("update status of KubeSphereUpgrade %s failed: %v", name, err)
+	}
+}
+
+func (c *Controller) get(ctx context.Context, path string, output interface{}) error {
+	raw, err := c.client.Discovery().RESTClient().Get().AbsPath(path).DoRaw(ctx)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, output)
+}
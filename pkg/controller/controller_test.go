@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"kubesphere.io/ks-upgrade/pkg/lock"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+// testServer serves the objects by path, a PUT replaces the object and the status PUTs are recorded.
+type testServer struct {
+	mutex    sync.Mutex
+	objects  map[string][]byte
+	statuses []KubeSphereUpgradeStatus
+}
+
+func newTestClient(t *testing.T, objects map[string]interface{}) (*kubernetes.Clientset, *testServer) {
+	s := &testServer{objects: make(map[string][]byte)}
+	for path, object := range objects {
+		marshal, err := json.Marshal(object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.objects[path] = marshal
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			if object, ok := s.objects[r.URL.Path]; ok {
+				_, _ = w.Write(object)
+				return
+			}
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			upgrade := &KubeSphereUpgrade{}
+			if err := json.Unmarshal(body, upgrade); err != nil {
+				t.Error(err)
+			}
+			s.statuses = append(s.statuses, upgrade.Status)
+			s.objects[upgradePath+"/"+upgrade.Name] = body
+			_, _ = w.Write(body)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, s
+}
+
+type testTask struct{}
+
+func (t *testTask) Name() string {
+	return "test"
+}
+
+func (t *testTask) Run() error {
+	return nil
+}
+
+func (t *testTask) Plan() ([]task.Change, error) {
+	return []task.Change{{Operation: task.OperationDelete, Path: "/api/v1/namespaces/test/configmaps", Name: "test"}}, nil
+}
+
+func testUpgrade(spec KubeSphereUpgradeSpec, status KubeSphereUpgradeStatus) *KubeSphereUpgrade {
+	return &KubeSphereUpgrade{ObjectMeta: metav1.ObjectMeta{Name: "upgrade", Generation: 2}, Spec: spec, Status: status}
+}
+
+func TestReconcile(t *testing.T) {
+	leasePath := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", lock.DefaultNamespace, lock.DefaultName)
+	holder := "pod_run1"
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: lock.DefaultName, Namespace: lock.DefaultNamespace},
+		Spec: coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: new(int32),
+			RenewTime: &metav1.MicroTime{Time: time.Now().Add(time.Hour)}},
+	}
+	tests := []struct {
+		name     string
+		upgrade  *KubeSphereUpgrade
+		objects  map[string]interface{}
+		tasksErr error
+		// phase is the phase the status is updated to, none if it's empty
+		phase   string
+		created bool
+		results []task.TaskRecord
+	}{
+		{
+			name:    "paused",
+			upgrade: testUpgrade(KubeSphereUpgradeSpec{TargetVersion: "v3.2.0", Paused: true}, KubeSphereUpgradeStatus{}),
+			phase:   PhasePaused,
+		},
+		{
+			name:    "already paused",
+			upgrade: testUpgrade(KubeSphereUpgradeSpec{TargetVersion: "v3.2.0", Paused: true}, KubeSphereUpgradeStatus{Phase: PhasePaused}),
+		},
+		{
+			name: "already reconciled",
+			upgrade: testUpgrade(KubeSphereUpgradeSpec{TargetVersion: "v3.2.0"},
+				KubeSphereUpgradeStatus{Phase: PhaseSucceeded, ObservedGeneration: 2}),
+		},
+		{
+			name: "running",
+			upgrade: testUpgrade(KubeSphereUpgradeSpec{TargetVersion: "v3.2.0"},
+				KubeSphereUpgradeStatus{Phase: PhaseRunning, ObservedGeneration: 2, RunID: "run1"}),
+			objects: map[string]interface{}{leasePath: lease},
+		},
+		{
+			name:     "tasks failing",
+			upgrade:  testUpgrade(KubeSphereUpgradeSpec{TargetVersion: "v3.2.0"}, KubeSphereUpgradeStatus{}),
+			tasksErr: errors.New("invalid target version"),
+			phase:    PhaseFailed,
+			created:  true,
+		},
+		{
+			name:    "dry run",
+			upgrade: testUpgrade(KubeSphereUpgradeSpec{TargetVersion: "v3.2.0", DryRun: true}, KubeSphereUpgradeStatus{}),
+			phase:   PhasePlanned,
+			created: true,
+			results: []task.TaskRecord{{Name: "test", Phase: PhasePlanned, Changes: 1}},
+		},
+		{
+			name: "new generation",
+			upgrade: testUpgrade(KubeSphereUpgradeSpec{TargetVersion: "v3.2.0", DryRun: true},
+				KubeSphereUpgradeStatus{Phase: PhaseSucceeded, ObservedGeneration: 1}),
+			phase:   PhasePlanned,
+			created: true,
+			results: []task.TaskRecord{{Name: "test", Phase: PhasePlanned, Changes: 1}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := map[string]interface{}{upgradePath + "/upgrade": test.upgrade}
+			for path, object := range test.objects {
+				objects[path] = object
+			}
+			client, server := newTestClient(t, objects)
+			created := false
+			newTasks := func(options *task.Options, targetVersion string) ([]task.UpgradeTask, error) {
+				created = true
+				if targetVersion != test.upgrade.Spec.TargetVersion {
+					t.Errorf("the tasks are created for %s", targetVersion)
+				}
+				return []task.UpgradeTask{&testTask{}}, test.tasksErr
+			}
+			controller := NewController(client, task.NewOptions, newTasks, lock.Options{})
+
+			// the event is stale, the latest object is reconciled
+			controller.reconcile(context.TODO(), &KubeSphereUpgrade{ObjectMeta: metav1.ObjectMeta{Name: "upgrade"}})
+
+			if created != test.created {
+				t.Errorf("the tasks were created: %t, expected %t", created, test.created)
+			}
+			if test.phase == "" {
+				if len(server.statuses) > 0 {
+					t.Errorf("the status is updated to %v", server.statuses)
+				}
+				return
+			}
+			if len(server.statuses) != 1 {
+				t.Fatalf("the status is updated %d times", len(server.statuses))
+			}
+			status := server.statuses[0]
+			if status.Phase != test.phase {
+				t.Errorf("the status is %s, expected %s", status.Phase, test.phase)
+			}
+			// pausing doesn't reconcile the spec
+			if test.phase != PhasePaused && status.ObservedGeneration != 2 {
+				t.Errorf("the status is at generation %d, expected 2", status.ObservedGeneration)
+			}
+			if test.results != nil && !reflect.DeepEqual(status.Results, test.results) {
+				t.Errorf("the results are %v, expected %v", status.Results, test.results)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	ConditionSucceeded = "Succeeded"
+	ConditionPaused    = "Paused"
+
+	PhasePending   = "Pending"
+	PhasePlanned   = "Planned"
+	PhaseRunning   = task.PhaseRunning
+	PhaseSucceeded = task.PhaseSucceeded
+	PhaseFailed    = task.PhaseFailed
+	PhasePaused    = task.PhasePaused
+)
+
+// KubeSphereUpgrade declares an upgrade, the controller runs the registered tasks and reports the results in its status.
+type KubeSphereUpgrade struct {
+	metav1.TypeMeta `json:",inline"`
+	// +optional
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   KubeSphereUpgradeSpec   `json:"spec"`
+	Status KubeSphereUpgradeStatus `json:"status,omitempty"`
+}
+
+type KubeSphereUpgradeSpec struct {
+	// TargetVersion is the KubeSphere version the cluster is upgraded to.
+	TargetVersion string `json:"targetVersion"`
+	// Tasks are the names of the tasks to run, all the registered tasks if empty.
+	// +optional
+	Tasks []string `json:"tasks,omitempty"`
+	// DryRun only plans the changes and reports them in the status.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+	// +optional
+	Backup *BackupSpec `json:"backup,omitempty"`
+	// Paused stops the upgrade before its next task, it's resumed by unsetting it.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+}
+
+type BackupSpec struct {
+	// Location is the directory the journal of every run is copied to, a directory of the volume mounted
+	// by the controller at /var/lib/ks-upgrade so that the journals outlive the pod.
+	Location string `json:"location"`
+}
+
+type KubeSphereUpgradeStatus struct {
+	// +optional
+	Phase string `json:"phase,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was computed from.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// RunID identifies the run in the ks-upgrade history.
+	// +optional
+	RunID string `json:"runID,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Results are the results of the tasks, the tasks which succeeded are not run again when resuming.
+	// +optional
+	Results []task.TaskRecord `json:"results,omitempty"`
+}
+
+type KubeSphereUpgradeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []KubeSphereUpgrade `json:"items"`
+}
@@ -0,0 +1,509 @@
+package devops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/role"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	group   = "devops.kubesphere.io"
+	version = "v1alpha3"
+
+	// ProjectLabel is set on the namespace of a DevOps project to the name of the project.
+	ProjectLabel = "kubesphere.io/devopsproject"
+
+	// TaskName is the name of the DevOps migration task.
+	TaskName = "devops-migrate"
+)
+
+// credentialType is a legacy type of the Jenkins credentials and the type it's converted to.
+type credentialType struct {
+	secretType corev1.SecretType
+	// keys are the keys of the data which are renamed
+	keys map[string]string
+}
+
+// credentialTypes are the legacy credential types which have a built-in equivalent, the secret-text
+// and kubeconfig credentials keep their type.
+var credentialTypes = map[corev1.SecretType]credentialType{
+	"credential.devops.kubesphere.io/basic-auth": {secretType: corev1.SecretTypeBasicAuth},
+	"credential.devops.kubesphere.io/ssh-auth": {secretType: corev1.SecretTypeSSHAuth,
+		keys: map[string]string{"private_key": corev1.SSHAuthPrivateKey}},
+}
+
+// syncAnnotations record the synchronization of a credential to Jenkins, they're dropped from the
+// converted credentials so that the controller synchronizes them again.
+var syncAnnotations = []string{
+	"credential.devops.kubesphere.io/syncstatus",
+	"credential.devops.kubesphere.io/synctime",
+	"credential.devops.kubesphere.io/syncmsg",
+}
+
+// Options are the parameters of the DevOps migration.
+type Options struct {
+	// SCMFieldRenames maps the legacy fields of the sources of the multi-branch pipelines onto their
+	// replacement, a dotted path in the source.
+	SCMFieldRenames map[string]string `json:"scmFieldRenames,omitempty"`
+	// DeprecatedRoleTemplates are the role templates removed from the custom Roles of the DevOps projects,
+	// in addition to the role templates the role options deprecate for the Roles.
+	DeprecatedRoleTemplates []string `json:"deprecatedRoleTemplates,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		SCMFieldRenames: map[string]string{
+			"credentialId":     "credential_id",
+			"apiUri":           "api_uri",
+			"serverName":       "server_name",
+			"discoverBranches": "discover_branches",
+			"discoverTags":     "discover_tags",
+			"regexFilter":      "regex_filter",
+			"shallow":          "git_clone_option.shallow",
+			"depth":            "git_clone_option.depth",
+			"timeout":          "git_clone_option.timeout",
+		},
+	}
+}
+
+type devopsMigrateTask struct {
+	client      kubernetes.Interface
+	applier     *task.Applier
+	options     *Options
+	roleOptions *role.Options
+
+	task.WarningList
+}
+
+// NewDevOpsMigrateTask creates the task migrating the DevOps projects: the Jenkins credentials are converted
+// to the built-in Secret types, the legacy SCM fields of the pipelines are renamed and the custom Roles of
+// the projects stop aggregating the deprecated role templates, selected with the same role options as the
+// role-migrate task. The objects stay in the namespace of their project.
+func NewDevOpsMigrateTask(client kubernetes.Interface, options *task.Options, devopsOptions *Options, roleOptions *role.Options) task.UpgradeTask {
+	return &devopsMigrateTask{client: client, applier: task.NewApplier(client, options), options: devopsOptions, roleOptions: roleOptions}
+}
+
+func (t *devopsMigrateTask) Name() string {
+	return TaskName
+}
+
+func (t *devopsMigrateTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+func (t *devopsMigrateTask) Plan() ([]task.Change, error) {
+	t.ResetWarnings()
+	projects, err := listProjects(t.client)
+	if err != nil {
+		return nil, err
+	}
+	if projects == nil {
+		klog.Infof("devopsprojects.%s is not served, skipping it.", group)
+		return nil, nil
+	}
+
+	changes := make([]task.Change, 0)
+	for _, project := range projects {
+		namespace, change, err := t.projectNamespace(project)
+		if err != nil {
+			return nil, err
+		}
+		if namespace == "" {
+			continue
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+
+		credentialChanges, err := t.convertCredentials(namespace)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, credentialChanges...)
+
+		pipelineChanges, err := t.convertPipelines(namespace)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, pipelineChanges...)
+
+		reCreator, err := role.NewNamespaceRoleReCreator(t.client, namespace, t.deprecatedRoleTemplates(), t.roleOptions)
+		if err != nil {
+			return nil, err
+		}
+		roleChanges, err := reCreator.Plan()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, roleChanges...)
+	}
+	return changes, nil
+}
+
+// listProjects lists the DevOps projects by name, it's nil if they aren't served.
+func listProjects(client kubernetes.Interface) ([]*unstructured.Unstructured, error) {
+	projects, err := task.ListObjects(client, task.CollectionPath(group, version, "devopsprojects", ""), "", "")
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].GetName() < projects[j].GetName() })
+	return projects, nil
+}
+
+// projectNamespace returns the namespace of a project, see resolveNamespace. The label is set on the admin
+// namespace if it's missing or names another project, so that the project keeps its namespace. The namespace
+// is empty if the project has none.
+func (t *devopsMigrateTask) projectNamespace(project *unstructured.Unstructured) (string, *task.Change, error) {
+	adminNamespace, namespace, warning, err := resolveNamespace(t.client, project)
+	if err != nil || adminNamespace == "" {
+		if warning != "" {
+			t.Warn("%s, it's left as it is", warning)
+		}
+		return "", nil, err
+	}
+	if namespace == nil {
+		return adminNamespace, nil, nil
+	}
+	label := namespace.GetLabels()[ProjectLabel]
+	if label == project.GetName() {
+		return adminNamespace, nil, nil
+	}
+
+	original, err := namespace.MarshalJSON()
+	if err != nil {
+		return "", nil, err
+	}
+	labels := namespace.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[ProjectLabel] = project.GetName()
+	namespace.SetLabels(labels)
+	modified, err := namespace.MarshalJSON()
+	if err != nil {
+		return "", nil, err
+	}
+	patch, err := task.CreateMergePatch(original, modified)
+	if err != nil {
+		return "", nil, err
+	}
+	return adminNamespace, &task.Change{
+		Operation:       task.OperationUpdate,
+		Path:            task.CollectionPath("", "v1", "namespaces", ""),
+		Name:            adminNamespace,
+		ResourceVersion: namespace.GetResourceVersion(),
+		Object:          modified,
+		Patch:           patch,
+		Description:     fmt.Sprintf("set the DevOps project label of namespace %s from %q to %s, its project", adminNamespace, label, project.GetName()),
+	}, nil
+}
+
+// resolveNamespace returns the namespace of a project, the admin namespace of its status or else the namespace
+// labeled with its name. The admin namespace is returned with its name, it's nil when the namespace is found by
+// its label. The name is empty and warning tells why when the project has no namespace.
+func resolveNamespace(client kubernetes.Interface, project *unstructured.Unstructured) (string, *unstructured.Unstructured, string, error) {
+	path := task.CollectionPath("", "v1", "namespaces", "")
+	adminNamespace, _, _ := unstructured.NestedString(project.Object, "status", "adminNamespace")
+	if adminNamespace == "" {
+		namespaces, err := task.ListObjects(client, path, fmt.Sprintf("%s=%s", ProjectLabel, project.GetName()), "")
+		if err != nil {
+			return "", nil, "", err
+		}
+		if len(namespaces) != 1 {
+			return "", nil, fmt.Sprintf("DevOps project %s has no admin namespace and %d namespaces are labeled with it", project.GetName(), len(namespaces)), nil
+		}
+		return namespaces[0].GetName(), nil, "", nil
+	}
+
+	raw, err := client.CoreV1().RESTClient().Get().AbsPath(path, adminNamespace).DoRaw(context.TODO())
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil, fmt.Sprintf("the admin namespace %s of DevOps project %s doesn't exist", adminNamespace, project.GetName()), nil
+		}
+		return "", nil, "", err
+	}
+	namespace := &unstructured.Unstructured{}
+	if err := namespace.UnmarshalJSON(raw); err != nil {
+		return "", nil, "", err
+	}
+	return adminNamespace, namespace, "", nil
+}
+
+// ProjectNamespaces returns the namespaces of the DevOps projects the task migrates, the custom Roles of the
+// other namespaces are left to role-migrate. There are none if the DevOps projects aren't served.
+func ProjectNamespaces(client kubernetes.Interface) ([]string, error) {
+	projects, err := listProjects(client)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]string, 0, len(projects))
+	for _, project := range projects {
+		namespace, _, _, err := resolveNamespace(client, project)
+		if err != nil {
+			return nil, err
+		}
+		if namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces, nil
+}
+
+// convertCredentials recreates the credentials of a project with a legacy type as Secrets of the built-in
+// type, the type of a Secret can't be updated. The credentials keep their name, the pipelines refer to them by it.
+func (t *devopsMigrateTask) convertCredentials(namespace string) ([]task.Change, error) {
+	secrets, err := t.client.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	path := task.CollectionPath("", "v1", "secrets", namespace)
+	changes := make([]task.Change, 0)
+	for _, secret := range secrets.Items {
+		converted, ok := convertCredential(&secret)
+		if !ok {
+			continue
+		}
+		original, err := json.Marshal(secret)
+		if err != nil {
+			return nil, err
+		}
+		marshal, err := json.Marshal(converted)
+		if err != nil {
+			return nil, err
+		}
+		patch, err := task.CreateMergePatch(original, marshal)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, task.Change{
+			Operation:       task.OperationRecreate,
+			Path:            path,
+			Name:            secret.Name,
+			ResourceVersion: secret.ResourceVersion,
+			Object:          marshal,
+			Patch:           patch,
+			Redact:          []string{"data"},
+			RestoreRedacted: true,
+			Description:     fmt.Sprintf("recreate credential %s/%s as %s", namespace, secret.Name, converted.Type),
+		})
+	}
+	return changes, nil
+}
+
+// convertCredential returns the Secret a credential of a legacy type is converted to, its data keys renamed
+// and its synchronization annotations dropped.
+func convertCredential(secret *corev1.Secret) (*corev1.Secret, bool) {
+	conversion, ok := credentialTypes[secret.Type]
+	if !ok {
+		return nil, false
+	}
+	data := make(map[string][]byte, len(secret.Data))
+	for k, v := range secret.Data {
+		if to, ok := conversion.keys[k]; ok {
+			k = to
+		}
+		data[k] = v
+	}
+	var annotations map[string]string
+	for k, v := range secret.Annotations {
+		if task.InSlice(k, syncAnnotations) {
+			continue
+		}
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[k] = v
+	}
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            secret.Name,
+			Namespace:       secret.Namespace,
+			Labels:          secret.Labels,
+			Annotations:     annotations,
+			OwnerReferences: secret.OwnerReferences,
+		},
+		Type: conversion.secretType,
+		Data: data,
+	}, true
+}
+
+// convertPipelines renames the legacy SCM fields of the multi-branch pipelines of a project.
+func (t *devopsMigrateTask) convertPipelines(namespace string) ([]task.Change, error) {
+	path := task.CollectionPath(group, version, "pipelines", namespace)
+	pipelines, err := task.ListObjects(t.client, path, "", "")
+	if err != nil {
+		if errors.IsNotFound(err) {
+			klog.Infof("pipelines.%s is not served, skipping it.", group)
+			return nil, nil
+		}
+		return nil, err
+	}
+	changes := make([]task.Change, 0)
+	for _, pipeline := range pipelines {
+		converted := pipeline.DeepCopy()
+		if err := t.renameSCMFields(converted); err != nil {
+			t.Warn("Pipeline %s/%s can't be converted, it's left as it is: %v", namespace, pipeline.GetName(), err)
+			continue
+		}
+		if reflect.DeepEqual(pipeline.Object, converted.Object) {
+			continue
+		}
+		original, err := pipeline.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		modified, err := converted.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		patch, err := task.CreateMergePatch(original, modified)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, task.Change{
+			Operation:       task.OperationUpdate,
+			Path:            path,
+			Name:            pipeline.GetName(),
+			ResourceVersion: pipeline.GetResourceVersion(),
+			Object:          modified,
+			Patch:           patch,
+			Description:     fmt.Sprintf("convert the legacy SCM fields of Pipeline %s/%s", namespace, pipeline.GetName()),
+		})
+	}
+	return changes, nil
+}
+
+// renameSCMFields renames the legacy fields of every source of a multi-branch pipeline, a field is
+// only renamed if its replacement is unset or has the same value.
+func (t *devopsMigrateTask) renameSCMFields(pipeline *unstructured.Unstructured) error {
+	multiBranch, found, err := unstructured.NestedMap(pipeline.Object, "spec", "multi_branch_pipeline")
+	if err != nil || !found {
+		return err
+	}
+	for field, value := range multiBranch {
+		source, ok := value.(map[string]interface{})
+		if !ok || !strings.HasSuffix(field, "_source") {
+			continue
+		}
+		for _, legacy := range legacySCMFields(source, t.options.SCMFieldRenames) {
+			to := strings.Split(t.options.SCMFieldRenames[legacy], ".")
+			current, found, err := unstructured.NestedFieldNoCopy(source, to...)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %v", field, strings.Join(to, "."), err)
+			}
+			if found && !reflect.DeepEqual(current, source[legacy]) {
+				return fmt.Errorf("%s.%s and its replacement %s differ", field, legacy, strings.Join(to, "."))
+			}
+			if err := unstructured.SetNestedField(source, source[legacy], to...); err != nil {
+				return fmt.Errorf("%s.%s: %v", field, strings.Join(to, "."), err)
+			}
+			delete(source, legacy)
+		}
+	}
+	return unstructured.SetNestedMap(pipeline.Object, multiBranch, "spec", "multi_branch_pipeline")
+}
+
+// legacySCMFields returns the legacy fields set in a source.
+func legacySCMFields(source map[string]interface{}, renames map[string]string) []string {
+	fields := make([]string, 0)
+	for legacy := range renames {
+		if _, ok := source[legacy]; ok {
+			fields = append(fields, legacy)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// deprecatedRoleTemplates returns the role templates removed from the custom Roles of the projects.
+func (t *devopsMigrateTask) deprecatedRoleTemplates() []string {
+	templates := append([]string{}, t.roleOptions.DeprecatedRoleTemplates["roles"]...)
+	for _, template := range t.options.DeprecatedRoleTemplates {
+		if !task.InSlice(template, templates) {
+			templates = append(templates, template)
+		}
+	}
+	return templates
+}
+
+// Verify checks every DevOps project keeps its namespace, and no credential, pipeline or custom Role of a
+// project is left in its legacy form, except the ones reported by the plan which are handled manually.
+func (t *devopsMigrateTask) Verify() error {
+	projects, err := listProjects(t.client)
+	if err != nil || projects == nil {
+		return err
+	}
+	errs := make([]error, 0)
+	for _, project := range projects {
+		namespace, ns, _, err := resolveNamespace(t.client, project)
+		if err != nil {
+			return err
+		}
+		if namespace == "" {
+			continue
+		}
+		if ns != nil && ns.GetLabels()[ProjectLabel] != project.GetName() {
+			errs = append(errs, fmt.Errorf("namespace %s of DevOps project %s is labeled with project %q", namespace, project.GetName(), ns.GetLabels()[ProjectLabel]))
+		}
+
+		secrets, err := t.client.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, secret := range secrets.Items {
+			if _, ok := credentialTypes[secret.Type]; ok {
+				errs = append(errs, fmt.Errorf("credential %s/%s still has the legacy type %s", namespace, secret.Name, secret.Type))
+			}
+		}
+
+		pipelines, err := task.ListObjects(t.client, task.CollectionPath(group, version, "pipelines", namespace), "", "")
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		for _, pipeline := range pipelines {
+			multiBranch, _, _ := unstructured.NestedMap(pipeline.Object, "spec", "multi_branch_pipeline")
+			for field, value := range multiBranch {
+				source, ok := value.(map[string]interface{})
+				if !ok || !strings.HasSuffix(field, "_source") {
+					continue
+				}
+				if legacy := legacySCMFields(source, t.options.SCMFieldRenames); len(legacy) > 0 {
+					errs = append(errs, fmt.Errorf("Pipeline %s/%s still has the legacy fields %s of %s", namespace, pipeline.GetName(), strings.Join(legacy, ", "), field))
+				}
+			}
+		}
+
+		if err := role.VerifyNamespaceRoles(t.client, namespace, t.deprecatedRoleTemplates(), t.roleOptions); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (t *devopsMigrateTask) RequiredPermissions() []task.Permission {
+	return []task.Permission{
+		{Group: group, Version: version, Resource: "devopsprojects", Verbs: []string{"list"}, Optional: true},
+		{Group: group, Version: version, Resource: "pipelines", Verbs: []string{"list", "update"}, Optional: true},
+		{Group: "", Version: "v1", Resource: "namespaces", Verbs: []string{"list", "get", "update"}},
+		{Group: "", Version: "v1", Resource: "secrets", Verbs: []string{"list", "get", "create", "delete"}},
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "roles", Verbs: []string{"list", "get", "create", "delete"}},
+	}
+}
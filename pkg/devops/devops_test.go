@@ -0,0 +1,71 @@
+package devops
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRenameSCMFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     map[string]interface{}
+		expected map[string]interface{}
+		err      bool
+	}{
+		{
+			name: "renamed and nested fields",
+			spec: map[string]interface{}{"multi_branch_pipeline": map[string]interface{}{
+				"name": "p",
+				"git_source": map[string]interface{}{
+					"url": "https://example.com/a.git", "credentialId": "c", "discoverBranches": true, "shallow": true, "depth": int64(1),
+				},
+			}},
+			expected: map[string]interface{}{"multi_branch_pipeline": map[string]interface{}{
+				"name": "p",
+				"git_source": map[string]interface{}{
+					"url": "https://example.com/a.git", "credential_id": "c", "discover_branches": true,
+					"git_clone_option": map[string]interface{}{"shallow": true, "depth": int64(1)},
+				},
+			}},
+		},
+		{
+			name: "replacement with the same value",
+			spec: map[string]interface{}{"multi_branch_pipeline": map[string]interface{}{
+				"github_source": map[string]interface{}{"apiUri": "https://api.github.com", "api_uri": "https://api.github.com"},
+			}},
+			expected: map[string]interface{}{"multi_branch_pipeline": map[string]interface{}{
+				"github_source": map[string]interface{}{"api_uri": "https://api.github.com"},
+			}},
+		},
+		{
+			name: "replacement with another value",
+			spec: map[string]interface{}{"multi_branch_pipeline": map[string]interface{}{
+				"github_source": map[string]interface{}{"apiUri": "https://api.github.com", "api_uri": "https://github.local/api"},
+			}},
+			err: true,
+		},
+		{
+			name:     "not a multi-branch pipeline",
+			spec:     map[string]interface{}{"pipeline": map[string]interface{}{"jenkinsfile": "node {}"}},
+			expected: map[string]interface{}{"pipeline": map[string]interface{}{"jenkinsfile": "node {}"}},
+		},
+	}
+	task := &devopsMigrateTask{options: NewOptions()}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipeline := &unstructured.Unstructured{Object: map[string]interface{}{"spec": test.spec}}
+			err := task.renameSCMFields(pipeline)
+			if (err != nil) != test.err {
+				t.Fatalf("renameSCMFields() failed: %v", err)
+			}
+			if test.err {
+				return
+			}
+			if !reflect.DeepEqual(pipeline.Object["spec"], test.expected) {
+				t.Errorf("spec is %v, expected %v", pipeline.Object["spec"], test.expected)
+			}
+		})
+	}
+}
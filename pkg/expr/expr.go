@@ -0,0 +1,120 @@
+package expr
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// ObjectVariable is the variable the evaluated object is bound to.
+	ObjectVariable = "object"
+
+	// the sandbox of an expression, CEL has no side effects and always terminates but the
+	// cost of an evaluation grows with the size of the object
+	maxExpressionLength = 10 * 1024
+	costLimit           = 1000000
+	evalTimeout         = time.Second
+)
+
+// Expression is a type-checked CEL expression evaluated against a Kubernetes object.
+type Expression struct {
+	source  string
+	program cel.Program
+}
+
+// CompileSelector compiles a predicate, it must evaluate to a bool.
+func CompileSelector(source string, variables ...string) (*Expression, error) {
+	return compile(source, decls.Bool, variables)
+}
+
+// CompileTransform compiles an expression computing a value of any type.
+func CompileTransform(source string, variables ...string) (*Expression, error) {
+	return compile(source, decls.Dyn, variables)
+}
+
+// compile type-checks the expression, the object is a map and the other variables are dynamically typed.
+func compile(source string, resultType *exprpb.Type, variables []string) (*Expression, error) {
+	if len(source) > maxExpressionLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxExpressionLength)
+	}
+	declarations := []*exprpb.Decl{decls.NewVar(ObjectVariable, decls.NewMapType(decls.String, decls.Dyn))}
+	for _, v := range variables {
+		declarations = append(declarations, decls.NewVar(v, decls.Dyn))
+	}
+	env, err := cel.NewEnv(cel.Declarations(declarations...))
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, issues.Err())
+	}
+	if resultType != decls.Dyn && !proto.Equal(ast.ResultType(), resultType) && !proto.Equal(ast.ResultType(), decls.Dyn) {
+		return nil, fmt.Errorf("expression %q evaluates to %s, expected %s", source,
+			cel.FormatType(ast.ResultType()), cel.FormatType(resultType))
+	}
+	program, err := env.Program(ast, cel.CostLimit(costLimit), cel.InterruptCheckFrequency(100))
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{source: source, program: program}, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Select evaluates a predicate.
+func (e *Expression) Select(object interface{}, variables map[string]interface{}) (bool, error) {
+	value, err := e.Eval(object, variables)
+	if err != nil {
+		return false, err
+	}
+	selected, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q evaluated to %v, expected a bool", e.source, value)
+	}
+	return selected, nil
+}
+
+// Eval evaluates the expression and returns its value as a JSON value: nil, bool, float64,
+// string, []interface{} or map[string]interface{}. The object is either a typed object or
+// an unstructured map.
+func (e *Expression) Eval(object interface{}, variables map[string]interface{}) (interface{}, error) {
+	objectMap, ok := object.(map[string]interface{})
+	if !ok {
+		var err error
+		if objectMap, err = runtime.DefaultUnstructuredConverter.ToUnstructured(object); err != nil {
+			return nil, err
+		}
+	}
+	activation := map[string]interface{}{ObjectVariable: objectMap}
+	for name, value := range variables {
+		activation[name] = value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), evalTimeout)
+	defer cancel()
+	value, _, err := e.program.ContextEval(ctx, activation)
+	if err != nil {
+		return nil, fmt.Errorf("evaluate expression %q failed: %v", e.source, err)
+	}
+	if types.IsError(value) {
+		return nil, fmt.Errorf("evaluate expression %q failed: %v", e.source, value)
+	}
+	native, err := value.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+	if err != nil {
+		return nil, fmt.Errorf("expression %q evaluated to %v, which isn't a JSON value", e.source, value)
+	}
+	return native.(*structpb.Value).AsInterface(), nil
+}
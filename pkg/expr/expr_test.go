@@ -0,0 +1,131 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		selector  bool
+		variables []string
+		err       string
+	}{
+		{name: "selector", source: `object.metadata.name.startsWith("ws1-")`, selector: true},
+		{name: "dynamic selector", source: `object.metadata.labels["app"]`, selector: true},
+		{name: "variable", source: `object.metadata.name in builtinRoles`, selector: true, variables: []string{"builtinRoles"}},
+		{name: "transform", source: `object.metadata.name + "-copy"`},
+		{name: "selector not a bool", source: `object.metadata.name + "-copy"`, selector: true, err: "evaluates to string, expected bool"},
+		{name: "syntax", source: `object.metadata.name ==`, err: "invalid expression"},
+		{name: "undeclared variable", source: `object.metadata.name in builtinRoles`, selector: true, err: "undeclared reference"},
+		{name: "too long", source: strings.Repeat("1 + ", maxExpressionLength) + "1", err: "longer than"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			if test.selector {
+				_, err = CompileSelector(test.source, test.variables...)
+			} else {
+				_, err = CompileTransform(test.source, test.variables...)
+			}
+			if (test.err == "" && err != nil) || (test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+				t.Errorf("compile() = %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	expression, err := CompileSelector(`!(object.metadata.name in builtinRoles) && has(object.metadata.annotations)`, "builtinRoles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builtinRoles := map[string]interface{}{"builtinRoles": []string{"admin", "viewer"}}
+	tests := []struct {
+		object   interface{}
+		selected bool
+	}{
+		// typed objects are converted to maps
+		{object: &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "custom", Annotations: map[string]string{"a": "b"}}}, selected: true},
+		{object: &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "admin", Annotations: map[string]string{"a": "b"}}}},
+		{object: &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "custom"}}},
+		{object: map[string]interface{}{"metadata": map[string]interface{}{"name": "custom", "annotations": map[string]interface{}{}}}, selected: true},
+	}
+	for i, test := range tests {
+		selected, err := expression.Select(test.object, builtinRoles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selected != test.selected {
+			t.Errorf("%d: Select() = %t, expected %t", i, selected, test.selected)
+		}
+	}
+
+	// a missing field fails the evaluation instead of selecting the object
+	expression, err = CompileSelector(`object.spec.enabled`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expression.Select(map[string]interface{}{}, nil); err == nil {
+		t.Error("a missing field was selected")
+	}
+}
+
+func TestEval(t *testing.T) {
+	object := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "a", "labels": map[string]interface{}{"app": "web"}},
+		"spec":     map[string]interface{}{"replicas": int64(2)},
+	}
+	tests := []struct {
+		source   string
+		expected interface{}
+		err      string
+	}{
+		{source: `object.metadata.name + "-copy"`, expected: "a-copy"},
+		{source: `object.spec.replicas * 2`, expected: float64(4)},
+		{source: `[object.metadata.name, object.metadata.labels.app]`, expected: []interface{}{"a", "web"}},
+		{source: `{"app": object.metadata.labels.app}`, expected: map[string]interface{}{"app": "web"}},
+		{source: `null`, expected: nil},
+		{source: `type(object)`, err: "isn't a JSON value"},
+		{source: `object.spec.replicas / 0`, err: "division by zero"},
+	}
+	for _, test := range tests {
+		expression, err := CompileTransform(test.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := expression.Eval(object, nil)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: Eval() = %v, %v, expected %q", test.source, value, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.source, err)
+		}
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("%s: Eval() = %#v, expected %#v", test.source, value, test.expected)
+		}
+	}
+}
+
+func TestCostLimit(t *testing.T) {
+	items := make([]interface{}, 2000)
+	for i := range items {
+		items[i] = "item"
+	}
+	expression, err := CompileSelector(`object.items.all(a, object.items.all(b, a == b))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expression.Select(map[string]interface{}{"items": items}, nil); err == nil {
+		t.Error("the evaluation didn't stop at the cost limit")
+	}
+}
@@ -0,0 +1,386 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	// AllTasks configures hooks around every task.
+	AllTasks = "*"
+
+	DefaultTimeout = 5 * time.Minute
+
+	PhaseSucceeded = task.PhaseSucceeded
+	PhaseFailed    = task.PhaseFailed
+
+	// maxOutput is how much of the output of a command is kept in its record
+	maxOutput = 1024
+
+	// OriginalReplicasAnnotation is set on a Deployment scaled by a hook to the replicas it had before, it's
+	// kept in the cluster so that a run restarted after a crash scales the Deployment back to them. It's
+	// removed once the Deployment is scaled back.
+	OriginalReplicasAnnotation = "ks-upgrade.kubesphere.io/original-replicas"
+)
+
+// Config holds the hooks of the run and of the tasks.
+type Config struct {
+	// Run are the hooks around the whole run.
+	Run Stages `json:"run,omitempty"`
+	// Tasks are the hooks around a task by task name, the hooks of "*" run around every task.
+	Tasks map[string]Stages `json:"tasks,omitempty"`
+}
+
+type Stages struct {
+	// Pre hooks run before, a failing pre hook aborts the task or the run.
+	Pre []Hook `json:"pre,omitempty"`
+	// Post hooks run after, even when the task or the run failed.
+	Post []Hook `json:"post,omitempty"`
+}
+
+// Hook is a single action, exactly one of ScaleDeployment, Job, Webhook and Exec is set.
+type Hook struct {
+	Name string `json:"name"`
+	// Timeout is how long the hook may take, DefaultTimeout if empty.
+	// +optional
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// IgnoreFailure records the failure of the hook without failing the task or the run.
+	// +optional
+	IgnoreFailure bool `json:"ignoreFailure,omitempty"`
+
+	ScaleDeployment *ScaleDeployment `json:"scaleDeployment,omitempty"`
+	Job             *Job             `json:"job,omitempty"`
+	Webhook         *Webhook         `json:"webhook,omitempty"`
+	Exec            *Exec            `json:"exec,omitempty"`
+}
+
+// ScaleDeployment scales a Deployment and waits until its pods are scaled.
+type ScaleDeployment struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Replicas is the new number of replicas. When it's not set, the Deployment is scaled back to
+	// the replicas it had before it was first scaled by a hook, even by a run which crashed.
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+}
+
+// Job creates a Job and waits until it completes.
+type Job struct {
+	// Manifest is a batch/v1 Job, its name is used as generateName so that every run creates a new Job.
+	Manifest json.RawMessage `json:"manifest"`
+}
+
+// Webhook posts the stage, the task and the run id to a URL as JSON, any 2xx status is a success.
+type Webhook struct {
+	URL string `json:"url"`
+	// +optional
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Exec runs a local command, the stage, the task and the run id are passed in the
+// KS_UPGRADE_HOOK_STAGE, KS_UPGRADE_HOOK_TASK and KS_UPGRADE_RUN_ID env vars.
+type Exec struct {
+	Command []string `json:"command"`
+}
+
+// Validate checks every hook sets exactly one action.
+func (c *Config) Validate() error {
+	all := map[string]Stages{"run": c.Run}
+	for name, stages := range c.Tasks {
+		all["task "+name] = stages
+	}
+	for owner, stages := range all {
+		for _, h := range append(append([]Hook{}, stages.Pre...), stages.Post...) {
+			set := 0
+			for _, isSet := range []bool{h.ScaleDeployment != nil, h.Job != nil, h.Webhook != nil, h.Exec != nil} {
+				if isSet {
+					set++
+				}
+			}
+			if set != 1 {
+				return fmt.Errorf("hook %s of %s must set exactly one of scaleDeployment, job, webhook and exec", h.Name, owner)
+			}
+			if h.Exec != nil && len(h.Exec.Command) == 0 {
+				return fmt.Errorf("hook %s of %s has no command", h.Name, owner)
+			}
+		}
+	}
+	return nil
+}
+
+// Runner runs the hooks of a run, it implements task.HookRunner.
+type Runner struct {
+	client kubernetes.Interface
+	config *Config
+	runID  string
+}
+
+func NewRunner(client kubernetes.Interface, config *Config, runID string) (*Runner, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Runner{client: client, config: config, runID: runID}, nil
+}
+
+func (r *Runner) RunHooks(stage, taskName string) ([]task.HookRecord, error) {
+	hooks := r.hooks(stage, taskName)
+	records := make([]task.HookRecord, 0, len(hooks))
+	for _, h := range hooks {
+		klog.Infof("running %s hook %s", stage, h.Name)
+		message, err := r.run(h, stage, taskName)
+		record := task.HookRecord{Name: h.Name, Stage: stage, Phase: PhaseSucceeded, Message: message}
+		if err != nil {
+			record.Phase = PhaseFailed
+			record.Message = err.Error()
+			records = append(records, record)
+			if h.IgnoreFailure {
+				klog.Warningf("%s hook %s failed, ignoring it: %v", stage, h.Name, err)
+				continue
+			}
+			return records, fmt.Errorf("%s: %v", h.Name, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (r *Runner) hooks(stage, taskName string) []Hook {
+	switch stage {
+	case task.HookPreRun:
+		return r.config.Run.Pre
+	case task.HookPostRun:
+		return r.config.Run.Post
+	}
+	hooks := make([]Hook, 0)
+	for _, name := range []string{AllTasks, taskName} {
+		stages := r.config.Tasks[name]
+		if stage == task.HookPreTask {
+			hooks = append(hooks, stages.Pre...)
+		} else {
+			hooks = append(hooks, stages.Post...)
+		}
+	}
+	return hooks
+}
+
+func (r *Runner) run(h Hook, stage, taskName string) (string, error) {
+	timeout := h.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch {
+	case h.ScaleDeployment != nil:
+		return r.scaleDeployment(ctx, h.ScaleDeployment)
+	case h.Job != nil:
+		return r.runJob(ctx, h.Job)
+	case h.Webhook != nil:
+		return r.callWebhook(ctx, h.Webhook, stage, taskName)
+	default:
+		return r.exec(ctx, h.Exec, stage, taskName)
+	}
+}
+
+func (r *Runner) scaleDeployment(ctx context.Context, s *ScaleDeployment) (string, error) {
+	deployments := r.client.AppsV1().Deployments(s.Namespace)
+	key := fmt.Sprintf("%s/%s", s.Namespace, s.Name)
+
+	var replicas int32
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := deployments.Get(ctx, s.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current := int32(1)
+		if deployment.Spec.Replicas != nil {
+			current = *deployment.Spec.Replicas
+		}
+		original, recorded, err := originalReplicas(deployment.Annotations)
+		if err != nil {
+			return fmt.Errorf("Deployment %s: %v", key, err)
+		}
+		if !recorded {
+			original = current
+		}
+		replicas = original
+		if s.Replicas != nil {
+			replicas = *s.Replicas
+		}
+		if current == replicas && recorded == (replicas != original) {
+			return nil
+		}
+
+		// the original replicas are written along with the new ones, a run restarted after a crash reads them
+		if replicas == original {
+			delete(deployment.Annotations, OriginalReplicasAnnotation)
+		} else {
+			if deployment.Annotations == nil {
+				deployment.Annotations = make(map[string]string)
+			}
+			deployment.Annotations[OriginalReplicasAnnotation] = strconv.Itoa(int(original))
+		}
+		deployment.Spec.Replicas = &replicas
+		_, err = deployments.Update(ctx, deployment, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// wait until the pods are gone or ready, so that a scaled down controller no longer reconciles
+	err = wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		deployment, err := deployments.Get(ctx, s.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return deployment.Status.ObservedGeneration >= deployment.Generation &&
+			deployment.Status.Replicas == replicas && deployment.Status.ReadyReplicas == replicas, nil
+	}, ctx.Done())
+	if err != nil {
+		return "", fmt.Errorf("wait for Deployment %s to scale to %d failed: %v", key, replicas, err)
+	}
+	return fmt.Sprintf("scaled Deployment %s to %d replicas", key, replicas), nil
+}
+
+// originalReplicas returns the replicas recorded in the annotations of a Deployment scaled by a hook.
+func originalReplicas(annotations map[string]string) (int32, bool, error) {
+	value, ok := annotations[OriginalReplicasAnnotation]
+	if !ok {
+		return 0, false, nil
+	}
+	replicas, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid annotation %s: %v", OriginalReplicasAnnotation, err)
+	}
+	return int32(replicas), true, nil
+}
+
+type job struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              json.RawMessage `json:"spec"`
+	Status            struct {
+		Succeeded  int32 `json:"succeeded"`
+		Conditions []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status,omitempty"`
+}
+
+func (r *Runner) runJob(ctx context.Context, j *Job) (string, error) {
+	manifest := &job{}
+	if err := json.Unmarshal(j.Manifest, manifest); err != nil {
+		return "", fmt.Errorf("invalid Job manifest: %v", err)
+	}
+	manifest.APIVersion, manifest.Kind = "batch/v1", "Job"
+	if manifest.Namespace == "" {
+		manifest.Namespace = task.StateNamespace
+	}
+	if manifest.GenerateName == "" {
+		manifest.GenerateName = manifest.Name + "-"
+	}
+	manifest.Name = ""
+	marshal, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	restClient := r.client.Discovery().RESTClient()
+	path := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", manifest.Namespace)
+	raw, err := restClient.Post().AbsPath(path).Body(marshal).DoRaw(ctx)
+	if err != nil {
+		return "", err
+	}
+	created := &job{}
+	if err := json.Unmarshal(raw, created); err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s/%s", created.Namespace, created.Name)
+	klog.Infof("created Job %s, waiting for it to complete", key)
+
+	err = wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		raw, err := restClient.Get().AbsPath(path, created.Name).DoRaw(ctx)
+		if err != nil {
+			return false, err
+		}
+		current := &job{}
+		if err := json.Unmarshal(raw, current); err != nil {
+			return false, err
+		}
+		for _, c := range current.Status.Conditions {
+			if c.Type == "Failed" && c.Status == "True" {
+				return false, fmt.Errorf("Job %s failed: %s", key, c.Message)
+			}
+		}
+		return current.Status.Succeeded > 0, nil
+	}, ctx.Done())
+	if err != nil {
+		return "", fmt.Errorf("wait for Job %s failed: %v", key, err)
+	}
+	return fmt.Sprintf("Job %s completed", key), nil
+}
+
+func (r *Runner) callWebhook(ctx context.Context, w *Webhook, stage, taskName string) (string, error) {
+	body, err := json.Marshal(map[string]string{"stage": stage, "task": taskName, "runID": r.runID})
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range w.Headers {
+		request.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("webhook %s returned %s", w.URL, resp.Status)
+	}
+	return fmt.Sprintf("webhook %s returned %s", w.URL, resp.Status), nil
+}
+
+func (r *Runner) exec(ctx context.Context, e *Exec, stage, taskName string) (string, error) {
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"KS_UPGRADE_HOOK_STAGE="+stage,
+		"KS_UPGRADE_HOOK_TASK="+taskName,
+		"KS_UPGRADE_RUN_ID="+r.runID,
+	)
+	output, err := cmd.CombinedOutput()
+	message := strings.TrimSpace(string(output))
+	if len(message) > maxOutput {
+		message = "..." + message[len(message)-maxOutput:]
+	}
+	if err != nil {
+		if message != "" {
+			return "", fmt.Errorf("%v: %s", err, message)
+		}
+		return "", err
+	}
+	return message, nil
+}
@@ -0,0 +1,167 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+func TestScaleDeployment(t *testing.T) {
+	replicas := int32(2)
+	client := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kubesphere-system", Name: "ks-controller-manager"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{Replicas: 2, ReadyReplicas: 2},
+	})
+	// the pods are scaled as soon as the Deployment is
+	client.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		deployment := action.(k8stesting.UpdateAction).GetObject().(*appsv1.Deployment)
+		deployment.Status.Replicas = *deployment.Spec.Replicas
+		deployment.Status.ReadyReplicas = *deployment.Spec.Replicas
+		return false, nil, nil
+	})
+	runner, err := NewRunner(client, &Config{}, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zero := int32(0)
+	steps := []struct {
+		name       string
+		replicas   *int32
+		expected   int32
+		annotation string
+	}{
+		{name: "scale down", replicas: &zero, expected: 0, annotation: "2"},
+		// a restarted run keeps the replicas of the first one
+		{name: "scale down again", replicas: &zero, expected: 0, annotation: "2"},
+		{name: "scale back", expected: 2},
+		{name: "scale back again", expected: 2},
+	}
+	for _, step := range steps {
+		message, err := runner.scaleDeployment(context.TODO(), &ScaleDeployment{Namespace: "kubesphere-system", Name: "ks-controller-manager", Replicas: step.replicas})
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		deployment, err := client.AppsV1().Deployments("kubesphere-system").Get(context.TODO(), "ks-controller-manager", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *deployment.Spec.Replicas != step.expected || deployment.Annotations[OriginalReplicasAnnotation] != step.annotation {
+			t.Errorf("%s: %s, the Deployment has %d replicas and the annotation %q, expected %d and %q", step.name, message,
+				*deployment.Spec.Replicas, deployment.Annotations[OriginalReplicasAnnotation], step.expected, step.annotation)
+		}
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	requests := make([]map[string]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		request := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, request)
+	}))
+	defer server.Close()
+
+	echo := func(name string) Hook {
+		return Hook{Name: name, Exec: &Exec{Command: []string{"sh", "-c", `echo "$KS_UPGRADE_HOOK_STAGE $KS_UPGRADE_HOOK_TASK $KS_UPGRADE_RUN_ID"`}}}
+	}
+	fail := func(name string, ignore bool) Hook {
+		return Hook{Name: name, IgnoreFailure: ignore, Exec: &Exec{Command: []string{"sh", "-c", "echo broken; exit 1"}}}
+	}
+	config := &Config{
+		Run: Stages{
+			Pre:  []Hook{echo("notify"), {Name: "webhook", Webhook: &Webhook{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}}}},
+			Post: []Hook{{Name: "unauthorized", Webhook: &Webhook{URL: server.URL}}, echo("cleanup")},
+		},
+		Tasks: map[string]Stages{
+			AllTasks:       {Pre: []Hook{echo("all")}},
+			"role-migrate": {Pre: []Hook{fail("ignored", true), echo("role")}, Post: []Hook{fail("failing", false), echo("skipped")}},
+		},
+	}
+	runner, err := NewRunner(fake.NewSimpleClientset(), config, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		stage, task string
+		expected    []task.HookRecord
+		err         string
+	}{
+		{
+			stage: task.HookPreRun,
+			expected: []task.HookRecord{
+				{Name: "notify", Stage: task.HookPreRun, Phase: PhaseSucceeded, Message: "pre-run  run1"},
+				{Name: "webhook", Stage: task.HookPreRun, Phase: PhaseSucceeded, Message: "webhook " + server.URL + " returned 200 OK"},
+			},
+		},
+		{
+			stage: task.HookPreTask, task: "role-migrate",
+			expected: []task.HookRecord{
+				{Name: "all", Stage: task.HookPreTask, Phase: PhaseSucceeded, Message: "pre-task role-migrate run1"},
+				{Name: "ignored", Stage: task.HookPreTask, Phase: PhaseFailed, Message: "exit status 1: broken"},
+				{Name: "role", Stage: task.HookPreTask, Phase: PhaseSucceeded, Message: "pre-task role-migrate run1"},
+			},
+		},
+		{
+			stage: task.HookPostTask, task: "role-migrate",
+			expected: []task.HookRecord{{Name: "failing", Stage: task.HookPostTask, Phase: PhaseFailed, Message: "exit status 1: broken"}},
+			err:      "failing: exit status 1: broken",
+		},
+		{
+			stage:    task.HookPostRun,
+			expected: []task.HookRecord{{Name: "unauthorized", Stage: task.HookPostRun, Phase: PhaseFailed, Message: "webhook " + server.URL + " returned 401 Unauthorized"}},
+			err:      "unauthorized",
+		},
+	}
+	for _, test := range tests {
+		records, err := runner.RunHooks(test.stage, test.task)
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+			t.Errorf("%s %s: RunHooks() = %v, expected %q", test.stage, test.task, err, test.err)
+		}
+		if !reflect.DeepEqual(records, test.expected) {
+			t.Errorf("%s %s: the records are %+v, expected %+v", test.stage, test.task, records, test.expected)
+		}
+	}
+	expected := []map[string]string{{"stage": task.HookPreRun, "task": "", "runID": "run1"}}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("the webhook received %v, expected %v", requests, expected)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		hook  Hook
+		valid bool
+	}{
+		{hook: Hook{Name: "exec", Exec: &Exec{Command: []string{"true"}}}, valid: true},
+		{hook: Hook{Name: "none"}},
+		{hook: Hook{Name: "two", Exec: &Exec{Command: []string{"true"}}, Webhook: &Webhook{URL: "http://localhost"}}},
+		{hook: Hook{Name: "no command", Exec: &Exec{}}},
+	}
+	for _, test := range tests {
+		config := &Config{Tasks: map[string]Stages{AllTasks: {Post: []Hook{test.hook}}}}
+		if err := config.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, expected valid %t", test.hook.Name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package interactive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/yaml"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorBold  = "\033[1m"
+	colorReset = "\033[0m"
+)
+
+// Approver prompts for every change, it implements task.Approver. The prompts are
+// serialized since the changes are applied in parallel.
+type Approver struct {
+	in    *bufio.Reader
+	out   io.Writer
+	color bool
+
+	mutex      sync.Mutex
+	approveAll bool
+	// aborted is set once the run was aborted, the changes still queued are refused without a prompt
+	aborted bool
+}
+
+// NewApprover returns an approver reading the answers from in, the diffs are colored
+// if out is a terminal and NO_COLOR isn't set.
+func NewApprover(in io.Reader, out io.Writer) *Approver {
+	color := false
+	if f, ok := out.(*os.File); ok && os.Getenv("NO_COLOR") == "" {
+		if stat, err := f.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			color = true
+		}
+	}
+	return &Approver{in: bufio.NewReader(in), out: out, color: color}
+}
+
+func (a *Approver) Approve(change task.Change, current []byte) (bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.aborted {
+		return false, task.ErrAborted
+	}
+	if a.approveAll {
+		return true, nil
+	}
+
+	diff, err := a.diff(change, current)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(a.out, "\n%s\n%s", a.paint(colorBold, fmt.Sprintf("%s %s: %s", change.Operation, change.Key(), change.Description)), diff)
+
+	for {
+		fmt.Fprint(a.out, "Apply this change? [y]es, [n]o (skip), [a]ll (apply all the remaining changes), [q]uit (abort): ")
+		answer, err := a.in.ReadString('\n')
+		if err != nil && answer == "" {
+			// stdin was closed, nobody can approve the change
+			a.aborted = true
+			return false, task.ErrAborted
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no", "s", "skip":
+			return false, nil
+		case "a", "all":
+			a.approveAll = true
+			return true, nil
+		case "q", "quit", "abort":
+			a.aborted = true
+			return false, task.ErrAborted
+		}
+	}
+}
+
+// diff returns the line diff between the YAML of the current and the desired object.
+func (a *Approver) diff(change task.Change, current []byte) (string, error) {
+	// the secrets are masked on both sides, the diff only tells whether their keys change
+	current, err := task.Redact(current, change.Redact)
+	if err != nil {
+		return "", err
+	}
+	before, err := toYAML(current)
+	if err != nil {
+		return "", err
+	}
+	after := ""
+	if change.Operation != task.OperationDelete {
+		desired, err := task.Redact(change.Object, change.Redact)
+		if err != nil {
+			return "", err
+		}
+		if after, err = toYAML(desired); err != nil {
+			return "", err
+		}
+	}
+
+	b := &strings.Builder{}
+	for _, line := range diffLines(splitLines(before), splitLines(after)) {
+		switch line[0] {
+		case '-':
+			b.WriteString(a.paint(colorRed, line))
+		case '+':
+			b.WriteString(a.paint(colorGreen, line))
+		default:
+			b.WriteString(line)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+func (a *Approver) paint(color, s string) string {
+	if !a.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// toYAML converts an object to YAML without the metadata managed by the apiserver, which is just noise in a diff.
+func toYAML(raw []byte) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+	object := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return "", err
+	}
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		for _, field := range []string{"managedFields", "resourceVersion", "uid", "selfLink", "creationTimestamp", "generation"} {
+			delete(metadata, field)
+		}
+	}
+	marshal, err := yaml.Marshal(object)
+	return string(marshal), err
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns a unified line diff of two texts based on their longest common subsequence,
+// the objects are small enough for the quadratic table.
+func diffLines(before, after []string) []string {
+	lcs := make([][]int, len(before)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(before)+len(after))
+	i, j := 0, 0
+	for i < len(before) && j < len(after) {
+		switch {
+		case before[i] == after[j]:
+			lines = append(lines, "  "+before[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "- "+before[i])
+			i++
+		default:
+			lines = append(lines, "+ "+after[j])
+			j++
+		}
+	}
+	for ; i < len(before); i++ {
+		lines = append(lines, "- "+before[i])
+	}
+	for ; j < len(after); j++ {
+		lines = append(lines, "+ "+after[j])
+	}
+	return lines
+}
@@ -0,0 +1,73 @@
+package interactive
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   []string
+		after    []string
+		expected []string
+	}{
+		{
+			name:     "unchanged",
+			before:   []string{"a", "b"},
+			after:    []string{"a", "b"},
+			expected: []string{"  a", "  b"},
+		},
+		{
+			name:     "changed line",
+			before:   []string{"a", "b", "c"},
+			after:    []string{"a", "x", "c"},
+			expected: []string{"  a", "- b", "+ x", "  c"},
+		},
+		{
+			name:     "added and removed lines",
+			before:   []string{"a", "b"},
+			after:    []string{"b", "c"},
+			expected: []string{"- a", "  b", "+ c"},
+		},
+		{
+			name:     "creation",
+			after:    []string{"a"},
+			expected: []string{"+ a"},
+		},
+		{
+			name:     "deletion",
+			before:   []string{"a"},
+			expected: []string{"- a"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := diffLines(test.before, test.after); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("diff is %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestDiffRedacts(t *testing.T) {
+	a := &Approver{}
+	change := task.Change{
+		Operation: task.OperationUpdate,
+		Object:    []byte(`{"data":{"password":"new","username":"admin"}}`),
+		Redact:    []string{"data"},
+	}
+	diff, err := a.diff(change, []byte(`{"data":{"password":"old"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(diff, "old") || strings.Contains(diff, "new") {
+		t.Errorf("diff shows the redacted values:\n%s", diff)
+	}
+	if !strings.Contains(diff, "+   username") {
+		t.Errorf("diff doesn't show the added key:\n%s", diff)
+	}
+}
@@ -0,0 +1,346 @@
+package kubesphereconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"kubesphere.io/ks-upgrade/pkg/schema"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	// ConfigKey is the key of the ConfigMap holding the configuration of ks-apiserver.
+	ConfigKey = "kubesphere.yaml"
+
+	// SchemaVersionAnnotation records the release the configuration was converted to.
+	SchemaVersionAnnotation = "ks-upgrade.kubesphere.io/schema-version"
+	// BackupLabel is set to the id of the run on the copies of the ConfigMap taken before it's converted.
+	BackupLabel = "kubesphere.io/upgrade-backup"
+
+	DefaultTargetVersion = "v3.4"
+
+	apiServerDeployment = "ks-apiserver"
+
+	installerGroup   = "installer.kubesphere.io"
+	installerVersion = "v1alpha1"
+	installerName    = "ks-installer"
+)
+
+// Options are the parameters of the kubesphere-config migration.
+type Options struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	// SourceVersion is the release the configuration was written for, it's read from the image tag
+	// of ks-apiserver if empty, or from the ClusterConfiguration if the image has no release tag.
+	SourceVersion string `json:"sourceVersion,omitempty"`
+	// TargetVersion is the release the configuration is converted to.
+	TargetVersion string `json:"targetVersion,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{Namespace: task.StateNamespace, Name: "kubesphere-config", TargetVersion: DefaultTargetVersion}
+}
+
+type kubesphereConfigTask struct {
+	client  kubernetes.Interface
+	applier *task.Applier
+	runID   string
+	options *Options
+
+	task.WarningList
+}
+
+// NewKubeSphereConfigTask creates the task converting kubesphere.yaml, the configuration of
+// ks-apiserver, to the target release. The ConfigMap is copied before it's updated.
+func NewKubeSphereConfigTask(client kubernetes.Interface, options *task.Options, configOptions *Options) (task.UpgradeTask, error) {
+	if _, err := schema.ParseVersion(configOptions.TargetVersion); err != nil {
+		return nil, fmt.Errorf("kubesphere config target version: %v", err)
+	}
+	if configOptions.SourceVersion != "" {
+		if _, err := schema.ParseVersion(configOptions.SourceVersion); err != nil {
+			return nil, fmt.Errorf("kubesphere config source version: %v", err)
+		}
+	}
+	return &kubesphereConfigTask{client: client, applier: task.NewApplier(client, options), runID: options.RunID, options: configOptions}, nil
+}
+
+func (t *kubesphereConfigTask) Name() string {
+	return "kubesphere-config"
+}
+
+func (t *kubesphereConfigTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+func (t *kubesphereConfigTask) path() string {
+	return task.CollectionPath("", "v1", "configmaps", t.options.Namespace)
+}
+
+// sourceVersion returns the release the configuration was written for, from the image tag of
+// ks-apiserver or, when the image is pinned by digest or untagged, from the ClusterConfiguration.
+func (t *kubesphereConfigTask) sourceVersion(cm *corev1.ConfigMap) (string, error) {
+	if v := cm.Annotations[SchemaVersionAnnotation]; v != "" {
+		return v, nil
+	}
+	if t.options.SourceVersion != "" {
+		return t.options.SourceVersion, nil
+	}
+	deployment, err := t.client.AppsV1().Deployments(t.options.Namespace).Get(context.TODO(), apiServerDeployment, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return "", fmt.Errorf("detect the release of %s failed, set its source version: %v", ConfigKey, err)
+	}
+	if err == nil {
+		for _, c := range deployment.Spec.Template.Spec.Containers {
+			if c.Name != apiServerDeployment {
+				continue
+			}
+			if tag := imageTag(c.Image); tag != "" {
+				if _, err := schema.ParseVersion(tag); err == nil {
+					return tag, nil
+				}
+			}
+			klog.Infof("the image %s of %s has no release tag, reading the release from the ClusterConfiguration", c.Image, apiServerDeployment)
+		}
+	}
+
+	version, err := t.installerVersion()
+	if err != nil {
+		return "", fmt.Errorf("detect the release of %s failed, set its source version: %v", ConfigKey, err)
+	}
+	if version == "" {
+		return "", fmt.Errorf("detect the release of %s failed, set its source version", ConfigKey)
+	}
+	return version, nil
+}
+
+// installerVersion returns the release of the ClusterConfiguration of ks-installer, from its version label
+// or its status. Its schema version annotation is left out, it's the release of the spec, not of KubeSphere.
+func (t *kubesphereConfigTask) installerVersion() (string, error) {
+	raw, err := t.client.Discovery().RESTClient().Get().
+		AbsPath(task.CollectionPath(installerGroup, installerVersion, "clusterconfigurations", t.options.Namespace), installerName).DoRaw(context.TODO())
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(raw); err != nil {
+		return "", err
+	}
+	if v := object.GetLabels()["version"]; v != "" {
+		return v, nil
+	}
+	v, _, _ := unstructured.NestedString(object.Object, "status", "core", "version")
+	return v, nil
+}
+
+// imageTag returns the tag of an image reference, empty if it's only pinned by digest or untagged.
+func imageTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i+1:], "/") {
+		// the colon is the port of the registry
+		return ""
+	}
+	return image[i+1:]
+}
+
+func (t *kubesphereConfigTask) Plan() ([]task.Change, error) {
+	t.ResetWarnings()
+	cm, err := t.client.CoreV1().ConfigMaps(t.options.Namespace).Get(context.TODO(), t.options.Name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			klog.Infof("ConfigMap %s/%s is not existing, skipping it.", t.options.Namespace, t.options.Name)
+			return nil, nil
+		}
+		return nil, err
+	}
+	raw, ok := cm.Data[ConfigKey]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no %s", cm.Namespace, cm.Name, ConfigKey)
+	}
+
+	source, err := t.sourceVersion(cm)
+	if err != nil {
+		return nil, err
+	}
+	sourceVersion, err := schema.ParseVersion(source)
+	if err != nil {
+		return nil, err
+	}
+	targetVersion, _ := schema.ParseVersion(t.options.TargetVersion)
+	if targetVersion.Less(sourceVersion) {
+		return nil, fmt.Errorf("%s is at %s, it can't be converted back to %s", ConfigKey, sourceVersion, targetVersion)
+	}
+	if !sourceVersion.Less(targetVersion) {
+		klog.Infof("%s is already at %s, skipping it.", ConfigKey, targetVersion)
+		return nil, nil
+	}
+
+	document := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(raw), &document); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", ConfigKey, err)
+	}
+	result, err := schema.Migrate(document, steps, sourceVersion.String(), targetVersion.String())
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range result.Warnings {
+		t.Warn("%s: %s", ConfigKey, w)
+	}
+	converted, err := validate(document)
+	if err != nil {
+		return nil, fmt.Errorf("%s converted to %s is invalid: %v", ConfigKey, targetVersion, err)
+	}
+	unknown := unknownKeys(document, reflect.TypeOf(Config{}), "")
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		t.Warn("%s: %s is unknown to %s, it's kept as it is", ConfigKey, key, targetVersion)
+	}
+
+	backup, err := t.backup(cm)
+	if err != nil {
+		return nil, err
+	}
+
+	original := cm.DeepCopy()
+	original.APIVersion, original.Kind = "v1", "ConfigMap"
+	updated := original.DeepCopy()
+	updated.Data[ConfigKey] = string(converted)
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string)
+	}
+	updated.Annotations[SchemaVersionAnnotation] = targetVersion.String()
+
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	modified, err := json.Marshal(updated)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := task.CreateMergePatch(originalJSON, modified)
+	if err != nil {
+		return nil, err
+	}
+	description := fmt.Sprintf("convert %s of ConfigMap %s/%s from %s to %s, moving %d settings",
+		ConfigKey, cm.Namespace, cm.Name, sourceVersion, targetVersion, len(result.Moved))
+	kept := make([]string, 0, len(result.Warnings)+len(unknown))
+	for _, w := range result.Warnings {
+		kept = append(kept, w.Path)
+	}
+	for _, key := range unknown {
+		if !task.InSlice(key, kept) {
+			kept = append(kept, key)
+		}
+	}
+	if len(kept) > 0 {
+		description = fmt.Sprintf("%s, unknown settings kept as they are: %s", description, strings.Join(kept, ", "))
+	}
+	return []task.Change{*backup, {
+		Operation:       task.OperationUpdate,
+		Path:            t.path(),
+		Name:            cm.Name,
+		ResourceVersion: cm.ResourceVersion,
+		Object:          modified,
+		Patch:           patch,
+		DependsOn:       []string{backup.Key()},
+		Description:     description,
+	}}, nil
+}
+
+// validate checks the converted configuration and returns it as YAML.
+func validate(document map[string]interface{}) ([]byte, error) {
+	marshal, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := json.Unmarshal(marshal, config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(marshal)
+}
+
+// backup returns the creation of the copy of the ConfigMap taken by this run.
+func (t *kubesphereConfigTask) backup(cm *corev1.ConfigMap) (*task.Change, error) {
+	backup := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-backup-%s", cm.Name, t.runID),
+			Namespace:   cm.Namespace,
+			Labels:      map[string]string{BackupLabel: t.runID},
+			Annotations: map[string]string{"kubesphere.io/description": fmt.Sprintf("copy of %s/%s taken before it was converted", cm.Namespace, cm.Name)},
+		},
+		Data: cm.Data,
+	}
+	marshal, err := json.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+	return &task.Change{
+		Operation:   task.OperationCreate,
+		Path:        t.path(),
+		Name:        backup.Name,
+		Object:      marshal,
+		Description: fmt.Sprintf("back up ConfigMap %s/%s to %s", cm.Namespace, cm.Name, backup.Name),
+	}, nil
+}
+
+// Verify checks the configuration was converted to the target release and is valid.
+func (t *kubesphereConfigTask) Verify() error {
+	cm, err := t.client.CoreV1().ConfigMaps(t.options.Namespace).Get(context.TODO(), t.options.Name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	source, err := t.sourceVersion(cm)
+	if err != nil {
+		return err
+	}
+	current, err := schema.ParseVersion(source)
+	if err != nil {
+		return err
+	}
+	target, _ := schema.ParseVersion(t.options.TargetVersion)
+	if current.Less(target) {
+		return fmt.Errorf("%s of ConfigMap %s/%s is at %s, expected %s", ConfigKey, cm.Namespace, cm.Name, current, target)
+	}
+	document := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(cm.Data[ConfigKey]), &document); err != nil {
+		return fmt.Errorf("parse %s failed: %v", ConfigKey, err)
+	}
+	if _, err := validate(document); err != nil {
+		return fmt.Errorf("%s is invalid: %v", ConfigKey, err)
+	}
+	return nil
+}
+
+func (t *kubesphereConfigTask) RequiredPermissions() []task.Permission {
+	return []task.Permission{
+		{Group: "", Version: "v1", Resource: "configmaps", Verbs: []string{"get", "create", "update"}},
+		{Group: "apps", Version: "v1", Resource: "deployments", Verbs: []string{"get"}},
+		{Group: installerGroup, Version: installerVersion, Resource: "clusterconfigurations", Verbs: []string{"get"}},
+	}
+}
@@ -0,0 +1,75 @@
+package kubesphereconfig
+
+import (
+	"testing"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"kubesphere.io/ks-upgrade/pkg/schema"
+)
+
+func TestMigrateAccessTokenMaxAge(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected time.Duration
+	}{
+		{
+			name:     "seconds",
+			config:   "authentication:\n  oauthOptions:\n    accessTokenMaxAgeSeconds: 7200\n",
+			expected: 2 * time.Hour,
+		},
+		{
+			name:     "zero",
+			config:   "authentication:\n  oauthOptions:\n    accessTokenMaxAgeSeconds: 0\n",
+			expected: 0,
+		},
+		{
+			name:     "quoted",
+			config:   "authentication:\n  oauthOptions:\n    accessTokenMaxAgeSeconds: \"90\"\n",
+			expected: 90 * time.Second,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document := make(map[string]interface{})
+			if err := yaml.Unmarshal([]byte(test.config), &document); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := schema.Migrate(document, steps, "v3.0", "v3.4"); err != nil {
+				t.Fatal(err)
+			}
+			converted, err := validate(document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &Config{}
+			if err := yaml.Unmarshal(converted, config); err != nil {
+				t.Fatal(err)
+			}
+			if got := time.Duration(config.Authentication.OAuthOptions.AccessTokenMaxAge); got != test.expected {
+				t.Errorf("accessTokenMaxAge is %s, expected %s", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestImageTag(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{image: "kubesphere/ks-apiserver:v3.3.2", expected: "v3.3.2"},
+		{image: "registry.local:5000/kubesphere/ks-apiserver:v3.3.2", expected: "v3.3.2"},
+		{image: "registry.local:5000/kubesphere/ks-apiserver", expected: ""},
+		{image: "kubesphere/ks-apiserver", expected: ""},
+		{image: "kubesphere/ks-apiserver@sha256:0123456789abcdef", expected: ""},
+		{image: "kubesphere/ks-apiserver:v3.3.2@sha256:0123456789abcdef", expected: "v3.3.2"},
+	}
+	for _, test := range tests {
+		if got := imageTag(test.image); got != test.expected {
+			t.Errorf("imageTag(%q) = %q, expected %q", test.image, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package kubesphereconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+// Config is the part of the configuration of ks-apiserver of the target release ks-upgrade
+// knows about, the keys it doesn't declare are kept as they are and reported.
+type Config struct {
+	Authentication *AuthenticationOptions `json:"authentication,omitempty"`
+	Authorization  *struct {
+		Mode string `json:"mode,omitempty"`
+	} `json:"authorization,omitempty"`
+	LDAP         map[string]interface{} `json:"ldap,omitempty"`
+	Redis        map[string]interface{} `json:"redis,omitempty"`
+	S3           map[string]interface{} `json:"s3,omitempty"`
+	OpenPitrix   map[string]interface{} `json:"openpitrix,omitempty"`
+	Monitoring   *EndpointOptions       `json:"monitoring,omitempty"`
+	Logging      map[string]interface{} `json:"logging,omitempty"`
+	Events       map[string]interface{} `json:"events,omitempty"`
+	Auditing     map[string]interface{} `json:"auditing,omitempty"`
+	Alerting     *AlertingOptions       `json:"alerting,omitempty"`
+	Notification *EndpointOptions       `json:"notification,omitempty"`
+	MultiCluster *MultiClusterOptions   `json:"multicluster,omitempty"`
+	Network      map[string]interface{} `json:"network,omitempty"`
+	ServiceMesh  map[string]interface{} `json:"servicemesh,omitempty"`
+	DevOps       *DevOpsOptions         `json:"devops,omitempty"`
+	SonarQube    map[string]interface{} `json:"sonarQube,omitempty"`
+	EdgeRuntime  *EndpointOptions       `json:"edgeruntime,omitempty"`
+	Gateway      map[string]interface{} `json:"gateway,omitempty"`
+	GPU          map[string]interface{} `json:"gpu,omitempty"`
+	Terminal     map[string]interface{} `json:"terminal,omitempty"`
+}
+
+type AuthenticationOptions struct {
+	AuthenticateRateLimiterMaxTries int           `json:"authenticateRateLimiterMaxTries,omitempty"`
+	AuthenticateRateLimiterDuration Duration      `json:"authenticateRateLimiterDuration,omitempty"`
+	LoginHistoryRetentionPeriod     Duration      `json:"loginHistoryRetentionPeriod,omitempty"`
+	LoginHistoryMaximumEntries      int           `json:"loginHistoryMaximumEntries,omitempty"`
+	MaximumClockSkew                Duration      `json:"maximumClockSkew,omitempty"`
+	MultipleLogin                   bool          `json:"multipleLogin"`
+	KubectlImage                    string        `json:"kubectlImage,omitempty"`
+	JwtSecret                       string        `json:"jwtSecret"`
+	OAuthOptions                    *OAuthOptions `json:"oauthOptions,omitempty"`
+}
+
+type OAuthOptions struct {
+	Issuer                       string                    `json:"issuer,omitempty"`
+	IdentityProviders            []IdentityProviderOptions `json:"identityProviders,omitempty"`
+	Clients                      []map[string]interface{}  `json:"clients,omitempty"`
+	AccessTokenMaxAge            Duration                  `json:"accessTokenMaxAge,omitempty"`
+	AccessTokenInactivityTimeout Duration                  `json:"accessTokenInactivityTimeout,omitempty"`
+}
+
+type IdentityProviderOptions struct {
+	Name                     string                 `json:"name"`
+	MappingMethod            string                 `json:"mappingMethod"`
+	DisableLoginConfirmation bool                   `json:"disableLoginConfirmation,omitempty"`
+	Type                     string                 `json:"type"`
+	Provider                 map[string]interface{} `json:"provider"`
+}
+
+type EndpointOptions struct {
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+type AlertingOptions struct {
+	Endpoint                 string `json:"endpoint,omitempty"`
+	PrometheusEndpoint       string `json:"prometheusEndpoint,omitempty"`
+	ThanosRulerEndpoint      string `json:"thanosRulerEndpoint,omitempty"`
+	ThanosRuleResourceLabels string `json:"thanosRuleResourceLabels,omitempty"`
+}
+
+type MultiClusterOptions struct {
+	ClusterRole                   string   `json:"clusterRole,omitempty"`
+	ClusterName                   string   `json:"clusterName,omitempty"`
+	EnableFederation              bool     `json:"enableFederation,omitempty"`
+	ProxyPublishService           string   `json:"proxyPublishService,omitempty"`
+	ProxyPublishAddress           string   `json:"proxyPublishAddress,omitempty"`
+	AgentImage                    string   `json:"agentImage,omitempty"`
+	ClusterControllerResyncPeriod Duration `json:"clusterControllerResyncPeriod,omitempty"`
+	HostClusterName               string   `json:"hostClusterName,omitempty"`
+}
+
+type DevOpsOptions struct {
+	Host           string `json:"host,omitempty"`
+	Username       string `json:"username,omitempty"`
+	Password       string `json:"password,omitempty"`
+	MaxConnections int    `json:"maxConnections,omitempty"`
+	Endpoint       string `json:"endpoint,omitempty"`
+}
+
+// Duration is a duration written as a string like 10m or as nanoseconds, as ks-apiserver accepts both.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return fmt.Errorf("invalid duration %s", raw)
+		}
+		*d = Duration(n)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+var (
+	clusterRoles   = []string{"host", "member", "none"}
+	mappingMethods = []string{"auto", "lookup", "mixed"}
+)
+
+// Validate checks the values ks-apiserver refuses to start with.
+func (c *Config) Validate() error {
+	if c.MultiCluster != nil && c.MultiCluster.ClusterRole != "" && !task.InSlice(c.MultiCluster.ClusterRole, clusterRoles) {
+		return fmt.Errorf("multicluster.clusterRole must be one of %s, it's %s", strings.Join(clusterRoles, ", "), c.MultiCluster.ClusterRole)
+	}
+	if c.Authentication != nil && c.Authentication.OAuthOptions != nil {
+		names := make(map[string]bool)
+		for i, idp := range c.Authentication.OAuthOptions.IdentityProviders {
+			if idp.Name == "" || idp.Type == "" {
+				return fmt.Errorf("authentication.oauthOptions.identityProviders[%d] must have a name and a type", i)
+			}
+			if names[idp.Name] {
+				return fmt.Errorf("duplicate identity provider %s", idp.Name)
+			}
+			names[idp.Name] = true
+			if idp.MappingMethod != "" && !task.InSlice(idp.MappingMethod, mappingMethods) {
+				return fmt.Errorf("the mapping method of identity provider %s must be one of %s, it's %s", idp.Name, strings.Join(mappingMethods, ", "), idp.MappingMethod)
+			}
+		}
+	}
+	return nil
+}
+
+// unknownKeys returns the paths of the keys of the document t doesn't declare, a map or
+// an interface of t accepts any key.
+func unknownKeys(document interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch value := document.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			fields[name] = t.Field(i).Type
+		}
+		unknown := make([]string, 0)
+		for key, child := range value {
+			childPath := strings.TrimPrefix(path+"."+key, ".")
+			fieldType, ok := fields[key]
+			if !ok {
+				unknown = append(unknown, childPath)
+				continue
+			}
+			unknown = append(unknown, unknownKeys(child, fieldType, childPath)...)
+		}
+		return unknown
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		unknown := make([]string, 0)
+		for i, item := range value {
+			unknown = append(unknown, unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return unknown
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package kubesphereconfig
+
+import "kubesphere.io/ks-upgrade/pkg/schema"
+
+// steps are the changes of kubesphere.yaml between the minor releases of ks-apiserver.
+var steps = []schema.Step{
+	{
+		From: "v3.0",
+		To:   "v3.1",
+		Moves: []schema.Move{
+			{From: "alerting.endpoint", To: "alerting.prometheusEndpoint"},
+			{From: "authentication.oauthOptions.accessTokenMaxAgeSeconds", To: "authentication.oauthOptions.accessTokenMaxAge", Convert: schema.SecondsToDuration},
+		},
+		Removed: []schema.Removed{
+			{Path: "multicluster.enable", Reason: "set multicluster.clusterRole to host, member or none"},
+		},
+	},
+	{
+		From: "v3.1",
+		To:   "v3.2",
+		Moves: []schema.Move{
+			{From: "notification.notificationEndpoint", To: "notification.endpoint"},
+		},
+		Removed: []schema.Removed{
+			{Path: "network.weaveScopeHost", Reason: "Weave Scope is no longer supported"},
+		},
+	},
+	{
+		From: "v3.2",
+		To:   "v3.3",
+		Moves: []schema.Move{
+			{From: "kubeedge.endpoint", To: "edgeruntime.endpoint"},
+			{From: "devops.sonarQube", To: "sonarQube"},
+		},
+	},
+	{
+		From: "v3.3",
+		To:   "v3.4",
+		Moves: []schema.Move{
+			{From: "authentication.loginHistoryMaxEntries", To: "authentication.loginHistoryMaximumEntries"},
+		},
+		Removed: []schema.Removed{
+			{Path: "metering", Reason: "metering is no longer part of KubeSphere"},
+		},
+	},
+}
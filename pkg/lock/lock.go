@@ -0,0 +1,263 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	DefaultNamespace     = "kubesphere-system"
+	DefaultName          = "ks-upgrade"
+	DefaultLeaseDuration = 60 * time.Second
+
+	retryInterval = 5 * time.Second
+)
+
+type Options struct {
+	Namespace string
+	Name      string
+	// Identity identifies the holder, e.g. the name of the pod running the upgrade.
+	Identity string
+	// LeaseDuration is how long the lock is valid without being renewed,
+	// a lease which isn't renewed in time is considered abandoned and is taken over.
+	LeaseDuration time.Duration
+	// Wait is how long to wait for the holder to release the lock before giving up.
+	Wait time.Duration
+	// Steal takes over the lock from a live holder once Wait has elapsed.
+	Steal bool
+}
+
+// HeldError is returned when the lock is held by another upgrade.
+type HeldError struct {
+	Namespace string
+	Name      string
+	Holder    string
+	Since     time.Time
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("another upgrade is running: lock %s/%s is held by %s since %s",
+		e.Namespace, e.Name, e.Holder, e.Since.Format(time.RFC3339))
+}
+
+// ErrLost is the error of the run context once the lock was taken over or couldn't be renewed in time.
+var ErrLost = errors.New("lock lost")
+
+// Lock is a Lease based lock that prevents two upgrades from running at the same time.
+type Lock struct {
+	client  kubernetes.Interface
+	options Options
+	cancel  context.CancelFunc
+
+	// ctx is the context of the run holding the lock, it's canceled when the lock is lost
+	ctx  context.Context
+	lost context.CancelFunc
+	// renewed is when the lease was last renewed, only the renewing goroutine accesses it
+	renewed time.Time
+}
+
+func New(client kubernetes.Interface, options Options) *Lock {
+	if options.Namespace == "" {
+		options.Namespace = DefaultNamespace
+	}
+	if options.Name == "" {
+		options.Name = DefaultName
+	}
+	if options.LeaseDuration == 0 {
+		options.LeaseDuration = DefaultLeaseDuration
+	}
+	ctx, lost := context.WithCancel(context.Background())
+	return &Lock{client: client, options: options, ctx: ctx, lost: lost}
+}
+
+// Context returns the context of the run holding the lock, it's done once the lock is lost: another
+// upgrade took it over or it couldn't be renewed before the lease expired. The run must stop then.
+func (l *Lock) Context() context.Context {
+	return l.ctx
+}
+
+// Err returns ErrLost once the lock is lost.
+func (l *Lock) Err() error {
+	if l.ctx.Err() != nil {
+		return ErrLost
+	}
+	return nil
+}
+
+// Acquire takes the lock and keeps renewing it in the background until Release is called.
+func (l *Lock) Acquire() error {
+	deadline := time.Now().Add(l.options.Wait)
+	for {
+		err := l.tryAcquire(false)
+		if err == nil {
+			break
+		}
+		held, ok := err.(*HeldError)
+		if !ok {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			if !l.options.Steal {
+				return err
+			}
+			klog.Warningf("stealing lock %s/%s from %s", l.options.Namespace, l.options.Name, held.Holder)
+			if err := l.tryAcquire(true); err != nil {
+				return err
+			}
+			break
+		}
+		klog.Infof("%v, waiting", err)
+		time.Sleep(retryInterval)
+	}
+
+	klog.Infof("acquired lock %s/%s as %s", l.options.Namespace, l.options.Name, l.options.Identity)
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.renewed = time.Now()
+	go wait.UntilWithContext(ctx, l.renew, l.options.LeaseDuration/3)
+	return nil
+}
+
+func (l *Lock) tryAcquire(steal bool) error {
+	leases := l.client.CoordinationV1().Leases(l.options.Namespace)
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(l.options.LeaseDuration.Seconds())
+
+	lease, err := leases.Get(context.TODO(), l.options.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: l.options.Name, Namespace: l.options.Namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.options.Identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = leases.Create(context.TODO(), lease, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	spec := lease.Spec
+	if spec.HolderIdentity != nil && *spec.HolderIdentity != "" && *spec.HolderIdentity != l.options.Identity &&
+		!expired(spec) && !steal {
+		since := time.Time{}
+		if spec.AcquireTime != nil {
+			since = spec.AcquireTime.Time
+		}
+		return &HeldError{Namespace: l.options.Namespace, Name: l.options.Name, Holder: *spec.HolderIdentity, Since: since}
+	}
+
+	transitions := int32(1)
+	if spec.LeaseTransitions != nil {
+		transitions = *spec.LeaseTransitions + 1
+	}
+	lease.Spec = coordinationv1.LeaseSpec{
+		HolderIdentity:       &l.options.Identity,
+		LeaseDurationSeconds: &durationSeconds,
+		AcquireTime:          &now,
+		RenewTime:            &now,
+		LeaseTransitions:     &transitions,
+	}
+	// the update fails with a conflict if another upgrade took the lock in the meantime
+	_, err = leases.Update(context.TODO(), lease, metav1.UpdateOptions{})
+	return err
+}
+
+func expired(spec coordinationv1.LeaseSpec) bool {
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second).Before(time.Now())
+}
+
+// renew renews the lease, the lock is lost if another upgrade took it over or if it wasn't renewed
+// for a lease duration, another upgrade may have taken over the expired lease then.
+func (l *Lock) renew(ctx context.Context) {
+	if err := l.tryRenew(ctx); err != nil {
+		if ctx.Err() != nil {
+			// released meanwhile
+			return
+		}
+		if err == ErrLost || time.Since(l.renewed) >= l.options.LeaseDuration {
+			klog.Errorf("lock %s/%s lost: %v, stopping the run", l.options.Namespace, l.options.Name, err)
+			l.lost()
+			l.cancel()
+			return
+		}
+		klog.Errorf("renew lock %s/%s failed: %v", l.options.Namespace, l.options.Name, err)
+		return
+	}
+	l.renewed = time.Now()
+}
+
+func (l *Lock) tryRenew(ctx context.Context) error {
+	leases := l.client.CoordinationV1().Leases(l.options.Namespace)
+	lease, err := leases.Get(ctx, l.options.Name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return ErrLost
+		}
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.options.Identity {
+		klog.Errorf("lock %s/%s was taken over by another upgrade", l.options.Namespace, l.options.Name)
+		return ErrLost
+	}
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// Holder returns the identity of the live holder of the lock, it's empty if the lock is free or its
+// lease expired, e.g. because its holder crashed.
+func Holder(client kubernetes.Interface, options Options) (string, error) {
+	l := New(client, options)
+	lease, err := client.CoordinationV1().Leases(l.options.Namespace).Get(context.TODO(), l.options.Name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if lease.Spec.HolderIdentity == nil || expired(lease.Spec) {
+		return "", nil
+	}
+	return *lease.Spec.HolderIdentity, nil
+}
+
+// Release stops renewing the lock and gives it up if it's still held.
+func (l *Lock) Release() error {
+	if l.cancel != nil {
+		l.cancel()
+	}
+
+	leases := l.client.CoordinationV1().Leases(l.options.Namespace)
+	lease, err := leases.Get(context.TODO(), l.options.Name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.options.Identity {
+		return nil
+	}
+	return leases.Delete(context.TODO(), l.options.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+}
@@ -0,0 +1,123 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func lease(holder string, renewed time.Time) *coordinationv1.Lease {
+	durationSeconds := int32(DefaultLeaseDuration.Seconds())
+	renewTime := metav1.NewMicroTime(renewed)
+	transitions := int32(1)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultName, Namespace: DefaultNamespace},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &durationSeconds,
+			AcquireTime:          &renewTime,
+			RenewTime:            &renewTime,
+			LeaseTransitions:     &transitions,
+		},
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	tests := []struct {
+		name        string
+		lease       *coordinationv1.Lease
+		steal       bool
+		held        bool
+		transitions int32
+	}{
+		{name: "free"},
+		{name: "held", lease: lease("other", time.Now()), held: true},
+		{name: "expired", lease: lease("other", time.Now().Add(-2*DefaultLeaseDuration)), transitions: 2},
+		{name: "released", lease: lease("", time.Now()), transitions: 2},
+		{name: "stolen", lease: lease("other", time.Now()), steal: true, transitions: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			if test.lease != nil {
+				client = fake.NewSimpleClientset(test.lease)
+			}
+			l := New(client, Options{Identity: "upgrade", Steal: test.steal})
+			err := l.Acquire()
+			if test.held {
+				if _, ok := err.(*HeldError); !ok {
+					t.Fatalf("Acquire() = %v, expected the lock to be held", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Release()
+
+			acquired, err := client.CoordinationV1().Leases(DefaultNamespace).Get(context.TODO(), DefaultName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *acquired.Spec.HolderIdentity != "upgrade" {
+				t.Errorf("the lock is held by %s", *acquired.Spec.HolderIdentity)
+			}
+			if test.transitions > 0 && *acquired.Spec.LeaseTransitions != test.transitions {
+				t.Errorf("the lease has %d transitions, expected %d", *acquired.Spec.LeaseTransitions, test.transitions)
+			}
+			if holder, err := Holder(client, Options{}); err != nil || holder != "upgrade" {
+				t.Errorf("Holder() = %s, %v", holder, err)
+			}
+		})
+	}
+}
+
+func TestLost(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	l := New(client, Options{Identity: "upgrade"})
+	if err := l.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+
+	l.renew(context.TODO())
+	if l.Err() != nil {
+		t.Fatalf("the lock is lost after a renewal: %v", l.Err())
+	}
+
+	if _, err := client.CoordinationV1().Leases(DefaultNamespace).Update(context.TODO(), lease("other", time.Now()), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	l.renew(context.TODO())
+	if l.Err() != ErrLost || l.Context().Err() == nil {
+		t.Errorf("the lock isn't lost once it's taken over: %v", l.Err())
+	}
+}
+
+func TestRelease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	l := New(client, Options{Identity: "upgrade"})
+	if err := l.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoordinationV1().Leases(DefaultNamespace).Get(context.TODO(), DefaultName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("the lease isn't deleted: %v", err)
+	}
+
+	// the lease of another holder is left alone
+	client = fake.NewSimpleClientset(lease("other", time.Now()))
+	if err := New(client, Options{Identity: "upgrade"}).Release(); err != nil {
+		t.Fatal(err)
+	}
+	if holder, err := Holder(client, Options{}); err != nil || holder != "other" {
+		t.Errorf("Holder() = %s, %v, expected the lock to be kept by other", holder, err)
+	}
+}
@@ -0,0 +1,430 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	legacyGroup   = "logging.kubesphere.io"
+	legacyVersion = "v1alpha2"
+	group         = "fluentbit.fluent.io"
+	version       = "v1alpha2"
+
+	DefaultNamespace = "kubesphere-logging-system"
+
+	// MigratedFromAnnotation is set on the new objects to the legacy object they were translated from.
+	MigratedFromAnnotation = "ks-upgrade.kubesphere.io/migrated-from"
+)
+
+// labelRenames are the labels of the legacy objects and their equivalent, the fluent-bit configurations
+// select the plugins with them.
+var labelRenames = map[string]string{
+	"logging.kubesphere.io/enabled":   "fluentbit.fluent.io/enabled",
+	"logging.kubesphere.io/component": "fluentbit.fluent.io/component",
+}
+
+// kind is a legacy kind and the kind it's translated to.
+type kind struct {
+	legacyKind     string
+	legacyResource string
+	kind           string
+	resource       string
+	// plugins are the plugin fields of the spec known to have an equivalent, empty for the kinds without plugins
+	plugins []string
+}
+
+var kinds = []kind{
+	{legacyKind: "Input", legacyResource: "inputs", kind: "ClusterInput", resource: "clusterinputs",
+		plugins: []string{"tail", "systemd", "dummy"}},
+	{legacyKind: "Filter", legacyResource: "filters", kind: "ClusterFilter", resource: "clusterfilters",
+		plugins: []string{"grep", "recordModifier", "kubernetes", "modify", "nest", "parser", "lua", "throttle", "aws", "multiline"}},
+	{legacyKind: "Output", legacyResource: "outputs", kind: "ClusterOutput", resource: "clusteroutputs",
+		plugins: []string{"es", "kafka", "forward", "http", "loki", "null", "stdout", "tcp", "file", "syslog", "opensearch"}},
+	{legacyKind: "FluentBitConfig", legacyResource: "fluentbitconfigs", kind: "ClusterFluentBitConfig", resource: "clusterfluentbitconfigs"},
+}
+
+// commonFields are the fields of the specs which aren't plugins.
+var commonFields = []string{"match", "matchRegex", "alias", "logLevel", "service", "inputSelector", "filterSelector", "outputSelector", "parserSelector", "namespace"}
+
+// Options are the parameters of the logging migration.
+type Options struct {
+	// Namespace is where fluentbit-operator kept the legacy objects.
+	Namespace string `json:"namespace,omitempty"`
+	// TargetNamespace is where fluent-operator runs fluent-bit, the Secrets the outputs refer to are
+	// copied there if it's another namespace.
+	TargetNamespace string `json:"targetNamespace,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{Namespace: DefaultNamespace, TargetNamespace: DefaultNamespace}
+}
+
+type loggingTask struct {
+	client  kubernetes.Interface
+	applier *task.Applier
+	dryRun  bool
+	options *Options
+
+	task.WarningList
+}
+
+// NewLoggingTask creates the task translating the pipeline of fluentbit-operator, the Inputs, Filters,
+// Outputs and FluentBitConfigs, to the cluster-wide objects of fluent-operator. The legacy objects are
+// kept, they're removed with fluentbit-operator once the new pipeline ships the logs.
+func NewLoggingTask(client kubernetes.Interface, options *task.Options, loggingOptions *Options) task.UpgradeTask {
+	return &loggingTask{client: client, applier: task.NewApplier(client, options), dryRun: options.DryRun, options: loggingOptions}
+}
+
+func (t *loggingTask) Name() string {
+	return "logging-migrate"
+}
+
+func (t *loggingTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+func (t *loggingTask) Plan() ([]task.Change, error) {
+	t.ResetWarnings()
+	changes := make([]task.Change, 0)
+	// the Secrets copied by this plan, several outputs may refer to the same Secret
+	copied := make(map[string]string)
+	for _, k := range kinds {
+		legacy, err := task.ListObjects(t.client, task.CollectionPath(legacyGroup, legacyVersion, k.legacyResource, t.options.Namespace), "", "")
+		if err != nil {
+			if errors.IsNotFound(err) {
+				klog.Infof("%s.%s is not served, skipping it.", k.legacyResource, legacyGroup)
+				continue
+			}
+			return nil, err
+		}
+	objects:
+		for _, object := range legacy {
+			name := fmt.Sprintf("%s %s/%s", k.legacyKind, object.GetNamespace(), object.GetName())
+			translated, err := translate(k, object)
+			if err != nil {
+				t.Warn("%s can't be translated, it's left as it is: %v", name, err)
+				continue
+			}
+			dependsOn := make([]string, 0)
+			for _, secret := range secretRefs(translated.Object) {
+				key, ok := copied[secret]
+				if !ok {
+					change, err := t.copySecret(secret)
+					if err != nil {
+						// without its credentials the output would drop the logs
+						t.Warn("%s can't be translated, Secret %s/%s it refers to can't be copied: %v", name, t.options.Namespace, secret, err)
+						continue objects
+					}
+					if change != nil {
+						changes = append(changes, *change)
+						key = change.Key()
+					}
+					copied[secret] = key
+				}
+				if key != "" && !task.InSlice(key, dependsOn) {
+					dependsOn = append(dependsOn, key)
+				}
+			}
+
+			change, err := t.change(k, name, translated)
+			if err != nil {
+				return nil, err
+			}
+			if change == nil {
+				continue
+			}
+			change.DependsOn = dependsOn
+			changes = append(changes, *change)
+			if t.dryRun {
+				generated, err := yaml.JSONToYAML(change.Object)
+				if err != nil {
+					return nil, err
+				}
+				klog.Infof("dry-run: %s translated from %s:\n%s", k.kind, name, generated)
+			}
+		}
+	}
+	return changes, nil
+}
+
+// translate returns the cluster-wide object of a legacy object. The plugins keep their fields, the
+// labels the fluent-bit configurations select them with are renamed.
+func translate(k kind, legacy *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	spec, _, err := unstructured.NestedMap(legacy.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	if err := checkPlugins(k, spec); err != nil {
+		return nil, err
+	}
+	for _, selector := range []string{"inputSelector", "filterSelector", "outputSelector", "parserSelector"} {
+		if labels, found, _ := unstructured.NestedStringMap(spec, selector, "matchLabels"); found {
+			if err := unstructured.SetNestedStringMap(spec, renameLabels(labels), selector, "matchLabels"); err != nil {
+				return nil, err
+			}
+		}
+		if expressions, found, _ := unstructured.NestedSlice(spec, selector, "matchExpressions"); found {
+			for _, e := range expressions {
+				if expression, ok := e.(map[string]interface{}); ok {
+					if key, ok := expression["key"].(string); ok && labelRenames[key] != "" {
+						expression["key"] = labelRenames[key]
+					}
+				}
+			}
+			if err := unstructured.SetNestedSlice(spec, expressions, selector, "matchExpressions"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	object := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	object.SetAPIVersion(group + "/" + version)
+	object.SetKind(k.kind)
+	object.SetName(legacy.GetName())
+	object.SetLabels(renameLabels(legacy.GetLabels()))
+	object.SetAnnotations(map[string]string{MigratedFromAnnotation: fmt.Sprintf("%s/%s", legacy.GetNamespace(), legacy.GetName())})
+	return object, nil
+}
+
+// checkPlugins checks every field of the spec is known to have an equivalent, a plugin which
+// doesn't would be dropped and the logs it ships lost.
+func checkPlugins(k kind, spec map[string]interface{}) error {
+	unknown := make([]string, 0)
+	for field, value := range spec {
+		if task.InSlice(field, commonFields) || task.InSlice(field, k.plugins) {
+			continue
+		}
+		// the filters of a Filter are a list of plugins
+		if field == "filters" && k.legacyKind == "Filter" {
+			filters, _ := value.([]interface{})
+			for _, f := range filters {
+				plugin, _ := f.(map[string]interface{})
+				for name := range plugin {
+					if !task.InSlice(name, k.plugins) {
+						unknown = append(unknown, "filters."+name)
+					}
+				}
+			}
+			continue
+		}
+		unknown = append(unknown, field)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("no equivalent of %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func renameLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	renamed := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if to, ok := labelRenames[k]; ok {
+			k = to
+		}
+		renamed[k] = v
+	}
+	return renamed
+}
+
+// secretRefs returns the names of the Secrets an object refers to, the plugins refer to them by
+// valueFrom.secretKeyRef wherever they take a credential.
+func secretRefs(v interface{}) []string {
+	names := make([]string, 0)
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if name, found, _ := unstructured.NestedString(value, "valueFrom", "secretKeyRef", "name"); found && name != "" {
+			names = append(names, name)
+		}
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if k != "valueFrom" {
+				names = append(names, secretRefs(value[k])...)
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			names = append(names, secretRefs(item)...)
+		}
+	}
+	return names
+}
+
+// copySecret returns the creation of the copy of a Secret in the target namespace, nothing if it's
+// the namespace of the legacy objects or the copy exists.
+func (t *loggingTask) copySecret(name string) (*task.Change, error) {
+	if t.options.TargetNamespace == t.options.Namespace {
+		return nil, nil
+	}
+	if _, err := t.client.CoreV1().Secrets(t.options.TargetNamespace).Get(context.TODO(), name, metav1.GetOptions{}); err == nil {
+		return nil, nil
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	secret, err := t.client.CoreV1().Secrets(t.options.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	secretCopy := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: t.options.TargetNamespace, Labels: renameLabels(secret.Labels)},
+		Type:       secret.Type,
+		Data:       secret.Data,
+	}
+	marshal, err := json.Marshal(secretCopy)
+	if err != nil {
+		return nil, err
+	}
+	return &task.Change{
+		Operation:   task.OperationCreate,
+		Path:        task.CollectionPath("", "v1", "secrets", t.options.TargetNamespace),
+		Name:        name,
+		Object:      marshal,
+		Description: fmt.Sprintf("copy Secret %s/%s to %s for fluent-bit", t.options.Namespace, name, t.options.TargetNamespace),
+		Redact:      []string{"data"},
+	}, nil
+}
+
+// change returns the creation of a translated object, or its update if it was translated before from
+// a legacy object which changed since. An object of the same name created otherwise is left as it is.
+func (t *loggingTask) change(k kind, name string, translated *unstructured.Unstructured) (*task.Change, error) {
+	path := task.CollectionPath(group, version, k.resource, "")
+	existing, err := t.get(path, translated.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		marshal, err := translated.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		return &task.Change{
+			Operation:   task.OperationCreate,
+			Path:        path,
+			Name:        translated.GetName(),
+			Object:      marshal,
+			Description: fmt.Sprintf("translate %s to %s %s", name, k.kind, translated.GetName()),
+		}, nil
+	}
+
+	if existing.GetAnnotations()[MigratedFromAnnotation] != translated.GetAnnotations()[MigratedFromAnnotation] {
+		t.Warn("%s can't be translated, %s %s already exists and wasn't translated from it", name, k.kind, translated.GetName())
+		return nil, nil
+	}
+	updated := existing.DeepCopy()
+	updated.Object["spec"] = translated.Object["spec"]
+	updated.SetLabels(translated.GetLabels())
+	if reflect.DeepEqual(existing.Object, updated.Object) {
+		return nil, nil
+	}
+	original, err := existing.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	modified, err := updated.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patch, err := task.CreateMergePatch(original, modified)
+	if err != nil {
+		return nil, err
+	}
+	return &task.Change{
+		Operation:       task.OperationUpdate,
+		Path:            path,
+		Name:            updated.GetName(),
+		ResourceVersion: updated.GetResourceVersion(),
+		Object:          modified,
+		Patch:           patch,
+		Description:     fmt.Sprintf("update %s %s, %s changed since it was translated", k.kind, updated.GetName(), name),
+	}, nil
+}
+
+func (t *loggingTask) get(path, name string) (*unstructured.Unstructured, error) {
+	raw, err := t.client.Discovery().RESTClient().Get().AbsPath(path, name).DoRaw(context.TODO())
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// Verify checks every legacy object which can be translated has its translation, and the Secrets
+// of the outputs exist in the target namespace, so that no log is lost once fluentbit-operator is gone.
+func (t *loggingTask) Verify() error {
+	errs := make([]error, 0)
+	for _, k := range kinds {
+		legacy, err := task.ListObjects(t.client, task.CollectionPath(legacyGroup, legacyVersion, k.legacyResource, t.options.Namespace), "", "")
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		for _, object := range legacy {
+			translated, err := translate(k, object)
+			if err != nil {
+				// reported by the plan, the object is left to be handled manually
+				continue
+			}
+			existing, err := t.get(task.CollectionPath(group, version, k.resource, ""), translated.GetName())
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				errs = append(errs, fmt.Errorf("%s %s/%s has no %s", k.legacyKind, object.GetNamespace(), object.GetName(), k.kind))
+				continue
+			}
+			for _, secret := range secretRefs(existing.Object) {
+				if _, err := t.client.CoreV1().Secrets(t.options.TargetNamespace).Get(context.TODO(), secret, metav1.GetOptions{}); err != nil {
+					errs = append(errs, fmt.Errorf("%s %s refers to Secret %s/%s: %v", k.kind, existing.GetName(), t.options.TargetNamespace, secret, err))
+				}
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (t *loggingTask) RequiredPermissions() []task.Permission {
+	permissions := []task.Permission{
+		{Group: "", Version: "v1", Resource: "secrets", Verbs: []string{"get", "create"}},
+	}
+	for _, k := range kinds {
+		permissions = append(permissions,
+			task.Permission{Group: legacyGroup, Version: legacyVersion, Resource: k.legacyResource, Verbs: []string{"list"}, Optional: true},
+			task.Permission{Group: group, Version: version, Resource: k.resource, Verbs: []string{"get", "create", "update"}, Optional: true})
+	}
+	return permissions
+}
@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCheckPlugins(t *testing.T) {
+	input, filter, output := kinds[0], kinds[1], kinds[2]
+	tests := []struct {
+		name string
+		kind kind
+		spec map[string]interface{}
+		// unknown are the fields reported without equivalent
+		unknown string
+	}{
+		{
+			name: "known input",
+			kind: input,
+			spec: map[string]interface{}{"tail": map[string]interface{}{"path": "/var/log/containers/*.log"}},
+		},
+		{
+			name: "known filters",
+			kind: filter,
+			spec: map[string]interface{}{"match": "kube.*", "filters": []interface{}{
+				map[string]interface{}{"kubernetes": map[string]interface{}{}},
+				map[string]interface{}{"modify": map[string]interface{}{}},
+			}},
+		},
+		{
+			name: "unknown filter",
+			kind: filter,
+			spec: map[string]interface{}{"filters": []interface{}{
+				map[string]interface{}{"kubeedge": map[string]interface{}{}},
+			}},
+			unknown: "filters.kubeedge",
+		},
+		{
+			name:    "unknown outputs",
+			kind:    output,
+			spec:    map[string]interface{}{"match": "*", "es": map[string]interface{}{}, "splunk": map[string]interface{}{}, "datadog": map[string]interface{}{}},
+			unknown: "datadog, splunk",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkPlugins(test.kind, test.spec)
+			if test.unknown == "" {
+				if err != nil {
+					t.Errorf("checkPlugins() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasSuffix(err.Error(), test.unknown) {
+				t.Errorf("checkPlugins() = %v, expected no equivalent of %s", err, test.unknown)
+			}
+		})
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	legacy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"service": map[string]interface{}{"parsersFile": "parsers.conf"},
+			"inputSelector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{"logging.kubesphere.io/enabled": "true"},
+			},
+			"filterSelector": map[string]interface{}{
+				"matchExpressions": []interface{}{
+					map[string]interface{}{"key": "logging.kubesphere.io/component", "operator": "In", "values": []interface{}{"logging"}},
+				},
+			},
+		},
+	}}
+	legacy.SetNamespace(DefaultNamespace)
+	legacy.SetName("fluent-bit-config")
+	legacy.SetLabels(map[string]string{"app.kubernetes.io/name": "fluent-bit", "logging.kubesphere.io/enabled": "true"})
+
+	translated, err := translate(kinds[3], legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if translated.GetKind() != "ClusterFluentBitConfig" || translated.GetNamespace() != "" {
+		t.Errorf("translated to %s in namespace %q", translated.GetKind(), translated.GetNamespace())
+	}
+	expectedLabels := map[string]string{"app.kubernetes.io/name": "fluent-bit", "fluentbit.fluent.io/enabled": "true"}
+	if !reflect.DeepEqual(translated.GetLabels(), expectedLabels) {
+		t.Errorf("labels are %v, expected %v", translated.GetLabels(), expectedLabels)
+	}
+	if labels, _, _ := unstructured.NestedStringMap(translated.Object, "spec", "inputSelector", "matchLabels"); !reflect.DeepEqual(labels, map[string]string{"fluentbit.fluent.io/enabled": "true"}) {
+		t.Errorf("input selector is %v", labels)
+	}
+	expressions, _, _ := unstructured.NestedSlice(translated.Object, "spec", "filterSelector", "matchExpressions")
+	if len(expressions) != 1 || expressions[0].(map[string]interface{})["key"] != "fluentbit.fluent.io/component" {
+		t.Errorf("filter selector expressions are %v", expressions)
+	}
+	if from := translated.GetAnnotations()[MigratedFromAnnotation]; from != DefaultNamespace+"/fluent-bit-config" {
+		t.Errorf("migrated from %q", from)
+	}
+
+	legacy.Object["spec"] = map[string]interface{}{"splunk": map[string]interface{}{}}
+	if _, err := translate(kinds[2], legacy); err == nil {
+		t.Errorf("an output without equivalent was translated")
+	}
+}
@@ -0,0 +1,203 @@
+package multicluster
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	group    = "cluster.kubesphere.io"
+	version  = "v1alpha1"
+	resource = "clusters"
+
+	// HostClusterLabel marks the Cluster object of the host cluster.
+	HostClusterLabel = "cluster-role.kubesphere.io/host"
+	// DefaultHostCluster is the name of the host cluster when it has no Cluster object.
+	DefaultHostCluster = "host"
+
+	// FailurePolicyStop stops the run at the first cluster failing, the clusters after it are left as they are.
+	FailurePolicyStop = "Stop"
+	// FailurePolicyContinue runs the remaining clusters after a failure and reports all the failures at the end.
+	FailurePolicyContinue = "Continue"
+
+	connectionTypeProxy = "proxy"
+)
+
+// Options are the parameters of the runs fanning out to the member clusters.
+type Options struct {
+	// FailurePolicy is what happens to the remaining clusters when a cluster fails, Stop or Continue.
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+	// Clusters restricts the run to these member clusters, all the ready members if empty.
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{FailurePolicy: FailurePolicyStop}
+}
+
+func (o *Options) Validate() error {
+	if o.FailurePolicy != FailurePolicyStop && o.FailurePolicy != FailurePolicyContinue {
+		return fmt.Errorf("unknown failure policy %q, one of: %s, %s", o.FailurePolicy, FailurePolicyStop, FailurePolicyContinue)
+	}
+	return nil
+}
+
+// Cluster is a cluster the tasks run against.
+type Cluster struct {
+	Name   string
+	Client kubernetes.Interface
+	// Kubeconfig is the kubeconfig stored in the Cluster object, it's empty for the host cluster.
+	Kubeconfig []byte
+}
+
+// Skipped is a member cluster the tasks don't run against.
+type Skipped struct {
+	Name   string
+	Reason string
+}
+
+func path() string {
+	return task.CollectionPath(group, version, resource, "")
+}
+
+// HostName returns the name of the Cluster object of the host cluster.
+func HostName(hostClient kubernetes.Interface) (string, error) {
+	hosts, err := task.ListObjects(hostClient, path(), HostClusterLabel, "")
+	if err != nil {
+		return "", err
+	}
+	if len(hosts) == 0 {
+		return DefaultHostCluster, nil
+	}
+	return hosts[0].GetName(), nil
+}
+
+// Members lists the Cluster objects on the host and returns a client for every ready member cluster
+// by name, along with the members which aren't ready or can't be reached.
+func Members(hostClient kubernetes.Interface, options *Options) ([]*Cluster, []Skipped, error) {
+	objects, err := task.ListObjects(hostClient, path(), "", "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("list clusters failed: %v", err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].GetName() < objects[j].GetName() })
+
+	found := make(map[string]bool)
+	members := make([]*Cluster, 0)
+	skipped := make([]Skipped, 0)
+	for _, object := range objects {
+		if _, ok := object.GetLabels()[HostClusterLabel]; ok {
+			continue
+		}
+		if len(options.Clusters) > 0 && !task.InSlice(object.GetName(), options.Clusters) {
+			continue
+		}
+		found[object.GetName()] = true
+		if reason := notReady(object); reason != "" {
+			skipped = append(skipped, Skipped{Name: object.GetName(), Reason: reason})
+			continue
+		}
+		member, err := newCluster(object)
+		if err != nil {
+			skipped = append(skipped, Skipped{Name: object.GetName(), Reason: err.Error()})
+			continue
+		}
+		members = append(members, member)
+	}
+	for _, name := range options.Clusters {
+		if !found[name] {
+			skipped = append(skipped, Skipped{Name: name, Reason: "no member cluster has this name"})
+		}
+	}
+	return members, skipped, nil
+}
+
+// Member returns the client of a single member cluster.
+func Member(hostClient kubernetes.Interface, name string) (*Cluster, error) {
+	raw, err := hostClient.Discovery().RESTClient().Get().AbsPath(path(), name).DoRaw(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return newCluster(object)
+}
+
+// notReady returns why a member cluster isn't ready, it's empty when it is.
+func notReady(object *unstructured.Unstructured) string {
+	if enabled, ok, _ := unstructured.NestedBool(object.Object, "spec", "enable"); ok && !enabled {
+		return "the cluster is disabled"
+	}
+	conditions, _, _ := unstructured.NestedSlice(object.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != "Ready" {
+			continue
+		}
+		if condition["status"] == "True" {
+			return ""
+		}
+		return fmt.Sprintf("the cluster isn't ready: %v", condition["message"])
+	}
+	return "the cluster has no Ready condition"
+}
+
+// newCluster builds the client of a member cluster from the kubeconfig stored in its Cluster object. A
+// cluster connected through the proxy is reached at the endpoint the proxy opened for it.
+func newCluster(object *unstructured.Unstructured) (*Cluster, error) {
+	encoded, _, _ := unstructured.NestedString(object.Object, "spec", "connection", "kubeconfig")
+	if encoded == "" {
+		return nil, fmt.Errorf("cluster %s has no kubeconfig", object.GetName())
+	}
+	kubeconfig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode the kubeconfig of cluster %s failed: %v", object.GetName(), err)
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("parse the kubeconfig of cluster %s failed: %v", object.GetName(), err)
+	}
+	connectionType, _, _ := unstructured.NestedString(object.Object, "spec", "connection", "type")
+	if connectionType == connectionTypeProxy {
+		endpoint, _, _ := unstructured.NestedString(object.Object, "spec", "connection", "kubernetesAPIEndpoint")
+		if endpoint == "" {
+			return nil, fmt.Errorf("the proxy of cluster %s isn't established yet", object.GetName())
+		}
+		config.Host = endpoint
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{Name: object.GetName(), Client: client, Kubeconfig: kubeconfig}, nil
+}
+
+// ReportSinks returns the report sinks of the run of a cluster, the files are suffixed by the name of the
+// cluster so that the reports of the clusters don't overwrite each other. The record names the cluster.
+func ReportSinks(sinks []string, cluster string) []string {
+	clusterSinks := make([]string, 0, len(sinks))
+	for _, sink := range sinks {
+		if strings.HasPrefix(sink, "file:") {
+			sink = "file:" + ClusterFile(strings.TrimPrefix(sink, "file:"), cluster)
+		}
+		clusterSinks = append(clusterSinks, sink)
+	}
+	return clusterSinks
+}
+
+// ClusterFile returns the file of a cluster, file suffixed by the name of the cluster before its extension.
+func ClusterFile(file, cluster string) string {
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(file, ext), cluster, ext)
+}
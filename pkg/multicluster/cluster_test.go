@@ -0,0 +1,215 @@
+package multicluster
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: member
+  cluster:
+    server: https://member.example.com:6443
+users:
+- name: admin
+  user:
+    token: token
+contexts:
+- name: member
+  context:
+    cluster: member
+    user: admin
+current-context: member
+`
+
+// newTestClient returns a client of a server serving the Cluster objects, the label selector only
+// selects the host cluster.
+func newTestClient(t *testing.T, clusters ...map[string]interface{}) *kubernetes.Clientset {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		items := make([]interface{}, 0, len(clusters))
+		for _, cluster := range clusters {
+			metadata := cluster["metadata"].(map[string]interface{})
+			if r.URL.Path == path()+"/"+metadata["name"].(string) {
+				_ = json.NewEncoder(w).Encode(cluster)
+				return
+			}
+			labels, _ := metadata["labels"].(map[string]interface{})
+			if _, host := labels[HostClusterLabel]; r.URL.Query().Get("labelSelector") == HostClusterLabel && !host {
+				continue
+			}
+			items = append(items, cluster)
+		}
+		if r.URL.Path != path() {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"apiVersion": group + "/" + version, "kind": "ClusterList", "items": items})
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// testCluster returns a Cluster object, its Ready condition is left out if ready is empty.
+func testCluster(name, ready string, connection map[string]interface{}) map[string]interface{} {
+	cluster := map[string]interface{}{
+		"apiVersion": group + "/" + version,
+		"kind":       "Cluster",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       map[string]interface{}{"connection": connection},
+	}
+	if ready != "" {
+		cluster["status"] = map[string]interface{}{"conditions": []interface{}{
+			map[string]interface{}{"type": "Ready", "status": ready, "message": "cluster is unreachable"},
+		}}
+	}
+	return cluster
+}
+
+func connection(kubeconfig string, extra ...string) map[string]interface{} {
+	c := map[string]interface{}{"kubeconfig": kubeconfig}
+	for i := 0; i+1 < len(extra); i += 2 {
+		c[extra[i]] = extra[i+1]
+	}
+	return c
+}
+
+func host(cluster *Cluster) string {
+	return cluster.Client.Discovery().RESTClient().Get().URL().Host
+}
+
+func TestMembers(t *testing.T) {
+	kubeconfig := base64.StdEncoding.EncodeToString([]byte(testKubeconfig))
+	hostCluster := testCluster("host", "True", connection(""))
+	hostCluster["metadata"].(map[string]interface{})["labels"] = map[string]interface{}{HostClusterLabel: ""}
+	disabled := testCluster("disabled", "True", connection(kubeconfig))
+	disabled["spec"].(map[string]interface{})["enable"] = false
+	client := newTestClient(t,
+		hostCluster,
+		testCluster("direct", "True", connection(kubeconfig, "type", "direct")),
+		testCluster("proxy", "True", connection(kubeconfig, "type", "proxy", "kubernetesAPIEndpoint", "https://10.0.0.1:6443")),
+		testCluster("proxy-pending", "True", connection(kubeconfig, "type", "proxy")),
+		disabled,
+		testCluster("unready", "False", connection(kubeconfig)),
+		testCluster("unknown", "", connection(kubeconfig)),
+		testCluster("no-kubeconfig", "True", connection("")),
+		testCluster("invalid-kubeconfig", "True", connection("not base64")),
+	)
+
+	members, skipped, err := Members(client, NewOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make(map[string]string)
+	for _, member := range members {
+		hosts[member.Name] = host(member)
+		if string(member.Kubeconfig) != testKubeconfig {
+			t.Errorf("expected the kubeconfig of %s to be kept, got %s", member.Name, member.Kubeconfig)
+		}
+	}
+	expectedHosts := map[string]string{"direct": "member.example.com:6443", "proxy": "10.0.0.1:6443"}
+	if !reflect.DeepEqual(hosts, expectedHosts) {
+		t.Errorf("expected the members %v, got %v", expectedHosts, hosts)
+	}
+
+	reasons := make(map[string]string)
+	for _, s := range skipped {
+		reasons[s.Name] = s.Reason
+	}
+	expectedReasons := map[string]string{
+		"proxy-pending":      "isn't established",
+		"disabled":           "disabled",
+		"unready":            "cluster is unreachable",
+		"unknown":            "no Ready condition",
+		"no-kubeconfig":      "has no kubeconfig",
+		"invalid-kubeconfig": "decode the kubeconfig",
+	}
+	if len(reasons) != len(expectedReasons) {
+		t.Errorf("expected the skipped clusters %v, got %v", expectedReasons, reasons)
+	}
+	for name, reason := range expectedReasons {
+		if !strings.Contains(reasons[name], reason) {
+			t.Errorf("expected %s to be skipped since %q, got %q", name, reason, reasons[name])
+		}
+	}
+
+	options := NewOptions()
+	options.Clusters = []string{"direct", "unready", "missing"}
+	members, skipped, err = Members(client, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Name != "direct" {
+		t.Errorf("expected the member direct only, got %v", members)
+	}
+	if len(skipped) != 2 || skipped[0].Name != "unready" || skipped[1].Name != "missing" {
+		t.Errorf("expected the clusters unready and missing to be skipped, got %v", skipped)
+	}
+}
+
+func TestHostName(t *testing.T) {
+	hostCluster := testCluster("kubesphere", "True", connection(""))
+	hostCluster["metadata"].(map[string]interface{})["labels"] = map[string]interface{}{HostClusterLabel: ""}
+	tests := map[string]struct {
+		client   *kubernetes.Clientset
+		expected string
+	}{
+		"labeled":   {client: newTestClient(t, testCluster("member", "True", connection("")), hostCluster), expected: "kubesphere"},
+		"no object": {client: newTestClient(t, testCluster("member", "True", connection(""))), expected: DefaultHostCluster},
+	}
+	for name, test := range tests {
+		actual, err := HostName(test.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != test.expected {
+			t.Errorf("%s: expected the host %s, got %s", name, test.expected, actual)
+		}
+	}
+}
+
+func TestMember(t *testing.T) {
+	kubeconfig := base64.StdEncoding.EncodeToString([]byte(testKubeconfig))
+	client := newTestClient(t, testCluster("member", "True", connection(kubeconfig)))
+	member, err := Member(client, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member.Name != "member" || host(member) != "member.example.com:6443" {
+		t.Errorf("expected the client of member, got %s at %s", member.Name, host(member))
+	}
+	if _, err := Member(client, "missing"); err == nil {
+		t.Errorf("expected a missing cluster to fail")
+	}
+}
+
+func TestReportSinks(t *testing.T) {
+	sinks := ReportSinks([]string{"file:/tmp/report.json", "file:report", "stdout", "https://example.com/report"}, "member")
+	expected := []string{"file:/tmp/report-member.json", "file:report-member", "stdout", "https://example.com/report"}
+	if !reflect.DeepEqual(sinks, expected) {
+		t.Errorf("expected the sinks %v, got %v", expected, sinks)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for policy, valid := range map[string]bool{FailurePolicyStop: true, FailurePolicyContinue: true, "Retry": false, "": false} {
+		options := &Options{FailurePolicy: policy}
+		if err := options.Validate(); (err == nil) != valid {
+			t.Errorf("expected the failure policy %q to be valid: %v, got %v", policy, valid, err)
+		}
+	}
+}
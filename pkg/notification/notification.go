@@ -0,0 +1,468 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	group = "notification.kubesphere.io"
+
+	DefaultTargetVersion   = "v2beta2"
+	DefaultSecretNamespace = "kubesphere-monitoring-federated"
+
+	// TypeLabel tells a global receiver from a tenant one, UserLabel is the tenant owning it.
+	TypeLabel = "type"
+	UserLabel = "user"
+
+	TypeDefault = "default"
+	TypeGlobal  = "global"
+	TypeTenant  = "tenant"
+)
+
+// Options are the parameters of the notification migration.
+type Options struct {
+	// TargetVersion is the API version the Configs and the Receivers are converted to, the CRDs of
+	// notification-manager serving it have to be installed. The objects are converted whatever version
+	// they were stored at, so that the ones kept as they were by the CRDs without conversion are too.
+	TargetVersion string `json:"targetVersion,omitempty"`
+	// SecretNamespace is where the inline credentials are moved to, notification-manager reads its Secrets there.
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{TargetVersion: DefaultTargetVersion, SecretNamespace: DefaultSecretNamespace}
+}
+
+// credentials are the paths of the credentials in the spec of the Configs and the Receivers by kind.
+var credentials = map[string][]string{
+	"Config": {
+		"email.authPassword",
+		"slack.slackTokenSecret",
+		"dingtalk.conversation.appkey",
+		"dingtalk.conversation.appsecret",
+		"wechat.wechatApiSecret",
+	},
+	"Receiver": {
+		"webhook.httpConfig.bearerToken",
+		"webhook.httpConfig.basicAuth.password",
+		"dingtalk.chatbot.webhook",
+		"dingtalk.chatbot.secret",
+	},
+}
+
+// types are the values of the type label by kind, the default Configs are the ones of the global receivers.
+var types = map[string][]string{"Config": {TypeDefault, TypeTenant}, "Receiver": {TypeGlobal, TypeTenant}}
+
+// channels are the notification channels in the spec of the Configs and the Receivers.
+var channels = []string{"email", "slack", "webhook", "dingtalk", "wechat"}
+
+// resources are the plural names of the kinds.
+var resources = map[string]string{"Config": "configs", "Receiver": "receivers"}
+
+type notificationTask struct {
+	client  kubernetes.Interface
+	applier *task.Applier
+	options *Options
+
+	task.WarningList
+}
+
+// NewNotificationTask creates the task converting the Configs and the Receivers of notification-manager
+// to the target API version, their inline credentials are moved to Secrets they refer to. The objects
+// which can't be told global from tenant ones are left as they are and reported.
+func NewNotificationTask(client kubernetes.Interface, options *task.Options, notificationOptions *Options) task.UpgradeTask {
+	return &notificationTask{client: client, applier: task.NewApplier(client, options), options: notificationOptions}
+}
+
+func (t *notificationTask) Name() string {
+	return "notification-migrate"
+}
+
+func (t *notificationTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+// list lists the objects of a kind at the target version, a kind which isn't served is empty.
+func (t *notificationTask) list(kind string) ([]*unstructured.Unstructured, error) {
+	objects, err := task.ListObjects(t.client, task.CollectionPath(group, t.options.TargetVersion, resources[kind], ""), "", "")
+	if errors.IsNotFound(err) {
+		klog.Infof("%s.%s/%s is not served, skipping it.", resources[kind], group, t.options.TargetVersion)
+		return nil, nil
+	}
+	return objects, err
+}
+
+func (t *notificationTask) Plan() ([]task.Change, error) {
+	t.ResetWarnings()
+	changes := make([]task.Change, 0)
+	for _, kind := range []string{"Config", "Receiver"} {
+		objects, err := t.list(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			objectChanges, err := t.convert(kind, object)
+			if err != nil {
+				t.Warn("%s %s: %v, it's left as it is", kind, object.GetName(), err)
+				continue
+			}
+			changes = append(changes, objectChanges...)
+		}
+	}
+	return changes, nil
+}
+
+// convert returns the changes converting an object, the creation or the update of the Secret
+// holding its inline credentials and the update of the object depending on it.
+func (t *notificationTask) convert(kind string, object *unstructured.Unstructured) ([]task.Change, error) {
+	original := object.DeepCopy()
+	if err := convertLabels(kind, object); err != nil {
+		return nil, err
+	}
+	spec, _, err := unstructured.NestedMap(object.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+
+	secretName := fmt.Sprintf("%s-%s-credentials", strings.ToLower(kind), object.GetName())
+	data := make(map[string][]byte)
+	for _, path := range credentials[kind] {
+		fields := strings.Split(path, ".")
+		value, found, err := unstructured.NestedFieldNoCopy(spec, fields...)
+		if err != nil || !found {
+			continue
+		}
+		credential, inline, err := t.credential(value, secretName, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if inline != nil {
+			data[path] = inline
+		}
+		if err := unstructured.SetNestedField(spec, credential, fields...); err != nil {
+			return nil, err
+		}
+	}
+	if kind == "Receiver" {
+		if err := splitRecipients(spec); err != nil {
+			return nil, err
+		}
+		if err := convertSelectors(spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := unstructured.SetNestedMap(object.Object, spec, "spec"); err != nil {
+		return nil, err
+	}
+
+	if reflect.DeepEqual(original.Object, object.Object) {
+		return nil, nil
+	}
+
+	changes := make([]task.Change, 0, 2)
+	var dependsOn []string
+	if len(data) > 0 {
+		secretChange, err := t.secret(object, secretName, data)
+		if err != nil {
+			return nil, err
+		}
+		if secretChange != nil {
+			changes = append(changes, *secretChange)
+			dependsOn = []string{secretChange.Key()}
+		}
+	}
+
+	originalJSON, err := original.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	modified, err := object.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patch, err := task.CreateMergePatch(originalJSON, modified)
+	if err != nil {
+		return nil, err
+	}
+	description := fmt.Sprintf("convert %s %s to %s/%s", kind, object.GetName(), group, t.options.TargetVersion)
+	if len(data) > 0 {
+		paths := make([]string, 0, len(data))
+		for path := range data {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		description = fmt.Sprintf("%s, moving the inline credentials %s to Secret %s/%s", description, strings.Join(paths, ", "), t.options.SecretNamespace, secretName)
+	}
+	// the original object holds the inline credentials, a rollback restores them from the state Secret
+	redact := make([]string, 0, len(credentials[kind]))
+	for _, path := range credentials[kind] {
+		redact = append(redact, "spec."+path)
+	}
+	return append(changes, task.Change{
+		Operation:       task.OperationUpdate,
+		Path:            task.CollectionPath(group, t.options.TargetVersion, resources[kind], ""),
+		Name:            object.GetName(),
+		ResourceVersion: object.GetResourceVersion(),
+		Object:          modified,
+		Patch:           patch,
+		DependsOn:       dependsOn,
+		Description:     description,
+		Redact:          redact,
+		RestoreRedacted: true,
+	}), nil
+}
+
+// credential converts a credential to a reference to the key of a Secret, an inline credential
+// is returned to be moved to the key named after its path in the Secret of the object.
+// The credentials of v2alpha1 are selectors of the key of a Secret.
+func (t *notificationTask) credential(value interface{}, secretName, path string) (map[string]interface{}, []byte, error) {
+	reference := func(namespace, name, key interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"valueFrom": map[string]interface{}{
+				"secretKeyRef": map[string]interface{}{"namespace": namespace, "name": name, "key": key},
+			},
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return reference(t.options.SecretNamespace, secretName, path), []byte(v), nil
+	case map[string]interface{}:
+		if _, ok := v["valueFrom"]; ok {
+			return v, nil, nil
+		}
+		if inline, ok := v["value"].(string); ok {
+			return reference(t.options.SecretNamespace, secretName, path), []byte(inline), nil
+		}
+		name, hasName := v["name"].(string)
+		key, hasKey := v["key"].(string)
+		if hasName && hasKey {
+			namespace, _ := v["namespace"].(string)
+			if namespace == "" {
+				namespace = t.options.SecretNamespace
+			}
+			return reference(namespace, name, key), nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unknown credential format %v", value)
+}
+
+// splitRecipients converts the recipients of the wechat receivers, a string of names separated by |
+// in v2alpha1, to lists.
+func splitRecipients(spec map[string]interface{}) error {
+	for _, field := range []string{"toUser", "toParty", "toTag"} {
+		value, found, err := unstructured.NestedFieldNoCopy(spec, "wechat", field)
+		if err != nil || !found {
+			continue
+		}
+		recipients, ok := value.(string)
+		if !ok {
+			continue
+		}
+		list := make([]interface{}, 0)
+		for _, recipient := range strings.Split(recipients, "|") {
+			if recipient = strings.TrimSpace(recipient); recipient != "" {
+				list = append(list, recipient)
+			}
+		}
+		if err := unstructured.SetNestedSlice(spec, list, "wechat", field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertLabels checks the type and the user labels of an object, the global and the tenant receivers and
+// their Configs are selected by type. An object only labelled with its user is labelled as a tenant one.
+func convertLabels(kind string, object *unstructured.Unstructured) error {
+	labels := object.GetLabels()
+	typ, user := labels[TypeLabel], labels[UserLabel]
+	switch {
+	case typ == "" && user != "":
+		labels[TypeLabel] = TypeTenant
+		object.SetLabels(labels)
+	case typ == "" && kind == "Receiver":
+		return fmt.Errorf("it has neither the %s nor the %s label, it's neither a global nor a tenant receiver", TypeLabel, UserLabel)
+	case typ == TypeTenant && user == "":
+		return fmt.Errorf("it's a tenant %s without the %s label", strings.ToLower(kind), UserLabel)
+	case typ != "" && !task.InSlice(typ, types[kind]):
+		return fmt.Errorf("unknown %s label %s, expected one of %s", TypeLabel, typ, strings.Join(types[kind], ", "))
+	}
+	return nil
+}
+
+// convertSelectors converts the Config and the alert selectors of the channels of a Receiver given as maps
+// of labels to label selectors, and checks they're valid.
+func convertSelectors(spec map[string]interface{}) error {
+	for _, channel := range channels {
+		for _, field := range []string{channel + "ConfigSelector", "alertSelector"} {
+			value, found, err := unstructured.NestedFieldNoCopy(spec, channel, field)
+			if err != nil || !found || value == nil {
+				continue
+			}
+			selector, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s.%s isn't a label selector", channel, field)
+			}
+			_, hasLabels := selector["matchLabels"]
+			_, hasExpressions := selector["matchExpressions"]
+			if !hasLabels && !hasExpressions && len(selector) > 0 {
+				selector = map[string]interface{}{"matchLabels": selector}
+			}
+			labelSelector := &metav1.LabelSelector{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(selector, labelSelector); err != nil {
+				return fmt.Errorf("%s.%s: %v", channel, field, err)
+			}
+			if _, err := metav1.LabelSelectorAsSelector(labelSelector); err != nil {
+				return fmt.Errorf("%s.%s: %v", channel, field, err)
+			}
+			if err := unstructured.SetNestedField(spec, selector, channel, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// secret returns the creation of the Secret of the inline credentials of an object, or its update if it
+// already exists, e.g. from a run which failed before updating the object. The Secret has the type and the
+// user labels of the object so that a tenant keeps owning its credentials.
+func (t *notificationTask) secret(object *unstructured.Unstructured, name string, data map[string][]byte) (*task.Change, error) {
+	path := task.CollectionPath("", "v1", "secrets", t.options.SecretNamespace)
+	labels := make(map[string]string)
+	for _, label := range []string{TypeLabel, UserLabel} {
+		if value, ok := object.GetLabels()[label]; ok {
+			labels[label] = value
+		}
+	}
+
+	existing, err := t.client.CoreV1().Secrets(t.options.SecretNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		updated := existing.DeepCopy()
+		updated.APIVersion, updated.Kind = "v1", "Secret"
+		if updated.Data == nil {
+			updated.Data = make(map[string][]byte)
+		}
+		for key, value := range data {
+			updated.Data[key] = value
+		}
+		if reflect.DeepEqual(existing.Data, updated.Data) {
+			return nil, nil
+		}
+		modified, err := json.Marshal(updated)
+		if err != nil {
+			return nil, err
+		}
+		// the patch would only show the credentials, it's left empty
+		return &task.Change{
+			Operation:       task.OperationUpdate,
+			Path:            path,
+			Name:            name,
+			ResourceVersion: existing.ResourceVersion,
+			Object:          modified,
+			Description:     fmt.Sprintf("store the inline credentials of %s %s in Secret %s/%s", object.GetKind(), object.GetName(), t.options.SecretNamespace, name),
+			Redact:          []string{"data"},
+			RestoreRedacted: true,
+		}, nil
+	}
+
+	secret := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: t.options.SecretNamespace, Labels: labels},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       data,
+	}
+	marshal, err := json.Marshal(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &task.Change{
+		Operation:   task.OperationCreate,
+		Path:        path,
+		Name:        name,
+		Object:      marshal,
+		Description: fmt.Sprintf("store the inline credentials of %s %s in Secret %s/%s", object.GetKind(), object.GetName(), t.options.SecretNamespace, name),
+		Redact:      []string{"data"},
+	}, nil
+}
+
+// Verify checks every credential of the Configs and the Receivers refers to an existing key of a Secret.
+func (t *notificationTask) Verify() error {
+	errs := make([]error, 0)
+	for _, kind := range []string{"Config", "Receiver"} {
+		objects, err := t.list(kind)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			for _, path := range credentials[kind] {
+				value, found, _ := unstructured.NestedFieldNoCopy(object.Object, append([]string{"spec"}, strings.Split(path, ".")...)...)
+				if !found {
+					continue
+				}
+				if err := t.verifyCredential(value); err != nil {
+					errs = append(errs, fmt.Errorf("%s %s: %s: %v", kind, object.GetName(), path, err))
+				}
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (t *notificationTask) verifyCredential(value interface{}) error {
+	credential, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("the credential is inline")
+	}
+	if _, ok := credential["value"]; ok {
+		return fmt.Errorf("the credential is inline")
+	}
+	namespace, _, _ := unstructured.NestedString(credential, "valueFrom", "secretKeyRef", "namespace")
+	name, _, _ := unstructured.NestedString(credential, "valueFrom", "secretKeyRef", "name")
+	key, _, _ := unstructured.NestedString(credential, "valueFrom", "secretKeyRef", "key")
+	if name == "" || key == "" {
+		return fmt.Errorf("the credential doesn't refer to a Secret")
+	}
+	if namespace == "" {
+		namespace = t.options.SecretNamespace
+	}
+	secret, err := t.client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, ok := secret.Data[key]; !ok {
+		return fmt.Errorf("Secret %s/%s has no key %s", namespace, name, key)
+	}
+	return nil
+}
+
+func (t *notificationTask) RequiredPermissions() []task.Permission {
+	permissions := []task.Permission{
+		{Group: "", Version: "v1", Resource: "secrets", Verbs: []string{"get", "create", "update"}},
+	}
+	for _, kind := range []string{"Config", "Receiver"} {
+		permissions = append(permissions, task.Permission{Group: group, Version: t.options.TargetVersion, Resource: resources[kind], Verbs: []string{"list", "update"}, Optional: true})
+	}
+	return permissions
+}
@@ -0,0 +1,193 @@
+package notification
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCredential(t *testing.T) {
+	reference := func(namespace, name, key string) map[string]interface{} {
+		return map[string]interface{}{
+			"valueFrom": map[string]interface{}{
+				"secretKeyRef": map[string]interface{}{"namespace": namespace, "name": name, "key": key},
+			},
+		}
+	}
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected map[string]interface{}
+		inline   string
+		err      bool
+	}{
+		{
+			name:     "inline string",
+			value:    "token",
+			expected: reference(DefaultSecretNamespace, "config-a-credentials", "slack.slackTokenSecret"),
+			inline:   "token",
+		},
+		{
+			name:     "inline value",
+			value:    map[string]interface{}{"value": "token"},
+			expected: reference(DefaultSecretNamespace, "config-a-credentials", "slack.slackTokenSecret"),
+			inline:   "token",
+		},
+		{
+			name:     "v2alpha1 selector",
+			value:    map[string]interface{}{"name": "slack", "key": "token"},
+			expected: reference(DefaultSecretNamespace, "slack", "token"),
+		},
+		{
+			name:     "v2alpha1 selector with a namespace",
+			value:    map[string]interface{}{"namespace": "tenant", "name": "slack", "key": "token"},
+			expected: reference("tenant", "slack", "token"),
+		},
+		{
+			name:     "reference",
+			value:    reference("tenant", "slack", "token"),
+			expected: reference("tenant", "slack", "token"),
+		},
+		{
+			name:  "unknown format",
+			value: map[string]interface{}{"name": "slack"},
+			err:   true,
+		},
+		{
+			name:  "number",
+			value: int64(1),
+			err:   true,
+		},
+	}
+	task := &notificationTask{options: NewOptions()}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			credential, inline, err := task.credential(test.value, "config-a-credentials", "slack.slackTokenSecret")
+			if (err != nil) != test.err {
+				t.Fatalf("credential() failed: %v", err)
+			}
+			if !reflect.DeepEqual(credential, test.expected) {
+				t.Errorf("credential is %v, expected %v", credential, test.expected)
+			}
+			if string(inline) != test.inline {
+				t.Errorf("inline credential is %q, expected %q", inline, test.inline)
+			}
+		})
+	}
+}
+
+func TestSplitRecipients(t *testing.T) {
+	spec := map[string]interface{}{"wechat": map[string]interface{}{"toUser": "a|b| c", "toParty": []interface{}{"p"}}}
+	if err := splitRecipients(spec); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"wechat": map[string]interface{}{"toUser": []interface{}{"a", "b", "c"}, "toParty": []interface{}{"p"}}}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Errorf("spec is %v, expected %v", spec, expected)
+	}
+}
+
+func TestConvertLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		labels   map[string]string
+		expected map[string]string
+		err      bool
+	}{
+		{
+			name:     "global receiver",
+			kind:     "Receiver",
+			labels:   map[string]string{TypeLabel: TypeGlobal},
+			expected: map[string]string{TypeLabel: TypeGlobal},
+		},
+		{
+			name:     "tenant receiver labelled with its user only",
+			kind:     "Receiver",
+			labels:   map[string]string{UserLabel: "alice"},
+			expected: map[string]string{TypeLabel: TypeTenant, UserLabel: "alice"},
+		},
+		{
+			name:   "receiver without labels",
+			kind:   "Receiver",
+			labels: nil,
+			err:    true,
+		},
+		{
+			name:     "config without labels",
+			kind:     "Config",
+			labels:   nil,
+			expected: nil,
+		},
+		{
+			name:   "tenant config without user",
+			kind:   "Config",
+			labels: map[string]string{TypeLabel: TypeTenant},
+			err:    true,
+		},
+		{
+			name:   "global config",
+			kind:   "Config",
+			labels: map[string]string{TypeLabel: TypeGlobal},
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			object := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			object.SetLabels(test.labels)
+			err := convertLabels(test.kind, object)
+			if (err != nil) != test.err {
+				t.Fatalf("convertLabels() failed: %v", err)
+			}
+			if !test.err && !reflect.DeepEqual(object.GetLabels(), test.expected) {
+				t.Errorf("labels are %v, expected %v", object.GetLabels(), test.expected)
+			}
+		})
+	}
+}
+
+func TestConvertSelectors(t *testing.T) {
+	selector := map[string]interface{}{"matchLabels": map[string]interface{}{"type": "tenant", "user": "alice"}}
+	tests := []struct {
+		name     string
+		spec     map[string]interface{}
+		expected map[string]interface{}
+		err      bool
+	}{
+		{
+			name:     "map of labels",
+			spec:     map[string]interface{}{"email": map[string]interface{}{"emailConfigSelector": map[string]interface{}{"type": "tenant", "user": "alice"}}},
+			expected: map[string]interface{}{"email": map[string]interface{}{"emailConfigSelector": selector}},
+		},
+		{
+			name:     "label selector",
+			spec:     map[string]interface{}{"slack": map[string]interface{}{"alertSelector": selector}},
+			expected: map[string]interface{}{"slack": map[string]interface{}{"alertSelector": selector}},
+		},
+		{
+			name: "invalid operator",
+			spec: map[string]interface{}{"wechat": map[string]interface{}{"alertSelector": map[string]interface{}{
+				"matchExpressions": []interface{}{map[string]interface{}{"key": "severity", "operator": "Like"}},
+			}}},
+			err: true,
+		},
+		{
+			name: "not a selector",
+			spec: map[string]interface{}{"webhook": map[string]interface{}{"webhookConfigSelector": "type=tenant"}},
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := convertSelectors(test.spec)
+			if (err != nil) != test.err {
+				t.Fatalf("convertSelectors() failed: %v", err)
+			}
+			if !test.err && !reflect.DeepEqual(test.spec, test.expected) {
+				t.Errorf("spec is %v, expected %v", test.spec, test.expected)
+			}
+		})
+	}
+}
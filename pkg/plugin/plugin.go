@@ -0,0 +1,186 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	APIVersion = "ks-upgrade.kubesphere.io/v1alpha1"
+
+	ActionRun    = "run"
+	ActionVerify = "verify"
+
+	// namePrefix is trimmed from the file name of a plugin to get its task name
+	namePrefix = "ks-upgrade-"
+
+	DefaultTimeout = 30 * time.Minute
+)
+
+// Request is written to the stdin of a plugin, the plugin replies with a Response on its
+// stdout. Everything a plugin writes to its stderr is copied to the log of ks-upgrade.
+type Request struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// Action is ActionRun or ActionVerify, a plugin which can't verify replies an empty response.
+	Action string `json:"action"`
+	RunID  string `json:"runID"`
+	// DryRun asks the plugin to report its changes without applying them.
+	DryRun      bool `json:"dryRun"`
+	Concurrency int  `json:"concurrency"`
+	// Filter restricts the run to a subset of the objects, a plugin is expected to leave the others untouched.
+	Filter *task.Filter `json:"filter,omitempty"`
+	// Kubeconfig is the path of the kubeconfig file of the cluster, the plugin uses the
+	// in-cluster config if it's empty. It's also passed in the KUBECONFIG env var.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Config is the configuration of the plugin, from plugins.config.<name> of the ks-upgrade configuration.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+type Response struct {
+	// Changes is the number of objects the plugin changed, or would change in a dry run.
+	Changes int    `json:"changes,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Errors fail the action, a plugin exiting with a non-zero status fails it too.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Options configure how the plugins are discovered and run.
+type Options struct {
+	// Dir is the directory the plugins are discovered in, every executable file in it is a plugin.
+	Dir string `json:"dir,omitempty"`
+	// Timeout is how long a plugin may run for one action.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// Kubeconfig is passed to the plugins, see Request.
+	Kubeconfig string `json:"-"`
+	// Config is the configuration of every plugin by name.
+	Config map[string]json.RawMessage `json:"config,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{Timeout: metav1.Duration{Duration: DefaultTimeout}}
+}
+
+// Discover returns a task for every executable in the plugin directory, sorted by name
+// so that the plugins always run in the same order.
+func Discover(pluginOptions *Options, options *task.Options) ([]task.UpgradeTask, error) {
+	if pluginOptions.Dir == "" {
+		return nil, nil
+	}
+	entries, err := ioutil.ReadDir(pluginOptions.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("discover plugins failed: %v", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	tasks := make([]task.UpgradeTask, 0)
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || entry.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		p := &pluginTask{
+			name:          strings.TrimPrefix(entry.Name(), namePrefix),
+			path:          filepath.Join(pluginOptions.Dir, entry.Name()),
+			pluginOptions: pluginOptions,
+			options:       options,
+		}
+		klog.V(4).Infof("discovered plugin %s at %s", p.name, p.path)
+		tasks = append(tasks, p)
+	}
+	return tasks, nil
+}
+
+// pluginTask runs a plugin as an upgrade task.
+type pluginTask struct {
+	name          string
+	path          string
+	pluginOptions *Options
+	options       *task.Options
+	result        Response
+}
+
+func (p *pluginTask) Name() string {
+	return p.name
+}
+
+func (p *pluginTask) Run() error {
+	response, err := p.call(ActionRun)
+	p.result = response
+	return err
+}
+
+func (p *pluginTask) Result() (int, string) {
+	return p.result.Changes, p.result.Message
+}
+
+func (p *pluginTask) Verify() error {
+	_, err := p.call(ActionVerify)
+	return err
+}
+
+func (p *pluginTask) call(action string) (Response, error) {
+	response := Response{}
+	request, err := json.Marshal(&Request{
+		APIVersion:  APIVersion,
+		Kind:        "PluginRequest",
+		Action:      action,
+		RunID:       p.options.RunID,
+		DryRun:      p.options.DryRun,
+		Concurrency: p.options.Concurrency,
+		Filter:      p.options.Filter,
+		Kubeconfig:  p.pluginOptions.Kubeconfig,
+		Config:      p.pluginOptions.Config[p.name],
+	})
+	if err != nil {
+		return response, err
+	}
+
+	timeout := p.pluginOptions.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stdout := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, p.path, action)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if p.pluginOptions.Kubeconfig != "" {
+		cmd.Env = append(cmd.Env, "KUBECONFIG="+p.pluginOptions.Kubeconfig)
+	}
+
+	klog.V(4).Infof("calling plugin %s: %s", p.name, action)
+	runErr := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return response, fmt.Errorf("plugin %s timed out after %s", p.name, timeout)
+	}
+	if output := bytes.TrimSpace(stdout.Bytes()); len(output) > 0 {
+		if err := json.Unmarshal(output, &response); err != nil {
+			return response, fmt.Errorf("invalid response of plugin %s: %v", p.name, err)
+		}
+	}
+	if runErr != nil {
+		response.Errors = append(response.Errors, runErr.Error())
+	}
+	if len(response.Errors) > 0 {
+		return response, fmt.Errorf("plugin %s failed: %s", p.name, strings.Join(response.Errors, "; "))
+	}
+	return response, nil
+}
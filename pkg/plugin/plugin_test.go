@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+// writePlugins writes the plugins as shell scripts, the request of a plugin is saved next to it.
+func writePlugins(t *testing.T, scripts map[string]string) string {
+	dir := t.TempDir()
+	for name, script := range scripts {
+		content := "#!/bin/sh\ncat > " + filepath.Join(dir, name+".request") + "\n" + script + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a plugin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "ks-upgrade-dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestPlugins(t *testing.T) {
+	dir := writePlugins(t, map[string]string{
+		"ks-upgrade-echo": `echo '{"changes":2,"message":"done"}'`,
+		"ks-upgrade-fail": `echo '{"errors":["broken"]}'; echo 'failing' >&2; exit 1`,
+		"ks-upgrade-bad":  `echo 'not json'`,
+		"slow":            `exec sleep 5`,
+	})
+	pluginOptions := NewOptions()
+	pluginOptions.Dir = dir
+	pluginOptions.Timeout.Duration = 500 * time.Millisecond
+	pluginOptions.Config = map[string]json.RawMessage{"echo": json.RawMessage(`{"key":"value"}`)}
+	options := task.NewOptions()
+	options.DryRun = true
+
+	tasks, err := Discover(pluginOptions, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(tasks))
+	for _, p := range tasks {
+		names = append(names, task.Name(p))
+	}
+	if strings.Join(names, ",") != "bad,echo,fail,slow" {
+		t.Fatalf("discovered the plugins %v", names)
+	}
+	byName := make(map[string]*pluginTask)
+	for _, p := range tasks {
+		byName[task.Name(p)] = p.(*pluginTask)
+	}
+
+	echo := byName["echo"]
+	if err := echo.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if changes, message := echo.Result(); changes != 2 || message != "done" {
+		t.Errorf("the result is %d, %q", changes, message)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "ks-upgrade-echo.request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &Request{}
+	if err := json.Unmarshal(raw, request); err != nil {
+		t.Fatal(err)
+	}
+	if request.Action != ActionRun || request.RunID != options.RunID || !request.DryRun || string(request.Config) != `{"key":"value"}` {
+		t.Errorf("unexpected request %s", raw)
+	}
+
+	tests := map[string]string{
+		"fail": "plugin fail failed: broken; exit status 1",
+		"bad":  "invalid response of plugin bad",
+		"slow": "plugin slow timed out after 500ms",
+	}
+	for name, expected := range tests {
+		if err := byName[name].Verify(); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: Verify() = %v, expected %q", name, err, expected)
+		}
+	}
+}
+
+func TestDiscoverWithoutDir(t *testing.T) {
+	tasks, err := Discover(NewOptions(), task.NewOptions())
+	if err != nil || tasks != nil {
+		t.Errorf("Discover() = %v, %v, expected no plugin", tasks, err)
+	}
+}
@@ -0,0 +1,209 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const kubesphereNamespace = "kubesphere-system"
+
+type Status string
+
+const (
+	StatusPass Status = "PASS"
+	StatusWarn Status = "WARN"
+	StatusFail Status = "FAIL"
+)
+
+type Result struct {
+	Check   string `json:"check"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+}
+
+// Checker verifies that the cluster is ready to be upgraded by the given tasks,
+// it never mutates the cluster.
+type Checker struct {
+	client kubernetes.Interface
+	tasks  []task.UpgradeTask
+}
+
+func NewChecker(client kubernetes.Interface, tasks ...task.UpgradeTask) *Checker {
+	return &Checker{client: client, tasks: tasks}
+}
+
+func (c *Checker) Run() []Result {
+	results := make([]Result, 0)
+	results = append(results, c.checkHealth()...)
+
+	permissions := make([]task.Permission, 0)
+	for _, t := range c.tasks {
+		if requirer, ok := t.(task.PermissionRequirer); ok {
+			permissions = append(permissions, requirer.RequiredPermissions()...)
+		}
+	}
+	results = append(results, c.checkResources(permissions)...)
+	results = append(results, c.checkAccess(permissions)...)
+	results = append(results, c.checkComponents()...)
+	return results
+}
+
+// checkHealth checks the health endpoints of the apiserver and its etcd.
+func (c *Checker) checkHealth() []Result {
+	results := make([]Result, 0)
+	for _, endpoint := range []string{"/livez", "/readyz", "/readyz/etcd"} {
+		check := fmt.Sprintf("apiserver %s", endpoint)
+		_, err := c.client.Discovery().RESTClient().Get().AbsPath(endpoint).DoRaw(context.TODO())
+		if errors.IsNotFound(err) {
+			// clusters older than v1.16 only serve /healthz
+			endpoint = strings.Replace(endpoint, "/livez", "/healthz", 1)
+			endpoint = strings.Replace(endpoint, "/readyz", "/healthz", 1)
+			_, err = c.client.Discovery().RESTClient().Get().AbsPath(endpoint).DoRaw(context.TODO())
+		}
+		if err != nil {
+			results = append(results, Result{Check: check, Status: StatusFail, Message: err.Error()})
+		} else {
+			results = append(results, Result{Check: check, Status: StatusPass, Message: "ok"})
+		}
+	}
+	return results
+}
+
+// checkResources checks that every resource the tasks need is served in the expected version.
+func (c *Checker) checkResources(permissions []task.Permission) []Result {
+	results := make([]Result, 0)
+	served := make(map[string]map[string]bool)
+	for _, p := range permissions {
+		groupVersion := p.Version
+		if p.Group != "" {
+			groupVersion = fmt.Sprintf("%s/%s", p.Group, p.Version)
+		}
+		check := fmt.Sprintf("resource %s/%s", groupVersion, p.Resource)
+
+		resources, ok := served[groupVersion]
+		if !ok {
+			resources = make(map[string]bool)
+			list, err := c.client.Discovery().ServerResourcesForGroupVersion(groupVersion)
+			if err != nil && !errors.IsNotFound(err) {
+				results = append(results, Result{Check: check, Status: StatusFail, Message: err.Error()})
+				continue
+			}
+			if list != nil {
+				for _, r := range list.APIResources {
+					resources[r.Name] = true
+				}
+			}
+			served[groupVersion] = resources
+		}
+
+		if resources[p.Resource] {
+			results = append(results, Result{Check: check, Status: StatusPass, Message: "served"})
+		} else if p.Optional {
+			results = append(results, Result{Check: check, Status: StatusWarn, Message: fmt.Sprintf("%s is not served, the component is skipped", groupVersion)})
+		} else {
+			results = append(results, Result{Check: check, Status: StatusFail, Message: fmt.Sprintf("%s is not served, is the CRD installed?", groupVersion)})
+		}
+	}
+	return results
+}
+
+// checkAccess asks the apiserver whether the current identity can perform every verb the tasks need.
+func (c *Checker) checkAccess(permissions []task.Permission) []Result {
+	results := make([]Result, 0)
+	for _, p := range permissions {
+		denied := make([]string, 0)
+		for _, verb := range p.Verbs {
+			review := &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Group:    p.Group,
+						Version:  p.Version,
+						Resource: p.Resource,
+						Verb:     verb,
+					},
+				},
+			}
+			review, err := c.client.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+			if err != nil {
+				klog.Error(err)
+				denied = append(denied, fmt.Sprintf("%s (%s)", verb, err.Error()))
+				continue
+			}
+			if !review.Status.Allowed {
+				denied = append(denied, verb)
+			}
+		}
+
+		check := fmt.Sprintf("access %s", p.Resource)
+		if p.Group != "" {
+			check = fmt.Sprintf("access %s.%s", p.Resource, p.Group)
+		}
+		if len(denied) > 0 {
+			results = append(results, Result{Check: check, Status: StatusFail, Message: fmt.Sprintf("denied: %s", strings.Join(denied, ", "))})
+		} else {
+			results = append(results, Result{Check: check, Status: StatusPass, Message: strings.Join(p.Verbs, ", ")})
+		}
+	}
+	return results
+}
+
+// checkComponents checks the KubeSphere components, ks-controller-manager reconciles the same roles
+// as the upgrade, so it should be scaled down while the upgrade is running.
+func (c *Checker) checkComponents() []Result {
+	results := make([]Result, 0)
+	for _, name := range []string{"ks-apiserver", "ks-controller-manager"} {
+		check := fmt.Sprintf("component %s", name)
+		deployment, err := c.client.AppsV1().Deployments(kubesphereNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			results = append(results, Result{Check: check, Status: StatusWarn, Message: err.Error()})
+			continue
+		}
+
+		replicas := int32(1)
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+		status := deployment.Status
+		message := fmt.Sprintf("%d/%d replicas ready", status.ReadyReplicas, replicas)
+
+		switch {
+		case name == "ks-controller-manager" && status.Replicas > 0:
+			results = append(results, Result{Check: check, Status: StatusWarn,
+				Message: fmt.Sprintf("%s, it reconciles the roles concurrently, consider scaling it down", message)})
+		case name != "ks-controller-manager" && status.ReadyReplicas < replicas:
+			results = append(results, Result{Check: check, Status: StatusWarn, Message: message})
+		default:
+			results = append(results, Result{Check: check, Status: StatusPass, Message: message})
+		}
+	}
+	return results
+}
+
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+func PrintTable(out io.Writer, results []Result) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tMESSAGE")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Check, r.Status, r.Message)
+	}
+	w.Flush()
+}
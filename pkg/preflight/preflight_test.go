@@ -0,0 +1,121 @@
+package preflight
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+type testTask struct {
+	permissions []task.Permission
+}
+
+func (t *testTask) Run() error {
+	return nil
+}
+
+func (t *testTask) RequiredPermissions() []task.Permission {
+	return t.permissions
+}
+
+// newTestServer serves a cluster older than v1.16 whose etcd is unhealthy, serving the iam group only and
+// denying the deletions, with ks-controller-manager running.
+func newTestServer(t *testing.T) *kubernetes.Clientset {
+	replicas := int32(1)
+	objects := map[string]interface{}{
+		"/apis/iam.kubesphere.io/v1alpha2": &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: "iam.kubesphere.io/v1alpha2",
+			APIResources: []metav1.APIResource{{Name: "globalroles", Kind: "GlobalRole"}},
+		},
+		"/apis/apps/v1/namespaces/kubesphere-system/deployments/ks-apiserver": &appsv1.Deployment{
+			Spec:   appsv1.DeploymentSpec{Replicas: &replicas},
+			Status: appsv1.DeploymentStatus{Replicas: 1, ReadyReplicas: 1},
+		},
+		"/apis/apps/v1/namespaces/kubesphere-system/deployments/ks-controller-manager": &appsv1.Deployment{
+			Spec:   appsv1.DeploymentSpec{Replicas: &replicas},
+			Status: appsv1.DeploymentStatus{Replicas: 1, ReadyReplicas: 1},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/healthz":
+			_, _ = w.Write([]byte("ok"))
+		case r.URL.Path == "/readyz/etcd":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"etcd failed","code":500}`))
+		case r.URL.Path == "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews":
+			review := &authorizationv1.SelfSubjectAccessReview{}
+			if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+				t.Error(err)
+			}
+			review.Status.Allowed = review.Spec.ResourceAttributes.Verb != "delete"
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(review)
+		case objects[r.URL.Path] != nil:
+			_ = json.NewEncoder(w).Encode(objects[r.URL.Path])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestChecker(t *testing.T) {
+	tasks := []task.UpgradeTask{
+		&testTask{permissions: []task.Permission{
+			{Group: "iam.kubesphere.io", Version: "v1alpha2", Resource: "globalroles", Verbs: []string{"list", "delete"}},
+		}},
+		&testTask{permissions: []task.Permission{
+			{Group: "notification.kubesphere.io", Version: "v2beta2", Resource: "receivers", Verbs: []string{"list"}, Optional: true},
+			{Group: "iam.kubesphere.io", Version: "v1alpha2", Resource: "users", Verbs: []string{"list"}},
+		}},
+	}
+	results := NewChecker(newTestServer(t), tasks...).Run()
+
+	expected := map[string]Status{
+		"apiserver /livez":                                      StatusPass,
+		"apiserver /readyz":                                     StatusPass,
+		"apiserver /readyz/etcd":                                StatusFail,
+		"resource iam.kubesphere.io/v1alpha2/globalroles":       StatusPass,
+		"resource notification.kubesphere.io/v2beta2/receivers": StatusWarn,
+		"resource iam.kubesphere.io/v1alpha2/users":             StatusFail,
+		"access globalroles.iam.kubesphere.io":                  StatusFail,
+		"access receivers.notification.kubesphere.io":           StatusPass,
+		"access users.iam.kubesphere.io":                        StatusPass,
+		"component ks-apiserver":                                StatusPass,
+		"component ks-controller-manager":                       StatusWarn,
+	}
+	statuses := make(map[string]Status, len(results))
+	for _, result := range results {
+		statuses[result.Check] = result.Status
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("the checks are %v, expected %v", statuses, expected)
+	}
+	if !Failed(results) {
+		t.Error("the checks didn't fail")
+	}
+	for _, result := range results {
+		if result.Check == "access globalroles.iam.kubesphere.io" && result.Message != "denied: delete" {
+			t.Errorf("the access check of globalroles tells %q", result.Message)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
+	"kubesphere.io/ks-upgrade/pkg/expr"
 	"kubesphere.io/ks-upgrade/pkg/task"
 )
 
@@ -61,365 +62,572 @@ var builtinRolesList = map[string][]string{
 	},
 }
 
+// Options are the parameters of the role migration.
+type Options struct {
+	// DeleteGlobalRoles are the deprecated global roles which are deleted.
+	DeleteGlobalRoles []string `json:"deleteGlobalRoles,omitempty"`
+	// DeprecatedRoleTemplates are the role templates removed from the custom roles, by role type.
+	DeprecatedRoleTemplates map[string][]string `json:"deprecatedRoleTemplates,omitempty"`
+	// BuiltinRoles are the roles which are never recreated, by role type.
+	BuiltinRoles map[string][]string `json:"builtinRoles,omitempty"`
+	// BindingRemap maps the global role a GlobalRoleBinding refers to onto its replacement.
+	BindingRemap map[string]string `json:"bindingRemap,omitempty"`
+	// CustomRoleSelectors are CEL predicates deciding which roles are custom roles, by role type.
+	// The role is bound to `object` and the built-in roles of the type to `builtinRoles`.
+	CustomRoleSelectors map[string]string `json:"customRoleSelectors,omitempty"`
+	// BindingRemapExpression is a CEL expression computing the global role a GlobalRoleBinding, bound
+	// to `object`, is remapped to when BindingRemap doesn't cover it. An empty string keeps the binding.
+	BindingRemapExpression string `json:"bindingRemapExpression,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		DeleteGlobalRoles:       append([]string{}, deleteGlobalRoleList...),
+		DeprecatedRoleTemplates: copyRoleLists(deprecatedRoleTemplateList),
+		BuiltinRoles:            copyRoleLists(builtinRolesList),
+		BindingRemap: map[string]string{
+			"users-manager":      "platform-regular",
+			"workspaces-manager": "platform-regular",
+		},
+	}
+}
+
+// RemapGlobalRole returns the global role which replaces a global role, the role itself if it's
+// kept and an empty string if it's deleted without replacement.
+func (o *Options) RemapGlobalRole(name string) string {
+	if newRole, ok := o.BindingRemap[name]; ok {
+		return newRole
+	}
+	if inSliceString(name, o.DeleteGlobalRoles) {
+		return ""
+	}
+	return name
+}
+
+func copyRoleLists(lists map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(lists))
+	for roleType, names := range lists {
+		c[roleType] = append([]string{}, names...)
+	}
+	return c
+}
+
+// NamespaceLister lists the namespaces whose custom Roles are migrated by another task.
+type NamespaceLister func() ([]string, error)
+
 type roleMigrateTask struct {
-	clientSet  *kubernetes.Clientset
-	reCreators []ReCreator
+	clientSet    *kubernetes.Clientset
+	applier      *task.Applier
+	options      *Options
+	selectors    map[string]*customRoleSelector
+	bindingRemap *expr.Expression
+	reCreators   []ReCreator
+	// skipped lists the namespaces of the DevOps projects migrated by devops-migrate, it's nil if it doesn't run
+	skipped NamespaceLister
 }
 
-func NewRoleMigrateTask(k8sClient kubernetes.Interface) task.UpgradeTask {
+// NewRoleMigrateTask creates the task, the CEL expressions of the options are type-checked here
+// so that an invalid expression fails before anything runs. The custom Roles of the namespaces skipped
+// lists are left to the task migrating them, skipped may be nil.
+func NewRoleMigrateTask(k8sClient kubernetes.Interface, options *task.Options, roleOptions *Options, skipped NamespaceLister) (task.UpgradeTask, error) {
 	clientset := k8sClient.(*kubernetes.Clientset)
-	r := &roleMigrateTask{clientSet: clientset, reCreators: make([]ReCreator, 0)}
+	r := &roleMigrateTask{clientSet: clientset, applier: task.NewApplier(k8sClient, options), options: roleOptions,
+		selectors: make(map[string]*customRoleSelector), reCreators: make([]ReCreator, 0), skipped: skipped}
+
+	for _, roleType := range []string{roleTypeGlobalRole, roleTypeWorkspaceRole, roleTypeRole} {
+		selector, err := newCustomRoleSelector(roleType, roleOptions)
+		if err != nil {
+			return nil, err
+		}
+		r.selectors[roleType] = selector
+	}
+	if roleOptions.BindingRemapExpression != "" {
+		expression, err := expr.CompileTransform(roleOptions.BindingRemapExpression)
+		if err != nil {
+			return nil, fmt.Errorf("binding remap expression: %v", err)
+		}
+		r.bindingRemap = expression
+	}
 
 	r.reCreators = append(r.reCreators,
-		newGlobalCustomRoleReCreator(k8sClient, deprecatedRoleTemplateList[roleTypeGlobalRole], builtinRolesList[roleTypeGlobalRole]),
-		newWorkspaceCustomRoleReCreator(k8sClient, deprecatedRoleTemplateList[roleTypeWorkspaceRole], builtinRolesList[roleTypeWorkspaceRole]),
-		newCustomRoleReCreator(k8sClient, deprecatedRoleTemplateList[roleTypeRole], builtinRolesList[roleTypeRole]),
+		newGlobalCustomRoleReCreator(k8sClient, roleOptions.DeprecatedRoleTemplates[roleTypeGlobalRole], r.selectors[roleTypeGlobalRole]),
+		newWorkspaceCustomRoleReCreator(k8sClient, roleOptions.DeprecatedRoleTemplates[roleTypeWorkspaceRole], r.selectors[roleTypeWorkspaceRole]),
+		newCustomRoleReCreator(k8sClient, roleOptions.DeprecatedRoleTemplates[roleTypeRole], r.selectors[roleTypeRole], skipped),
 	)
 
-	return r
+	return r, nil
+}
+
+func (t *roleMigrateTask) Name() string {
+	return "role-migrate"
 }
 
 func (t *roleMigrateTask) Run() error {
-	err := t.migrateBuiltinRole()
+	return t.applier.PlanAndApply(t)
+}
+
+func (t *roleMigrateTask) Plan() ([]task.Change, error) {
+	changes, err := t.migrateBuiltinRole()
 	if err != nil {
-		klog.Error(err)
-		return err
+		return nil, err
 	}
 
-	// delete the deprecated global roles
-	for _, globalRole := range deleteGlobalRoleList {
-		err := t.deleteGlobalRole(globalRole)
+	// delete the deprecated global roles once no binding refers to them
+	bindings := make([]string, 0, len(changes))
+	for _, c := range changes {
+		bindings = append(bindings, c.Key())
+	}
+	for _, globalRole := range t.options.DeleteGlobalRoles {
+		change, err := t.deleteGlobalRole(globalRole)
 		if err != nil {
-			klog.Error(err)
-			return err
+			return nil, err
+		}
+		if change != nil {
+			change.DependsOn = bindings
+			changes = append(changes, *change)
 		}
 	}
 
 	// recreate the roles is including deprecated role templates
 	for _, reCreator := range t.reCreators {
-		if err := reCreator.Recreate(); err != nil {
-			klog.Error(err)
-			return err
+		recreations, err := reCreator.Plan()
+		if err != nil {
+			return nil, err
 		}
+		changes = append(changes, recreations...)
 	}
 
-	return nil
+	return changes, nil
 }
 
-func (t *roleMigrateTask) migrateBuiltinRole() error {
+func (t *roleMigrateTask) RequiredPermissions() []task.Permission {
+	roleVerbs := []string{"list", "get", "create", "delete"}
+	return []task.Permission{
+		{Group: "iam.kubesphere.io", Version: "v1alpha2", Resource: roleTypeGlobalRole, Verbs: roleVerbs},
+		{Group: "iam.kubesphere.io", Version: "v1alpha2", Resource: roleTypeWorkspaceRole, Verbs: roleVerbs},
+		{Group: "iam.kubesphere.io", Version: "v1alpha2", Resource: "globalrolebindings", Verbs: []string{"list", "get", "update"}},
+		{Group: "iam.kubesphere.io", Version: "v1alpha2", Resource: "workspacerolebindings", Verbs: []string{"list"}},
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: roleTypeRole, Verbs: roleVerbs},
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "rolebindings", Verbs: []string{"list"}},
+		{Group: "", Version: "v1", Resource: "namespaces", Verbs: []string{"list"}},
+	}
+}
+
+func (t *roleMigrateTask) migrateBuiltinRole() ([]task.Change, error) {
 	absPath := fmt.Sprintf("%s/%s", iamPath, "globalrolebindings")
 	roleList := &GlobalRoleBindingList{}
 	err := listRole(t.clientSet, absPath, "", roleList)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	changes := make([]task.Change, 0)
 	for _, role := range roleList.Items {
-		if role.RoleRef.Name == "users-manager" || role.RoleRef.Name == "workspaces-manager" {
-			klog.Infof("change GlobalRoleBinding %s, modify the roleRef.name to platform-regular.", role.Name)
-			role.RoleRef.Name = "platform-regular"
-			err := updateRoleBindings(t.clientSet, absPath, role.Name, role)
+		newRoleRef, err := t.remapBinding(&role)
+		if err != nil {
+			return nil, err
+		}
+		if newRoleRef != "" && newRoleRef != role.RoleRef.Name {
+			original, err := json.Marshal(role)
 			if err != nil {
-				return err
+				return nil, err
 			}
-
+			oldRoleRef := role.RoleRef.Name
+			role.RoleRef.Name = newRoleRef
+			role.APIVersion = "iam.kubesphere.io/v1alpha2"
+			role.Kind = "GlobalRoleBinding"
+			marshal, err := json.Marshal(role)
+			if err != nil {
+				return nil, err
+			}
+			patch, err := task.CreateMergePatch(original, marshal)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, task.Change{
+				Operation:       task.OperationUpdate,
+				Path:            absPath,
+				Name:            role.Name,
+				ResourceVersion: role.ResourceVersion,
+				Object:          marshal,
+				Patch:           patch,
+				Description:     fmt.Sprintf("change GlobalRoleBinding %s, modify the roleRef.name from %s to %s", role.Name, oldRoleRef, newRoleRef),
+			})
 		}
 	}
-	return nil
+	return changes, nil
 }
 
-func (t *roleMigrateTask) deleteGlobalRole(name string) error {
+// remapBinding returns the global role a binding is remapped to, an empty string if it's kept.
+func (t *roleMigrateTask) remapBinding(binding *GlobalRoleBinding) (string, error) {
+	if newRoleRef, ok := t.options.BindingRemap[binding.RoleRef.Name]; ok {
+		return newRoleRef, nil
+	}
+	if t.bindingRemap == nil {
+		return "", nil
+	}
+	value, err := t.bindingRemap.Eval(binding, nil)
+	if err != nil {
+		return "", fmt.Errorf("remap GlobalRoleBinding %s failed: %v", binding.Name, err)
+	}
+	if value == nil {
+		return "", nil
+	}
+	newRoleRef, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("remap GlobalRoleBinding %s failed: %v isn't a role name", binding.Name, value)
+	}
+	return newRoleRef, nil
+}
+
+func (t *roleMigrateTask) deleteGlobalRole(name string) (*task.Change, error) {
 	path := fmt.Sprintf("%s/%s", iamPath, roleTypeGlobalRole)
 
-	err := deleteRole(t.clientSet, path, name)
+	globalRole := &GlobalRole{}
+	err := listRole(t.clientSet, path, name, globalRole)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			klog.Infof(fmt.Sprintf("Global Role %s is not existing, skipping it.", name))
-		} else {
-			return err
+			klog.Infof("Global Role %s is not existing, skipping it.", name)
+			return nil, nil
 		}
+		return nil, err
 	}
-	return nil
+	return &task.Change{
+		Operation:       task.OperationDelete,
+		Path:            path,
+		Name:            name,
+		ResourceVersion: globalRole.ResourceVersion,
+		Description:     fmt.Sprintf("delete the deprecated global role %s", name),
+	}, nil
 }
 
+// ReCreator plans the recreation of the custom roles which aggregate deprecated role templates.
 type ReCreator interface {
-	Recreate() error
+	Plan() ([]task.Change, error)
 }
 
 type globalCustomRoleReCreator struct {
 	client                  *kubernetes.Clientset
 	deprecatedRoleTemplates []string
-	builtinRoles            []string
+	selector                *customRoleSelector
 }
 
-func newGlobalCustomRoleReCreator(client kubernetes.Interface, deprecatedRoleTemplates []string, builtinRole []string) ReCreator {
+func newGlobalCustomRoleReCreator(client kubernetes.Interface, deprecatedRoleTemplates []string, selector *customRoleSelector) ReCreator {
 	return &globalCustomRoleReCreator{
 		client:                  client.(*kubernetes.Clientset),
 		deprecatedRoleTemplates: deprecatedRoleTemplates,
-		builtinRoles:            builtinRole,
+		selector:                selector,
 	}
 }
 
-func (g *globalCustomRoleReCreator) Recreate() error {
+func (g *globalCustomRoleReCreator) Plan() ([]task.Change, error) {
 	path := fmt.Sprintf("%s/%s", iamPath, roleTypeGlobalRole)
 
 	globalRoleList := &GlobalRoleList{}
 	err := listRole(g.client, path, "", globalRoleList)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// role templates are global roles too, so they are looked up in the same list
+	rules := make(map[string][]v1.PolicyRule, len(globalRoleList.Items))
+	for _, globalrole := range globalRoleList.Items {
+		rules[globalrole.Name] = globalrole.Rules
 	}
+
+	changes := make([]task.Change, 0)
 	for _, globalrole := range globalRoleList.Items {
-		if isValidCustomRole(globalrole.ObjectMeta, g.builtinRoles) {
+		custom, err := g.selector.isCustom(&globalrole, globalrole.ObjectMeta)
+		if err != nil {
+			return nil, err
+		}
+		if custom {
 			oldAggregateRoles, err := getAggregationRoles(globalrole.ObjectMeta)
 			if err != nil {
-				klog.Warning("get aggregation roles of %s failed, %s", globalrole.Name, err.Error())
+				klog.Warningf("get aggregation roles of %s failed, %s", globalrole.Name, err.Error())
 				continue
 			}
 
 			trimmed, aggregateRoles := trimRoleTemplates(g.deprecatedRoleTemplates, oldAggregateRoles)
-			if trimmed {
-				marshal, err := json.Marshal(aggregateRoles)
-				if err != nil {
-					return err
-				}
-
-				// Creating a new custom role excluding the deprecated role templates.
-				newGlobalRole := &GlobalRole{
-					TypeMeta: metav1.TypeMeta{
-						APIVersion: "iam.kubesphere.io/v1alpha2",
-						Kind:       "GlobalRole",
-					},
-					ObjectMeta: metav1.ObjectMeta{
-						Name: globalrole.Name,
-						Annotations: map[string]string{
-							"iam.kubesphere.io/aggregation-roles": string(marshal),
-							"kubesphere.io/creator":               globalrole.Annotations["kubesphere.io/creator"],
-						},
+			if !trimmed {
+				continue
+			}
+			marshal, err := json.Marshal(aggregateRoles)
+			if err != nil {
+				return nil, err
+			}
+
+			// Creating a new custom role excluding the deprecated role templates.
+			newGlobalRole := &GlobalRole{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "iam.kubesphere.io/v1alpha2",
+					Kind:       "GlobalRole",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name: globalrole.Name,
+					Annotations: map[string]string{
+						"iam.kubesphere.io/aggregation-roles": string(marshal),
+						"kubesphere.io/creator":               globalrole.Annotations["kubesphere.io/creator"],
 					},
-					Rules: make([]v1.PolicyRule, 0),
-				}
-
-				for _, a := range aggregateRoles {
-					roleTemplate := &GlobalRole{}
-					err := listRole(g.client, path, a, roleTemplate)
-					if err != nil {
-						if errors.IsNotFound(err) {
-							klog.Warning(err)
-						} else {
-							return err
-						}
-					}
-					newGlobalRole.Rules = append(newGlobalRole.Rules, roleTemplate.Rules...)
-				}
-
-				klog.Infof("recreate global role %s with aggregating role: %s", newGlobalRole.Name, string(marshal))
-				// delete the old custom role
-				if err := deleteRole(g.client, path, globalrole.Name); err != nil {
-					return err
-				}
-
-				if err := createRole(g.client, path, newGlobalRole.Name, newGlobalRole); err != nil {
-					return err
-				}
+				},
+				Rules: aggregateRules(rules, aggregateRoles),
 			}
+
+			change, err := recreateChange(path, globalrole.ObjectMeta, globalrole, newGlobalRole, aggregateRoles,
+				fmt.Sprintf("recreate global role %s with aggregating role: %s", newGlobalRole.Name, string(marshal)))
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, *change)
 		}
 	}
-	return nil
+	return changes, nil
 }
 
 type workspaceCustomRoleReCreator struct {
 	client                  *kubernetes.Clientset
 	deprecatedRoleTemplates []string
-	builtinRoles            []string
+	selector                *customRoleSelector
 }
 
-func newWorkspaceCustomRoleReCreator(client kubernetes.Interface, deprecatedRoleTemplates, builtinRoles []string) ReCreator {
+func newWorkspaceCustomRoleReCreator(client kubernetes.Interface, deprecatedRoleTemplates []string, selector *customRoleSelector) ReCreator {
 	return &workspaceCustomRoleReCreator{
 		client:                  client.(*kubernetes.Clientset),
 		deprecatedRoleTemplates: deprecatedRoleTemplates,
-		builtinRoles:            builtinRoles,
+		selector:                selector,
 	}
 }
 
-func (w *workspaceCustomRoleReCreator) Recreate() error {
+func (w *workspaceCustomRoleReCreator) Plan() ([]task.Change, error) {
 	path := fmt.Sprintf("%s/%s", iamPath, roleTypeWorkspaceRole)
 
 	workspaceRoleList := &WorkspaceRoleList{}
 	err := listRole(w.client, path, "", workspaceRoleList)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	rules := make(map[string][]v1.PolicyRule, len(workspaceRoleList.Items))
 	for _, workspaceRole := range workspaceRoleList.Items {
-		// Just check the custom role
-
-		if workspaceRole.Labels["iam.kubesphere.io/role-template"] == "" &&
-			!suffixInSliceString(workspaceRole.Name, w.builtinRoles) &&
-			workspaceRole.Annotations["iam.kubesphere.io/aggregation-roles"] != "" {
+		rules[workspaceRole.Name] = workspaceRole.Rules
+	}
 
+	changes := make([]task.Change, 0)
+	for _, workspaceRole := range workspaceRoleList.Items {
+		// Just check the custom role
+		custom, err := w.selector.isCustom(&workspaceRole, workspaceRole.ObjectMeta)
+		if err != nil {
+			return nil, err
+		}
+		if custom {
 			oldAggregateRoles, err := getAggregationRoles(workspaceRole.ObjectMeta)
 			if err != nil {
-				klog.Warning("get aggregation roles of %s failed, %s", workspaceRole.Name, err.Error())
+				klog.Warningf("get aggregation roles of %s failed, %s", workspaceRole.Name, err.Error())
 				continue
 			}
 
 			trimmed, aggregateRoles := trimRoleTemplates(w.deprecatedRoleTemplates, oldAggregateRoles)
-			if trimmed {
-				marshal, err := json.Marshal(aggregateRoles)
-				if err != nil {
-					return err
-				}
-
-				// Creating a new custom role excluding the deprecated role templates.
-				newWorkspaceRole := &WorkspaceRole{
-					TypeMeta: metav1.TypeMeta{
-						APIVersion: "iam.kubesphere.io/v1alpha2",
-						Kind:       "WorkspaceRole",
+			if !trimmed {
+				continue
+			}
+			marshal, err := json.Marshal(aggregateRoles)
+			if err != nil {
+				return nil, err
+			}
+
+			// Creating a new custom role excluding the deprecated role templates.
+			newWorkspaceRole := &WorkspaceRole{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "iam.kubesphere.io/v1alpha2",
+					Kind:       "WorkspaceRole",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name: workspaceRole.Name,
+					Labels: map[string]string{
+						"kubesphere.io/workspace": workspaceRole.Labels["kubesphere.io/workspace"],
 					},
-					ObjectMeta: metav1.ObjectMeta{
-						Name: workspaceRole.Name,
-						Labels: map[string]string{
-							"kubesphere.io/workspace": workspaceRole.Labels["kubesphere.io/workspace"],
-						},
-						Annotations: map[string]string{
-							"iam.kubesphere.io/aggregation-roles": string(marshal),
-							"kubesphere.io/creator":               workspaceRole.Annotations["kubesphere.io/creator"],
-						},
+					Annotations: map[string]string{
+						"iam.kubesphere.io/aggregation-roles": string(marshal),
+						"kubesphere.io/creator":               workspaceRole.Annotations["kubesphere.io/creator"],
 					},
-					Rules: make([]v1.PolicyRule, 0),
-				}
-
-				for _, a := range aggregateRoles {
-					roleTemplate := &WorkspaceRole{}
-					err := listRole(w.client, path, a, roleTemplate)
-					if err != nil {
-						if errors.IsNotFound(err) {
-							klog.Warning(err)
-						} else {
-							return err
-						}
-					}
-					newWorkspaceRole.Rules = append(newWorkspaceRole.Rules, roleTemplate.Rules...)
-				}
-
-				klog.Infof("recreate workspace role %s with aggregating role: %s", newWorkspaceRole.Name, string(marshal))
-				// delete the old custom role
-				if err := deleteRole(w.client, path, workspaceRole.Name); err != nil {
-					return err
-				}
-				if err := createRole(w.client, path, newWorkspaceRole.Name, newWorkspaceRole); err != nil {
-					return err
-				}
+				},
+				Rules: aggregateRules(rules, aggregateRoles),
+			}
+
+			change, err := recreateChange(path, workspaceRole.ObjectMeta, workspaceRole, newWorkspaceRole, aggregateRoles,
+				fmt.Sprintf("recreate workspace role %s with aggregating role: %s", newWorkspaceRole.Name, string(marshal)))
+			if err != nil {
+				return nil, err
 			}
+			changes = append(changes, *change)
 		}
 	}
-	return nil
+	return changes, nil
 }
 
 type customRoleReCreator struct {
 	client                  *kubernetes.Clientset
 	deprecatedRoleTemplates []string
-	builtinRoles            []string
+	selector                *customRoleSelector
+	// namespace restricts the roles to a namespace, the roles of all the namespaces but the skipped ones
+	// are recreated if it's empty
+	namespace string
+	skipped   NamespaceLister
 }
 
-func newCustomRoleReCreator(client kubernetes.Interface, deprecatedRoleTemplates, builtinRoles []string) ReCreator {
+func newCustomRoleReCreator(client kubernetes.Interface, deprecatedRoleTemplates []string, selector *customRoleSelector, skipped NamespaceLister) ReCreator {
 	return &customRoleReCreator{
 		client:                  client.(*kubernetes.Clientset),
 		deprecatedRoleTemplates: deprecatedRoleTemplates,
-		builtinRoles:            builtinRoles,
+		selector:                selector,
+		skipped:                 skipped,
 	}
 }
 
-func (w *customRoleReCreator) Recreate() error {
-	path := fmt.Sprintf("%s/%s", rbacPath, roleTypeRole)
+// NewNamespaceRoleReCreator returns the ReCreator of the custom Roles of a namespace, the Roles aggregating
+// one of deprecatedRoleTemplates are recreated without it. The custom Roles are selected by the role options.
+func NewNamespaceRoleReCreator(client kubernetes.Interface, namespace string, deprecatedRoleTemplates []string, roleOptions *Options) (ReCreator, error) {
+	selector, err := newCustomRoleSelector(roleTypeRole, roleOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &customRoleReCreator{
+		client:                  client.(*kubernetes.Clientset),
+		deprecatedRoleTemplates: deprecatedRoleTemplates,
+		selector:                selector,
+		namespace:               namespace,
+	}, nil
+}
 
-	roleList := &v1.RoleList{}
-	err := listRole(w.client, path, "", roleList)
+func (w *customRoleReCreator) Plan() ([]task.Change, error) {
+	roleList, err := listRoles(w.client, w.namespace)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	// roles only aggregate the role templates in the same namespace
+	rules := make(map[string]map[string][]v1.PolicyRule)
 	for _, role := range roleList.Items {
-		// Confirm the role isn`t builtinRole or role template
-		if isValidCustomRole(role.ObjectMeta, w.builtinRoles) {
+		if rules[role.Namespace] == nil {
+			rules[role.Namespace] = make(map[string][]v1.PolicyRule)
+		}
+		rules[role.Namespace][role.Name] = role.Rules
+	}
 
+	skipped := make([]string, 0)
+	if w.namespace == "" && w.skipped != nil {
+		if skipped, err = w.skipped(); err != nil {
+			return nil, err
+		}
+	}
+
+	changes := make([]task.Change, 0)
+	for _, role := range roleList.Items {
+		if inSliceString(role.Namespace, skipped) {
+			continue
+		}
+		// Confirm the role isn`t builtinRole or role template
+		custom, err := w.selector.isCustom(&role, role.ObjectMeta)
+		if err != nil {
+			return nil, err
+		}
+		if custom {
 			oldAggregateRoles, err := getAggregationRoles(role.ObjectMeta)
 			if err != nil {
-				klog.Warning("get aggregation roles of %s failed, %s", role.Name, err.Error())
+				klog.Warningf("get aggregation roles of %s failed, %s", role.Name, err.Error())
 				continue
 			}
 
 			pathWithNs := fmt.Sprintf("%s/namespaces/%s/%s", rbacPath, role.Namespace, roleTypeRole)
 			hasTrimmed, aggregateRoles := trimRoleTemplates(w.deprecatedRoleTemplates, oldAggregateRoles)
-			if hasTrimmed {
-				marshal, err := json.Marshal(aggregateRoles)
-				if err != nil {
-					return err
-				}
-
-				// Delete old role and creating a new role with the same name as old one but excluding the deprecated role templates.
-				newRole := &v1.Role{
-					TypeMeta: metav1.TypeMeta{
-						APIVersion: "rbac.authorization.k8s.io/v1",
-						Kind:       "Role",
-					},
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      role.Name,
-						Namespace: role.Namespace,
-						Annotations: map[string]string{
-							"iam.kubesphere.io/aggregation-roles": string(marshal),
-							"kubesphere.io/creator":               role.Annotations["kubesphere.io/creator"],
-						},
+			if !hasTrimmed {
+				continue
+			}
+			marshal, err := json.Marshal(aggregateRoles)
+			if err != nil {
+				return nil, err
+			}
+
+			// Delete old role and creating a new role with the same name as old one but excluding the deprecated role templates.
+			newRole := &v1.Role{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "rbac.authorization.k8s.io/v1",
+					Kind:       "Role",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      role.Name,
+					Namespace: role.Namespace,
+					Annotations: map[string]string{
+						"iam.kubesphere.io/aggregation-roles": string(marshal),
+						"kubesphere.io/creator":               role.Annotations["kubesphere.io/creator"],
 					},
-					Rules: make([]v1.PolicyRule, 0),
-				}
-
-				for _, a := range aggregateRoles {
-					roleTemplate := &v1.Role{}
-					err := listRole(w.client, pathWithNs, a, roleTemplate)
-					if err != nil {
-						if errors.IsNotFound(err) {
-							klog.Warning(err)
-						} else {
-							return err
-						}
-					}
-					newRole.Rules = append(newRole.Rules, roleTemplate.Rules...)
-				}
-
-				klog.Infof("recreate role %s with aggregating role: %s", newRole.Name, string(marshal))
-				if err := deleteRole(w.client, pathWithNs, role.Name); err != nil {
-					return err
-				}
-				if err := createRole(w.client, pathWithNs, newRole.Name, newRole); err != nil {
-					return err
-				}
+				},
+				Rules: aggregateRules(rules[role.Namespace], aggregateRoles),
 			}
+
+			change, err := recreateChange(pathWithNs, role.ObjectMeta, role, newRole, aggregateRoles,
+				fmt.Sprintf("recreate role %s/%s with aggregating role: %s", role.Namespace, newRole.Name, string(marshal)))
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, *change)
 		}
 	}
-	return nil
+	return changes, nil
 }
 
-func deleteRole(clientSet *kubernetes.Clientset, path, name string) error {
-	_, err := clientSet.RESTClient().Delete().AbsPath(fmt.Sprintf("%s/%s", path, name)).DoRaw(context.TODO())
+// recreateChange builds the change replacing a custom role, the recreation waits for
+// the aggregated roles which are recreated too.
+func recreateChange(path string, meta metav1.ObjectMeta, oldRole, newRole interface{}, aggregateRoles []string, description string) (*task.Change, error) {
+	marshal, err := json.Marshal(newRole)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	klog.Infof("deleted role %s", name)
-	return nil
-}
-
-func createRole(clientSet *kubernetes.Clientset, path, name string, body interface{}) error {
-	marshal, err := json.Marshal(body)
+	original, err := json.Marshal(oldRole)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = clientSet.RESTClient().Post().AbsPath(path).Body(marshal).DoRaw(context.TODO())
+	patch, err := task.CreateMergePatch(original, marshal)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	klog.Infof("created role %s", name)
+	dependsOn := make([]string, 0, len(aggregateRoles))
+	for _, a := range aggregateRoles {
+		dependsOn = append(dependsOn, task.ChangeKey(path, a))
+	}
+	return &task.Change{
+		Operation:       task.OperationRecreate,
+		Path:            path,
+		Name:            meta.Name,
+		ResourceVersion: meta.ResourceVersion,
+		Object:          marshal,
+		Patch:           patch,
+		DependsOn:       dependsOn,
+		Description:     description,
+	}, nil
+}
 
-	return nil
+func aggregateRules(templates map[string][]v1.PolicyRule, aggregateRoles []string) []v1.PolicyRule {
+	rules := make([]v1.PolicyRule, 0)
+	for _, a := range aggregateRoles {
+		templateRules, ok := templates[a]
+		if !ok {
+			klog.Warningf("role template %s not found", a)
+			continue
+		}
+		rules = append(rules, templateRules...)
+	}
+	return rules
+}
+
+// listRoles lists the Roles of a namespace, or of all the namespaces if it's empty.
+func listRoles(clientSet *kubernetes.Clientset, namespace string) (*v1.RoleList, error) {
+	path := fmt.Sprintf("%s/%s", rbacPath, roleTypeRole)
+	if namespace != "" {
+		path = fmt.Sprintf("%s/namespaces/%s/%s", rbacPath, namespace, roleTypeRole)
+	}
+	roleList := &v1.RoleList{}
+	if err := listRole(clientSet, path, "", roleList); err != nil {
+		return nil, err
+	}
+	return roleList, nil
 }
 
 func listRole(clientSet *kubernetes.Clientset, path, name string, output interface{}) error {
@@ -436,19 +644,6 @@ func listRole(clientSet *kubernetes.Clientset, path, name string, output interfa
 	return nil
 }
 
-func updateRoleBindings(clientSet *kubernetes.Clientset, path, name string, body interface{}) error {
-	marshal, err := json.Marshal(body)
-	if err != nil {
-		return err
-	}
-	_, err = clientSet.RESTClient().Put().AbsPath(fmt.Sprintf("%s/%s", path, name)).Body(marshal).DoRaw(context.TODO())
-	if err != nil {
-		return err
-	}
-	klog.Infof("update roleBinding %s", name)
-	return nil
-}
-
 func inSliceString(e string, slice []string) bool {
 	for _, s := range slice {
 		if s == e {
@@ -493,6 +688,13 @@ func isValidCustomRole(meta metav1.ObjectMeta, builtinRoles []string) bool {
 	return false
 }
 
+// Workspace roles are prefixed with the workspace name, so the builtin roles are matched by suffix.
+func isValidCustomWorkspaceRole(meta metav1.ObjectMeta, builtinRoles []string) bool {
+	return meta.Labels["iam.kubesphere.io/role-template"] == "" &&
+		!suffixInSliceString(meta.Name, builtinRoles) &&
+		meta.Annotations["iam.kubesphere.io/aggregation-roles"] != ""
+}
+
 func getAggregationRoles(meta metav1.ObjectMeta) ([]string, error) {
 	roles := make([]string, 0)
 	err := json.Unmarshal([]byte(meta.Annotations["iam.kubesphere.io/aggregation-roles"]), &roles)
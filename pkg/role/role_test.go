@@ -0,0 +1,155 @@
+package role
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+// newTestClient returns a client of a server answering the GETs of the paths with their objects.
+func newTestClient(t *testing.T, objects map[string]interface{}) *kubernetes.Clientset {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		object, ok := objects[r.URL.Path]
+		if !ok || r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(object)
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func testRole(namespace, name string, aggregationRoles string, rules ...v1.PolicyRule) v1.Role {
+	role := v1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, ResourceVersion: "1"}, Rules: rules}
+	if aggregationRoles != "" {
+		role.Annotations = map[string]string{"iam.kubesphere.io/aggregation-roles": aggregationRoles}
+	}
+	return role
+}
+
+func testTemplate(namespace, name string, rules ...v1.PolicyRule) v1.Role {
+	role := testRole(namespace, name, "", rules...)
+	role.Labels = map[string]string{"iam.kubesphere.io/role-template": "true"}
+	return role
+}
+
+var (
+	viewRule   = v1.PolicyRule{Verbs: []string{"get", "list"}, APIGroups: []string{""}, Resources: []string{"pods"}}
+	manageRule = v1.PolicyRule{Verbs: []string{"*"}, APIGroups: []string{"iam.kubesphere.io"}, Resources: []string{"members"}}
+)
+
+func TestCustomRoleReCreatorPlan(t *testing.T) {
+	roles := &v1.RoleList{Items: []v1.Role{
+		testTemplate("ns1", "role-template-view", viewRule),
+		testTemplate("ns1", "role-template-manage-members", manageRule),
+		testRole("ns1", "custom", `["role-template-view","role-template-manage-members"]`, viewRule, manageRule),
+		testRole("ns1", "migrated", `["role-template-view"]`, viewRule),
+		testRole("ns1", "admin", `["role-template-manage-members"]`, manageRule),
+		testRole("ns1", "invalid", `role-template-manage-members`, manageRule),
+		testTemplate("devops", "role-template-manage-members", manageRule),
+		testRole("devops", "custom", `["role-template-manage-members"]`, manageRule),
+	}}
+	client := newTestClient(t, map[string]interface{}{rbacPath + "/roles/": roles})
+	selector, err := newCustomRoleSelector(roleTypeRole, NewOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := func() ([]string, error) { return []string{"devops"}, nil }
+	reCreator := newCustomRoleReCreator(client, deprecatedRoleTemplateList[roleTypeRole], selector, skipped)
+
+	changes, err := reCreator.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("planned %d changes, expected the recreation of ns1/custom only: %v", len(changes), changes)
+	}
+	change := changes[0]
+	path := rbacPath + "/namespaces/ns1/roles"
+	if change.Operation != task.OperationRecreate || change.Path != path || change.Name != "custom" || change.ResourceVersion != "1" {
+		t.Errorf("unexpected change %s %s/%s at %s", change.Operation, change.Path, change.Name, change.ResourceVersion)
+	}
+	if expected := []string{task.ChangeKey(path, "role-template-view")}; !reflect.DeepEqual(change.DependsOn, expected) {
+		t.Errorf("the recreation depends on %v, expected %v", change.DependsOn, expected)
+	}
+	role := &v1.Role{}
+	if err := json.Unmarshal(change.Object, role); err != nil {
+		t.Fatal(err)
+	}
+	if aggregated := role.Annotations["iam.kubesphere.io/aggregation-roles"]; aggregated != `["role-template-view"]` {
+		t.Errorf("the recreated role aggregates %s", aggregated)
+	}
+	if !reflect.DeepEqual(role.Rules, []v1.PolicyRule{viewRule}) {
+		t.Errorf("the recreated role has the rules %v, expected the ones of its templates", role.Rules)
+	}
+}
+
+func TestRemapGlobalRole(t *testing.T) {
+	options := NewOptions()
+	options.DeleteGlobalRoles = append(options.DeleteGlobalRoles, "deprecated")
+	tests := map[string]string{
+		"users-manager":      "platform-regular",
+		"workspaces-manager": "platform-regular",
+		"deprecated":         "",
+		"platform-admin":     "platform-admin",
+	}
+	for name, expected := range tests {
+		if remapped := options.RemapGlobalRole(name); remapped != expected {
+			t.Errorf("RemapGlobalRole(%s) = %q, expected %q", name, remapped, expected)
+		}
+	}
+}
+
+func TestIsCustom(t *testing.T) {
+	meta := func(name string, template bool) metav1.ObjectMeta {
+		m := metav1.ObjectMeta{Name: name, Annotations: map[string]string{"iam.kubesphere.io/aggregation-roles": `["role-template-view"]`}}
+		if template {
+			m.Labels = map[string]string{"iam.kubesphere.io/role-template": "true"}
+		}
+		return m
+	}
+	tests := []struct {
+		name     string
+		roleType string
+		meta     metav1.ObjectMeta
+		custom   bool
+	}{
+		{name: "custom global role", roleType: roleTypeGlobalRole, meta: meta("auditor", false), custom: true},
+		{name: "built-in global role", roleType: roleTypeGlobalRole, meta: meta("platform-admin", false)},
+		{name: "role template", roleType: roleTypeGlobalRole, meta: meta("role-template-view", true)},
+		{name: "role without aggregation", roleType: roleTypeRole, meta: metav1.ObjectMeta{Name: "custom"}},
+		{name: "custom workspace role", roleType: roleTypeWorkspaceRole, meta: meta("ws1-auditor", false), custom: true},
+		{name: "built-in workspace role", roleType: roleTypeWorkspaceRole, meta: meta("ws1-viewer", false)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selector, err := newCustomRoleSelector(test.roleType, NewOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			custom, err := selector.isCustom(nil, test.meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if custom != test.custom {
+				t.Errorf("isCustom() = %t, expected %t", custom, test.custom)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package role
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kubesphere.io/ks-upgrade/pkg/expr"
+)
+
+// customRoleSelector decides which roles are custom roles, the CEL expression configured
+// for the role type replaces the built-in rules.
+type customRoleSelector struct {
+	builtinRoles []string
+	// matchSuffix matches the built-in roles by suffix, workspace roles are prefixed with the workspace name
+	matchSuffix bool
+	expression  *expr.Expression
+}
+
+func newCustomRoleSelector(roleType string, options *Options) (*customRoleSelector, error) {
+	s := &customRoleSelector{builtinRoles: options.BuiltinRoles[roleType], matchSuffix: roleType == roleTypeWorkspaceRole}
+	if source := options.CustomRoleSelectors[roleType]; source != "" {
+		expression, err := expr.CompileSelector(source, "builtinRoles")
+		if err != nil {
+			return nil, fmt.Errorf("custom role selector of %s: %v", roleType, err)
+		}
+		s.expression = expression
+	}
+	return s, nil
+}
+
+func (s *customRoleSelector) isCustom(role interface{}, meta metav1.ObjectMeta) (bool, error) {
+	if s.expression != nil {
+		return s.expression.Select(role, map[string]interface{}{"builtinRoles": s.builtinRoles})
+	}
+	if s.matchSuffix {
+		return isValidCustomWorkspaceRole(meta, s.builtinRoles), nil
+	}
+	return isValidCustomRole(meta, s.builtinRoles), nil
+}
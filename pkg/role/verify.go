@@ -0,0 +1,207 @@
+package role
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Verify checks that no custom role aggregates a deprecated role template any more,
+// that the rules of every custom role match its role templates, that no GlobalRoleBinding
+// refers to a deleted global role and that no binding refers to a missing role.
+func (t *roleMigrateTask) Verify() error {
+	errs := make([]error, 0)
+
+	globalRoles := &GlobalRoleList{}
+	if err := listRole(t.clientSet, fmt.Sprintf("%s/%s", iamPath, roleTypeGlobalRole), "", globalRoles); err != nil {
+		return err
+	}
+	globalRoleRules := make(map[string][]v1.PolicyRule)
+	for _, r := range globalRoles.Items {
+		globalRoleRules[r.Name] = r.Rules
+	}
+	for _, r := range globalRoles.Items {
+		if inSliceString(r.Name, t.options.DeleteGlobalRoles) {
+			errs = append(errs, fmt.Errorf("global role %s should have been deleted", r.Name))
+		}
+		custom, err := t.selectors[roleTypeGlobalRole].isCustom(&r, r.ObjectMeta)
+		if err != nil {
+			return err
+		}
+		if custom {
+			errs = append(errs, verifyCustomRole("global role", r.ObjectMeta, r.Rules, globalRoleRules,
+				t.options.DeprecatedRoleTemplates[roleTypeGlobalRole])...)
+		}
+	}
+
+	workspaceRoles := &WorkspaceRoleList{}
+	if err := listRole(t.clientSet, fmt.Sprintf("%s/%s", iamPath, roleTypeWorkspaceRole), "", workspaceRoles); err != nil {
+		return err
+	}
+	workspaceRoleRules := make(map[string][]v1.PolicyRule)
+	for _, r := range workspaceRoles.Items {
+		workspaceRoleRules[r.Name] = r.Rules
+	}
+	for _, r := range workspaceRoles.Items {
+		custom, err := t.selectors[roleTypeWorkspaceRole].isCustom(&r, r.ObjectMeta)
+		if err != nil {
+			return err
+		}
+		if custom {
+			errs = append(errs, verifyCustomRole("workspace role", r.ObjectMeta, r.Rules, workspaceRoleRules,
+				t.options.DeprecatedRoleTemplates[roleTypeWorkspaceRole])...)
+		}
+	}
+
+	roles, err := listRoles(t.clientSet, "")
+	if err != nil {
+		return err
+	}
+	// the Roles of the DevOps projects are verified by the devops-migrate task
+	skipped := make([]string, 0)
+	if t.skipped != nil {
+		if skipped, err = t.skipped(); err != nil {
+			return err
+		}
+	}
+	roleErrs, roleRules, err := verifyCustomRoles(roles, skipped, t.selectors[roleTypeRole], t.options.DeprecatedRoleTemplates[roleTypeRole])
+	if err != nil {
+		return err
+	}
+	errs = append(errs, roleErrs...)
+
+	globalRoleBindings := &GlobalRoleBindingList{}
+	if err := listRole(t.clientSet, fmt.Sprintf("%s/%s", iamPath, "globalrolebindings"), "", globalRoleBindings); err != nil {
+		return err
+	}
+	for _, b := range globalRoleBindings.Items {
+		if inSliceString(b.RoleRef.Name, t.options.DeleteGlobalRoles) {
+			errs = append(errs, fmt.Errorf("GlobalRoleBinding %s still refers to the deleted global role %s", b.Name, b.RoleRef.Name))
+		} else if _, ok := globalRoleRules[b.RoleRef.Name]; !ok {
+			errs = append(errs, fmt.Errorf("GlobalRoleBinding %s refers to the missing global role %s", b.Name, b.RoleRef.Name))
+		}
+	}
+
+	workspaceRoleBindings := &WorkspaceRoleBindingList{}
+	if err := listRole(t.clientSet, fmt.Sprintf("%s/%s", iamPath, "workspacerolebindings"), "", workspaceRoleBindings); err != nil {
+		return err
+	}
+	for _, b := range workspaceRoleBindings.Items {
+		if _, ok := workspaceRoleRules[b.RoleRef.Name]; !ok {
+			errs = append(errs, fmt.Errorf("WorkspaceRoleBinding %s refers to the missing workspace role %s", b.Name, b.RoleRef.Name))
+		}
+	}
+
+	roleBindings := &v1.RoleBindingList{}
+	if err := listRole(t.clientSet, fmt.Sprintf("%s/%s", rbacPath, "rolebindings"), "", roleBindings); err != nil {
+		return err
+	}
+	for _, b := range roleBindings.Items {
+		if b.RoleRef.Kind != "Role" {
+			continue
+		}
+		if _, ok := roleRules[b.Namespace][b.RoleRef.Name]; !ok {
+			errs = append(errs, fmt.Errorf("RoleBinding %s/%s refers to the missing role %s", b.Namespace, b.Name, b.RoleRef.Name))
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// VerifyNamespaceRoles checks that no custom Role of a namespace aggregates one of deprecatedRoleTemplates
+// any more and that their rules match their role templates.
+func VerifyNamespaceRoles(client kubernetes.Interface, namespace string, deprecatedRoleTemplates []string, roleOptions *Options) error {
+	selector, err := newCustomRoleSelector(roleTypeRole, roleOptions)
+	if err != nil {
+		return err
+	}
+	roles, err := listRoles(client.(*kubernetes.Clientset), namespace)
+	if err != nil {
+		return err
+	}
+	errs, _, err := verifyCustomRoles(roles, nil, selector, deprecatedRoleTemplates)
+	if err != nil {
+		return err
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// verifyCustomRoles verifies the custom Roles of a list but the ones in the skipped namespaces, it returns
+// the rules of all the roles indexed by namespace too.
+func verifyCustomRoles(roles *v1.RoleList, skipped []string, selector *customRoleSelector, deprecatedRoleTemplates []string) ([]error, map[string]map[string][]v1.PolicyRule, error) {
+	// role templates of a role live in the same namespace, so the rules are indexed by namespace
+	roleRules := make(map[string]map[string][]v1.PolicyRule)
+	for _, r := range roles.Items {
+		if roleRules[r.Namespace] == nil {
+			roleRules[r.Namespace] = make(map[string][]v1.PolicyRule)
+		}
+		roleRules[r.Namespace][r.Name] = r.Rules
+	}
+	errs := make([]error, 0)
+	for _, r := range roles.Items {
+		if inSliceString(r.Namespace, skipped) {
+			continue
+		}
+		custom, err := selector.isCustom(&r, r.ObjectMeta)
+		if err != nil {
+			return nil, nil, err
+		}
+		if custom {
+			errs = append(errs, verifyCustomRole("role", r.ObjectMeta, r.Rules, roleRules[r.Namespace], deprecatedRoleTemplates)...)
+		}
+	}
+	return errs, roleRules, nil
+}
+
+func verifyCustomRole(kind string, meta metav1.ObjectMeta, rules []v1.PolicyRule, templates map[string][]v1.PolicyRule, deprecatedRoleTemplates []string) []error {
+	name := meta.Name
+	if meta.Namespace != "" {
+		name = fmt.Sprintf("%s/%s", meta.Namespace, meta.Name)
+	}
+
+	aggregateRoles, err := getAggregationRoles(meta)
+	if err != nil {
+		return []error{fmt.Errorf("%s %s has invalid aggregation roles: %v", kind, name, err)}
+	}
+
+	errs := make([]error, 0)
+	templateRules := make([]v1.PolicyRule, 0)
+	for _, a := range aggregateRoles {
+		if inSliceString(a, deprecatedRoleTemplates) {
+			errs = append(errs, fmt.Errorf("%s %s still aggregates the deprecated role template %s", kind, name, a))
+		}
+		templateRules = append(templateRules, templates[a]...)
+	}
+
+	if !equalRuleSets(rules, templateRules) {
+		errs = append(errs, fmt.Errorf("%s %s has rules that don't match its role templates %v", kind, name, aggregateRoles))
+	}
+	return errs
+}
+
+// equalRuleSets compares the rules ignoring their order and duplicates.
+func equalRuleSets(a, b []v1.PolicyRule) bool {
+	setA, setB := ruleSet(a), ruleSet(b)
+	if len(setA) != len(setB) {
+		return false
+	}
+	for r := range setA {
+		if !setB[r] {
+			return false
+		}
+	}
+	return true
+}
+
+func ruleSet(rules []v1.PolicyRule) map[string]bool {
+	set := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		marshal, _ := json.Marshal(r)
+		set[string(marshal)] = true
+	}
+	return set
+}
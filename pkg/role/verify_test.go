@@ -0,0 +1,63 @@
+package role
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/rbac/v1"
+)
+
+func TestVerifyCustomRoles(t *testing.T) {
+	roles := &v1.RoleList{Items: []v1.Role{
+		testTemplate("ns1", "role-template-view", viewRule),
+		testTemplate("ns1", "role-template-manage-members", manageRule),
+		testRole("ns1", "migrated", `["role-template-view"]`, viewRule, viewRule),
+		testRole("ns1", "deprecated", `["role-template-view","role-template-manage-members"]`, manageRule, viewRule),
+		testRole("ns1", "drifted", `["role-template-view"]`, viewRule, manageRule),
+		testRole("ns1", "invalid", `role-template-view`, viewRule),
+		testRole("devops", "deprecated", `["role-template-manage-members"]`),
+	}}
+	selector, err := newCustomRoleSelector(roleTypeRole, NewOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, rules, err := verifyCustomRoles(roles, []string{"devops"}, selector, deprecatedRoleTemplateList[roleTypeRole])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"role ns1/deprecated still aggregates the deprecated role template role-template-manage-members",
+		"role ns1/drifted has rules that don't match its role templates",
+		"role ns1/invalid has invalid aggregation roles",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("got the errors %v, expected %d", errs, len(expected))
+	}
+	for i, part := range expected {
+		if !strings.Contains(errs[i].Error(), part) {
+			t.Errorf("error %v doesn't contain %q", errs[i], part)
+		}
+	}
+	if len(rules["ns1"]) != 6 || len(rules["devops"]) != 1 {
+		t.Errorf("the rules are indexed by namespace with %d and %d roles", len(rules["ns1"]), len(rules["devops"]))
+	}
+}
+
+func TestEqualRuleSets(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  []v1.PolicyRule
+		equal bool
+	}{
+		{name: "order", a: []v1.PolicyRule{viewRule, manageRule}, b: []v1.PolicyRule{manageRule, viewRule}, equal: true},
+		{name: "duplicates", a: []v1.PolicyRule{viewRule, viewRule}, b: []v1.PolicyRule{viewRule}, equal: true},
+		{name: "empty", a: nil, b: []v1.PolicyRule{}, equal: true},
+		{name: "missing rule", a: []v1.PolicyRule{viewRule}, b: []v1.PolicyRule{viewRule, manageRule}},
+		{name: "different rule", a: []v1.PolicyRule{viewRule}, b: []v1.PolicyRule{manageRule}},
+	}
+	for _, test := range tests {
+		if equal := equalRuleSets(test.a, test.b); equal != test.equal {
+			t.Errorf("%s: equalRuleSets() = %t, expected %t", test.name, equal, test.equal)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Step reshapes a document from the schema of a minor release to the schema of the next one.
+// The fields are dot separated paths, e.g. common.es.elkPrefix.
+type Step struct {
+	// From and To are the minor releases, e.g. v3.3 and v3.4.
+	From string
+	To   string
+	// Moves are the fields which moved, their values are kept.
+	Moves []Move
+	// Removed are the fields which have no equivalent in To, they're left untouched and reported.
+	Removed []Removed
+}
+
+type Move struct {
+	From string
+	To   string
+	// Convert converts the value to the type of the new field, e.g. seconds to a duration,
+	// the value is moved as it is if it's nil.
+	Convert func(value interface{}) (interface{}, error)
+}
+
+type Removed struct {
+	Path string
+	// Reason tells the user what to do instead.
+	Reason string
+}
+
+// Warning is a user setting which couldn't be converted.
+type Warning struct {
+	Step    string      `json:"step"`
+	Path    string      `json:"path"`
+	Value   interface{} `json:"value,omitempty"`
+	Message string      `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s: %s", w.Step, w.Path, w.Message)
+}
+
+// Result tells what a migration did.
+type Result struct {
+	// Steps are the applied steps, e.g. v3.3->v3.4.
+	Steps []string
+	// Moved are the moved fields as from->to.
+	Moved    []string
+	Warnings []Warning
+}
+
+// Migrate applies to the document, in order, the steps between the source and the target
+// releases. A moved field never overwrites a value the user already set at its new path,
+// both are kept and a warning is reported instead. Migrating a migrated document changes nothing.
+func Migrate(document map[string]interface{}, steps []Step, source, target string) (*Result, error) {
+	sourceVersion, err := ParseVersion(source)
+	if err != nil {
+		return nil, err
+	}
+	targetVersion, err := ParseVersion(target)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Steps: make([]string, 0), Moved: make([]string, 0), Warnings: make([]Warning, 0)}
+	for _, step := range steps {
+		from, err := ParseVersion(step.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := ParseVersion(step.To)
+		if err != nil {
+			return nil, err
+		}
+		if from.Less(sourceVersion) || targetVersion.Less(to) {
+			continue
+		}
+		name := fmt.Sprintf("%s->%s", step.From, step.To)
+		result.Steps = append(result.Steps, name)
+
+		for _, move := range step.Moves {
+			value, found := Get(document, move.From)
+			if !found {
+				continue
+			}
+			if move.Convert != nil {
+				if value, err = move.Convert(value); err != nil {
+					return nil, fmt.Errorf("%s: convert %s failed: %v", name, move.From, err)
+				}
+			}
+			if current, exists := Get(document, move.To); exists && !reflect.DeepEqual(current, value) {
+				result.Warnings = append(result.Warnings, Warning{Step: name, Path: move.From, Value: value,
+					Message: fmt.Sprintf("not moved to %s, which is already set to %v", move.To, current)})
+				continue
+			}
+			if err := Set(document, move.To, value); err != nil {
+				return nil, fmt.Errorf("%s: move %s to %s failed: %v", name, move.From, move.To, err)
+			}
+			Remove(document, move.From)
+			result.Moved = append(result.Moved, fmt.Sprintf("%s->%s", move.From, move.To))
+		}
+		for _, removed := range step.Removed {
+			if value, found := Get(document, removed.Path); found {
+				result.Warnings = append(result.Warnings, Warning{Step: name, Path: removed.Path, Value: value,
+					Message: fmt.Sprintf("no equivalent in %s, %s", step.To, removed.Reason)})
+			}
+		}
+	}
+	return result, nil
+}
+
+// Get returns the value of a field.
+func Get(document map[string]interface{}, path string) (interface{}, bool) {
+	fields := strings.Split(path, ".")
+	current := document
+	for i, field := range fields {
+		value, ok := current[field]
+		if !ok {
+			return nil, false
+		}
+		if i == len(fields)-1 {
+			return value, true
+		}
+		if current, ok = value.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// Set sets a field, the missing parents are created.
+func Set(document map[string]interface{}, path string, value interface{}) error {
+	fields := strings.Split(path, ".")
+	current := document
+	for i, field := range fields[:len(fields)-1] {
+		next, ok := current[field]
+		if !ok || next == nil {
+			next = make(map[string]interface{})
+			current[field] = next
+		}
+		if current, ok = next.(map[string]interface{}); !ok {
+			return fmt.Errorf("%s isn't an object", strings.Join(fields[:i+1], "."))
+		}
+	}
+	current[fields[len(fields)-1]] = value
+	return nil
+}
+
+// Remove removes a field and the parents it leaves empty.
+func Remove(document map[string]interface{}, path string) {
+	fields := strings.Split(path, ".")
+	parent, ok := document[fields[0]]
+	if len(fields) == 1 || !ok {
+		delete(document, fields[0])
+		return
+	}
+	if child, ok := parent.(map[string]interface{}); ok {
+		Remove(child, strings.Join(fields[1:], "."))
+		if len(child) == 0 {
+			delete(document, fields[0])
+		}
+	}
+}
+
+// SecondsToDuration converts a number of seconds to a duration like 2h0m0s, the fields
+// holding a duration read a bare number as nanoseconds.
+func SecondsToDuration(value interface{}) (interface{}, error) {
+	var seconds float64
+	switch v := value.(type) {
+	case float64:
+		seconds = v
+	case int64:
+		seconds = float64(v)
+	case int:
+		seconds = float64(v)
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a number of seconds", v)
+		}
+		seconds = parsed
+	default:
+		return nil, fmt.Errorf("%v isn't a number of seconds", value)
+	}
+	return time.Duration(seconds * float64(time.Second)).String(), nil
+}
+
+// Version is a minor release, the patch version is ignored.
+type Version struct {
+	Major int
+	Minor int
+}
+
+// ParseVersion parses a version like v3.1 or 3.1.2.
+func ParseVersion(s string) (Version, error) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(s), "v"), ".")
+	if len(parts) < 2 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	// ignore a pre-release suffix, e.g. 3.4-rc.1
+	minor, err := strconv.Atoi(strings.SplitN(parts[1], "-", 2)[0])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	return Version{Major: major, Minor: minor}, nil
+}
+
+func (v Version) Less(other Version) bool {
+	return v.Major < other.Major || (v.Major == other.Major && v.Minor < other.Minor)
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d", v.Major, v.Minor)
+}
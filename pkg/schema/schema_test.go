@@ -0,0 +1,110 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testSteps = []Step{
+	{
+		From:  "v3.0",
+		To:    "v3.1",
+		Moves: []Move{{From: "auth.maxAgeSeconds", To: "auth.maxAge", Convert: SecondsToDuration}},
+	},
+	{
+		From:    "v3.1",
+		To:      "v3.2",
+		Moves:   []Move{{From: "common.es.elkPrefix", To: "logging.prefix"}},
+		Removed: []Removed{{Path: "weave", Reason: "it's no longer supported"}},
+	},
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name     string
+		document map[string]interface{}
+		source   string
+		target   string
+		expected map[string]interface{}
+		steps    []string
+		warnings int
+	}{
+		{
+			name:     "all steps",
+			document: map[string]interface{}{"auth": map[string]interface{}{"maxAgeSeconds": float64(7200)}, "common": map[string]interface{}{"es": map[string]interface{}{"elkPrefix": "logstash"}}},
+			source:   "v3.0",
+			target:   "v3.2",
+			expected: map[string]interface{}{"auth": map[string]interface{}{"maxAge": "2h0m0s"}, "logging": map[string]interface{}{"prefix": "logstash"}},
+			steps:    []string{"v3.0->v3.1", "v3.1->v3.2"},
+		},
+		{
+			name:     "steps outside of the range are skipped",
+			document: map[string]interface{}{"auth": map[string]interface{}{"maxAgeSeconds": float64(60)}, "weave": true},
+			source:   "3.1.2",
+			target:   "v3.2",
+			expected: map[string]interface{}{"auth": map[string]interface{}{"maxAgeSeconds": float64(60)}, "weave": true},
+			steps:    []string{"v3.1->v3.2"},
+			warnings: 1,
+		},
+		{
+			name:     "a set field isn't overwritten",
+			document: map[string]interface{}{"common": map[string]interface{}{"es": map[string]interface{}{"elkPrefix": "logstash"}}, "logging": map[string]interface{}{"prefix": "ks"}},
+			source:   "v3.1",
+			target:   "v3.2",
+			expected: map[string]interface{}{"common": map[string]interface{}{"es": map[string]interface{}{"elkPrefix": "logstash"}}, "logging": map[string]interface{}{"prefix": "ks"}},
+			steps:    []string{"v3.1->v3.2"},
+			warnings: 1,
+		},
+		{
+			name:     "a migrated document is unchanged",
+			document: map[string]interface{}{"auth": map[string]interface{}{"maxAge": "2h0m0s"}, "logging": map[string]interface{}{"prefix": "logstash"}},
+			source:   "v3.0",
+			target:   "v3.2",
+			expected: map[string]interface{}{"auth": map[string]interface{}{"maxAge": "2h0m0s"}, "logging": map[string]interface{}{"prefix": "logstash"}},
+			steps:    []string{"v3.0->v3.1", "v3.1->v3.2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := Migrate(test.document, testSteps, test.source, test.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(test.document, test.expected) {
+				t.Errorf("document is %v, expected %v", test.document, test.expected)
+			}
+			if !reflect.DeepEqual(result.Steps, test.steps) {
+				t.Errorf("steps are %v, expected %v", result.Steps, test.steps)
+			}
+			if len(result.Warnings) != test.warnings {
+				t.Errorf("warnings are %v, expected %d", result.Warnings, test.warnings)
+			}
+		})
+	}
+}
+
+func TestSecondsToDuration(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+		err      bool
+	}{
+		{value: float64(7200), expected: "2h0m0s"},
+		{value: float64(1.5), expected: "1.5s"},
+		{value: int64(90), expected: "1m30s"},
+		{value: 0, expected: "0s"},
+		{value: "45", expected: "45s"},
+		{value: "2h", err: true},
+		{value: true, err: true},
+	}
+	for _, test := range tests {
+		got, err := SecondsToDuration(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("SecondsToDuration(%v) failed: %v", test.value, err)
+			continue
+		}
+		if err == nil && got != test.expected {
+			t.Errorf("SecondsToDuration(%v) = %v, expected %s", test.value, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package task
+
+import "errors"
+
+// ErrAborted is returned when the run was aborted while a change was being approved.
+var ErrAborted = errors.New("upgrade aborted")
+
+// isAborted tells whether a job failed because the run was aborted.
+func isAborted(err error) bool {
+	return errors.Is(err, ErrAborted)
+}
+
+// Approver is asked before every change which modifies or deletes an existing object,
+// current is the object as it is in the cluster. A rejected change is skipped and reported,
+// ErrAborted stops the task.
+type Approver interface {
+	Approve(change Change, current []byte) (bool, error)
+}
+
+// SkippedChange is a change which wasn't applied, it has to be handled manually.
+type SkippedChange struct {
+	Operation   string `json:"operation"`
+	Object      string `json:"object"`
+	Description string `json:"description,omitempty"`
+	Reason      string `json:"reason"`
+}
@@ -0,0 +1,381 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// OperationRecreate deletes the object and creates it again, it's used when
+// the object can't be updated in place.
+const OperationRecreate = "recreate"
+
+// Change is a single mutation an upgrade task is going to perform.
+type Change struct {
+	Operation string `json:"operation"`
+	// Path is the absolute path of the collection the object belongs to.
+	Path string `json:"path"`
+	Name string `json:"name"`
+	// ResourceVersion is the version of the object the change was computed from.
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	// Object is the desired state of the object, it's empty for deletions.
+	Object json.RawMessage `json:"object,omitempty"`
+	// Patch is the JSON merge patch from the current to the desired state, for reviewing only.
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// DependsOn lists the keys of the changes that must be applied before this one.
+	DependsOn   []string `json:"dependsOn,omitempty"`
+	Description string   `json:"description,omitempty"`
+	// Redact are the fields holding secrets, e.g. spec.password. They're masked in the logs and the
+	// diffs and left out of the journal, a rollback keeps their current values.
+	Redact []string `json:"redact,omitempty"`
+	// RestoreRedacted keeps the values of the redacted fields in the state Secret of the run instead,
+	// so that a rollback restores them, e.g. credentials which are moved elsewhere.
+	RestoreRedacted bool `json:"restoreRedacted,omitempty"`
+	// Garbage marks the deletion of garbage, e.g. an expired login record. It isn't journaled, nor
+	// logged one by one, since there may be too many.
+	Garbage bool `json:"garbage,omitempty"`
+}
+
+func (c Change) Key() string {
+	return ChangeKey(c.Path, c.Name)
+}
+
+func ChangeKey(path, name string) string {
+	return fmt.Sprintf("%s/%s", path, name)
+}
+
+// Planner is implemented by the tasks that can compute their changes without applying them.
+type Planner interface {
+	Plan() ([]Change, error)
+}
+
+// BatchPlanner is implemented by the Planners whose changes are too many to be held at once, e.g. the
+// garbage collection of large collections. A run applies every batch as soon as it's planned, Plan returns
+// all the batches.
+type BatchPlanner interface {
+	Planner
+	PlanBatches(apply func(changes []Change) error) error
+}
+
+// Namer is implemented by the tasks that have a stable name, it's used to match saved plans.
+type Namer interface {
+	Name() string
+}
+
+func Name(t UpgradeTask) string {
+	if namer, ok := t.(Namer); ok {
+		return namer.Name()
+	}
+	return fmt.Sprintf("%T", t)
+}
+
+// Select returns the tasks with the given names in the given order, all tasks if no name is given.
+func Select(tasks []UpgradeTask, names []string) ([]UpgradeTask, error) {
+	if len(names) == 0 {
+		return tasks, nil
+	}
+	byName := make(map[string]UpgradeTask, len(tasks))
+	for _, t := range tasks {
+		byName[Name(t)] = t
+	}
+	selected := make([]UpgradeTask, 0, len(names))
+	for _, name := range names {
+		t, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown task %s", name)
+		}
+		selected = append(selected, t)
+	}
+	return selected, nil
+}
+
+// Applier applies changes in parallel and records them in the journal.
+type Applier struct {
+	client kubernetes.Interface
+	// options are kept for the context of the run, it's set once the run holds its lock
+	options  *Options
+	executor *Executor
+	journal  *Journal
+	retry    wait.Backoff
+	dryRun   bool
+	approver Approver
+	filter   *Filter
+	// matcher matches the changes against the filter, it's created on first use
+	matcher *changeFilter
+
+	mutex   sync.Mutex
+	skipped []SkippedChange
+	// skippedKeys are the keys of the skipped changes, the changes depending on them are skipped too
+	skippedKeys map[string]bool
+}
+
+func NewApplier(client kubernetes.Interface, options *Options) *Applier {
+	backoff := options.Retry
+	if backoff.Steps < 1 {
+		// every request is sent at least once
+		backoff.Steps = 1
+	}
+	executor := NewExecutor(options.Concurrency)
+	// an aborted approval stops the jobs which didn't start, nobody is left to approve them
+	executor.Stop = func(err error) bool { return options.FailFast || isAborted(err) }
+	return &Applier{
+		client:   client,
+		options:  options,
+		executor: executor,
+		journal:  options.Journal,
+		retry:    backoff,
+		dryRun:   options.DryRun,
+		approver: options.Approver,
+		filter:   options.Filter,
+
+		skippedKeys: make(map[string]bool),
+	}
+}
+
+// Filter leaves out the changes of the objects not matching the filter of the options,
+// it returns the remaining changes and the number of changes left out.
+func (a *Applier) Filter(changes []Change) ([]Change, int, error) {
+	if a.filter.IsEmpty() {
+		return changes, 0, nil
+	}
+	if a.matcher == nil {
+		matcher, err := newChangeFilter(a.client, a.filter)
+		if err != nil {
+			return nil, 0, err
+		}
+		a.matcher = matcher
+	}
+	filtered, excluded, err := a.matcher.Filter(changes)
+	if err != nil {
+		return nil, 0, fmt.Errorf("filter changes failed: %v", err)
+	}
+	if excluded > 0 {
+		klog.Infof("%d changes left out by the filter %s", excluded, a.filter)
+	}
+	return filtered, excluded, nil
+}
+
+// TakeSkipped returns the changes skipped since it was last called.
+func (a *Applier) TakeSkipped() []SkippedChange {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	skipped := a.skipped
+	a.skipped = nil
+	return skipped
+}
+
+func (a *Applier) skip(change Change, reason string) {
+	klog.Warningf("skipped %s %s: %s", change.Operation, change.Key(), reason)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.skipped = append(a.skipped, SkippedChange{Operation: change.Operation, Object: change.Key(), Description: change.Description, Reason: reason})
+	a.skippedKeys[change.Key()] = true
+}
+
+// approve asks the approver whether the change may be applied, it's skipped otherwise.
+func (a *Applier) approve(change Change) (bool, error) {
+	a.mutex.Lock()
+	for _, key := range change.DependsOn {
+		if a.skippedKeys[key] {
+			a.mutex.Unlock()
+			a.skip(change, fmt.Sprintf("it depends on %s which was skipped", key))
+			return false, nil
+		}
+	}
+	a.mutex.Unlock()
+
+	if a.approver == nil || change.Operation == OperationCreate {
+		return true, nil
+	}
+	current, err := a.doRaw(func() *rest.Request { return a.client.Discovery().RESTClient().Get().AbsPath(change.Key()) })
+	if err != nil {
+		return false, err
+	}
+	approved, err := a.approver.Approve(change, current)
+	if err != nil {
+		return false, err
+	}
+	if !approved {
+		a.skip(change, "rejected interactively")
+	}
+	return approved, nil
+}
+
+// PlanAndApply plans the changes of a task, filters them and applies them, it's the Run of the tasks
+// which are Planners.
+func (a *Applier) PlanAndApply(planner Planner) error {
+	if batchPlanner, ok := planner.(BatchPlanner); ok {
+		return batchPlanner.PlanBatches(func(changes []Change) error {
+			changes, _, err := a.Filter(changes)
+			if err != nil {
+				return err
+			}
+			return a.Apply(changes)
+		})
+	}
+	changes, err := planner.Plan()
+	if err != nil {
+		klog.Error(err)
+		return err
+	}
+	if changes, _, err = a.Filter(changes); err != nil {
+		return err
+	}
+	return a.Apply(changes)
+}
+
+func (a *Applier) Apply(changes []Change) error {
+	jobs := make([]Job, 0, len(changes))
+	for i := range changes {
+		change := changes[i]
+		jobs = append(jobs, Job{
+			Key:       change.Key(),
+			DependsOn: change.DependsOn,
+			Run: func() error {
+				return a.apply(change)
+			},
+		})
+	}
+	return a.executor.ExecuteContext(a.options.context(), jobs)
+}
+
+func (a *Applier) apply(change Change) error {
+	restClient := a.client.Discovery().RESTClient()
+	path := change.Key()
+
+	if a.dryRun {
+		if change.Garbage {
+			klog.V(4).Infof("dry-run: %s %s: %s", change.Operation, path, change.Description)
+			return nil
+		}
+		if len(change.Patch) > 0 {
+			patch, err := Redact(change.Patch, change.Redact)
+			if err != nil {
+				return err
+			}
+			klog.Infof("dry-run: %s %s: %s, patch: %s", change.Operation, path, change.Description, patch)
+		} else {
+			klog.Infof("dry-run: %s %s: %s", change.Operation, path, change.Description)
+		}
+		return nil
+	}
+
+	if approved, err := a.approve(change); err != nil || !approved {
+		return err
+	}
+
+	create := func() *rest.Request { return restClient.Post().AbsPath(change.Path).Body([]byte(change.Object)) }
+	remove := func() *rest.Request { return restClient.Delete().AbsPath(path) }
+
+	switch change.Operation {
+	case OperationCreate:
+		a.journal.Record(JournalEntry{Operation: OperationCreate, Path: change.Path, Name: change.Name})
+		if err := a.do(create); err != nil {
+			return err
+		}
+	case OperationUpdate:
+		if err := a.record(OperationUpdate, change); err != nil {
+			return err
+		}
+		if err := a.do(func() *rest.Request { return restClient.Put().AbsPath(path).Body([]byte(change.Object)) }); err != nil {
+			return err
+		}
+	case OperationDelete:
+		if change.Garbage {
+			if err := a.do(remove); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			klog.V(4).Infof("%s %s: %s", change.Operation, path, change.Description)
+			return nil
+		}
+		// an object which is already gone was deleted concurrently, e.g. by its controller
+		if err := a.record(OperationDelete, change); err != nil {
+			if errors.IsNotFound(err) {
+				klog.V(4).Infof("%s was already deleted", path)
+				return nil
+			}
+			return err
+		}
+		if err := a.do(remove); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	case OperationRecreate:
+		if err := a.record(OperationDelete, change); err != nil {
+			return err
+		}
+		if err := a.do(remove); err != nil {
+			return err
+		}
+		a.journal.Record(JournalEntry{Operation: OperationCreate, Path: change.Path, Name: change.Name})
+		if err := a.do(create); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown operation %s", change.Operation)
+	}
+
+	klog.Infof("%s %s: %s", change.Operation, path, change.Description)
+	return nil
+}
+
+// do sends the request, it's sent again while it fails with a transient error.
+// The request is built for every attempt since its body can only be read once.
+func (a *Applier) do(request func() *rest.Request) error {
+	_, err := a.doRaw(request)
+	return err
+}
+
+func (a *Applier) doRaw(request func() *rest.Request) ([]byte, error) {
+	var raw []byte
+	err := retry.OnError(a.retry, IsTransient, func() error {
+		var err error
+		raw, err = request().DoRaw(context.TODO())
+		if err != nil && IsTransient(err) {
+			klog.Warningf("%s, retrying", err)
+		}
+		return err
+	})
+	return raw, err
+}
+
+// IsTransient reports whether the API call may succeed when it's retried.
+func IsTransient(err error) bool {
+	return errors.IsServerTimeout(err) || errors.IsTimeout(err) || errors.IsTooManyRequests(err) ||
+		errors.IsServiceUnavailable(err) || errors.IsInternalError(err) ||
+		utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+}
+
+// record saves the current state of the object in the journal before it's mutated.
+func (a *Applier) record(operation string, change Change) error {
+	if a.journal == nil {
+		return nil
+	}
+	raw, err := a.doRaw(func() *rest.Request { return a.client.Discovery().RESTClient().Get().AbsPath(change.Key()) })
+	if err != nil {
+		return err
+	}
+	entry := JournalEntry{Operation: operation, Path: change.Path, Name: change.Name, Object: raw}
+	if len(change.Redact) == 0 {
+		a.journal.Record(entry)
+		return nil
+	}
+	var values map[string]interface{}
+	if entry.Object, values, err = cutFields(raw, change.Redact); err != nil {
+		return err
+	}
+	entry.Redacted = change.Redact
+	if change.RestoreRedacted {
+		return a.journal.RecordSecret(entry, values)
+	}
+	a.journal.Record(entry)
+	return nil
+}
@@ -0,0 +1,260 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const DefaultConcurrency = 1
+
+// Options holds the runtime options shared by all upgrade tasks.
+type Options struct {
+	// RunID identifies the upgrade run, the state of the run is stored under it.
+	RunID string
+	// Cluster is the name of the cluster the run targets when it fans out to the member clusters.
+	Cluster string
+	// Concurrency is the maximum number of objects processed in parallel.
+	Concurrency int
+	// Journal records every mutation of the run so that it can be undone.
+	Journal *Journal
+	// RollbackOnFailure undoes the mutations of a task when it fails.
+	RollbackOnFailure bool
+	// FailFast stops applying the changes of a task at its first failure, only the changes depending
+	// on the failed one are skipped otherwise.
+	FailFast bool
+	// BackupDir is a directory the journal is copied to, it's only kept in the cluster if empty.
+	BackupDir string
+	// Paused is checked before each task, the run stops when it returns true.
+	Paused func() bool
+	// Context stops the run when it's done, e.g. once the lock of the run is lost. The changes
+	// which didn't start are canceled and the task isn't rolled back, no more mutation is made.
+	Context context.Context
+	// Retry is the backoff of the API calls failing with a transient error.
+	Retry wait.Backoff
+	// DryRun logs the changes instead of applying them.
+	DryRun bool
+	// Filter restricts the changes of every task to a subset of the objects, all objects are changed if it's nil.
+	Filter *Filter
+	// Approver approves every change before it's applied, all changes are applied if it's nil.
+	Approver Approver
+	// Hooks runs the hooks around the run and the tasks, no hook runs if it's nil.
+	Hooks HookRunner
+	// ReportSinks are where the record of the run is written when it finishes,
+	// "stdout", "file:<path>" or a http(s) URL it's posted to.
+	ReportSinks []string
+}
+
+func NewOptions() *Options {
+	runID := time.Now().UTC().Format("20060102-150405")
+	return &Options{
+		RunID:             runID,
+		Concurrency:       DefaultConcurrency,
+		Journal:           NewJournal(runID),
+		RollbackOnFailure: true,
+		Retry:             retry.DefaultBackoff,
+	}
+}
+
+// context returns the context of the run, it's never done if none is set.
+func (o *Options) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
+
+// Job is a unit of work on a single object.
+type Job struct {
+	// Key identifies the object, e.g. "namespace/name".
+	Key string
+	// DependsOn lists the keys of jobs that must succeed before this one starts.
+	// Keys which are not part of the same Execute call are ignored.
+	DependsOn []string
+	Run       func() error
+}
+
+// ErrCanceled is the error of the jobs which weren't started because the execution was stopped.
+var ErrCanceled = errors.New("canceled")
+
+// Executor runs independent jobs in parallel with bounded parallelism.
+type Executor struct {
+	concurrency int
+	// Stop tells whether the failure of a job stops the execution, the jobs which didn't start are
+	// canceled and the running ones finish. Only the dependents of a failed job are skipped if it's nil.
+	Stop func(err error) bool
+}
+
+func NewExecutor(concurrency int) *Executor {
+	if concurrency < 1 {
+		concurrency = DefaultConcurrency
+	}
+	return &Executor{concurrency: concurrency}
+}
+
+// Execute runs all jobs and waits for them to finish. A job starts only after every
+// job it depends on has succeeded; dependents of a failed job are not run.
+// The returned error aggregates the failures in the order the jobs were given.
+func (e *Executor) Execute(jobs []Job) error {
+	return e.ExecuteContext(context.Background(), jobs)
+}
+
+type jobResult struct {
+	index int
+	err   error
+}
+
+// ExecuteContext is Execute stopping when ctx is done, the jobs which didn't start are canceled.
+// The jobs are run by a fixed pool of workers fed with the jobs whose dependencies succeeded.
+func (e *Executor) ExecuteContext(ctx context.Context, jobs []Job) error {
+	index := make(map[string]int, len(jobs))
+	for i, job := range jobs {
+		if _, exists := index[job.Key]; exists {
+			return fmt.Errorf("duplicate job key %s", job.Key)
+		}
+		index[job.Key] = i
+	}
+
+	// detect dependency cycles up front, a cycle would block forever otherwise
+	if err := checkCycles(jobs, index); err != nil {
+		return err
+	}
+
+	// pending counts the dependencies of a job which haven't succeeded yet
+	pending := make([]int, len(jobs))
+	dependents := make([][]int, len(jobs))
+	for i, job := range jobs {
+		seen := make(map[int]bool, len(job.DependsOn))
+		for _, dep := range job.DependsOn {
+			j, ok := index[dep]
+			if !ok || j == i || seen[j] {
+				continue
+			}
+			seen[j] = true
+			pending[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	errs := make([]error, len(jobs))
+	finished := make([]bool, len(jobs))
+	ready := make([]int, 0, len(jobs))
+	for i := range jobs {
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	// finish records the result of a job, its dependents are ready once all their dependencies
+	// succeeded and are skipped as soon as one of them failed
+	var finish func(i int, err error)
+	finish = func(i int, err error) {
+		if finished[i] {
+			return
+		}
+		finished[i] = true
+		errs[i] = err
+		for _, d := range dependents[i] {
+			if err != nil {
+				finish(d, fmt.Errorf("skip %s: dependency %s failed", jobs[d].Key, jobs[i].Key))
+				continue
+			}
+			if pending[d]--; pending[d] == 0 && !finished[d] {
+				ready = append(ready, d)
+			}
+		}
+	}
+
+	work := make(chan int)
+	results := make(chan jobResult)
+	wg := sync.WaitGroup{}
+	for w := 0; w < e.concurrency && w < len(jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results <- jobResult{index: i, err: jobs[i].Run()}
+			}
+		}()
+	}
+
+	var stopped error
+	running := 0
+	for {
+		if stopped == nil && ctx.Err() != nil {
+			stopped = ctx.Err()
+		}
+		// every running job holds a worker, so an idle worker is waiting for the next job
+		for len(ready) > 0 && (running < e.concurrency || stopped != nil) {
+			i := ready[0]
+			ready = ready[1:]
+			if finished[i] {
+				continue
+			}
+			if stopped != nil {
+				finish(i, fmt.Errorf("skip %s: %w", jobs[i].Key, ErrCanceled))
+				continue
+			}
+			running++
+			work <- i
+		}
+		if running == 0 {
+			break
+		}
+		result := <-results
+		running--
+		if result.err == nil {
+			finish(result.index, nil)
+			continue
+		}
+		klog.Errorf("%s: %v", jobs[result.index].Key, result.err)
+		finish(result.index, fmt.Errorf("%s: %w", jobs[result.index].Key, result.err))
+		if stopped == nil && e.Stop != nil && e.Stop(result.err) {
+			stopped = result.err
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return utilerrors.NewAggregate(errs)
+}
+
+func checkCycles(jobs []Job, index map[string]int) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(jobs))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("dependency cycle detected at %s", jobs[i].Key)
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		for _, dep := range jobs[i].DependsOn {
+			if j, ok := index[dep]; ok && j != i {
+				if err := visit(j); err != nil {
+					return err
+				}
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range jobs {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package task
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExecute(t *testing.T) {
+	failure := errors.New("failure")
+	tests := []struct {
+		name string
+		// jobs maps the keys of the jobs to their dependencies, in order
+		jobs     [][]string
+		failing  []string
+		stop     bool
+		ran      []string
+		order    [][2]string
+		errParts []string
+	}{
+		{
+			name:  "chain",
+			jobs:  [][]string{{"c", "b"}, {"b", "a"}, {"a"}},
+			ran:   []string{"a", "b", "c"},
+			order: [][2]string{{"a", "b"}, {"b", "c"}},
+		},
+		{
+			name:  "diamond",
+			jobs:  [][]string{{"d", "b", "c"}, {"b", "a"}, {"c", "a"}, {"a"}},
+			ran:   []string{"a", "b", "c", "d"},
+			order: [][2]string{{"a", "b"}, {"a", "c"}, {"b", "d"}, {"c", "d"}},
+		},
+		{
+			name: "unknown dependencies are ignored",
+			jobs: [][]string{{"a", "missing"}, {"b", "b"}},
+			ran:  []string{"a", "b"},
+		},
+		{
+			name:     "dependents of a failure are skipped",
+			jobs:     [][]string{{"a"}, {"b", "a"}, {"c", "b"}, {"d"}},
+			failing:  []string{"a"},
+			ran:      []string{"a", "d"},
+			errParts: []string{"a: failure", "skip b: dependency a failed", "skip c: dependency b failed"},
+		},
+		{
+			name:     "stop cancels the jobs which didn't start",
+			jobs:     [][]string{{"a"}, {"b"}, {"c"}},
+			failing:  []string{"a"},
+			stop:     true,
+			ran:      []string{"a"},
+			errParts: []string{"a: failure", "skip b: canceled", "skip c: canceled"},
+		},
+		{
+			name:     "cycle",
+			jobs:     [][]string{{"a", "b"}, {"b", "a"}},
+			errParts: []string{"dependency cycle detected"},
+		},
+		{
+			name:     "duplicate key",
+			jobs:     [][]string{{"a"}, {"a"}},
+			errParts: []string{"duplicate job key a"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mutex := sync.Mutex{}
+			ran := make([]string, 0)
+			jobs := make([]Job, 0, len(test.jobs))
+			for _, job := range test.jobs {
+				key := job[0]
+				jobs = append(jobs, Job{Key: key, DependsOn: job[1:], Run: func() error {
+					mutex.Lock()
+					ran = append(ran, key)
+					mutex.Unlock()
+					if InSlice(key, test.failing) {
+						return failure
+					}
+					return nil
+				}})
+			}
+			concurrency := 4
+			if test.stop {
+				concurrency = 1
+			}
+			executor := NewExecutor(concurrency)
+			if test.stop {
+				executor.Stop = func(err error) bool { return true }
+			}
+
+			err := executor.Execute(jobs)
+			if len(test.errParts) == 0 && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, part := range test.errParts {
+				if err == nil || !strings.Contains(err.Error(), part) {
+					t.Errorf("error %v doesn't contain %q", err, part)
+				}
+			}
+			if len(ran) != len(test.ran) {
+				t.Fatalf("ran %v, expected %v", ran, test.ran)
+			}
+			for _, key := range test.ran {
+				if !InSlice(key, ran) {
+					t.Errorf("%s didn't run, ran %v", key, ran)
+				}
+			}
+			position := make(map[string]int, len(ran))
+			for i, key := range ran {
+				position[key] = i
+			}
+			for _, o := range test.order {
+				if position[o[0]] > position[o[1]] {
+					t.Errorf("%s ran before %s, ran %v", o[1], o[0], ran)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// WorkspaceLabel is the label of the objects, and the namespaces, belonging to a workspace.
+const WorkspaceLabel = "kubesphere.io/workspace"
+
+// Filter restricts a run to a subset of the objects, the changes of the other objects are
+// left out of the plan. Since the tasks plan only what still has to change, a later run
+// without a filter picks up exactly the objects a filtered run left out.
+type Filter struct {
+	// Namespaces are the namespaces of the objects, a Namespace object belongs to itself.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Workspaces are the workspaces of the objects, from their own label or the label of their namespace.
+	Workspaces []string `json:"workspaces,omitempty"`
+	// Selector is a label selector the objects must match.
+	Selector string `json:"selector,omitempty"`
+	// IncludeNames and ExcludeNames are patterns matched against the object names, a pattern
+	// enclosed in slashes is a regular expression, e.g. /^ws1-/, any other is a glob, e.g. ws1-*.
+	IncludeNames []string `json:"includeNames,omitempty"`
+	ExcludeNames []string `json:"excludeNames,omitempty"`
+}
+
+func (f *Filter) IsEmpty() bool {
+	return f == nil || (len(f.Namespaces) == 0 && len(f.Workspaces) == 0 && f.Selector == "" &&
+		len(f.IncludeNames) == 0 && len(f.ExcludeNames) == 0)
+}
+
+func (f *Filter) String() string {
+	parts := make([]string, 0)
+	add := func(name string, values []string) {
+		if len(values) > 0 && values[0] != "" {
+			parts = append(parts, fmt.Sprintf("%s %s", name, strings.Join(values, ",")))
+		}
+	}
+	add("namespaces", f.Namespaces)
+	add("workspaces", f.Workspaces)
+	add("selector", []string{f.Selector})
+	add("include names", f.IncludeNames)
+	add("exclude names", f.ExcludeNames)
+	return strings.Join(parts, "; ")
+}
+
+// Validate checks the selector and the name patterns.
+func (f *Filter) Validate() error {
+	if _, err := labels.Parse(f.Selector); err != nil {
+		return fmt.Errorf("invalid selector %s: %v", f.Selector, err)
+	}
+	for _, pattern := range append(append([]string{}, f.IncludeNames...), f.ExcludeNames...) {
+		if _, err := matchName(pattern, ""); err != nil {
+			return fmt.Errorf("invalid name pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchName(pattern, name string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(name), nil
+	}
+	return path.Match(pattern, name)
+}
+
+func matchAnyName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := matchName(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// changeFilter filters the changes of a run, the namespaces are looked up once for their workspace.
+type changeFilter struct {
+	client   kubernetes.Interface
+	filter   *Filter
+	selector labels.Selector
+
+	mutex      sync.Mutex
+	workspaces map[string]string
+}
+
+func newChangeFilter(client kubernetes.Interface, filter *Filter) (*changeFilter, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	selector, _ := labels.Parse(filter.Selector)
+	return &changeFilter{client: client, filter: filter, selector: selector, workspaces: make(map[string]string)}, nil
+}
+
+// Filter returns the changes of the objects matching the filter. A change depending on a
+// change which was left out is left out too, since it can't be applied safely.
+func (c *changeFilter) Filter(changes []Change) ([]Change, int, error) {
+	excluded := make(map[string]bool)
+	for _, change := range changes {
+		matched, err := c.matches(change)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !matched {
+			excluded[change.Key()] = true
+		}
+	}
+	for found := true; found; {
+		found = false
+		for _, change := range changes {
+			if excluded[change.Key()] {
+				continue
+			}
+			for _, key := range change.DependsOn {
+				if excluded[key] {
+					excluded[change.Key()] = true
+					found = true
+					break
+				}
+			}
+		}
+	}
+
+	filtered := make([]Change, 0, len(changes))
+	for _, change := range changes {
+		if !excluded[change.Key()] {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered, len(changes) - len(filtered), nil
+}
+
+type objectMeta struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+}
+
+func (c *changeFilter) matches(change Change) (bool, error) {
+	f := c.filter
+	namespace := changeNamespace(change)
+
+	if len(f.Namespaces) > 0 && !InSlice(namespace, f.Namespaces) {
+		return false, nil
+	}
+	if len(f.IncludeNames) > 0 && !matchAnyName(f.IncludeNames, change.Name) {
+		return false, nil
+	}
+	if matchAnyName(f.ExcludeNames, change.Name) {
+		return false, nil
+	}
+	if f.Selector == "" && len(f.Workspaces) == 0 {
+		return true, nil
+	}
+
+	// an existing object is matched by its labels in the cluster, the desired object of an update or
+	// a recreate may not carry them, e.g. a recreated role doesn't keep the labels of the users
+	raw := []byte(change.Object)
+	if change.Operation != OperationCreate {
+		current, err := c.client.Discovery().RESTClient().Get().AbsPath(change.Key()).DoRaw(context.TODO())
+		switch {
+		case err == nil:
+			raw = current
+		case !errors.IsNotFound(err):
+			return false, err
+		case len(raw) == 0:
+			// the object of a deletion is already gone, there's nothing left to match
+			return false, nil
+		}
+	}
+	meta := &objectMeta{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return false, err
+	}
+	if !c.selector.Matches(labels.Set(meta.Metadata.Labels)) {
+		return false, nil
+	}
+	if len(f.Workspaces) == 0 {
+		return true, nil
+	}
+	workspace := meta.Metadata.Labels[WorkspaceLabel]
+	if workspace == "" && namespace != "" {
+		var err error
+		if workspace, err = c.namespaceWorkspace(namespace); err != nil {
+			return false, err
+		}
+	}
+	return InSlice(workspace, f.Workspaces), nil
+}
+
+func (c *changeFilter) namespaceWorkspace(namespace string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if workspace, ok := c.workspaces[namespace]; ok {
+		return workspace, nil
+	}
+	raw, err := c.client.Discovery().RESTClient().Get().AbsPath("/api/v1/namespaces", namespace).DoRaw(context.TODO())
+	if err != nil {
+		return "", err
+	}
+	meta := &objectMeta{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return "", err
+	}
+	c.workspaces[namespace] = meta.Metadata.Labels[WorkspaceLabel]
+	return c.workspaces[namespace], nil
+}
+
+// changeNamespace returns the namespace of the object of a change, parsed from its path.
+func changeNamespace(change Change) string {
+	if strings.HasSuffix(change.Path, "/namespaces") {
+		return change.Name
+	}
+	parts := strings.Split(change.Path, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "namespaces" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// InSlice tells whether the slice contains e.
+func InSlice(e string, slice []string) bool {
+	for _, s := range slice {
+		if s == e {
+			return true
+		}
+	}
+	return false
+}
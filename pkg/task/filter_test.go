@@ -0,0 +1,123 @@
+package task
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestChangeFilter(t *testing.T) {
+	rolePath := CollectionPath("rbac.authorization.k8s.io", "v1", "roles", "ns1")
+	otherPath := CollectionPath("rbac.authorization.k8s.io", "v1", "roles", "ns2")
+	changes := []Change{
+		{Operation: OperationCreate, Path: rolePath, Name: "ws1-viewer", Object: []byte(`{"metadata":{"name":"ws1-viewer","labels":{"app":"a"}}}`)},
+		{Operation: OperationCreate, Path: rolePath, Name: "ws2-viewer", Object: []byte(`{"metadata":{"name":"ws2-viewer"}}`)},
+		{Operation: OperationCreate, Path: otherPath, Name: "ws1-admin", Object: []byte(`{"metadata":{"name":"ws1-admin","labels":{"app":"a"}}}`),
+			DependsOn: []string{ChangeKey(rolePath, "ws2-viewer")}},
+		{Operation: OperationCreate, Path: CollectionPath("", "v1", "namespaces", ""), Name: "ns1", Object: []byte(`{"metadata":{"name":"ns1"}}`)},
+	}
+	tests := []struct {
+		name     string
+		filter   *Filter
+		expected []string
+	}{
+		{
+			name:     "namespaces",
+			filter:   &Filter{Namespaces: []string{"ns1"}},
+			expected: []string{"ws1-viewer", "ws2-viewer", "ns1"},
+		},
+		{
+			name:     "glob",
+			filter:   &Filter{IncludeNames: []string{"ws1-*"}},
+			expected: []string{"ws1-viewer"},
+		},
+		{
+			name:     "regular expression",
+			filter:   &Filter{IncludeNames: []string{"/-viewer$/"}},
+			expected: []string{"ws1-viewer", "ws2-viewer"},
+		},
+		{
+			name:     "dependents of excluded changes are excluded",
+			filter:   &Filter{ExcludeNames: []string{"ws2-*"}},
+			expected: []string{"ws1-viewer", "ns1"},
+		},
+		{
+			name:     "selector",
+			filter:   &Filter{Selector: "app=a"},
+			expected: []string{"ws1-viewer"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := newChangeFilter(nil, test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filtered, excluded, err := filter.Filter(changes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(filtered))
+			for _, change := range filtered {
+				names = append(names, change.Name)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("filtered %v, expected %v", names, test.expected)
+			}
+			if excluded != len(changes)-len(test.expected) {
+				t.Errorf("excluded %d changes, expected %d", excluded, len(changes)-len(test.expected))
+			}
+		})
+	}
+}
+
+func TestFilterValidate(t *testing.T) {
+	tests := []struct {
+		filter *Filter
+		valid  bool
+	}{
+		{filter: &Filter{Selector: "app=a", IncludeNames: []string{"ws1-*", "/^ws2-/"}}, valid: true},
+		{filter: &Filter{Selector: "app in ("}, valid: false},
+		{filter: &Filter{ExcludeNames: []string{"/(/"}}, valid: false},
+		{filter: &Filter{IncludeNames: []string{"["}}, valid: false},
+	}
+	for _, test := range tests {
+		if err := test.filter.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate(%s) = %v, expected valid %t", test.filter, err, test.valid)
+		}
+	}
+}
+
+func TestFilterMissingObject(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := newChangeFilter(client, &Filter{Selector: "app=a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := CollectionPath("rbac.authorization.k8s.io", "v1", "roles", "ns1")
+	changes := []Change{
+		{Operation: OperationDelete, Path: path, Name: "gone"},
+		{Operation: OperationRecreate, Path: path, Name: "recreated", Object: []byte(`{"metadata":{"name":"recreated","labels":{"app":"a"}}}`)},
+	}
+	filtered, excluded, err := filter.Filter(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 1 || filtered[0].Name != "recreated" || excluded != 1 {
+		t.Errorf("filtered %v, excluded %d, expected the recreate only", filtered, excluded)
+	}
+}
@@ -0,0 +1,22 @@
+package task
+
+const (
+	HookPreRun   = "pre-run"
+	HookPostRun  = "post-run"
+	HookPreTask  = "pre-task"
+	HookPostTask = "post-task"
+)
+
+// HookRunner runs the hooks configured around the run and around every task, see pkg/hook.
+type HookRunner interface {
+	// RunHooks runs the hooks of a stage in order, taskName is empty for the run stages.
+	// The records of the hooks which ran are returned even if one failed.
+	RunHooks(stage, taskName string) ([]HookRecord, error)
+}
+
+type HookRecord struct {
+	Name    string `json:"name"`
+	Stage   string `json:"stage"`
+	Phase   string `json:"phase"`
+	Message string `json:"message,omitempty"`
+}
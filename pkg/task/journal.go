@@ -0,0 +1,294 @@
+package task
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	OperationCreate = "create"
+	OperationDelete = "delete"
+	OperationUpdate = "update"
+
+	journalKey = "journal.json.gz"
+)
+
+// JournalEntry records a single mutation performed by a task.
+type JournalEntry struct {
+	Operation string `json:"operation"`
+	// Path is the absolute path of the collection the object belongs to.
+	Path string `json:"path"`
+	Name string `json:"name"`
+	// Object is the state of the object before it was mutated, it's empty for creations.
+	Object json.RawMessage `json:"object,omitempty"`
+	// Redacted are the fields left out of Object, a rollback keeps their current values.
+	Redacted []string `json:"redacted,omitempty"`
+	// SecretKey is the key of the values of the redacted fields in the state Secret of the run, a
+	// rollback restores them instead of keeping the current values.
+	SecretKey string `json:"secretKey,omitempty"`
+}
+
+// Journal is the undo log of an upgrade run, it's persisted in a ConfigMap
+// so that a run can be rolled back later. The values of the redacted fields
+// which have to be restored are kept in a Secret next to it.
+type Journal struct {
+	RunID   string
+	mutex   sync.Mutex
+	entries []JournalEntry
+	// secrets are the values of the redacted fields by secret key
+	secrets map[string][]byte
+	// sequence numbers the secret keys, they must stay unique when entries are rolled back
+	sequence int
+}
+
+func NewJournal(runID string) *Journal {
+	return &Journal{RunID: runID, entries: make([]JournalEntry, 0), secrets: make(map[string][]byte)}
+}
+
+// Record appends an entry, it must be called before the mutation is sent to the apiserver.
+func (j *Journal) Record(entry JournalEntry) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.entries = append(j.entries, entry)
+}
+
+// RecordSecret appends an entry whose redacted fields are restored by a rollback, their values are kept
+// in the state Secret of the run.
+func (j *Journal) RecordSecret(entry JournalEntry, values map[string]interface{}) error {
+	if j == nil {
+		return nil
+	}
+	marshal, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.sequence++
+	entry.SecretKey = fmt.Sprintf("entry-%d", j.sequence)
+	for j.secrets[entry.SecretKey] != nil {
+		j.sequence++
+		entry.SecretKey = fmt.Sprintf("entry-%d", j.sequence)
+	}
+	j.secrets[entry.SecretKey] = marshal
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+func (j *Journal) Len() int {
+	if j == nil {
+		return 0
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return len(j.entries)
+}
+
+// Rollback undoes the entries recorded since the given position in reverse order.
+// Entries that could not be undone are kept in the journal and returned as errors.
+func (j *Journal) Rollback(client kubernetes.Interface, from int) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	failed := make([]JournalEntry, 0)
+	errs := make([]error, 0)
+	for i := len(j.entries) - 1; i >= from; i-- {
+		entry := j.entries[i]
+		if err := undo(client, entry, j.secrets[entry.SecretKey]); err != nil {
+			klog.Errorf("undo %s %s/%s failed: %v", entry.Operation, entry.Path, entry.Name, err)
+			errs = append(errs, fmt.Errorf("undo %s %s/%s: %v", entry.Operation, entry.Path, entry.Name, err))
+			failed = append([]JournalEntry{entry}, failed...)
+			continue
+		}
+		if entry.SecretKey != "" {
+			delete(j.secrets, entry.SecretKey)
+		}
+		klog.Infof("undone %s %s/%s", entry.Operation, entry.Path, entry.Name)
+	}
+	j.entries = append(j.entries[:from], failed...)
+	return utilerrors.NewAggregate(errs)
+}
+
+// undo undoes an entry, secret are the values of its redacted fields if they're restored.
+func undo(client kubernetes.Interface, entry JournalEntry, secret []byte) error {
+	restored := make(map[string]interface{})
+	if entry.SecretKey != "" {
+		if secret == nil {
+			return fmt.Errorf("the values of the redacted fields %s are missing from the state Secret of the run", strings.Join(entry.Redacted, ", "))
+		}
+		if err := json.Unmarshal(secret, &restored); err != nil {
+			return err
+		}
+	}
+
+	path := fmt.Sprintf("%s/%s", entry.Path, entry.Name)
+	switch entry.Operation {
+	case OperationCreate:
+		_, err := client.Discovery().RESTClient().Delete().AbsPath(path).DoRaw(context.TODO())
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	case OperationDelete:
+		object, err := stripServerFields(entry.Object, "")
+		if err != nil {
+			return err
+		}
+		if object, err = pasteFields(object, restored); err != nil {
+			return err
+		}
+		_, err = client.Discovery().RESTClient().Post().AbsPath(entry.Path).Body(object).DoRaw(context.TODO())
+		// the deletion was recorded but never happened
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	case OperationUpdate:
+		current := &metav1.PartialObjectMetadata{}
+		raw, err := client.Discovery().RESTClient().Get().AbsPath(path).DoRaw(context.TODO())
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, current); err != nil {
+			return err
+		}
+		object, err := stripServerFields(entry.Object, current.ResourceVersion)
+		if err != nil {
+			return err
+		}
+		if entry.SecretKey == "" && len(entry.Redacted) > 0 {
+			// the current values are kept
+			if _, restored, err = cutFields(raw, entry.Redacted); err != nil {
+				return err
+			}
+		}
+		if object, err = pasteFields(object, restored); err != nil {
+			return err
+		}
+		_, err = client.Discovery().RESTClient().Put().AbsPath(path).Body(object).DoRaw(context.TODO())
+		return err
+	default:
+		return fmt.Errorf("unknown operation %s", entry.Operation)
+	}
+}
+
+// stripServerFields removes the metadata set by the apiserver so that the object can be sent again.
+func stripServerFields(raw []byte, resourceVersion string) ([]byte, error) {
+	object := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		for _, field := range []string{"uid", "selfLink", "creationTimestamp", "managedFields", "generation"} {
+			delete(metadata, field)
+		}
+		if resourceVersion != "" {
+			metadata["resourceVersion"] = resourceVersion
+		} else {
+			delete(metadata, "resourceVersion")
+		}
+	}
+	return json.Marshal(object)
+}
+
+func (j *Journal) Marshal() ([]byte, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return json.Marshal(j.entries)
+}
+
+// Save persists the journal in the state ConfigMap of the run.
+func (j *Journal) Save(client kubernetes.Interface) error {
+	marshal, err := j.Marshal()
+	if err != nil {
+		return err
+	}
+
+	// the journal contains whole objects, compress it to stay below the size limit of a ConfigMap
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(marshal); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	err = updateState(client, j.RunID, func(cm *corev1.ConfigMap) {
+		if cm.BinaryData == nil {
+			cm.BinaryData = make(map[string][]byte)
+		}
+		cm.BinaryData[journalKey] = buf.Bytes()
+	})
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	secrets := make(map[string][]byte, len(j.secrets))
+	for key, value := range j.secrets {
+		secrets[key] = value
+	}
+	j.mutex.Unlock()
+	return updateStateSecret(client, j.RunID, secrets)
+}
+
+// LoadJournal reads the journal of a previous run from its state ConfigMap.
+func LoadJournal(client kubernetes.Interface, runID string) (*Journal, error) {
+	cm, err := client.CoreV1().ConfigMaps(StateNamespace).Get(context.TODO(), stateConfigMapName(runID), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	j := NewJournal(runID)
+	data, ok := cm.BinaryData[journalKey]
+	if !ok {
+		return j, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	marshal, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(marshal, &j.entries); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range j.entries {
+		if entry.SecretKey == "" {
+			continue
+		}
+		secret, err := client.CoreV1().Secrets(StateNamespace).Get(context.TODO(), stateSecretName(runID), metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil && secret.Data != nil {
+			j.secrets = secret.Data
+			j.sequence = len(secret.Data)
+		}
+		break
+	}
+	return j, nil
+}
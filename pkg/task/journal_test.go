@@ -0,0 +1,107 @@
+package task
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestJournalRollback(t *testing.T) {
+	path := CollectionPath("iam.kubesphere.io", "v1alpha2", "users", "")
+	current := map[string]string{
+		path + "/updated":  `{"metadata":{"name":"updated","resourceVersion":"5"},"spec":{"email":"b@kubesphere.io","password":"current"}}`,
+		path + "/restored": `{"metadata":{"name":"restored","resourceVersion":"7"},"spec":{"password":"moved"}}`,
+	}
+	mutex := sync.Mutex{}
+	requests := make([]string, 0)
+	bodies := make(map[string]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Method != http.MethodGet {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+		}
+		if body, _ := ioutil.ReadAll(r.Body); len(body) > 0 {
+			object := make(map[string]interface{})
+			if err := json.Unmarshal(body, &object); err != nil {
+				t.Error(err)
+			}
+			bodies[r.Method+" "+r.URL.Path] = object
+		}
+		switch {
+		case r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/failing"):
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Forbidden","code":403}`))
+		case r.Method == http.MethodGet:
+			_, _ = w.Write([]byte(current[r.URL.Path]))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal := NewJournal("test")
+	journal.Record(JournalEntry{Operation: OperationCreate, Path: path, Name: "kept"})
+	journal.Record(JournalEntry{Operation: OperationCreate, Path: path, Name: "created"})
+	journal.Record(JournalEntry{Operation: OperationCreate, Path: path, Name: "failing"})
+	journal.Record(JournalEntry{Operation: OperationDelete, Path: path, Name: "deleted",
+		Object: []byte(`{"metadata":{"name":"deleted","uid":"1","resourceVersion":"3","creationTimestamp":"2021-01-01T00:00:00Z"}}`)})
+	journal.Record(JournalEntry{Operation: OperationUpdate, Path: path, Name: "updated", Redacted: []string{"spec.password"},
+		Object: []byte(`{"metadata":{"name":"updated","resourceVersion":"4"},"spec":{"email":"a@kubesphere.io"}}`)})
+	err = journal.RecordSecret(JournalEntry{Operation: OperationUpdate, Path: path, Name: "restored", Redacted: []string{"spec.password"},
+		Object: []byte(`{"metadata":{"name":"restored","resourceVersion":"6"},"spec":{}}`)}, map[string]interface{}{"spec.password": "original"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = journal.Rollback(client, 1)
+	if err == nil || !strings.Contains(err.Error(), "undo create "+path+"/failing") {
+		t.Errorf("the rollback didn't fail on the failing entry: %v", err)
+	}
+
+	expected := []string{
+		"PUT " + path + "/restored",
+		"PUT " + path + "/updated",
+		"POST " + path,
+		"DELETE " + path + "/failing",
+		"DELETE " + path + "/created",
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("the rollback sent %v, expected %v", requests, expected)
+	}
+	// the updates are reverted at the current resourceVersion, the redacted field keeps its current value
+	// or the value of the state Secret
+	objects := map[string]string{
+		"PUT " + path + "/restored": `{"metadata":{"name":"restored","resourceVersion":"7"},"spec":{"password":"original"}}`,
+		"PUT " + path + "/updated":  `{"metadata":{"name":"updated","resourceVersion":"5"},"spec":{"email":"a@kubesphere.io","password":"current"}}`,
+		"POST " + path:              `{"metadata":{"name":"deleted"}}`,
+	}
+	for request, object := range objects {
+		expected := make(map[string]interface{})
+		_ = json.Unmarshal([]byte(object), &expected)
+		if !reflect.DeepEqual(bodies[request], expected) {
+			t.Errorf("%s sent %v, expected %v", request, bodies[request], expected)
+		}
+	}
+
+	// the failed entry is kept to be rolled back later, the secret of the restored entry is dropped
+	if journal.Len() != 2 || journal.entries[1].Name != "failing" {
+		t.Errorf("the journal keeps %v, expected the kept and the failing entries", journal.entries)
+	}
+	if len(journal.secrets) != 0 {
+		t.Errorf("the journal keeps the secrets %v", journal.secrets)
+	}
+}
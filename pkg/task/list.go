@@ -0,0 +1,99 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// listPageSize is the number of objects requested at a time, so that large
+// collections don't have to be held by the apiserver in one response.
+const listPageSize = 500
+
+// CollectionPath returns the absolute path of a collection, namespace is empty for
+// cluster scoped resources or to list a namespaced resource in all namespaces.
+func CollectionPath(group, version, resource, namespace string) string {
+	path := fmt.Sprintf("/apis/%s/%s", group, version)
+	if group == "" {
+		path = fmt.Sprintf("/api/%s", version)
+	}
+	if namespace != "" {
+		path = fmt.Sprintf("%s/namespaces/%s", path, namespace)
+	}
+	return fmt.Sprintf("%s/%s", path, resource)
+}
+
+// ObjectCollectionPath returns the path of the collection an object of a resource belongs to.
+func ObjectCollectionPath(group, version, resource string, object *unstructured.Unstructured) string {
+	return CollectionPath(group, version, resource, object.GetNamespace())
+}
+
+type objectList struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []map[string]interface{} `json:"items"`
+}
+
+// ListObjects lists all the objects of a collection page by page, labelSelector and fieldSelector
+// may be empty. The apiVersion and kind of the items are set, the apiserver omits them for built-in resources.
+func ListObjects(client kubernetes.Interface, path, labelSelector, fieldSelector string) ([]*unstructured.Unstructured, error) {
+	objects := make([]*unstructured.Unstructured, 0)
+	err := ListObjectPages(client, path, labelSelector, fieldSelector, func(page []*unstructured.Unstructured) error {
+		objects = append(objects, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// ListObjectPages is ListObjects handing every page to f as soon as it's received, so that
+// collections too large to be held in memory can be processed.
+func ListObjectPages(client kubernetes.Interface, path, labelSelector, fieldSelector string, f func(page []*unstructured.Unstructured) error) error {
+	continueToken := ""
+	for {
+		request := client.Discovery().RESTClient().Get().AbsPath(path).Param("limit", fmt.Sprint(listPageSize))
+		if labelSelector != "" {
+			request = request.Param("labelSelector", labelSelector)
+		}
+		if fieldSelector != "" {
+			request = request.Param("fieldSelector", fieldSelector)
+		}
+		if continueToken != "" {
+			request = request.Param("continue", continueToken)
+		}
+		raw, err := request.DoRaw(context.TODO())
+		if err != nil {
+			return err
+		}
+		list := &objectList{}
+		if err := json.Unmarshal(raw, list); err != nil {
+			return err
+		}
+		page := make([]*unstructured.Unstructured, 0, len(list.Items))
+		for _, item := range list.Items {
+			object := &unstructured.Unstructured{Object: item}
+			if object.GetAPIVersion() == "" {
+				object.SetAPIVersion(list.APIVersion)
+			}
+			if object.GetKind() == "" {
+				object.SetKind(strings.TrimSuffix(list.Kind, "List"))
+			}
+			page = append(page, object)
+		}
+		if err := f(page); err != nil {
+			return err
+		}
+		if continueToken = list.Metadata.Continue; continueToken == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package task
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// CreateMergePatch returns the JSON merge patch (RFC 7386) turning the original object into
+// the modified one, it's recorded in the plan for reviewing. The metadata set by the apiserver is ignored.
+func CreateMergePatch(original, modified []byte) ([]byte, error) {
+	original, err := stripServerFields(original, "")
+	if err != nil {
+		return nil, err
+	}
+	modified, err = stripServerFields(modified, "")
+	if err != nil {
+		return nil, err
+	}
+
+	originalMap := make(map[string]interface{})
+	if err := json.Unmarshal(original, &originalMap); err != nil {
+		return nil, err
+	}
+	modifiedMap := make(map[string]interface{})
+	if err := json.Unmarshal(modified, &modifiedMap); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(originalMap, modifiedMap))
+}
+
+func mergePatch(original, modified map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for key, value := range modified {
+		originalValue, ok := original[key]
+		if !ok {
+			patch[key] = value
+			continue
+		}
+		originalObject, originalIsObject := originalValue.(map[string]interface{})
+		modifiedObject, modifiedIsObject := value.(map[string]interface{})
+		if originalIsObject && modifiedIsObject {
+			if nested := mergePatch(originalObject, modifiedObject); len(nested) > 0 {
+				patch[key] = nested
+			}
+			continue
+		}
+		if !reflect.DeepEqual(originalValue, value) {
+			patch[key] = value
+		}
+	}
+	for key := range original {
+		if _, ok := modified[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	return patch
+}
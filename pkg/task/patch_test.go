@@ -0,0 +1,65 @@
+package task
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCreateMergePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		modified string
+		expected string
+	}{
+		{
+			name:     "unchanged",
+			original: `{"metadata":{"name":"a"},"rules":[{"verbs":["get"]}]}`,
+			modified: `{"metadata":{"name":"a"},"rules":[{"verbs":["get"]}]}`,
+			expected: `{}`,
+		},
+		{
+			name:     "added, changed and removed fields",
+			original: `{"metadata":{"name":"a","labels":{"x":"1","y":"2"}},"spec":{"replicas":1}}`,
+			modified: `{"metadata":{"name":"a","labels":{"x":"3","z":"4"}},"spec":{"replicas":1}}`,
+			expected: `{"metadata":{"labels":{"x":"3","y":null,"z":"4"}}}`,
+		},
+		{
+			name:     "lists are replaced",
+			original: `{"rules":[{"verbs":["get"]},{"verbs":["list"]}]}`,
+			modified: `{"rules":[{"verbs":["get"]}]}`,
+			expected: `{"rules":[{"verbs":["get"]}]}`,
+		},
+		{
+			name:     "an object replacing a value",
+			original: `{"spec":"legacy"}`,
+			modified: `{"spec":{"value":"legacy"}}`,
+			expected: `{"spec":{"value":"legacy"}}`,
+		},
+		{
+			name:     "the server fields are ignored",
+			original: `{"metadata":{"name":"a","uid":"1","resourceVersion":"2","managedFields":[{}]}}`,
+			modified: `{"metadata":{"name":"a"}}`,
+			expected: `{}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := CreateMergePatch([]byte(test.original), []byte(test.modified))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, expected interface{}
+			if err := json.Unmarshal(patch, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.expected), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("patch is %s, expected %s", patch, test.expected)
+			}
+		})
+	}
+}
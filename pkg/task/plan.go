@@ -0,0 +1,80 @@
+package task
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	PlanAPIVersion = "ks-upgrade.kubesphere.io/v1alpha1"
+	PlanKind       = "Plan"
+)
+
+// Plan is the list of changes the upgrade tasks are going to perform,
+// it can be saved to a file, reviewed and applied later.
+type Plan struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Filter is the filter the changes were planned with.
+	Filter    *Filter    `json:"filter,omitempty"`
+	Tasks     []TaskPlan `json:"tasks"`
+	Signature *Signature `json:"signature,omitempty"`
+}
+
+type TaskPlan struct {
+	Name    string   `json:"name"`
+	Changes []Change `json:"changes"`
+	// Warnings are the objects the task leaves as they are, see Warner.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func NewPlan() *Plan {
+	return &Plan{APIVersion: PlanAPIVersion, Kind: PlanKind, CreatedAt: time.Now().UTC(), Tasks: make([]TaskPlan, 0)}
+}
+
+// Redacted returns a copy of the plan whose changes have their redacted fields masked, to be printed.
+// The signature is kept as it is, it doesn't match the masked changes.
+func (p *Plan) Redacted() (*Plan, error) {
+	redacted := *p
+	redacted.Tasks = make([]TaskPlan, 0, len(p.Tasks))
+	for _, taskPlan := range p.Tasks {
+		changes := make([]Change, 0, len(taskPlan.Changes))
+		for _, change := range taskPlan.Changes {
+			var err error
+			if change.Object, err = Redact(change.Object, change.Redact); err != nil {
+				return nil, err
+			}
+			if change.Patch, err = Redact(change.Patch, change.Redact); err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+		taskPlan.Changes = changes
+		redacted.Tasks = append(redacted.Tasks, taskPlan)
+	}
+	return &redacted, nil
+}
+
+// WritePlan writes the plan with the values of the redacted fields, which are needed to apply it, so
+// that only the owner can read it.
+func WritePlan(path string, plan *Plan) error {
+	marshal, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, marshal, 0600)
+}
+
+func ReadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
@@ -0,0 +1,79 @@
+package task
+
+import (
+	"encoding/json"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// redactedValue replaces the values of the redacted fields in the logs and the diffs.
+const redactedValue = "REDACTED"
+
+// Redact returns the object, or the patch, with the values of the fields masked. The keys of a
+// redacted map are kept so that a diff still tells which ones change. The fields are dot separated
+// paths, e.g. spec.password or data.
+func Redact(raw []byte, fields []string) ([]byte, error) {
+	if len(raw) == 0 || len(fields) == 0 {
+		return raw, nil
+	}
+	object := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		value, found, _ := unstructured.NestedFieldNoCopy(object, path...)
+		if !found || value == nil {
+			continue
+		}
+		if m, ok := value.(map[string]interface{}); ok {
+			masked := make(map[string]interface{}, len(m))
+			for k := range m {
+				masked[k] = redactedValue
+			}
+			value = masked
+		} else {
+			value = redactedValue
+		}
+		if err := unstructured.SetNestedField(object, value, path...); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(object)
+}
+
+// cutFields removes the fields from the object and returns their values by field.
+func cutFields(raw []byte, fields []string) ([]byte, map[string]interface{}, error) {
+	object := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, nil, err
+	}
+	values := make(map[string]interface{})
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		if value, found, _ := unstructured.NestedFieldNoCopy(object, path...); found {
+			values[field] = value
+			unstructured.RemoveNestedField(object, path...)
+		}
+	}
+	marshal, err := json.Marshal(object)
+	return marshal, values, err
+}
+
+// pasteFields sets the fields of the object to the values.
+func pasteFields(raw []byte, values map[string]interface{}) ([]byte, error) {
+	if len(values) == 0 {
+		return raw, nil
+	}
+	object := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	for field, value := range values {
+		if err := unstructured.SetNestedField(object, value, strings.Split(field, ".")...); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(object)
+}
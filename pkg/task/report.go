@@ -0,0 +1,63 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	SinkStdout     = "stdout"
+	sinkFilePrefix = "file:"
+)
+
+// Report writes the record of a run to every sink, see Options.ReportSinks.
+func Report(record *RunRecord, sinks []string) error {
+	if len(sinks) == 0 {
+		return nil
+	}
+	marshal, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	marshal = append(marshal, '\n')
+
+	for _, sink := range sinks {
+		switch {
+		case sink == SinkStdout:
+			_, err = os.Stdout.Write(marshal)
+		case strings.HasPrefix(sink, sinkFilePrefix):
+			path := strings.TrimPrefix(sink, sinkFilePrefix)
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = ioutil.WriteFile(path, marshal, 0644)
+			}
+		case strings.HasPrefix(sink, "http://") || strings.HasPrefix(sink, "https://"):
+			err = post(sink, marshal)
+		default:
+			err = fmt.Errorf("unknown report sink %s", sink)
+		}
+		if err != nil {
+			return fmt.Errorf("report run %s to %s failed: %v", record.ID, sink, err)
+		}
+	}
+	return nil
+}
+
+func post(url string, body []byte) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// ErrPaused is returned when the run was paused before all tasks ran.
+var ErrPaused = errors.New("upgrade paused")
+
+// ErrStopped is returned when the context of the run was done before all tasks ran.
+var ErrStopped = errors.New("upgrade stopped")
+
+// Runner runs the upgrade tasks in order, records the run and verifies the results.
+type Runner struct {
+	client  kubernetes.Interface
+	options *Options
+	tasks   []UpgradeTask
+	record  *RunRecord
+}
+
+func NewRunner(client kubernetes.Interface, options *Options, tasks ...UpgradeTask) *Runner {
+	return &Runner{client: client, options: options, tasks: tasks}
+}
+
+// Record returns the state of the current run, it's nil until the run started.
+func (r *Runner) Record() *RunRecord {
+	return r.record
+}
+
+// Plan computes the changes of every task without applying them.
+func (r *Runner) Plan() (*Plan, error) {
+	plan := NewPlan()
+	applier := NewApplier(r.client, r.options)
+	if !r.options.Filter.IsEmpty() {
+		plan.Filter = r.options.Filter
+	}
+	for _, t := range r.tasks {
+		planner, ok := t.(Planner)
+		if !ok {
+			klog.Warningf("%s doesn't support planning, its changes are unknown until it runs", Name(t))
+			continue
+		}
+		changes, err := planner.Plan()
+		if err != nil {
+			return nil, fmt.Errorf("plan %s failed: %v", Name(t), err)
+		}
+		if changes, _, err = applier.Filter(changes); err != nil {
+			return nil, fmt.Errorf("plan %s failed: %v", Name(t), err)
+		}
+		plan.Tasks = append(plan.Tasks, TaskPlan{Name: Name(t), Changes: changes, Warnings: warnings(t)})
+	}
+	return plan, nil
+}
+
+// Run plans and applies every task, then verifies the results.
+func (r *Runner) Run() error {
+	applier := NewApplier(r.client, r.options)
+	return r.run(func() error {
+		for _, t := range r.tasks {
+			if r.paused() {
+				return ErrPaused
+			}
+			if err := r.stopped(); err != nil {
+				return err
+			}
+			err := r.runTask(Name(t), func(record *TaskRecord) error {
+				planner, ok := t.(Planner)
+				if !ok {
+					err := t.Run()
+					if reporter, ok := t.(Reporter); ok {
+						record.Changes, record.Message = reporter.Result()
+					}
+					if skipper, ok := t.(Skipper); ok {
+						record.Skipped = skipper.TakeSkipped()
+					}
+					return err
+				}
+				// apply filters and applies the changes, the batches of a BatchPlanner one after the other
+				apply := func(changes []Change) error {
+					changes, filtered, err := applier.Filter(changes)
+					if err != nil {
+						return err
+					}
+					record.Changes += len(changes)
+					record.Filtered += filtered
+					return applier.Apply(changes)
+				}
+				var err error
+				if batchPlanner, ok := t.(BatchPlanner); ok {
+					err = batchPlanner.PlanBatches(apply)
+					record.Warnings = warnings(t)
+				} else {
+					var changes []Change
+					changes, err = planner.Plan()
+					record.Warnings = warnings(t)
+					if err != nil {
+						return err
+					}
+					err = apply(changes)
+				}
+				record.Skipped = applier.TakeSkipped()
+				if reporter, ok := t.(Reporter); ok {
+					_, record.Message = reporter.Result()
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return r.verifyRun()
+	})
+}
+
+// Apply applies the changes of a saved plan, then verifies the results.
+func (r *Runner) Apply(plan *Plan) error {
+	if r.options.Filter.IsEmpty() && plan.Filter != nil {
+		// the plan was filtered, so is the run
+		r.options.Filter = plan.Filter
+	}
+	applier := NewApplier(r.client, r.options)
+	return r.run(func() error {
+		for _, taskPlan := range plan.Tasks {
+			if r.paused() {
+				return ErrPaused
+			}
+			if err := r.stopped(); err != nil {
+				return err
+			}
+			changes := taskPlan.Changes
+			err := r.runTask(taskPlan.Name, func(record *TaskRecord) error {
+				record.Warnings = taskPlan.Warnings
+				changes, filtered, err := applier.Filter(changes)
+				if err != nil {
+					return err
+				}
+				record.Changes, record.Filtered = len(changes), filtered
+				err = applier.Apply(changes)
+				record.Skipped = applier.TakeSkipped()
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return r.verifyRun()
+	})
+}
+
+// warnings returns the warnings of the last plan of a task.
+func warnings(t UpgradeTask) []string {
+	if warner, ok := t.(Warner); ok {
+		return warner.Warnings()
+	}
+	return nil
+}
+
+// run records the run of the tasks, the post-run hooks run whatever the outcome
+// so that they can undo what the pre-run hooks did.
+func (r *Runner) run(runTasks func() error) error {
+	r.start()
+	err := r.runHooks(HookPreRun, "", &r.record.Hooks)
+	if err == nil {
+		err = runTasks()
+	}
+	if hookErr := r.runHooks(HookPostRun, "", &r.record.Hooks); hookErr != nil {
+		err = joinErrors(err, hookErr)
+	}
+	if err == ErrPaused {
+		return err
+	}
+	return r.finish(err)
+}
+
+// verifyRun verifies the results of the run, there's nothing to verify when the changes weren't
+// applied and a filtered run would fail the verification of the objects it left out.
+func (r *Runner) verifyRun() error {
+	if r.options.DryRun {
+		return nil
+	}
+	if !r.options.Filter.IsEmpty() {
+		klog.Infof("skipping verification, the run was filtered by %s", r.options.Filter)
+		return nil
+	}
+	return r.Verify()
+}
+
+func (r *Runner) start() {
+	r.record = &RunRecord{ID: r.options.RunID, Cluster: r.options.Cluster, Phase: PhaseRunning, StartTime: time.Now().UTC(), DryRun: r.options.DryRun, Tasks: make([]TaskRecord, 0)}
+	if !r.options.Filter.IsEmpty() {
+		r.record.Filter = r.options.Filter
+	} else if !r.options.DryRun {
+		r.completeFilteredRuns()
+	}
+	r.saveRecord()
+}
+
+// completeFilteredRuns records the filtered runs a full run completes, since the tasks plan only
+// what still has to change, the full run changes exactly the objects they left out.
+func (r *Runner) completeFilteredRuns() {
+	ids, err := filteredRuns(r.client, r.options.Cluster, r.options.RunID)
+	if err != nil {
+		klog.Warningf("list the filtered runs failed: %v", err)
+		return
+	}
+	if len(ids) > 0 {
+		klog.Infof("run %s completes the filtered runs %s, the objects they changed are already done", r.options.RunID, strings.Join(ids, ", "))
+		r.record.Completes = ids
+	}
+}
+
+func (r *Runner) paused() bool {
+	if r.options.Paused == nil || !r.options.Paused() {
+		return false
+	}
+	klog.Infof("run %s paused", r.options.RunID)
+	r.record.Phase = PhasePaused
+	r.saveRecord()
+	return true
+}
+
+// stopped returns ErrStopped once the context of the run is done.
+func (r *Runner) stopped() error {
+	if err := r.options.context().Err(); err != nil {
+		klog.Errorf("run %s stopped: %v", r.options.RunID, err)
+		return ErrStopped
+	}
+	return nil
+}
+
+// runHooks runs the hooks of a stage and appends their results to records.
+func (r *Runner) runHooks(stage, taskName string, records *[]HookRecord) error {
+	if r.options.Hooks == nil {
+		return nil
+	}
+	results, err := r.options.Hooks.RunHooks(stage, taskName)
+	*records = append(*records, results...)
+	r.saveRecord()
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %v", stage, err)
+	}
+	return nil
+}
+
+func (r *Runner) runTask(name string, run func(record *TaskRecord) error) error {
+	journal := r.options.Journal
+	klog.Infof("starting upgrade: %s", name)
+	r.record.Tasks = append(r.record.Tasks, TaskRecord{Name: name, Phase: PhaseRunning})
+	taskRecord := &r.record.Tasks[len(r.record.Tasks)-1]
+	r.saveRecord()
+
+	// a failing pre-task hook aborts the task before it changed anything
+	mark := journal.Len()
+	err := r.runHooks(HookPreTask, name, &taskRecord.Hooks)
+	if err == nil {
+		err = run(taskRecord)
+	}
+	if err != nil {
+		klog.Error(err)
+		err = fmt.Errorf("upgrade %s failed: %v", name, err)
+		taskRecord.Phase = PhaseFailed
+		if r.options.context().Err() != nil {
+			// another upgrade may be running, the journal is kept for the rollback command
+			err = fmt.Errorf("%v\nthe run was stopped, the task isn't rolled back", err)
+		} else if r.options.RollbackOnFailure {
+			klog.Infof("rolling back upgrade: %s", name)
+			if rollbackErr := journal.Rollback(r.client, mark); rollbackErr != nil {
+				err = fmt.Errorf("%v\n%s", err, formatFailure("rollback incomplete, the following mutations must be undone manually", rollbackErr))
+			} else {
+				taskRecord.Phase = PhaseRolledBack
+			}
+		}
+	} else {
+		taskRecord.Phase = PhaseSucceeded
+	}
+
+	if hookErr := r.runHooks(HookPostTask, name, &taskRecord.Hooks); hookErr != nil {
+		klog.Error(hookErr)
+		if err == nil {
+			taskRecord.Phase = PhaseFailed
+		}
+		err = joinErrors(err, fmt.Errorf("upgrade %s failed: %v", name, hookErr))
+	}
+	if err != nil {
+		taskRecord.Message = err.Error()
+	}
+	r.saveJournal()
+	r.saveRecord()
+	if err == nil {
+		klog.Infof("successfully upgraded: %s", name)
+	}
+	return err
+}
+
+func joinErrors(err, other error) error {
+	if err == nil {
+		return other
+	}
+	return fmt.Errorf("%v\n%v", err, other)
+}
+
+func (r *Runner) finish(err error) error {
+	now := time.Now().UTC()
+	r.record.CompletionTime = &now
+	if err != nil {
+		r.record.Phase = PhaseFailed
+		r.record.Message = err.Error()
+	} else {
+		r.record.Phase = PhaseSucceeded
+	}
+	r.saveRecord()
+	if reportErr := Report(r.record, r.options.ReportSinks); reportErr != nil {
+		klog.Error(reportErr)
+	}
+	return err
+}
+
+// Rollback undoes every mutation recorded in the journal of the run.
+func (r *Runner) Rollback() error {
+	err := r.options.Journal.Rollback(r.client, 0)
+	r.saveJournal()
+	if record, loadErr := LoadRun(r.client, r.options.RunID); loadErr == nil {
+		r.record = record
+		if err == nil {
+			r.record.Phase = PhaseRolledBack
+		}
+		r.saveRecord()
+	}
+	if err != nil {
+		return errors.New(formatFailure(fmt.Sprintf("rollback of run %s incomplete, the following mutations must be undone manually", r.options.RunID), err))
+	}
+	return nil
+}
+
+func (r *Runner) saveJournal() {
+	if r.options.Journal == nil {
+		return
+	}
+	if err := r.options.Journal.Save(r.client); err != nil {
+		klog.Errorf("save journal of run %s failed: %v", r.options.RunID, err)
+	}
+	if r.options.BackupDir == "" {
+		return
+	}
+	if err := r.backupJournal(); err != nil {
+		klog.Errorf("backup journal of run %s failed: %v", r.options.RunID, err)
+	}
+}
+
+// backupJournal copies the journal to the backup directory, it contains the state
+// of every object before it was mutated.
+func (r *Runner) backupJournal() error {
+	marshal, err := r.options.Journal.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.options.BackupDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.options.BackupDir, fmt.Sprintf("%s-journal.json", r.options.RunID)), marshal, 0644)
+}
+
+func (r *Runner) saveRecord() {
+	if err := SaveRun(r.client, r.record); err != nil {
+		klog.Errorf("save state of run %s failed: %v", r.options.RunID, err)
+	}
+}
+
+// Verify runs the verification of every task supporting it and returns a report of all the failures.
+func (r *Runner) Verify() error {
+	failures := make([]string, 0)
+	for _, t := range r.tasks {
+		verifier, ok := t.(Verifier)
+		if !ok {
+			continue
+		}
+
+		klog.Infof("verifying upgrade: %s", Name(t))
+		if err := verifier.Verify(); err != nil {
+			failures = append(failures, formatFailure(Name(t), err))
+			continue
+		}
+		klog.Infof("successfully verified: %s", Name(t))
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("verification failed:\n%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func formatFailure(title string, err error) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s:", title)
+	if agg, ok := err.(utilerrors.Aggregate); ok {
+		for _, e := range agg.Errors() {
+			fmt.Fprintf(b, "\n  - %v", e)
+		}
+	} else {
+		fmt.Fprintf(b, "\n  - %v", err)
+	}
+	return b.String()
+}
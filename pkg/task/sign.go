@@ -0,0 +1,182 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	SignatureHMACSHA256 = "hmac-sha256"
+	SignatureEd25519    = "ed25519"
+)
+
+type Signature struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// payload is the canonical form of the plan that is signed, the plan without its signature.
+func (p *Plan) payload() ([]byte, error) {
+	unsigned := *p
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+// keyBlock returns the PEM block of a key, it's nil for a raw HMAC secret. A key which looks like PEM
+// but can't be decoded is refused, so that a broken key file is never used as a HMAC secret.
+func keyBlock(key []byte) (*pem.Block, error) {
+	block, _ := pem.Decode(key)
+	if block == nil && bytes.Contains(key, []byte("-----BEGIN")) {
+		return nil, fmt.Errorf("invalid PEM encoded key")
+	}
+	return block, nil
+}
+
+// Sign signs the plan with an ed25519 private key in PKCS #8 PEM format, or with a raw
+// HMAC-SHA256 shared secret. Any other PEM encoded key, e.g. a public key, is refused.
+func (p *Plan) Sign(key []byte) error {
+	payload, err := p.payload()
+	if err != nil {
+		return err
+	}
+	block, err := keyBlock(key)
+	if err != nil {
+		return err
+	}
+
+	if block != nil {
+		if block.Type != "PRIVATE KEY" {
+			return fmt.Errorf("a %s can't sign a plan, an ed25519 private key in PKCS #8 PEM format or a raw HMAC secret is required", strings.ToLower(block.Type))
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		privateKey, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("unsupported private key type %T, only ed25519 keys are supported", parsed)
+		}
+		p.Signature = &Signature{
+			Algorithm: SignatureEd25519,
+			Value:     base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, payload)),
+		}
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	p.Signature = &Signature{
+		Algorithm: SignatureHMACSHA256,
+		Value:     base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	}
+	return nil
+}
+
+// VerifySignature checks the signature of the plan with an ed25519 public key in PKIX PEM format,
+// or with the raw HMAC-SHA256 shared secret it was signed with. The algorithm is given by the key,
+// never by the plan: a plan claiming another algorithm than the one of the key is refused.
+func (p *Plan) VerifySignature(key []byte) error {
+	if p.Signature == nil {
+		return fmt.Errorf("plan is not signed")
+	}
+	block, err := keyBlock(key)
+	if err != nil {
+		return err
+	}
+	algorithm := SignatureHMACSHA256
+	if block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return fmt.Errorf("a %s can't verify a plan, an ed25519 public key in PKIX PEM format or a raw HMAC secret is required", strings.ToLower(block.Type))
+		}
+		algorithm = SignatureEd25519
+	}
+	if p.Signature.Algorithm != algorithm {
+		return fmt.Errorf("plan is signed with %s, the key only verifies %s signatures", p.Signature.Algorithm, algorithm)
+	}
+	signature, err := base64.StdEncoding.DecodeString(p.Signature.Value)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	payload, err := p.payload()
+	if err != nil {
+		return err
+	}
+
+	switch algorithm {
+	case SignatureEd25519:
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		publicKey, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("unsupported public key type %T, only ed25519 keys are supported", parsed)
+		}
+		if !ed25519.Verify(publicKey, payload, signature) {
+			return fmt.Errorf("invalid signature, the plan was modified or signed with another key")
+		}
+	case SignatureHMACSHA256:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(payload)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("invalid signature, the plan was modified or signed with another key")
+		}
+	}
+	return nil
+}
+
+// CheckDrift checks that no object changed since the plan was computed, so that
+// exactly what was reviewed is applied. The garbage isn't checked, a collected object
+// which changed or is already gone is still garbage.
+func (p *Plan) CheckDrift(client kubernetes.Interface) error {
+	errs := make([]error, 0)
+	for _, taskPlan := range p.Tasks {
+		for _, change := range taskPlan.Changes {
+			if change.Garbage {
+				continue
+			}
+			raw, err := client.Discovery().RESTClient().Get().AbsPath(change.Key()).DoRaw(context.TODO())
+			if change.Operation == OperationCreate {
+				if err == nil {
+					errs = append(errs, fmt.Errorf("%s was created since planning", change.Key()))
+				} else if !errors.IsNotFound(err) {
+					errs = append(errs, fmt.Errorf("%s: %v", change.Key(), err))
+				}
+				continue
+			}
+			if err != nil {
+				if errors.IsNotFound(err) {
+					errs = append(errs, fmt.Errorf("%s was deleted since planning", change.Key()))
+				} else {
+					errs = append(errs, fmt.Errorf("%s: %v", change.Key(), err))
+				}
+				continue
+			}
+
+			current := &metav1.PartialObjectMetadata{}
+			if err := json.Unmarshal(raw, current); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", change.Key(), err))
+				continue
+			}
+			if current.ResourceVersion != change.ResourceVersion {
+				errs = append(errs, fmt.Errorf("%s changed since planning, resourceVersion %s is now %s",
+					change.Key(), change.ResourceVersion, current.ResourceVersion))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
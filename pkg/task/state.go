@@ -0,0 +1,215 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	StateNamespace = "kubesphere-system"
+
+	stateAppLabel = "app"
+	stateRunLabel = "kubesphere.io/upgrade-run"
+	stateAppName  = "ks-upgrade"
+	runKey        = "run.json"
+)
+
+const (
+	PhaseRunning    = "Running"
+	PhaseSucceeded  = "Succeeded"
+	PhaseFailed     = "Failed"
+	PhaseRolledBack = "RolledBack"
+	PhasePaused     = "Paused"
+)
+
+// RunRecord is the state of an upgrade run, it's kept in a ConfigMap after the run finished.
+type RunRecord struct {
+	ID             string     `json:"id"`
+	Phase          string     `json:"phase"`
+	StartTime      time.Time  `json:"startTime"`
+	CompletionTime *time.Time `json:"completionTime,omitempty"`
+	DryRun         bool       `json:"dryRun,omitempty"`
+	// Cluster is the cluster the run targeted when it fanned out to the member clusters.
+	Cluster string `json:"cluster,omitempty"`
+	// Filter restricted the run to a subset of the objects, the others are left for a later run.
+	Filter *Filter `json:"filter,omitempty"`
+	// Completes are the filtered runs since the last full run, a full run changes the objects they left out.
+	Completes []string     `json:"completes,omitempty"`
+	Tasks     []TaskRecord `json:"tasks,omitempty"`
+	// Hooks are the results of the hooks run around the whole run.
+	Hooks   []HookRecord `json:"hooks,omitempty"`
+	Message string       `json:"message,omitempty"`
+}
+
+type TaskRecord struct {
+	Name    string `json:"name"`
+	Phase   string `json:"phase"`
+	Changes int    `json:"changes"`
+	// Filtered is the number of changes left out by the filter of the run.
+	Filtered int    `json:"filtered,omitempty"`
+	Message  string `json:"message,omitempty"`
+	// Skipped are the changes which weren't applied and have to be handled manually.
+	Skipped []SkippedChange `json:"skipped,omitempty"`
+	// Warnings are the objects the task left as they are, they have to be handled manually too.
+	Warnings []string `json:"warnings,omitempty"`
+	// Hooks are the results of the hooks run around the task.
+	Hooks []HookRecord `json:"hooks,omitempty"`
+}
+
+func stateConfigMapName(runID string) string {
+	return fmt.Sprintf("ks-upgrade-run-%s", runID)
+}
+
+// stateSecretName is named after the state ConfigMap, it holds what the ConfigMap mustn't.
+func stateSecretName(runID string) string {
+	return stateConfigMapName(runID)
+}
+
+// updateStateSecret creates or updates the state Secret of the run, it holds the values of the redacted
+// fields of the journal. It's only created once there's a value to hold.
+func updateStateSecret(client kubernetes.Interface, runID string, data map[string][]byte) error {
+	secrets := client.CoreV1().Secrets(StateNamespace)
+	secret, err := secrets.Get(context.TODO(), stateSecretName(runID), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if len(data) == 0 {
+			return nil
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      stateSecretName(runID),
+				Namespace: StateNamespace,
+				Labels: map[string]string{
+					stateAppLabel: stateAppName,
+					stateRunLabel: runID,
+				},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: data,
+		}
+		_, err = secrets.Create(context.TODO(), secret, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	secret.Data = data
+	_, err = secrets.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	return err
+}
+
+// updateState creates or updates the state ConfigMap of the run.
+func updateState(client kubernetes.Interface, runID string, update func(cm *corev1.ConfigMap)) error {
+	configMaps := client.CoreV1().ConfigMaps(StateNamespace)
+	cm, err := configMaps.Get(context.TODO(), stateConfigMapName(runID), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      stateConfigMapName(runID),
+				Namespace: StateNamespace,
+				Labels: map[string]string{
+					stateAppLabel: stateAppName,
+					stateRunLabel: runID,
+				},
+			},
+		}
+		update(cm)
+		_, err = configMaps.Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	update(cm)
+	_, err = configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+func SaveRun(client kubernetes.Interface, record *RunRecord) error {
+	marshal, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return updateState(client, record.ID, func(cm *corev1.ConfigMap) {
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[runKey] = string(marshal)
+	})
+}
+
+func LoadRun(client kubernetes.Interface, runID string) (*RunRecord, error) {
+	cm, err := client.CoreV1().ConfigMaps(StateNamespace).Get(context.TODO(), stateConfigMapName(runID), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return decodeRun(cm)
+}
+
+// ListRuns returns the recorded runs, the latest first.
+func ListRuns(client kubernetes.Interface) ([]*RunRecord, error) {
+	list, err := client.CoreV1().ConfigMaps(StateNamespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", stateAppLabel, stateAppName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*RunRecord, 0, len(list.Items))
+	for i := range list.Items {
+		record, err := decodeRun(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartTime.After(records[j].StartTime)
+	})
+	return records, nil
+}
+
+// filteredRuns returns the IDs of the filtered runs of a cluster since its last full run, the latest first.
+// The dry runs changed nothing, they're left out.
+func filteredRuns(client kubernetes.Interface, cluster, runID string) ([]string, error) {
+	records, err := ListRuns(client)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for _, record := range records {
+		if record.ID == runID || record.Cluster != cluster || record.DryRun {
+			continue
+		}
+		if record.Filter.IsEmpty() {
+			if record.Phase == PhaseSucceeded {
+				break
+			}
+			continue
+		}
+		ids = append(ids, record.ID)
+	}
+	return ids, nil
+}
+
+func decodeRun(cm *corev1.ConfigMap) (*RunRecord, error) {
+	record := &RunRecord{ID: cm.Labels[stateRunLabel], StartTime: cm.CreationTimestamp.Time}
+	data, ok := cm.Data[runKey]
+	if !ok {
+		// the run was started by a version which didn't record it
+		return record, nil
+	}
+	if err := json.Unmarshal([]byte(data), record); err != nil {
+		return nil, fmt.Errorf("decode run %s: %v", cm.Name, err)
+	}
+	return record, nil
+}
@@ -1,5 +1,74 @@
 package task
 
+import (
+	"fmt"
+
+	"k8s.io/klog"
+)
+
 type UpgradeTask interface {
 	Run() error
 }
+
+// Permission describes the API access a task needs on a resource.
+type Permission struct {
+	Group    string
+	Version  string
+	Resource string
+	Verbs    []string
+	// Optional resources belong to components which may not be installed, the task skips
+	// them when they're not served.
+	Optional bool
+}
+
+// PermissionRequirer is implemented by the tasks that can tell which API access they need,
+// the preflight checks use it to verify RBAC and the presence of the resources.
+type PermissionRequirer interface {
+	RequiredPermissions() []Permission
+}
+
+// Verifier is implemented by the tasks that can assert the cluster is in the expected state
+// after they ran, the runner calls it automatically once all tasks succeeded.
+type Verifier interface {
+	Verify() error
+}
+
+// Reporter is implemented by the tasks which can tell the result of their last run, it's merged
+// into the record of the run. Only the message of a planner is, its changes are counted by the runner.
+type Reporter interface {
+	Result() (changes int, message string)
+}
+
+// Skipper is implemented by the tasks which are not planners but apply their changes with their
+// own applier, the changes it skipped are merged into the record of the run.
+type Skipper interface {
+	TakeSkipped() []SkippedChange
+}
+
+// Warner is implemented by the tasks which leave objects as they are because they can't change
+// them, e.g. objects they can't convert. The warnings of the last plan are kept in the plan and
+// in the record of the run, those objects have to be handled manually.
+type Warner interface {
+	Warnings() []string
+}
+
+// WarningList keeps the warnings of the last plan, the tasks embed it to implement Warner.
+type WarningList struct {
+	warnings []string
+}
+
+// Warn logs a warning and keeps it.
+func (w *WarningList) Warn(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	klog.Warning(warning)
+	w.warnings = append(w.warnings, warning)
+}
+
+func (w *WarningList) Warnings() []string {
+	return w.warnings
+}
+
+// ResetWarnings drops the warnings of the previous plan.
+func (w *WarningList) ResetWarnings() {
+	w.warnings = make([]string, 0)
+}
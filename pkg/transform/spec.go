@@ -0,0 +1,198 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	APIVersion = "ks-upgrade.kubesphere.io/v1alpha1"
+	Kind       = "Transformation"
+)
+
+// Spec declares a transformation, the operations are applied in order to every selected object.
+type Spec struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// Name is the name of the task.
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Resource selects the objects to transform.
+	Resource   Resource    `json:"resource"`
+	Operations []Operation `json:"operations"`
+}
+
+type Resource struct {
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// Namespace restricts a namespaced resource to one namespace, all namespaces are selected if empty.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// +optional
+	LabelSelector string `json:"labelSelector,omitempty"`
+	// +optional
+	FieldSelector string `json:"fieldSelector,omitempty"`
+	// Select is a CEL predicate filtering the listed objects, the object is bound to `object`.
+	// +optional
+	Select string `json:"select,omitempty"`
+}
+
+// Operation is a single step of a transformation, exactly one of its fields is set.
+type Operation struct {
+	// JSONPatch is a JSON patch (RFC 6902) applied to the object.
+	JSONPatch json.RawMessage `json:"jsonPatch,omitempty"`
+	// MergePatch is a JSON merge patch (RFC 7386) applied to the object.
+	MergePatch json.RawMessage `json:"mergePatch,omitempty"`
+	// RenameLabel renames a label key, the value is kept.
+	RenameLabel *Rename `json:"renameLabel,omitempty"`
+	// RenameAnnotation renames an annotation key, the value is kept.
+	RenameAnnotation *Rename `json:"renameAnnotation,omitempty"`
+	SetField         *Field  `json:"setField,omitempty"`
+	RemoveField      *Field  `json:"removeField,omitempty"`
+	// Transform sets a field to the value of a CEL expression evaluated against the object.
+	Transform *Transform `json:"transform,omitempty"`
+	// Clone creates a copy of the object, as it is at this step, as an object of another resource.
+	Clone *Clone `json:"clone,omitempty"`
+	// Delete deletes the object, it must be the last operation.
+	Delete bool `json:"delete,omitempty"`
+}
+
+type Rename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type Field struct {
+	// Path is the dot separated path of the field, e.g. spec.template.metadata.
+	Path string `json:"path"`
+	// Value is the value the field is set to, it's ignored when removing the field.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type Transform struct {
+	// Path is the dot separated path of the field.
+	Path string `json:"path"`
+	// Expression computes the value of the field, the object is bound to `object`.
+	// The field is removed when the expression evaluates to null.
+	Expression string `json:"expression"`
+}
+
+type Clone struct {
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	Kind     string `json:"kind"`
+	// Namespace is the namespace of the copy, the namespace of the object is kept if empty.
+	// Cluster scoped copies of namespaced objects are created by setting it to "-".
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Options configure where the transformations are loaded from.
+type Options struct {
+	// Dir is a directory of YAML files holding transformations, several may be put in one file separated by "---".
+	Dir string `json:"dir,omitempty"`
+	// Specs are transformations declared inline.
+	Specs []Spec `json:"specs,omitempty"`
+}
+
+// Load returns the inline transformations followed by the ones of the directory, sorted by file name.
+func Load(options *Options) ([]Spec, error) {
+	specs := append([]Spec{}, options.Specs...)
+	if options.Dir != "" {
+		files, err := filepath.Glob(filepath.Join(options.Dir, "*.y*ml"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			fileSpecs, err := ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			specs = append(specs, fileSpecs...)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range specs {
+		if err := specs[i].Validate(); err != nil {
+			return nil, err
+		}
+		if names[specs[i].Name] {
+			return nil, fmt.Errorf("duplicate transformation %s", specs[i].Name)
+		}
+		names[specs[i].Name] = true
+	}
+	return specs, nil
+}
+
+// ReadFile reads the transformations of a YAML file.
+func ReadFile(path string) ([]Spec, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]Spec, 0)
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(raw), 4096)
+	for {
+		spec := Spec{}
+		if err := decoder.Decode(&spec); err != nil {
+			if err == io.EOF {
+				return specs, nil
+			}
+			return nil, fmt.Errorf("parse transformations %s failed: %v", path, err)
+		}
+		if spec.Kind == "" && spec.Name == "" {
+			// an empty document
+			continue
+		}
+		specs = append(specs, spec)
+	}
+}
+
+func (s *Spec) Validate() error {
+	if s.APIVersion != APIVersion || s.Kind != Kind {
+		return fmt.Errorf("transformation %s is a %s %s, expected a %s %s", s.Name, s.APIVersion, s.Kind, APIVersion, Kind)
+	}
+	if s.Name == "" {
+		return fmt.Errorf("transformation without a name")
+	}
+	if s.Resource.Version == "" || s.Resource.Resource == "" {
+		return fmt.Errorf("transformation %s: resource.version and resource.resource are required", s.Name)
+	}
+	if len(s.Operations) == 0 {
+		return fmt.Errorf("transformation %s has no operations", s.Name)
+	}
+	for i, op := range s.Operations {
+		set := 0
+		for _, isSet := range []bool{len(op.JSONPatch) > 0, len(op.MergePatch) > 0, op.RenameLabel != nil,
+			op.RenameAnnotation != nil, op.SetField != nil, op.RemoveField != nil, op.Transform != nil, op.Clone != nil, op.Delete} {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("transformation %s: operation %d must set exactly one operation, it sets %d", s.Name, i, set)
+		}
+		if op.Delete && i != len(s.Operations)-1 {
+			return fmt.Errorf("transformation %s: delete must be the last operation", s.Name)
+		}
+		if op.Clone != nil && (op.Clone.Version == "" || op.Clone.Resource == "" || op.Clone.Kind == "") {
+			return fmt.Errorf("transformation %s: clone.version, clone.resource and clone.kind are required", s.Name)
+		}
+		if (op.SetField != nil && op.SetField.Path == "") || (op.RemoveField != nil && op.RemoveField.Path == "") ||
+			(op.Transform != nil && op.Transform.Path == "") {
+			return fmt.Errorf("transformation %s: operation %d has no field path", s.Name, i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package transform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/expr"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+type transformTask struct {
+	client  kubernetes.Interface
+	applier *task.Applier
+	spec    Spec
+	// selector and transforms are the compiled CEL expressions of the spec,
+	// transforms are indexed like the operations
+	selector   *expr.Expression
+	transforms map[int]*expr.Expression
+}
+
+// NewTransformTask creates the task of a transformation, its changes go through the
+// runner like the changes of any task, so they're journaled, dry-run and reported.
+// The CEL expressions of the spec are type-checked here.
+func NewTransformTask(client kubernetes.Interface, options *task.Options, spec Spec) (task.UpgradeTask, error) {
+	t := &transformTask{client: client, applier: task.NewApplier(client, options), spec: spec, transforms: make(map[int]*expr.Expression)}
+	if spec.Resource.Select != "" {
+		selector, err := expr.CompileSelector(spec.Resource.Select)
+		if err != nil {
+			return nil, fmt.Errorf("transformation %s: %v", spec.Name, err)
+		}
+		t.selector = selector
+	}
+	for i, op := range spec.Operations {
+		if op.Transform == nil {
+			continue
+		}
+		transform, err := expr.CompileTransform(op.Transform.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("transformation %s: operation %d: %v", spec.Name, i, err)
+		}
+		t.transforms[i] = transform
+	}
+	return t, nil
+}
+
+func (t *transformTask) Name() string {
+	return t.spec.Name
+}
+
+func (t *transformTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+func (t *transformTask) Plan() ([]task.Change, error) {
+	r := t.spec.Resource
+	objects, err := task.ListObjects(t.client, task.CollectionPath(r.Group, r.Version, r.Resource, r.Namespace), r.LabelSelector, r.FieldSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]task.Change, 0)
+	for _, object := range objects {
+		if t.selector != nil {
+			selected, err := t.selector.Select(object.Object, nil)
+			if err != nil {
+				return nil, fmt.Errorf("select %s %s failed: %v", object.GetKind(), objectName(object), err)
+			}
+			if !selected {
+				continue
+			}
+		}
+		objectChanges, err := t.transform(object)
+		if err != nil {
+			return nil, fmt.Errorf("transform %s %s failed: %v", object.GetKind(), objectName(object), err)
+		}
+		changes = append(changes, objectChanges...)
+	}
+	return changes, nil
+}
+
+// transform applies the operations to an object and returns the changes turning the
+// cluster into the result, nothing is returned if the object is already transformed.
+func (t *transformTask) transform(object *unstructured.Unstructured) ([]task.Change, error) {
+	r := t.spec.Resource
+	path := task.ObjectCollectionPath(r.Group, r.Version, r.Resource, object)
+	original := object.DeepCopy()
+	changes := make([]task.Change, 0)
+	clones := make([]string, 0)
+
+	for i, op := range t.spec.Operations {
+		switch {
+		case op.Transform != nil:
+			value, err := t.transforms[i].Eval(object.Object, nil)
+			if err != nil {
+				return nil, err
+			}
+			fields := strings.Split(op.Transform.Path, ".")
+			if value == nil {
+				unstructured.RemoveNestedField(object.Object, fields...)
+			} else if err := unstructured.SetNestedField(object.Object, value, fields...); err != nil {
+				return nil, err
+			}
+		case op.Clone != nil:
+			change, err := t.clone(object, op.Clone)
+			if err != nil {
+				return nil, err
+			}
+			if change != nil {
+				changes = append(changes, *change)
+				clones = append(clones, change.Key())
+			}
+		case op.Delete:
+			changes = append(changes, task.Change{
+				Operation:       task.OperationDelete,
+				Path:            path,
+				Name:            object.GetName(),
+				ResourceVersion: object.GetResourceVersion(),
+				// the object is deleted only once its copies exist
+				DependsOn:   clones,
+				Description: fmt.Sprintf("%s: delete %s %s", t.spec.Name, object.GetKind(), objectName(object)),
+			})
+			return changes, nil
+		default:
+			if err := apply(object, op); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if reflect.DeepEqual(original.Object, object.Object) {
+		return changes, nil
+	}
+	originalJSON, err := original.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	modified, err := object.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patch, err := task.CreateMergePatch(originalJSON, modified)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, task.Change{
+		Operation:       task.OperationUpdate,
+		Path:            path,
+		Name:            object.GetName(),
+		ResourceVersion: object.GetResourceVersion(),
+		Object:          modified,
+		Patch:           patch,
+		Description:     fmt.Sprintf("%s: update %s %s", t.spec.Name, object.GetKind(), objectName(object)),
+	}), nil
+}
+
+// clone returns the creation of a copy of the object, nothing if the copy already exists.
+func (t *transformTask) clone(object *unstructured.Unstructured, clone *Clone) (*task.Change, error) {
+	c := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	for key, value := range object.DeepCopy().Object {
+		if key != "status" {
+			c.Object[key] = value
+		}
+	}
+	for _, field := range []string{"uid", "selfLink", "creationTimestamp", "managedFields", "generation", "resourceVersion", "ownerReferences"} {
+		unstructured.RemoveNestedField(c.Object, "metadata", field)
+	}
+	c.SetAPIVersion(strings.TrimPrefix(fmt.Sprintf("%s/%s", clone.Group, clone.Version), "/"))
+	c.SetKind(clone.Kind)
+	switch clone.Namespace {
+	case "":
+	case "-":
+		c.SetNamespace("")
+	default:
+		c.SetNamespace(clone.Namespace)
+	}
+
+	path := task.CollectionPath(clone.Group, clone.Version, clone.Resource, c.GetNamespace())
+	_, err := t.client.Discovery().RESTClient().Get().AbsPath(path, c.GetName()).DoRaw(context.TODO())
+	if err == nil {
+		klog.V(4).Infof("%s: %s %s already exists, skipping it.", t.spec.Name, clone.Kind, objectName(c))
+		return nil, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	marshal, err := c.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return &task.Change{
+		Operation:   task.OperationCreate,
+		Path:        path,
+		Name:        c.GetName(),
+		Object:      marshal,
+		Description: fmt.Sprintf("%s: clone %s %s to %s", t.spec.Name, object.GetKind(), objectName(object), clone.Kind),
+	}, nil
+}
+
+// apply applies an operation which modifies the object in place.
+func apply(object *unstructured.Unstructured, op Operation) error {
+	switch {
+	case len(op.JSONPatch) > 0 || len(op.MergePatch) > 0:
+		raw, err := object.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if len(op.JSONPatch) > 0 {
+			patch, err := jsonpatch.DecodePatch(op.JSONPatch)
+			if err != nil {
+				return err
+			}
+			raw, err = patch.Apply(raw)
+			if err != nil {
+				return err
+			}
+		} else {
+			raw, err = jsonpatch.MergePatch(raw, op.MergePatch)
+			if err != nil {
+				return err
+			}
+		}
+		patched := make(map[string]interface{})
+		if err := json.Unmarshal(raw, &patched); err != nil {
+			return err
+		}
+		object.Object = patched
+	case op.RenameLabel != nil:
+		object.SetLabels(renameKey(object.GetLabels(), op.RenameLabel))
+	case op.RenameAnnotation != nil:
+		object.SetAnnotations(renameKey(object.GetAnnotations(), op.RenameAnnotation))
+	case op.SetField != nil:
+		var value interface{}
+		if err := json.Unmarshal(op.SetField.Value, &value); err != nil {
+			return fmt.Errorf("invalid value of field %s: %v", op.SetField.Path, err)
+		}
+		return unstructured.SetNestedField(object.Object, value, strings.Split(op.SetField.Path, ".")...)
+	case op.RemoveField != nil:
+		unstructured.RemoveNestedField(object.Object, strings.Split(op.RemoveField.Path, ".")...)
+	}
+	return nil
+}
+
+// renameKey moves the value of a key to another key, an existing value of the new key is overwritten.
+func renameKey(m map[string]string, rename *Rename) map[string]string {
+	value, ok := m[rename.From]
+	if !ok {
+		return m
+	}
+	delete(m, rename.From)
+	m[rename.To] = value
+	return m
+}
+
+func objectName(object *unstructured.Unstructured) string {
+	if object.GetNamespace() == "" {
+		return object.GetName()
+	}
+	return fmt.Sprintf("%s/%s", object.GetNamespace(), object.GetName())
+}
+
+func (t *transformTask) RequiredPermissions() []task.Permission {
+	r := t.spec.Resource
+	verbs := []string{"list"}
+	permissions := make([]task.Permission, 0)
+	for _, op := range t.spec.Operations {
+		switch {
+		case op.Delete:
+			verbs = append(verbs, "get", "delete")
+		case op.Clone != nil:
+			permissions = append(permissions, task.Permission{Group: op.Clone.Group, Version: op.Clone.Version,
+				Resource: op.Clone.Resource, Verbs: []string{"get", "create"}})
+		default:
+			if !task.InSlice("update", verbs) {
+				verbs = append(verbs, "get", "update")
+			}
+		}
+	}
+	return append([]task.Permission{{Group: r.Group, Version: r.Version, Resource: r.Resource, Verbs: verbs}}, permissions...)
+}
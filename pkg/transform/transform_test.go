@@ -0,0 +1,205 @@
+package transform
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+// newTestClient returns a client of a server answering the GETs of the paths with their JSON.
+func newTestClient(t *testing.T, objects map[string]string) kubernetes.Interface {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if object, ok := objects[r.URL.Path]; ok && r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(object))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+const configMaps = `{"kind":"ConfigMapList","apiVersion":"v1","metadata":{},"items":[
+	{"metadata":{"name":"a","namespace":"ns1","resourceVersion":"1","labels":{"old":"x"}},"data":{"key":"value","drop":"me"}},
+	{"metadata":{"name":"b","namespace":"ns1","resourceVersion":"2","labels":{"new":"x"}},"data":{"key":"patched"}}
+]}`
+
+func TestPlan(t *testing.T) {
+	client := newTestClient(t, map[string]string{
+		"/api/v1/configmaps":                  configMaps,
+		"/api/v1/namespaces/ns2/configmaps/b": `{"metadata":{"name":"b","namespace":"ns2"}}`,
+	})
+	resource := Resource{Version: "v1", Resource: "configmaps"}
+	tests := []struct {
+		name       string
+		operations []Operation
+		// expected are the operations, the names and the data of the changes
+		expected []string
+		data     map[string]map[string]interface{}
+	}{
+		{
+			name: "update",
+			operations: []Operation{
+				{RenameLabel: &Rename{From: "old", To: "new"}},
+				{RemoveField: &Field{Path: "data.drop"}},
+				{JSONPatch: json.RawMessage(`[{"op":"replace","path":"/data/key","value":"patched"}]`)},
+			},
+			// b is already transformed
+			expected: []string{"update /api/v1/namespaces/ns1/configmaps/a"},
+			data:     map[string]map[string]interface{}{"a": {"key": "patched"}},
+		},
+		{
+			name: "set field and merge patch",
+			operations: []Operation{
+				{SetField: &Field{Path: "data.added", Value: json.RawMessage(`"value"`)}},
+				{MergePatch: json.RawMessage(`{"data":{"key":null}}`)},
+			},
+			expected: []string{"update /api/v1/namespaces/ns1/configmaps/a", "update /api/v1/namespaces/ns1/configmaps/b"},
+			data: map[string]map[string]interface{}{
+				"a": {"drop": "me", "added": "value"},
+				"b": {"added": "value"},
+			},
+		},
+		{
+			name: "move",
+			operations: []Operation{
+				{Clone: &Clone{Version: "v1", Resource: "configmaps", Kind: "ConfigMap", Namespace: "ns2"}},
+				{Delete: true},
+			},
+			// the copy of b already exists
+			expected: []string{
+				"create /api/v1/namespaces/ns2/configmaps/a",
+				"delete /api/v1/namespaces/ns1/configmaps/a",
+				"delete /api/v1/namespaces/ns1/configmaps/b",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := Spec{APIVersion: APIVersion, Kind: Kind, Name: "test", Resource: resource, Operations: test.operations}
+			if err := spec.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			transform, err := NewTransformTask(client, task.NewOptions(), spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changes, err := transform.(task.Planner).Plan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			planned := make([]string, 0, len(changes))
+			for _, change := range changes {
+				planned = append(planned, change.Operation+" "+change.Key())
+				if change.Operation == task.OperationUpdate {
+					object := struct {
+						Data map[string]interface{} `json:"data"`
+					}{}
+					if err := json.Unmarshal(change.Object, &object); err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(object.Data, test.data[change.Name]) {
+						t.Errorf("%s has the data %v, expected %v", change.Name, object.Data, test.data[change.Name])
+					}
+				}
+				if change.Operation == task.OperationDelete && change.Name == "a" &&
+					!reflect.DeepEqual(change.DependsOn, []string{"/api/v1/namespaces/ns2/configmaps/a"}) {
+					t.Errorf("the deletion of a depends on %v, expected its copy", change.DependsOn)
+				}
+			}
+			if !reflect.DeepEqual(planned, test.expected) {
+				t.Errorf("planned %v, expected %v", planned, test.expected)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.yaml": `
+apiVersion: ks-upgrade.kubesphere.io/v1alpha1
+kind: Transformation
+name: rename
+resource: {version: v1, resource: configmaps}
+operations:
+- renameLabel: {from: old, to: new}
+---
+---
+apiVersion: ks-upgrade.kubesphere.io/v1alpha1
+kind: Transformation
+name: drop
+resource: {version: v1, resource: configmaps}
+operations:
+- delete: true
+`,
+		"b.yml": `{"apiVersion":"ks-upgrade.kubesphere.io/v1alpha1","kind":"Transformation","name":"set",
+"resource":{"version":"v1","resource":"secrets"},"operations":[{"setField":{"path":"type","value":"Opaque"}}]}`,
+		"README.md": "not a transformation",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inline := Spec{APIVersion: APIVersion, Kind: Kind, Name: "inline", Resource: Resource{Version: "v1", Resource: "pods"},
+		Operations: []Operation{{RemoveField: &Field{Path: "spec.nodeName"}}}}
+
+	specs, err := Load(&Options{Dir: dir, Specs: []Spec{inline}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	if strings.Join(names, ",") != "inline,rename,drop,set" {
+		t.Errorf("loaded %v", names)
+	}
+
+	inline.Name = "set"
+	if _, err := Load(&Options{Dir: dir, Specs: []Spec{inline}}); err == nil || !strings.Contains(err.Error(), "duplicate transformation set") {
+		t.Errorf("Load() = %v, expected the duplicate to be refused", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func(operations ...Operation) Spec {
+		return Spec{APIVersion: APIVersion, Kind: Kind, Name: "test", Resource: Resource{Version: "v1", Resource: "configmaps"}, Operations: operations}
+	}
+	tests := []struct {
+		name string
+		spec Spec
+		err  string
+	}{
+		{name: "valid", spec: valid(Operation{RemoveField: &Field{Path: "data"}}, Operation{Delete: true})},
+		{name: "kind", spec: Spec{APIVersion: APIVersion, Kind: "Other", Name: "test"}, err: "expected a"},
+		{name: "no operations", spec: valid(), err: "has no operations"},
+		{name: "two operations in one", spec: valid(Operation{Delete: true, RemoveField: &Field{Path: "data"}}), err: "it sets 2"},
+		{name: "delete first", spec: valid(Operation{Delete: true}, Operation{RemoveField: &Field{Path: "data"}}), err: "delete must be the last operation"},
+		{name: "clone without kind", spec: valid(Operation{Clone: &Clone{Version: "v1", Resource: "secrets"}}), err: "clone.kind are required"},
+		{name: "no path", spec: valid(Operation{SetField: &Field{}}), err: "has no field path"},
+	}
+	for _, test := range tests {
+		err := test.spec.Validate()
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+			t.Errorf("%s: Validate() = %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+
+	"kubesphere.io/ks-upgrade/pkg/role"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	iamGroup   = "iam.kubesphere.io"
+	iamVersion = "v1alpha2"
+
+	GlobalRoleAnnotation        = "iam.kubesphere.io/globalrole"
+	PasswordEncryptedAnnotation = "iam.kubesphere.io/password-encrypted"
+	UserReferenceLabel          = "iam.kubesphere.io/user-ref"
+
+	// passwordField is masked in the logs and the diffs and left out of the journal
+	passwordField = "spec.password"
+)
+
+var defaultStates = map[string]string{
+	"active":            "Active",
+	"disabled":          "Disabled",
+	"authlimitexceeded": "AuthLimitExceeded",
+}
+
+var defaultLabelRenames = map[string]string{
+	"iam.kubesphere.io/idp":       "iam.kubesphere.io/identify-provider",
+	"iam.kubesphere.io/origin-id": "iam.kubesphere.io/origin-uid",
+}
+
+// Options are the parameters of the user migration.
+type Options struct {
+	// EncryptPasswords hashes the plain text passwords with bcrypt.
+	EncryptPasswords bool `json:"encryptPasswords"`
+	// States maps the deprecated states of status.state onto the current ones, they're matched ignoring case.
+	States map[string]string `json:"states,omitempty"`
+	// LabelRenames maps the deprecated identity provider label keys onto their replacements.
+	LabelRenames map[string]string `json:"labelRenames,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{EncryptPasswords: true, States: copyMap(defaultStates), LabelRenames: copyMap(defaultLabelRenames)}
+}
+
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+type userMigrateTask struct {
+	client      kubernetes.Interface
+	applier     *task.Applier
+	options     *Options
+	roleOptions *role.Options
+
+	task.WarningList
+}
+
+// NewUserMigrateTask creates the task fixing up the users, the global role of a user is remapped
+// with the same role options as the role-migrate task remaps the GlobalRoleBindings.
+func NewUserMigrateTask(client kubernetes.Interface, options *task.Options, userOptions *Options, roleOptions *role.Options) task.UpgradeTask {
+	return &userMigrateTask{client: client, applier: task.NewApplier(client, options), options: userOptions, roleOptions: roleOptions}
+}
+
+func (t *userMigrateTask) Name() string {
+	return "user-migrate"
+}
+
+func (t *userMigrateTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+// globalRoles returns the global roles of the users by user name, after the remapping of the
+// role-migrate task, and the names of the existing global roles.
+func (t *userMigrateTask) globalRoles() (map[string][]string, map[string]bool, error) {
+	bindings := &role.GlobalRoleBindingList{}
+	raw, err := t.client.Discovery().RESTClient().Get().AbsPath(task.CollectionPath(iamGroup, iamVersion, "globalrolebindings", "")).DoRaw(context.TODO())
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(raw, bindings); err != nil {
+		return nil, nil, err
+	}
+	userRoles := make(map[string][]string)
+	for _, binding := range bindings.Items {
+		globalRole := t.roleOptions.RemapGlobalRole(binding.RoleRef.Name)
+		if globalRole == "" {
+			continue
+		}
+		for _, subject := range binding.Subjects {
+			if subject.Kind == rbacv1.UserKind && !task.InSlice(globalRole, userRoles[subject.Name]) {
+				userRoles[subject.Name] = append(userRoles[subject.Name], globalRole)
+			}
+		}
+	}
+
+	roles, err := task.ListObjects(t.client, task.CollectionPath(iamGroup, iamVersion, "globalroles", ""), "", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	existing := make(map[string]bool, len(roles))
+	for _, r := range roles {
+		existing[r.GetName()] = true
+	}
+	return userRoles, existing, nil
+}
+
+func (t *userMigrateTask) Plan() ([]task.Change, error) {
+	t.ResetWarnings()
+	path := task.CollectionPath(iamGroup, iamVersion, "users", "")
+	users, err := task.ListObjects(t.client, path, "", "")
+	if err != nil {
+		return nil, err
+	}
+	userRoles, existingRoles, err := t.globalRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]task.Change, 0)
+	for _, user := range users {
+		original := user.DeepCopy()
+		fixes := make([]string, 0)
+
+		if t.options.EncryptPasswords {
+			fixed, err := encryptPassword(user)
+			if err != nil {
+				return nil, fmt.Errorf("encrypt the password of user %s failed: %v", user.GetName(), err)
+			}
+			if fixed {
+				fixes = append(fixes, "encrypt the password")
+			}
+		}
+
+		fix, binding, err := t.reconcileGlobalRole(user, userRoles[user.GetName()], existingRoles)
+		if err != nil {
+			return nil, err
+		}
+		if fix != "" {
+			fixes = append(fixes, fix)
+		}
+		if binding != nil {
+			changes = append(changes, *binding)
+		}
+
+		if fix := t.normalizeState(user); fix != "" {
+			fixes = append(fixes, fix)
+		}
+		fixes = append(fixes, t.renameLabels(user)...)
+
+		if reflect.DeepEqual(original.Object, user.Object) {
+			continue
+		}
+		change, err := updateChange(path, original, user, fmt.Sprintf("fix user %s: %s", user.GetName(), strings.Join(fixes, ", ")))
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *change)
+	}
+	return changes, nil
+}
+
+// encryptPassword hashes a plain text password, a password which is a bcrypt hash is kept.
+func encryptPassword(user *unstructured.Unstructured) (bool, error) {
+	password, _, _ := unstructured.NestedString(user.Object, "spec", "password")
+	if password == "" || isEncrypted(password) {
+		return false, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return false, err
+	}
+	if err := unstructured.SetNestedField(user.Object, string(hash), "spec", "password"); err != nil {
+		return false, err
+	}
+	setAnnotation(user, PasswordEncryptedAnnotation, "true")
+	return true, nil
+}
+
+func isEncrypted(password string) bool {
+	_, err := bcrypt.Cost([]byte(password))
+	return err == nil
+}
+
+// reconcileGlobalRole sets the global role annotation of a user to the role of its GlobalRoleBinding.
+// A user without binding gets one for the role of its annotation, remapped like the bindings.
+func (t *userMigrateTask) reconcileGlobalRole(user *unstructured.Unstructured, boundRoles []string, existingRoles map[string]bool) (string, *task.Change, error) {
+	annotated := user.GetAnnotations()[GlobalRoleAnnotation]
+	switch {
+	case len(boundRoles) > 1:
+		sort.Strings(boundRoles)
+		t.Warn("user %s is bound to several global roles %s, its %s annotation is kept", user.GetName(), strings.Join(boundRoles, ", "), GlobalRoleAnnotation)
+		return "", nil, nil
+	case len(boundRoles) == 1:
+		if annotated == boundRoles[0] {
+			return "", nil, nil
+		}
+		setAnnotation(user, GlobalRoleAnnotation, boundRoles[0])
+		return fmt.Sprintf("set the global role annotation from %q to %s", annotated, boundRoles[0]), nil, nil
+	case annotated == "":
+		return "", nil, nil
+	}
+
+	globalRole := t.roleOptions.RemapGlobalRole(annotated)
+	if globalRole == "" || !existingRoles[globalRole] {
+		t.Warn("user %s has no GlobalRoleBinding and its global role %s doesn't exist, its %s annotation is kept", user.GetName(), annotated, GlobalRoleAnnotation)
+		return "", nil, nil
+	}
+	fix := ""
+	if globalRole != annotated {
+		setAnnotation(user, GlobalRoleAnnotation, globalRole)
+		fix = fmt.Sprintf("set the global role annotation from %s to %s", annotated, globalRole)
+	}
+	binding := &role.GlobalRoleBinding{
+		TypeMeta: metav1.TypeMeta{APIVersion: "iam.kubesphere.io/v1alpha2", Kind: "GlobalRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   fmt.Sprintf("%s-%s", user.GetName(), globalRole),
+			Labels: map[string]string{UserReferenceLabel: user.GetName()},
+		},
+		Subjects: []rbacv1.Subject{{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: user.GetName()}},
+		RoleRef:  rbacv1.RoleRef{APIGroup: iamGroup, Kind: "GlobalRole", Name: globalRole},
+	}
+	marshal, err := json.Marshal(binding)
+	if err != nil {
+		return "", nil, err
+	}
+	return fix, &task.Change{
+		Operation:   task.OperationCreate,
+		Path:        task.CollectionPath(iamGroup, iamVersion, "globalrolebindings", ""),
+		Name:        binding.Name,
+		Object:      marshal,
+		Description: fmt.Sprintf("bind user %s to global role %s of its %s annotation", user.GetName(), globalRole, GlobalRoleAnnotation),
+	}, nil
+}
+
+// normalizeState replaces a deprecated state.
+func (t *userMigrateTask) normalizeState(user *unstructured.Unstructured) string {
+	state, found, _ := unstructured.NestedString(user.Object, "status", "state")
+	if !found || state == "" {
+		return ""
+	}
+	current, known := t.currentState(state)
+	if !known {
+		t.Warn("user %s has the unknown state %s, it's kept", user.GetName(), state)
+		return ""
+	}
+	if state == current {
+		return ""
+	}
+	_ = unstructured.SetNestedField(user.Object, current, "status", "state")
+	return fmt.Sprintf("set the state from %s to %s", state, current)
+}
+
+// currentState returns the state replacing a state.
+func (t *userMigrateTask) currentState(state string) (string, bool) {
+	for deprecated, current := range t.options.States {
+		if strings.EqualFold(state, deprecated) {
+			return current, true
+		}
+	}
+	return "", false
+}
+
+// renameLabels renames the deprecated identity provider labels, a label already set under the new key wins.
+func (t *userMigrateTask) renameLabels(user *unstructured.Unstructured) []string {
+	labels := user.GetLabels()
+	fixes := make([]string, 0)
+	keys := make([]string, 0, len(t.options.LabelRenames))
+	for from := range t.options.LabelRenames {
+		keys = append(keys, from)
+	}
+	sort.Strings(keys)
+	for _, from := range keys {
+		to := t.options.LabelRenames[from]
+		value, ok := labels[from]
+		if !ok {
+			continue
+		}
+		if current, exists := labels[to]; exists && current != value {
+			t.Warn("user %s has both %s=%s and %s=%s, %s is removed", user.GetName(), from, value, to, current, from)
+		} else {
+			labels[to] = value
+		}
+		delete(labels, from)
+		fixes = append(fixes, fmt.Sprintf("rename label %s to %s", from, to))
+	}
+	if len(fixes) > 0 {
+		user.SetLabels(labels)
+	}
+	return fixes
+}
+
+func setAnnotation(object *unstructured.Unstructured, key, value string) {
+	annotations := object.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[key] = value
+	object.SetAnnotations(annotations)
+}
+
+func updateChange(path string, original, modified *unstructured.Unstructured, description string) (*task.Change, error) {
+	originalJSON, err := original.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	modifiedJSON, err := modified.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patch, err := task.CreateMergePatch(originalJSON, modifiedJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &task.Change{
+		Operation:       task.OperationUpdate,
+		Path:            path,
+		Name:            modified.GetName(),
+		ResourceVersion: modified.GetResourceVersion(),
+		Object:          modifiedJSON,
+		Patch:           patch,
+		Description:     description,
+		// a plain text password must not end up in the journal, a rollback keeps the hash
+		Redact: []string{passwordField},
+	}, nil
+}
+
+// Verify checks that no user has a plain text password, a deprecated state or label, or a
+// global role annotation different from its GlobalRoleBinding.
+func (t *userMigrateTask) Verify() error {
+	users, err := task.ListObjects(t.client, task.CollectionPath(iamGroup, iamVersion, "users", ""), "", "")
+	if err != nil {
+		return err
+	}
+	userRoles, _, err := t.globalRoles()
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, user := range users {
+		name := user.GetName()
+		if password, _, _ := unstructured.NestedString(user.Object, "spec", "password"); t.options.EncryptPasswords && password != "" && !isEncrypted(password) {
+			errs = append(errs, fmt.Errorf("user %s has a plain text password", name))
+		}
+		if roles := userRoles[name]; len(roles) == 1 && user.GetAnnotations()[GlobalRoleAnnotation] != roles[0] {
+			errs = append(errs, fmt.Errorf("the global role annotation of user %s is %q, it's bound to %s", name, user.GetAnnotations()[GlobalRoleAnnotation], roles[0]))
+		}
+		if state, _, _ := unstructured.NestedString(user.Object, "status", "state"); state != "" {
+			if current, known := t.currentState(state); known && current != state {
+				errs = append(errs, fmt.Errorf("user %s has the deprecated state %s", name, state))
+			}
+		}
+		for from := range t.options.LabelRenames {
+			if _, ok := user.GetLabels()[from]; ok {
+				errs = append(errs, fmt.Errorf("user %s has the deprecated label %s", name, from))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (t *userMigrateTask) RequiredPermissions() []task.Permission {
+	return []task.Permission{
+		{Group: iamGroup, Version: iamVersion, Resource: "users", Verbs: []string{"list", "get", "update"}},
+		{Group: iamGroup, Version: iamVersion, Resource: "globalrolebindings", Verbs: []string{"list", "create"}},
+		{Group: iamGroup, Version: iamVersion, Resource: "globalroles", Verbs: []string{"list"}},
+	}
+}
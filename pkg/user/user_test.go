@@ -0,0 +1,212 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"kubesphere.io/ks-upgrade/pkg/role"
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+// newTestClient returns a client of a server answering the GETs of the paths with their objects.
+func newTestClient(t *testing.T, objects map[string]interface{}) *kubernetes.Clientset {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		object, ok := objects[r.URL.Path]
+		if !ok || r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(object)
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func testUser(name, password, state string, labels, annotations map[string]interface{}) map[string]interface{} {
+	metadata := map[string]interface{}{"name": name, "resourceVersion": "1"}
+	if labels != nil {
+		metadata["labels"] = labels
+	}
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+	return map[string]interface{}{
+		"apiVersion": "iam.kubesphere.io/v1alpha2",
+		"kind":       "User",
+		"metadata":   metadata,
+		"spec":       map[string]interface{}{"password": password},
+		"status":     map[string]interface{}{"state": state},
+	}
+}
+
+func testBinding(name, globalRole string, users ...string) map[string]interface{} {
+	subjects := make([]interface{}, 0, len(users))
+	for _, user := range users {
+		subjects = append(subjects, map[string]interface{}{"kind": "User", "apiGroup": "rbac.authorization.k8s.io", "name": user})
+	}
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name},
+		"subjects": subjects,
+		"roleRef":  map[string]interface{}{"apiGroup": "iam.kubesphere.io", "kind": "GlobalRole", "name": globalRole},
+	}
+}
+
+func TestUserMigratePlan(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("P@88w0rd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, map[string]interface{}{
+		"/apis/iam.kubesphere.io/v1alpha2/users": map[string]interface{}{"items": []interface{}{
+			// a plain text password and a deprecated state
+			testUser("alice", "P@88w0rd", "active", nil, map[string]interface{}{GlobalRoleAnnotation: "platform-admin"}),
+			// a deprecated label, the new key wins
+			testUser("bob", string(hashed), "Active", map[string]interface{}{
+				"iam.kubesphere.io/idp":        "ldap",
+				"iam.kubesphere.io/origin-id":  "1000",
+				"iam.kubesphere.io/origin-uid": "2000",
+			}, map[string]interface{}{GlobalRoleAnnotation: "platform-regular"}),
+			// no binding, the remapped role of the annotation is bound
+			testUser("carol", string(hashed), "Active", nil, map[string]interface{}{GlobalRoleAnnotation: "users-manager"}),
+			// no binding and a missing role
+			testUser("dave", string(hashed), "Active", nil, map[string]interface{}{GlobalRoleAnnotation: "missing"}),
+			// several bindings
+			testUser("erin", string(hashed), "Active", nil, map[string]interface{}{GlobalRoleAnnotation: "platform-admin"}),
+			// an unknown state
+			testUser("frank", string(hashed), "Locked", nil, nil),
+		}},
+		"/apis/iam.kubesphere.io/v1alpha2/globalrolebindings": map[string]interface{}{"items": []interface{}{
+			testBinding("alice-platform-admin", "platform-admin", "alice"),
+			testBinding("bob-platform-regular", "platform-regular", "bob"),
+			testBinding("erin-platform-admin", "platform-admin", "erin"),
+			testBinding("erin-workspaces-manager", "workspaces-manager", "erin"),
+		}},
+		"/apis/iam.kubesphere.io/v1alpha2/globalroles": map[string]interface{}{"items": []interface{}{
+			map[string]interface{}{"metadata": map[string]interface{}{"name": "platform-admin"}},
+			map[string]interface{}{"metadata": map[string]interface{}{"name": "platform-regular"}},
+		}},
+	})
+	userTask := &userMigrateTask{client: client, options: NewOptions(), roleOptions: role.NewOptions()}
+
+	changes, err := userTask.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byKey := make(map[string]task.Change, len(changes))
+	for _, change := range changes {
+		byKey[change.Key()] = change
+	}
+	if len(byKey) != 4 {
+		t.Fatalf("expected the changes of alice, bob and carol and the binding of carol, got %v", changes)
+	}
+
+	users := "/apis/iam.kubesphere.io/v1alpha2/users/"
+	alice := decode(t, byKey[users+"alice"])
+	password, _, _ := unstructured.NestedString(alice.Object, "spec", "password")
+	if err := bcrypt.CompareHashAndPassword([]byte(password), []byte("P@88w0rd")); err != nil {
+		t.Errorf("expected the password of alice to be hashed, got %s: %v", password, err)
+	}
+	if alice.GetAnnotations()[PasswordEncryptedAnnotation] != "true" {
+		t.Errorf("expected alice to be annotated as encrypted, got %v", alice.GetAnnotations())
+	}
+	if state, _, _ := unstructured.NestedString(alice.Object, "status", "state"); state != "Active" {
+		t.Errorf("expected the state of alice to be Active, got %s", state)
+	}
+	if redact := byKey[users+"alice"].Redact; !reflect.DeepEqual(redact, []string{passwordField}) {
+		t.Errorf("expected the password to be redacted, got %v", redact)
+	}
+
+	bob := decode(t, byKey[users+"bob"])
+	expectedLabels := map[string]string{"iam.kubesphere.io/identify-provider": "ldap", "iam.kubesphere.io/origin-uid": "2000"}
+	if !reflect.DeepEqual(bob.GetLabels(), expectedLabels) {
+		t.Errorf("expected the labels of bob to be %v, got %v", expectedLabels, bob.GetLabels())
+	}
+	if _, ok := bob.GetAnnotations()[PasswordEncryptedAnnotation]; ok {
+		t.Errorf("expected the hashed password of bob to be kept")
+	}
+
+	carol := decode(t, byKey[users+"carol"])
+	if globalRole := carol.GetAnnotations()[GlobalRoleAnnotation]; globalRole != "platform-regular" {
+		t.Errorf("expected the global role of carol to be remapped to platform-regular, got %s", globalRole)
+	}
+	binding, ok := byKey["/apis/iam.kubesphere.io/v1alpha2/globalrolebindings/carol-platform-regular"]
+	if !ok || binding.Operation != task.OperationCreate {
+		t.Errorf("expected a GlobalRoleBinding to be created for carol, got %v", binding)
+	}
+
+	warnings := strings.Join(userTask.Warnings(), "\n")
+	for _, name := range []string{"dave", "erin", "frank"} {
+		if !strings.Contains(warnings, "user "+name+" ") {
+			t.Errorf("expected a warning for %s, got %s", name, warnings)
+		}
+	}
+
+	plan := task.NewPlan()
+	plan.Tasks = append(plan.Tasks, task.TaskPlan{Name: userTask.Name(), Changes: changes})
+	redacted, err := plan.Redacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshal, err := json.Marshal(redacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(marshal), password) || strings.Contains(string(marshal), string(hashed)) {
+		t.Errorf("expected the passwords to be masked in the plan, got %s", marshal)
+	}
+}
+
+func TestEncryptPassword(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("P@88w0rd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		password  string
+		encrypted bool
+	}{
+		{password: "", encrypted: false},
+		{password: "P@88w0rd", encrypted: true},
+		{password: string(hashed), encrypted: false},
+	}
+	for _, test := range tests {
+		user := &unstructured.Unstructured{Object: testUser("test", test.password, "Active", nil, nil)}
+		encrypted, err := encryptPassword(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted != test.encrypted {
+			t.Errorf("expected %q to be encrypted: %v, got %v", test.password, test.encrypted, encrypted)
+		}
+		password, _, _ := unstructured.NestedString(user.Object, "spec", "password")
+		if test.password != "" && !isEncrypted(password) {
+			t.Errorf("expected %q to end up hashed, got %s", test.password, password)
+		}
+	}
+}
+
+func decode(t *testing.T, change task.Change) *unstructured.Unstructured {
+	if len(change.Object) == 0 {
+		t.Fatalf("expected change %s to have an object", change.Key())
+	}
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(change.Object); err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
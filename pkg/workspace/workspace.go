@@ -0,0 +1,403 @@
+package workspace
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+const (
+	tenantGroup = "tenant.kubesphere.io"
+
+	workspaceVersion         = "v1alpha1"
+	workspaceTemplateVersion = "v1alpha2"
+
+	iamGroup   = "iam.kubesphere.io"
+	iamVersion = "v1alpha2"
+
+	roleTemplateLabel          = "iam.kubesphere.io/role-template"
+	aggregationRolesAnnotation = "iam.kubesphere.io/aggregation-roles"
+	creatorAnnotation          = "kubesphere.io/creator"
+
+	DefaultHostCluster = "host"
+)
+
+// Options are the parameters of the workspace migration.
+type Options struct {
+	// HostCluster is the cluster a workspace is placed on when it has no cluster assignment.
+	HostCluster string `json:"hostCluster,omitempty"`
+}
+
+func NewOptions() *Options {
+	return &Options{HostCluster: DefaultHostCluster}
+}
+
+type workspaceMigrateTask struct {
+	client  kubernetes.Interface
+	applier *task.Applier
+	options *Options
+
+	task.WarningList
+}
+
+// NewWorkspaceMigrateTask creates the task converting the Workspaces into WorkspaceTemplates and
+// fixing the workspace labels of the namespaces and the WorkspaceRoles.
+func NewWorkspaceMigrateTask(client kubernetes.Interface, options *task.Options, workspaceOptions *Options) task.UpgradeTask {
+	return &workspaceMigrateTask{client: client, applier: task.NewApplier(client, options), options: workspaceOptions}
+}
+
+func (t *workspaceMigrateTask) Name() string {
+	return "workspace-migrate"
+}
+
+func (t *workspaceMigrateTask) Run() error {
+	return t.applier.PlanAndApply(t)
+}
+
+// list lists a collection, a resource which isn't served is empty.
+func (t *workspaceMigrateTask) list(path string) ([]*unstructured.Unstructured, error) {
+	objects, err := task.ListObjects(t.client, path, "", "")
+	if errors.IsNotFound(err) {
+		klog.Infof("%s is not served, skipping it.", path)
+		return nil, nil
+	}
+	return objects, err
+}
+
+func (t *workspaceMigrateTask) Plan() ([]task.Change, error) {
+	t.ResetWarnings()
+	workspaces, err := t.list(task.CollectionPath(tenantGroup, workspaceVersion, "workspaces", ""))
+	if err != nil {
+		return nil, err
+	}
+	templatesPath := task.CollectionPath(tenantGroup, workspaceTemplateVersion, "workspacetemplates", "")
+	templates, err := t.list(templatesPath)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(workspaces)+len(templates))
+	existingTemplates := make(map[string]bool, len(templates))
+	for _, template := range templates {
+		names[template.GetName()] = true
+		existingTemplates[template.GetName()] = true
+	}
+	for _, workspace := range workspaces {
+		names[workspace.GetName()] = true
+	}
+
+	changes := make([]task.Change, 0)
+	for _, workspace := range workspaces {
+		if existingTemplates[workspace.GetName()] {
+			continue
+		}
+		change, err := t.convert(templatesPath, workspace)
+		if err != nil {
+			return nil, fmt.Errorf("convert Workspace %s failed: %v", workspace.GetName(), err)
+		}
+		changes = append(changes, *change)
+	}
+
+	namespaceChanges, err := t.relabelNamespaces(names)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, namespaceChanges...)
+
+	roleChanges, err := t.relabelWorkspaceRoles(names)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, roleChanges...), nil
+}
+
+// convert returns the creation of the WorkspaceTemplate of a Workspace. The spec of the Workspace becomes
+// the template, its cluster assignments the placement, and it's placed on the host cluster if it has none.
+func (t *workspaceMigrateTask) convert(path string, workspace *unstructured.Unstructured) (*task.Change, error) {
+	spec, _, err := unstructured.NestedMap(workspace.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	placement, hasPlacement := spec["placement"]
+	overrides, hasOverrides := spec["overrides"]
+	clusters, hasClusters := spec["clusters"]
+	for _, field := range []string{"placement", "overrides", "clusters"} {
+		delete(spec, field)
+	}
+	switch {
+	case hasPlacement:
+	case hasClusters:
+		placement = map[string]interface{}{"clusters": clusters}
+	default:
+		placement = map[string]interface{}{"clusters": []interface{}{map[string]interface{}{"name": t.options.HostCluster}}}
+	}
+
+	metadata := map[string]interface{}{}
+	if labels := workspace.GetLabels(); len(labels) > 0 {
+		metadata["labels"] = stringMap(labels)
+	}
+	if annotations := workspace.GetAnnotations(); len(annotations) > 0 {
+		metadata["annotations"] = stringMap(annotations)
+	}
+	templateSpec := map[string]interface{}{
+		"template": map[string]interface{}{
+			"metadata": metadata,
+			"spec":     spec,
+		},
+		"placement": placement,
+	}
+	if hasOverrides {
+		templateSpec["overrides"] = overrides
+	}
+
+	template := &unstructured.Unstructured{Object: map[string]interface{}{"spec": templateSpec}}
+	template.SetAPIVersion(tenantGroup + "/" + workspaceTemplateVersion)
+	template.SetKind("WorkspaceTemplate")
+	template.SetName(workspace.GetName())
+	template.SetLabels(workspace.GetLabels())
+	template.SetAnnotations(workspace.GetAnnotations())
+	marshal, err := template.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	placementJSON, _ := json.Marshal(placement)
+	return &task.Change{
+		Operation:   task.OperationCreate,
+		Path:        path,
+		Name:        template.GetName(),
+		Object:      marshal,
+		Description: fmt.Sprintf("convert Workspace %s into a WorkspaceTemplate placed on %s", workspace.GetName(), placementJSON),
+	}, nil
+}
+
+func stringMap(m map[string]string) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// relabelNamespaces sets the workspace label of the namespaces owned by a workspace which are missing
+// it or have another one. A namespace without owner keeps its label, it's reported if the workspace doesn't
+// exist, or if it's a project created in KubeSphere without label.
+func (t *workspaceMigrateTask) relabelNamespaces(workspaces map[string]bool) ([]task.Change, error) {
+	path := task.CollectionPath("", "v1", "namespaces", "")
+	namespaces, err := task.ListObjects(t.client, path, "", "")
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]task.Change, 0)
+	for _, namespace := range namespaces {
+		label := namespace.GetLabels()[task.WorkspaceLabel]
+		owner := ownerWorkspace(namespace.GetOwnerReferences())
+		if owner == "" || owner == label {
+			if label != "" && !workspaces[label] {
+				t.Warn("namespace %s belongs to workspace %s which doesn't exist", namespace.GetName(), label)
+			}
+			// a project created in KubeSphere which lost its label and its owner can't be told its workspace
+			if label == "" && owner == "" && namespace.GetAnnotations()[creatorAnnotation] != "" {
+				t.Warn("namespace %s was created in KubeSphere but belongs to no workspace, label it with %s to assign it", namespace.GetName(), task.WorkspaceLabel)
+			}
+			continue
+		}
+		if !workspaces[owner] {
+			t.Warn("namespace %s is owned by workspace %s which doesn't exist, its label is kept", namespace.GetName(), owner)
+			continue
+		}
+		change, err := relabel(path, namespace, owner, fmt.Sprintf("set the workspace label of namespace %s from %q to %s, its owner", namespace.GetName(), label, owner))
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *change)
+	}
+	return changes, nil
+}
+
+func ownerWorkspace(owners []metav1.OwnerReference) string {
+	for _, owner := range owners {
+		if strings.HasPrefix(owner.APIVersion, tenantGroup+"/") && (owner.Kind == "Workspace" || owner.Kind == "WorkspaceTemplate") {
+			return owner.Name
+		}
+	}
+	return ""
+}
+
+// relabelWorkspaceRoles fixes the workspace label of the WorkspaceRoles referring to a workspace which
+// doesn't exist. The workspace of a role is the one of the WorkspaceRoleBindings granting it, or of the
+// WorkspaceRoles it aggregates, a role matching none or several workspaces is reported. The role
+// templates are shared by the workspaces, they're left out.
+func (t *workspaceMigrateTask) relabelWorkspaceRoles(workspaces map[string]bool) ([]task.Change, error) {
+	path := task.CollectionPath(iamGroup, iamVersion, "workspaceroles", "")
+	roles, err := t.list(path)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := t.list(task.CollectionPath(iamGroup, iamVersion, "workspacerolebindings", ""))
+	if err != nil {
+		return nil, err
+	}
+	// the workspaces of the roles, from the labels of their bindings and of the roles themselves
+	granted := make(map[string][]string)
+	for _, binding := range bindings {
+		roleRef, _, _ := unstructured.NestedString(binding.Object, "roleRef", "name")
+		addWorkspace(granted, roleRef, binding.GetLabels()[task.WorkspaceLabel], workspaces)
+	}
+	labeled := make(map[string][]string)
+	for _, role := range roles {
+		addWorkspace(labeled, role.GetName(), role.GetLabels()[task.WorkspaceLabel], workspaces)
+	}
+
+	changes := make([]task.Change, 0)
+	for _, role := range roles {
+		label := role.GetLabels()[task.WorkspaceLabel]
+		if workspaces[label] || role.GetLabels()[roleTemplateLabel] != "" {
+			continue
+		}
+		candidates := granted[role.GetName()]
+		if len(candidates) == 0 {
+			for _, aggregated := range t.aggregationRoles(role) {
+				for _, workspace := range labeled[aggregated] {
+					if !task.InSlice(workspace, candidates) {
+						candidates = append(candidates, workspace)
+					}
+				}
+			}
+		}
+		if len(candidates) == 0 {
+			t.Warn("WorkspaceRole %s belongs to workspace %q which doesn't exist, neither its bindings nor its aggregated roles tell its workspace", role.GetName(), label)
+			continue
+		}
+		if len(candidates) > 1 {
+			sort.Strings(candidates)
+			t.Warn("WorkspaceRole %s belongs to workspace %q which doesn't exist, its bindings or its aggregated roles belong to several workspaces: %s", role.GetName(), label, strings.Join(candidates, ", "))
+			continue
+		}
+		workspace := candidates[0]
+		change, err := relabel(path, role, workspace, fmt.Sprintf("set the workspace label of WorkspaceRole %s from %q to %s", role.GetName(), label, workspace))
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *change)
+	}
+	return changes, nil
+}
+
+// addWorkspace adds an existing workspace to the workspaces of a role.
+func addWorkspace(roles map[string][]string, role, workspace string, workspaces map[string]bool) {
+	if role == "" || !workspaces[workspace] || task.InSlice(workspace, roles[role]) {
+		return
+	}
+	roles[role] = append(roles[role], workspace)
+}
+
+// aggregationRoles returns the names of the roles aggregated by a role, none if its annotation is invalid.
+func (t *workspaceMigrateTask) aggregationRoles(role *unstructured.Unstructured) []string {
+	roles := make([]string, 0)
+	if annotation := role.GetAnnotations()[aggregationRolesAnnotation]; annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &roles); err != nil {
+			t.Warn("invalid annotation %s of WorkspaceRole %s: %v", aggregationRolesAnnotation, role.GetName(), err)
+			return nil
+		}
+	}
+	return roles
+}
+
+func relabel(path string, object *unstructured.Unstructured, workspace, description string) (*task.Change, error) {
+	original, err := object.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	labels := object.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[task.WorkspaceLabel] = workspace
+	object.SetLabels(labels)
+	modified, err := object.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patch, err := task.CreateMergePatch(original, modified)
+	if err != nil {
+		return nil, err
+	}
+	return &task.Change{
+		Operation:       task.OperationUpdate,
+		Path:            path,
+		Name:            object.GetName(),
+		ResourceVersion: object.GetResourceVersion(),
+		Object:          modified,
+		Patch:           patch,
+		Description:     description,
+	}, nil
+}
+
+// Verify checks every Workspace has a WorkspaceTemplate with the same manager and no namespace or
+// WorkspaceRole has a workspace label which can be fixed.
+func (t *workspaceMigrateTask) Verify() error {
+	workspaces, err := t.list(task.CollectionPath(tenantGroup, workspaceVersion, "workspaces", ""))
+	if err != nil {
+		return err
+	}
+	templates, err := t.list(task.CollectionPath(tenantGroup, workspaceTemplateVersion, "workspacetemplates", ""))
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*unstructured.Unstructured, len(templates))
+	names := make(map[string]bool)
+	for _, template := range templates {
+		byName[template.GetName()] = template
+		names[template.GetName()] = true
+	}
+
+	errs := make([]error, 0)
+	for _, workspace := range workspaces {
+		names[workspace.GetName()] = true
+		template, ok := byName[workspace.GetName()]
+		if !ok {
+			errs = append(errs, fmt.Errorf("Workspace %s has no WorkspaceTemplate", workspace.GetName()))
+			continue
+		}
+		manager, _, _ := unstructured.NestedString(workspace.Object, "spec", "manager")
+		templateManager, _, _ := unstructured.NestedString(template.Object, "spec", "template", "spec", "manager")
+		if manager != templateManager {
+			errs = append(errs, fmt.Errorf("the manager of WorkspaceTemplate %s is %q, the Workspace's is %q", workspace.GetName(), templateManager, manager))
+		}
+	}
+
+	namespaceChanges, err := t.relabelNamespaces(names)
+	if err != nil {
+		return err
+	}
+	roleChanges, err := t.relabelWorkspaceRoles(names)
+	if err != nil {
+		return err
+	}
+	for _, change := range append(namespaceChanges, roleChanges...) {
+		errs = append(errs, fmt.Errorf("%s wasn't done", change.Description))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (t *workspaceMigrateTask) RequiredPermissions() []task.Permission {
+	return []task.Permission{
+		{Group: tenantGroup, Version: workspaceVersion, Resource: "workspaces", Verbs: []string{"list"}},
+		{Group: tenantGroup, Version: workspaceTemplateVersion, Resource: "workspacetemplates", Verbs: []string{"list", "create"}},
+		{Group: "", Version: "v1", Resource: "namespaces", Verbs: []string{"list", "get", "update"}},
+		{Group: iamGroup, Version: iamVersion, Resource: "workspaceroles", Verbs: []string{"list", "get", "update"}},
+		{Group: iamGroup, Version: iamVersion, Resource: "workspacerolebindings", Verbs: []string{"list"}},
+	}
+}
@@ -0,0 +1,239 @@
+package workspace
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"kubesphere.io/ks-upgrade/pkg/task"
+)
+
+// newTestClient returns a client of a server answering the GETs of the paths with their objects.
+func newTestClient(t *testing.T, objects map[string]interface{}) *kubernetes.Clientset {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		object, ok := objects[r.URL.Path]
+		if !ok || r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(object)
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func list(items ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"items": items}
+}
+
+func testObject(name, workspace string, annotations map[string]interface{}, owner string) map[string]interface{} {
+	metadata := map[string]interface{}{"name": name, "resourceVersion": "1"}
+	if workspace != "" {
+		metadata["labels"] = map[string]interface{}{task.WorkspaceLabel: workspace}
+	}
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+	if owner != "" {
+		metadata["ownerReferences"] = []interface{}{map[string]interface{}{
+			"apiVersion": "tenant.kubesphere.io/v1alpha1", "kind": "Workspace", "name": owner, "uid": owner,
+		}}
+	}
+	return map[string]interface{}{"metadata": metadata}
+}
+
+func testWorkspace(name string, spec map[string]interface{}) map[string]interface{} {
+	workspace := testObject(name, "", nil, "")
+	workspace["spec"] = spec
+	return workspace
+}
+
+func testBinding(name, workspace, role string) map[string]interface{} {
+	binding := testObject(name, workspace, nil, "")
+	binding["roleRef"] = map[string]interface{}{"apiGroup": "iam.kubesphere.io", "kind": "WorkspaceRole", "name": role}
+	return binding
+}
+
+func TestWorkspaceMigratePlan(t *testing.T) {
+	template := testObject("role-template-view", "gone", nil, "")
+	template["metadata"].(map[string]interface{})["labels"].(map[string]interface{})[roleTemplateLabel] = "true"
+	client := newTestClient(t, map[string]interface{}{
+		"/apis/tenant.kubesphere.io/v1alpha1/workspaces": list(
+			testWorkspace("ws1", map[string]interface{}{"manager": "admin", "clusters": []interface{}{map[string]interface{}{"name": "member"}}}),
+			testWorkspace("ws2", map[string]interface{}{"manager": "admin"}),
+			testWorkspace("ws3", map[string]interface{}{"manager": "admin"}),
+		),
+		"/apis/tenant.kubesphere.io/v1alpha2/workspacetemplates": list(testObject("ws3", "", nil, "")),
+		"/api/v1/namespaces": list(
+			// owned by a workspace with another label
+			testObject("ns1", "gone", nil, "ws1"),
+			testObject("ns2", "ws1", nil, "ws1"),
+			// the label of a workspace which doesn't exist
+			testObject("ns3", "gone", nil, ""),
+			// created in KubeSphere without workspace
+			testObject("ns4", "", map[string]interface{}{creatorAnnotation: "admin"}, ""),
+			// owned by a workspace which doesn't exist
+			testObject("ns5", "", nil, "gone"),
+			testObject("kube-system", "", nil, ""),
+		),
+		"/apis/iam.kubesphere.io/v1alpha2/workspaceroles": list(
+			testObject("ws1-admin", "ws1", nil, ""),
+			// granted by a binding of ws2
+			testObject("role-a", "gone", nil, ""),
+			// aggregating a role of ws1
+			testObject("role-b", "gone", map[string]interface{}{aggregationRolesAnnotation: `["ws1-admin"]`}, ""),
+			// granted by the bindings of several workspaces
+			testObject("role-c", "gone", nil, ""),
+			// granted by nothing
+			testObject("role-d", "gone", nil, ""),
+			// an invalid aggregation
+			testObject("role-e", "gone", map[string]interface{}{aggregationRolesAnnotation: `ws1-admin`}, ""),
+			template,
+		),
+		"/apis/iam.kubesphere.io/v1alpha2/workspacerolebindings": list(
+			testBinding("ws2-role-a", "ws2", "role-a"),
+			testBinding("ws1-role-c", "ws1", "role-c"),
+			testBinding("ws2-role-c", "ws2", "role-c"),
+		),
+	})
+	workspaceTask := &workspaceMigrateTask{client: client, options: NewOptions()}
+
+	changes, err := workspaceTask.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byKey := make(map[string]task.Change, len(changes))
+	keys := make([]string, 0, len(changes))
+	for _, change := range changes {
+		byKey[change.Key()] = change
+		keys = append(keys, change.Key())
+	}
+	sort.Strings(keys)
+	expected := []string{
+		"/api/v1/namespaces/ns1",
+		"/apis/iam.kubesphere.io/v1alpha2/workspaceroles/role-a",
+		"/apis/iam.kubesphere.io/v1alpha2/workspaceroles/role-b",
+		"/apis/tenant.kubesphere.io/v1alpha2/workspacetemplates/ws1",
+		"/apis/tenant.kubesphere.io/v1alpha2/workspacetemplates/ws2",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected the changes of %v, got %v", expected, keys)
+	}
+
+	placements := map[string]string{"ws1": "member", "ws2": DefaultHostCluster}
+	for name, cluster := range placements {
+		change := byKey["/apis/tenant.kubesphere.io/v1alpha2/workspacetemplates/"+name]
+		object := decode(t, change)
+		if change.Operation != task.OperationCreate || object.GetKind() != "WorkspaceTemplate" {
+			t.Errorf("expected the creation of WorkspaceTemplate %s, got %s %s", name, change.Operation, object.GetKind())
+		}
+		manager, _, _ := unstructured.NestedString(object.Object, "spec", "template", "spec", "manager")
+		if manager != "admin" {
+			t.Errorf("expected the manager of %s to be admin, got %q", name, manager)
+		}
+		clusters, _, _ := unstructured.NestedSlice(object.Object, "spec", "placement", "clusters")
+		if !reflect.DeepEqual(clusters, []interface{}{map[string]interface{}{"name": cluster}}) {
+			t.Errorf("expected %s to be placed on %s, got %v", name, cluster, clusters)
+		}
+		if _, ok, _ := unstructured.NestedFieldNoCopy(object.Object, "spec", "template", "spec", "clusters"); ok {
+			t.Errorf("expected the clusters of %s to be moved into its placement", name)
+		}
+	}
+
+	relabeled := map[string]string{
+		"/api/v1/namespaces/ns1":                                 "ws1",
+		"/apis/iam.kubesphere.io/v1alpha2/workspaceroles/role-a": "ws2",
+		"/apis/iam.kubesphere.io/v1alpha2/workspaceroles/role-b": "ws1",
+	}
+	for key, workspace := range relabeled {
+		change := byKey[key]
+		if change.Operation != task.OperationUpdate || change.ResourceVersion != "1" {
+			t.Errorf("expected the update of %s at its resource version, got %s %q", key, change.Operation, change.ResourceVersion)
+		}
+		if label := decode(t, change).GetLabels()[task.WorkspaceLabel]; label != workspace {
+			t.Errorf("expected %s to be labeled with workspace %s, got %s", key, workspace, label)
+		}
+	}
+
+	warnings := strings.Join(workspaceTask.Warnings(), "\n")
+	for _, name := range []string{"namespace ns3 ", "namespace ns4 ", "namespace ns5 ", "WorkspaceRole role-c ", "WorkspaceRole role-d ", "WorkspaceRole role-e"} {
+		if !strings.Contains(warnings, name) {
+			t.Errorf("expected a warning for %s, got %s", name, warnings)
+		}
+	}
+	if len(workspaceTask.Warnings()) != 7 {
+		t.Errorf("expected 7 warnings, got %s", warnings)
+	}
+}
+
+func TestWorkspaceMigrateNotServed(t *testing.T) {
+	client := newTestClient(t, map[string]interface{}{
+		"/api/v1/namespaces": list(testObject("ns1", "ws1", nil, "")),
+	})
+	workspaceTask := &workspaceMigrateTask{client: client, options: NewOptions()}
+	changes, err := workspaceTask.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no change, got %v", changes)
+	}
+	if warnings := workspaceTask.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "namespace ns1 ") {
+		t.Errorf("expected a warning for namespace ns1, got %v", warnings)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	workspaceTask := &workspaceMigrateTask{options: &Options{HostCluster: "host"}}
+	workspace := &unstructured.Unstructured{Object: testWorkspace("ws", map[string]interface{}{
+		"manager":   "admin",
+		"placement": map[string]interface{}{"clusterSelector": map[string]interface{}{}},
+		"overrides": []interface{}{map[string]interface{}{"clusterName": "member"}},
+	})}
+	workspace.SetLabels(map[string]string{"kubesphere.io/creator": "admin"})
+
+	change, err := workspaceTask.convert("/apis/tenant.kubesphere.io/v1alpha2/workspacetemplates", workspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := decode(t, *change)
+	expected := map[string]interface{}{
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": map[string]interface{}{"kubesphere.io/creator": "admin"}},
+			"spec":     map[string]interface{}{"manager": "admin"},
+		},
+		"placement": map[string]interface{}{"clusterSelector": map[string]interface{}{}},
+		"overrides": []interface{}{map[string]interface{}{"clusterName": "member"}},
+	}
+	if spec := template.Object["spec"]; !reflect.DeepEqual(spec, expected) {
+		t.Errorf("expected the spec %v, got %v", expected, spec)
+	}
+	if !reflect.DeepEqual(template.GetLabels(), workspace.GetLabels()) {
+		t.Errorf("expected the labels of the workspace to be kept, got %v", template.GetLabels())
+	}
+}
+
+func decode(t *testing.T, change task.Change) *unstructured.Unstructured {
+	if len(change.Object) == 0 {
+		t.Fatalf("expected change %s to have an object", change.Key())
+	}
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(change.Object, &object.Object); err != nil {
+		t.Fatal(err)
+	}
+	return object
+}